@@ -0,0 +1,567 @@
+// Package capacity buys and deletes BigQuery slot commitments under a cap on
+// the slots of each project and region. It has no HTTP or Cloud Tasks
+// dependencies, so it can be embedded in other services.
+package capacity
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	reservation "cloud.google.com/go/bigquery/reservation/apiv1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/iterator"
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go-slot-scheduler/internal/tracing"
+	"go-slot-scheduler/retry"
+)
+
+// Client is the part of the reservation API the Manager calls. NewClient
+// adapts *reservation.Client to it, and Fake implements it in memory.
+type Client interface {
+	CreateCapacityCommitment(ctx context.Context, req *reservationpb.CreateCapacityCommitmentRequest) (*reservationpb.CapacityCommitment, error)
+	GetCapacityCommitment(ctx context.Context, req *reservationpb.GetCapacityCommitmentRequest) (*reservationpb.CapacityCommitment, error)
+	DeleteCapacityCommitment(ctx context.Context, req *reservationpb.DeleteCapacityCommitmentRequest) error
+	// ListCapacityCommitments returns every page of commitments.
+	ListCapacityCommitments(ctx context.Context, req *reservationpb.ListCapacityCommitmentsRequest) ([]*reservationpb.CapacityCommitment, error)
+}
+
+// NewClient returns a Client calling the reservation API with c.
+func NewClient(c *reservation.Client) Client {
+	return grpcClient{c}
+}
+
+type grpcClient struct {
+	*reservation.Client
+}
+
+func (c grpcClient) CreateCapacityCommitment(ctx context.Context, req *reservationpb.CreateCapacityCommitmentRequest) (*reservationpb.CapacityCommitment, error) {
+	return c.Client.CreateCapacityCommitment(ctx, req)
+}
+
+func (c grpcClient) GetCapacityCommitment(ctx context.Context, req *reservationpb.GetCapacityCommitmentRequest) (*reservationpb.CapacityCommitment, error) {
+	return c.Client.GetCapacityCommitment(ctx, req)
+}
+
+func (c grpcClient) DeleteCapacityCommitment(ctx context.Context, req *reservationpb.DeleteCapacityCommitmentRequest) error {
+	return c.Client.DeleteCapacityCommitment(ctx, req)
+}
+
+func (c grpcClient) ListCapacityCommitments(ctx context.Context, req *reservationpb.ListCapacityCommitmentsRequest) ([]*reservationpb.CapacityCommitment, error) {
+	var list []*reservationpb.CapacityCommitment
+	it := c.Client.ListCapacityCommitments(ctx, req)
+	for {
+		commit, err := it.Next()
+		if err == iterator.Done {
+			return list, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, commit)
+	}
+}
+
+// ErrMaxSlots is returned when the commitments of a project and region
+// already reach their cap.
+var ErrMaxSlots = errors.New("commitment has reached MAX Capacity Slot")
+
+// ErrStockout is returned when the region has no capacity for a commitment
+// of the size asked for: creating it fails with RESOURCE_EXHAUSTED, or it
+// FAILED with that failure_status, telling the capacity ran out.
+var ErrStockout = errors.New("the region has no capacity for the commitment")
+
+// ErrQuotaExceeded is returned when creating a commitment fails with
+// RESOURCE_EXHAUSTED for a quota or rate limit of the project, which callers
+// should back off from rather than buy elsewhere.
+var ErrQuotaExceeded = errors.New("a quota or rate limit of the reservation API was exceeded")
+
+// stockoutMessages are in the messages of RESOURCE_EXHAUSTED errors telling
+// the region is out of capacity.
+var stockoutMessages = []string{"stockout", "no capacity", "not enough capacity", "insufficient capacity", "capacity is not available", "not enough resources", "insufficient resources"}
+
+// stockout reports whether st tells the region has no capacity. Quotas and
+// rate limits of the project are RESOURCE_EXHAUSTED as well, but only a
+// stockout is named as such by the details or message of st.
+func stockout(st *status.Status) bool {
+	if st.Code() != codes.ResourceExhausted {
+		return false
+	}
+	for _, d := range st.Details() {
+		switch d := d.(type) {
+		case *errdetails.QuotaFailure:
+			return false
+		case *errdetails.ErrorInfo:
+			reason := strings.ToUpper(d.Reason)
+			if strings.Contains(reason, "QUOTA") || strings.Contains(reason, "RATE_LIMIT") {
+				return false
+			}
+			if strings.Contains(reason, "STOCKOUT") || strings.Contains(reason, "RESOURCE_AVAILABILITY") {
+				return true
+			}
+		}
+	}
+	msg := strings.ToLower(st.Message())
+	if strings.Contains(msg, "quota") || strings.Contains(msg, "rate limit") {
+		return false
+	}
+	for _, m := range stockoutMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// MinSlots is the smallest commitment that can be bought.
+const MinSlots = 100
+
+// FlexMinDuration is how long a FLEX commitment must exist before it can be
+// deleted.
+const FlexMinDuration = 60 * time.Second
+
+// CapReachedError is returned when nothing can be bought because the
+// commitments of a project and region already reach their cap. It is
+// ErrMaxSlots.
+type CapReachedError struct {
+	Parent    string
+	Requested int64
+	Total     int64
+	MaxSlots  int64
+}
+
+func (e *CapReachedError) Error() string {
+	return fmt.Sprintf("%v: %s holds %d of %d slots, %d requested", ErrMaxSlots, e.Parent, e.Total, e.MaxSlots, e.Requested)
+}
+
+func (e *CapReachedError) Is(target error) bool { return target == ErrMaxSlots }
+
+// Headroom is how many slots can still be bought, never negative.
+func (e *CapReachedError) Headroom() int64 {
+	if e.Total >= e.MaxSlots {
+		return 0
+	}
+	return e.MaxSlots - e.Total
+}
+
+// DeleteTooSoonError is returned when a commitment can't be deleted until
+// RetryAt.
+type DeleteTooSoonError struct {
+	RetryAt time.Time
+	Err     error
+}
+
+func (e *DeleteTooSoonError) Error() string {
+	return fmt.Sprintf("commitment can not be deleted before %s: %v", e.RetryAt.Format(time.RFC3339), e.Err)
+}
+
+func (e *DeleteTooSoonError) Unwrap() error { return e.Err }
+
+// ErrNotActive is returned by WaitActive when a commitment is still pending
+// at its timeout.
+var ErrNotActive = errors.New("commitment is not active yet")
+
+// FailedError is returned by WaitActive when a commitment failed to be
+// provisioned. Status is its failure_status.
+type FailedError struct {
+	Name   string
+	Status *status.Status
+}
+
+func (e *FailedError) Error() string {
+	return fmt.Sprintf("commitment %s failed: %s", e.Name, e.Status.Message())
+}
+
+func (e *FailedError) Is(target error) bool {
+	return target == ErrStockout && stockout(e.Status)
+}
+
+// UncertainError is returned by Buy when its context ended with the create of
+// the commitment Name in flight, which may have gone through all the same.
+type UncertainError struct {
+	Name string
+	Err  error
+}
+
+func (e *UncertainError) Error() string {
+	return fmt.Sprintf("creating capacity commitment %s: %v; it may have been created", e.Name, e.Err)
+}
+
+func (e *UncertainError) Unwrap() error { return e.Err }
+
+// ParsePlan maps a plan name to the commitment plans that may be bought.
+func ParsePlan(name string) (reservationpb.CapacityCommitment_CommitmentPlan, error) {
+	switch plan := reservationpb.CapacityCommitment_CommitmentPlan(reservationpb.CapacityCommitment_CommitmentPlan_value[strings.ToUpper(name)]); plan {
+	case reservationpb.CapacityCommitment_FLEX, reservationpb.CapacityCommitment_MONTHLY, reservationpb.CapacityCommitment_ANNUAL:
+		return plan, nil
+	default:
+		return plan, fmt.Errorf("unsupported plan %q, want FLEX, MONTHLY or ANNUAL", name)
+	}
+}
+
+// Parent is the parent of the commitments of a project in a region.
+func Parent(project, region string) string {
+	return fmt.Sprintf("projects/%s/locations/%s", project, region)
+}
+
+// Region extracts the location from a commitment name of the form
+// projects/{project}/locations/{location}/capacityCommitments/{id}.
+func Region(commitName string) string {
+	parts := strings.Split(commitName, "/")
+	if len(parts) < 4 || parts[2] != "locations" {
+		return ""
+	}
+	return parts[3]
+}
+
+// Filter selects the commitments counted toward the cap.
+type Filter struct {
+	// Plans counted, nil counts every plan.
+	Plans map[reservationpb.CapacityCommitment_CommitmentPlan]bool
+	// States counted, nil counts every state.
+	States map[reservationpb.CapacityCommitment_State]bool
+	// OwnedOnly only counts the commitments bought by the service.
+	OwnedOnly bool
+}
+
+// Counts reports whether c counts toward the cap. owned holds the names of
+// the commitments bought by the service, it is only used with OwnedOnly.
+func (f Filter) Counts(c *reservationpb.CapacityCommitment, owned map[string]bool) bool {
+	if f.Plans != nil && !f.Plans[c.Plan] {
+		return false
+	}
+	if f.States != nil && !f.States[c.State] {
+		return false
+	}
+	return !f.OwnedOnly || owned[c.Name]
+}
+
+// Manager buys, lists and deletes commitments. Its zero value is not usable,
+// Client must be set.
+type Manager struct {
+	// Client returns the client to call for a resource name or parent, so
+	// that projects can use their own credentials.
+	Client func(name string) Client
+	// Retry is the policy calls are retried with. The zero value tries once.
+	Retry retry.Policy
+	// Filter returns the filter selecting the commitments counted toward the
+	// cap. It is called on every purchase, so the filter can change. Nil
+	// counts every commitment.
+	Filter func() Filter
+	// Owned returns the names of the commitments bought by the service. It is
+	// required with OwnedOnly filters.
+	Owned func(ctx context.Context) (map[string]bool, error)
+	// Lock, if set, is held from reading the slot total of a parent until a
+	// purchase is made, so concurrent purchases can't both fit under the cap.
+	Lock func(ctx context.Context, name string) (unlock func(), err error)
+	// Totals, if set, keeps the slots counted toward the cap of each parent
+	// between purchases for TotalsTTL, so bursts of purchases don't all list
+	// the commitments. Buy reads and updates them under Lock, which keeps
+	// the cap safe across the instances sharing Totals, and Delete drops
+	// them.
+	Totals    TotalsStore
+	TotalsTTL time.Duration
+}
+
+// TotalsStore keeps the slots counted toward the cap of each parent, with
+// when the commitments they were counted from were listed.
+type TotalsStore interface {
+	// GetTotal returns false if parent has no total.
+	GetTotal(ctx context.Context, parent string) (total int64, listedAt time.Time, ok bool, err error)
+	PutTotal(ctx context.Context, parent string, total int64, listedAt time.Time) error
+	DropTotal(ctx context.Context, parent string) error
+}
+
+// NewManager returns a Manager calling c for every project.
+func NewManager(c Client) *Manager {
+	return &Manager{
+		Client: func(string) Client { return c },
+		Retry:  retry.Default,
+	}
+}
+
+// List returns the commitments of parent, projects/{project}/locations/{region}.
+func (m *Manager) List(ctx context.Context, parent string) (list []*reservationpb.CapacityCommitment, err error) {
+	err = m.Retry.Do(ctx, "ListCapacityCommitments", func(ctx context.Context) error {
+		list, err = m.Client(parent).ListCapacityCommitments(ctx, &reservationpb.ListCapacityCommitmentsRequest{Parent: parent})
+		return err
+	})
+	return list, err
+}
+
+// Get returns the commitment name.
+func (m *Manager) Get(ctx context.Context, name string) (commit *reservationpb.CapacityCommitment, err error) {
+	err = m.Retry.Do(ctx, "GetCapacityCommitment", func(ctx context.Context) error {
+		commit, err = m.Client(name).GetCapacityCommitment(ctx, &reservationpb.GetCapacityCommitmentRequest{Name: name})
+		return err
+	})
+	return commit, err
+}
+
+// WaitActive reads the commitment name every interval until it is ACTIVE,
+// for at most timeout. It returns the commitment as last read, with a
+// *FailedError if it FAILED and ErrNotActive if it was still pending.
+func (m *Manager) WaitActive(ctx context.Context, name string, timeout, interval time.Duration) (*reservationpb.CapacityCommitment, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		commit, err := m.Get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		switch commit.State {
+		case reservationpb.CapacityCommitment_ACTIVE:
+			return commit, nil
+		case reservationpb.CapacityCommitment_FAILED:
+			return commit, &FailedError{Name: name, Status: status.FromProto(commit.FailureStatus)}
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return commit, ErrNotActive
+		}
+		select {
+		case <-ctx.Done():
+			return commit, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Available returns how many of extraSlots can be bought in parent without
+// the commitments counted by the filter exceeding maxSlots, and the slots
+// they hold now.
+func (m *Manager) Available(ctx context.Context, parent string, extraSlots, maxSlots int64) (int64, int64, error) {
+	total, _, err := m.total(ctx, parent)
+	if err != nil {
+		return 0, 0, err
+	}
+	return available(extraSlots, maxSlots, total), total, nil
+}
+
+// available is how many of extraSlots fit under maxSlots with total held.
+func available(extraSlots, maxSlots, total int64) int64 {
+	if slotCap := maxSlots - total; slotCap < extraSlots {
+		return slotCap
+	}
+	return extraSlots
+}
+
+// total returns the slots counted toward the cap of parent and when they
+// were listed, from Totals if that was less than TotalsTTL ago. A store
+// failing only costs a listing.
+func (m *Manager) total(ctx context.Context, parent string) (int64, time.Time, error) {
+	if m.Totals != nil && m.TotalsTTL > 0 {
+		total, at, ok, err := m.Totals.GetTotal(ctx, parent)
+		if err == nil && ok && time.Since(at) < m.TotalsTTL {
+			return total, at, nil
+		}
+	}
+	at := time.Now()
+	total, err := m.listTotal(ctx, parent)
+	return total, at, err
+}
+
+// putTotal keeps total for parent, or drops it if it can't, so an older
+// total isn't used.
+func (m *Manager) putTotal(ctx context.Context, parent string, total int64, listedAt time.Time) {
+	if m.Totals == nil || m.TotalsTTL <= 0 {
+		return
+	}
+	if err := m.Totals.PutTotal(ctx, parent, total, listedAt); err != nil {
+		m.dropTotal(ctx, parent)
+	}
+}
+
+func (m *Manager) dropTotal(ctx context.Context, parent string) {
+	if m.Totals != nil {
+		// The total expires after TotalsTTL all the same.
+		_ = m.Totals.DropTotal(ctx, parent)
+	}
+}
+
+// listTotal lists the commitments of parent and sums the slots of those
+// counted toward the cap.
+func (m *Manager) listTotal(ctx context.Context, parent string) (int64, error) {
+	commitments, err := m.List(ctx, parent)
+	if err != nil {
+		return 0, err
+	}
+
+	var filter Filter
+	if m.Filter != nil {
+		filter = m.Filter()
+	}
+	var owned map[string]bool
+	if filter.OwnedOnly {
+		if owned, err = m.Owned(ctx); err != nil {
+			return 0, fmt.Errorf("listing owned commitments: %v", err)
+		}
+	}
+
+	var total int64
+	for _, c := range commitments {
+		if filter.Counts(c, owned) {
+			total += c.SlotCount
+		}
+	}
+	return total, nil
+}
+
+// Buy buys a commitment of extraSlots in parent, or as many multiples of
+// MinSlots as fit under maxSlots, and at least MinSlots. It returns a
+// *CapReachedError if not even MinSlots fit.
+func (m *Manager) Buy(ctx context.Context, parent string, plan reservationpb.CapacityCommitment_CommitmentPlan, extraSlot, maxSlots int64) (commit *reservationpb.CapacityCommitment, err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "addCapacity", trace.WithAttributes(
+		attribute.String("parent", parent),
+		attribute.String("plan", plan.String()),
+		attribute.Int64("slots_requested", extraSlot),
+	))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	if m.Lock != nil {
+		unlock, err := m.Lock(ctx, "purchase/"+parent)
+		if err != nil {
+			return nil, fmt.Errorf("waiting for purchase lock: %v", err)
+		}
+		defer unlock()
+	}
+
+	total, listedAt, err := m.total(ctx, parent)
+	if err != nil {
+		return nil, fmt.Errorf("getting project slots: %v", err)
+	}
+	slotsToAdd := available(extraSlot, maxSlots, total)
+	if slotsToAdd < extraSlot {
+		// Clamped to the headroom, which commitments fill in whole
+		// MinSlots.
+		slotsToAdd -= slotsToAdd % MinSlots
+	}
+	if slotsToAdd < MinSlots {
+		slotsToAdd = MinSlots
+	}
+	if total+slotsToAdd > maxSlots {
+		return nil, &CapReachedError{Parent: parent, Requested: extraSlot, Total: total, MaxSlots: maxSlots}
+	}
+
+	// A fixed commitment ID makes retries idempotent: a create that succeeded
+	// without us seeing the response fails with ALREADY_EXISTS on retry
+	// instead of buying the slots twice.
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("generating random id: %v", err)
+	}
+	// IDs must start with a letter and only contain lower case letters,
+	// digits and dashes.
+	commitmentID := "slots-" + hex.EncodeToString(b)
+	req := &reservationpb.CreateCapacityCommitmentRequest{
+		// See https://pkg.go.dev/google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1#CreateCapacityCommitmentRequest.
+		Parent:               parent,
+		CapacityCommitmentId: commitmentID,
+		CapacityCommitment: &reservationpb.CapacityCommitment{
+			SlotCount: slotsToAdd,
+			Plan:      plan,
+		},
+	}
+	err = m.Retry.Do(ctx, "CreateCapacityCommitment", func(ctx context.Context) error {
+		commit, err = m.Client(parent).CreateCapacityCommitment(ctx, req)
+		if status.Code(err) == codes.AlreadyExists {
+			commit, err = m.Client(parent).GetCapacityCommitment(ctx, &reservationpb.GetCapacityCommitmentRequest{
+				Name: parent + "/capacityCommitments/" + commitmentID,
+			})
+		}
+		return err
+	})
+	if status.Code(err) == codes.ResourceExhausted {
+		if stockout(status.Convert(err)) {
+			return nil, fmt.Errorf("creating capacity commitment of %d slots: %w: %v", slotsToAdd, ErrStockout, err)
+		}
+		return nil, fmt.Errorf("creating capacity commitment of %d slots: %w: %v", slotsToAdd, ErrQuotaExceeded, err)
+	}
+	if err != nil {
+		// The commitment may have been created all the same.
+		m.dropTotal(ctx, parent)
+		if ctx.Err() != nil {
+			return nil, &UncertainError{Name: parent + "/capacityCommitments/" + commitmentID, Err: err}
+		}
+		return nil, fmt.Errorf("creating capacity commitment: %v", err)
+	}
+	// Counted whatever the filter, a total too high is only cautious.
+	m.putTotal(ctx, parent, total+commit.SlotCount, listedAt)
+
+	return commit, nil
+}
+
+// Delete deletes the commitment commitName. FLEX commitments can't be deleted
+// in their first minute: Delete waits it out if ctx allows, otherwise it
+// returns a *DeleteTooSoonError.
+func (m *Manager) Delete(ctx context.Context, commitName string) (err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "deleteCapacity", trace.WithAttributes(attribute.String("commit", commitName)))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	req := &reservationpb.DeleteCapacityCommitmentRequest{
+		// See https://pkg.go.dev/google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1#DeleteCapacityCommitmentRequest.
+		Name:  commitName,
+		Force: false,
+	}
+
+	del := func(ctx context.Context) error {
+		return m.Client(commitName).DeleteCapacityCommitment(ctx, req)
+	}
+	attempted := time.Now()
+	err = m.Retry.Do(ctx, "DeleteCapacityCommitment", del)
+	if status.Code(err) == codes.FailedPrecondition {
+		// Compare with when the delete was attempted, the minimum duration
+		// may have ended since.
+		if at, ok := m.flexEnd(ctx, commitName); ok && attempted.Before(at) {
+			wait := time.Until(at)
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= wait {
+				return &DeleteTooSoonError{RetryAt: at, Err: err}
+			}
+			select {
+			case <-ctx.Done():
+				return &DeleteTooSoonError{RetryAt: at, Err: err}
+			case <-time.After(wait):
+			}
+			err = m.Retry.Do(ctx, "DeleteCapacityCommitment", del)
+		}
+	}
+	if err == nil {
+		m.dropTotal(ctx, parentOf(commitName))
+	}
+	return err
+}
+
+// parentOf is the parent of the commitment commitName.
+func parentOf(commitName string) string {
+	if i := strings.Index(commitName, "/capacityCommitments/"); i >= 0 {
+		return commitName[:i]
+	}
+	return commitName
+}
+
+// EarliestDelete returns when commitName leaves the minimum duration of its
+// FLEX plan, if it hasn't yet.
+func (m *Manager) EarliestDelete(ctx context.Context, commitName string) (time.Time, bool) {
+	at, ok := m.flexEnd(ctx, commitName)
+	if !ok || !time.Now().Before(at) {
+		return time.Time{}, false
+	}
+	return at, true
+}
+
+// flexEnd returns when commitName leaves the minimum duration of its FLEX
+// plan, false if it is not a FLEX commitment.
+func (m *Manager) flexEnd(ctx context.Context, commitName string) (time.Time, bool) {
+	commit, err := m.Get(ctx, commitName)
+	if err != nil || commit.Plan != reservationpb.CapacityCommitment_FLEX || commit.CommitmentStartTime == nil {
+		return time.Time{}, false
+	}
+	return commit.CommitmentStartTime.AsTime().Add(FlexMinDuration), true
+}
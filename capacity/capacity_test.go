@@ -0,0 +1,224 @@
+package capacity
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"go-slot-scheduler/retry"
+)
+
+const testParent = "projects/test-project/locations/US"
+
+// testRetry retries UNAVAILABLE without waiting.
+var testRetry = retry.Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Codes: map[codes.Code]bool{codes.Unavailable: true}}
+
+// newTestManager returns a Manager buying from a Fake already holding held
+// FLEX slots in testParent.
+func newTestManager(held int64) (*Manager, *Fake) {
+	f := NewFake()
+	if held > 0 {
+		f.Add(&reservationpb.CapacityCommitment{
+			Name:      testParent + "/capacityCommitments/held",
+			SlotCount: held,
+			Plan:      reservationpb.CapacityCommitment_FLEX,
+			State:     reservationpb.CapacityCommitment_ACTIVE,
+		})
+	}
+	m := NewManager(f)
+	m.Retry = testRetry
+	return m, f
+}
+
+func TestBuyClampsToCap(t *testing.T) {
+	for _, tc := range []struct {
+		name                 string
+		held, requested, max int64
+		want                 int64
+	}{
+		{name: "under the cap", held: 0, requested: 300, max: 1000, want: 300},
+		{name: "clamped to the headroom", held: 800, requested: 500, max: 1000, want: 200},
+		{name: "clamped to whole MinSlots", held: 850, requested: 500, max: 1000, want: 100},
+		{name: "at least MinSlots", held: 0, requested: 50, max: 1000, want: MinSlots},
+		{name: "exactly the headroom", held: 500, requested: 500, max: 1000, want: 500},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, f := newTestManager(tc.held)
+			commit, err := m.Buy(context.Background(), testParent, reservationpb.CapacityCommitment_FLEX, tc.requested, tc.max)
+			if err != nil {
+				t.Fatalf("Buy: %v", err)
+			}
+			if commit.SlotCount != tc.want {
+				t.Errorf("bought %d slots, want %d", commit.SlotCount, tc.want)
+			}
+			if _, err := f.GetCapacityCommitment(context.Background(), &reservationpb.GetCapacityCommitmentRequest{Name: commit.Name}); err != nil {
+				t.Errorf("commitment %s not created: %v", commit.Name, err)
+			}
+		})
+	}
+}
+
+func TestBuyCapReached(t *testing.T) {
+	m, f := newTestManager(1000)
+	_, err := m.Buy(context.Background(), testParent, reservationpb.CapacityCommitment_FLEX, 100, 1000)
+	var capErr *CapReachedError
+	if !errors.As(err, &capErr) {
+		t.Fatalf("Buy returned %v, want a *CapReachedError", err)
+	}
+	if !errors.Is(err, ErrMaxSlots) {
+		t.Errorf("%v is not ErrMaxSlots", err)
+	}
+	if capErr.Total != 1000 || capErr.MaxSlots != 1000 || capErr.Requested != 100 || capErr.Headroom() != 0 {
+		t.Errorf("got %+v with headroom %d, want 1000 of 1000 slots held, 100 requested and no headroom", capErr, capErr.Headroom())
+	}
+	list, _ := f.ListCapacityCommitments(context.Background(), &reservationpb.ListCapacityCommitmentsRequest{Parent: testParent})
+	if len(list) != 1 {
+		t.Errorf("%d commitments after a purchase over the cap, want only the one held", len(list))
+	}
+}
+
+func TestBuyHeadroomUnderMinSlots(t *testing.T) {
+	m, f := newTestManager(950)
+	_, err := m.Buy(context.Background(), testParent, reservationpb.CapacityCommitment_FLEX, 500, 1000)
+	var capErr *CapReachedError
+	if !errors.As(err, &capErr) {
+		t.Fatalf("Buy returned %v, want a *CapReachedError", err)
+	}
+	if capErr.Headroom() != 50 {
+		t.Errorf("headroom %d, want 50", capErr.Headroom())
+	}
+	list, _ := f.ListCapacityCommitments(context.Background(), &reservationpb.ListCapacityCommitmentsRequest{Parent: testParent})
+	if len(list) != 1 {
+		t.Errorf("%d commitments after a purchase the cap has no room for, want only the one held", len(list))
+	}
+}
+
+// lostResponse creates the commitment of its first create call but fails it
+// as UNAVAILABLE, as when the response is lost.
+type lostResponse struct {
+	*Fake
+	creates int
+}
+
+func (c *lostResponse) CreateCapacityCommitment(ctx context.Context, req *reservationpb.CreateCapacityCommitmentRequest) (*reservationpb.CapacityCommitment, error) {
+	c.creates++
+	commit, err := c.Fake.CreateCapacityCommitment(ctx, req)
+	if c.creates == 1 && err == nil {
+		return nil, status.Error(codes.Unavailable, "connection reset")
+	}
+	return commit, err
+}
+
+func TestBuyRetryFindsCreatedCommitment(t *testing.T) {
+	f := NewFake()
+	client := &lostResponse{Fake: f}
+	m := NewManager(client)
+	m.Retry = testRetry
+
+	commit, err := m.Buy(context.Background(), testParent, reservationpb.CapacityCommitment_FLEX, 200, 1000)
+	if err != nil {
+		t.Fatalf("Buy: %v", err)
+	}
+	if client.creates != 2 {
+		t.Errorf("%d create calls, want the create retried once", client.creates)
+	}
+	if commit.SlotCount != 200 {
+		t.Errorf("bought %d slots, want 200", commit.SlotCount)
+	}
+	list, _ := f.ListCapacityCommitments(context.Background(), &reservationpb.ListCapacityCommitmentsRequest{Parent: testParent})
+	if len(list) != 1 || list[0].Name != commit.Name {
+		t.Errorf("commitments %v after the retry, want only %s", list, commit.Name)
+	}
+}
+
+// exhausted fails every create with err.
+type exhausted struct {
+	*Fake
+	err error
+}
+
+func (c *exhausted) CreateCapacityCommitment(ctx context.Context, req *reservationpb.CreateCapacityCommitmentRequest) (*reservationpb.CapacityCommitment, error) {
+	return nil, c.err
+}
+
+// withDetails returns a RESOURCE_EXHAUSTED error of msg with details.
+func withDetails(t *testing.T, msg string, details ...proto.Message) error {
+	t.Helper()
+	st := &spb.Status{Code: int32(codes.ResourceExhausted), Message: msg}
+	for _, d := range details {
+		a, err := anypb.New(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.Details = append(st.Details, a)
+	}
+	return status.FromProto(st).Err()
+}
+
+func TestBuyResourceExhausted(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  func(t *testing.T) error
+		want error
+	}{
+		{"stockout message", func(*testing.T) error {
+			return status.Error(codes.ResourceExhausted, "Not enough capacity in US to create the commitment")
+		}, ErrStockout},
+		{"stockout reason", func(t *testing.T) error {
+			return withDetails(t, "resource exhausted", &errdetails.ErrorInfo{Reason: "RESOURCE_AVAILABILITY"})
+		}, ErrStockout},
+		{"quota failure", func(t *testing.T) error {
+			return withDetails(t, "resource exhausted", &errdetails.QuotaFailure{Violations: []*errdetails.QuotaFailure_Violation{{Subject: "project:test-project"}}})
+		}, ErrQuotaExceeded},
+		{"quota reason", func(t *testing.T) error {
+			return withDetails(t, "not enough capacity", &errdetails.ErrorInfo{Reason: "RATE_LIMIT_EXCEEDED"})
+		}, ErrQuotaExceeded},
+		{"quota message", func(*testing.T) error {
+			return status.Error(codes.ResourceExhausted, "Quota exceeded for quota metric 'Create requests' of service bigqueryreservation.googleapis.com")
+		}, ErrQuotaExceeded},
+		{"rate limit message", func(*testing.T) error {
+			return status.Error(codes.ResourceExhausted, "Exceeded rate limits: too many api requests per user per method")
+		}, ErrQuotaExceeded},
+		{"bare", func(*testing.T) error {
+			return status.Error(codes.ResourceExhausted, "resource exhausted")
+		}, ErrQuotaExceeded},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewManager(&exhausted{Fake: NewFake(), err: tc.err(t)})
+			m.Retry = testRetry
+
+			_, err := m.Buy(context.Background(), testParent, reservationpb.CapacityCommitment_FLEX, 200, 1000)
+			if !errors.Is(err, tc.want) {
+				t.Errorf("Buy error = %v, want %v", err, tc.want)
+			}
+			if tc.want != ErrStockout && errors.Is(err, ErrStockout) {
+				t.Errorf("Buy error %v is a stockout", err)
+			}
+		})
+	}
+}
+
+func TestFailedErrorStockout(t *testing.T) {
+	for _, tc := range []struct {
+		st   *status.Status
+		want bool
+	}{
+		{status.New(codes.ResourceExhausted, "insufficient capacity for the commitment"), true},
+		{status.New(codes.ResourceExhausted, "quota exceeded"), false},
+		{status.New(codes.Internal, "not enough capacity"), false},
+	} {
+		err := &FailedError{Name: testParent + "/capacityCommitments/c1", Status: tc.st}
+		if got := errors.Is(err, ErrStockout); got != tc.want {
+			t.Errorf("errors.Is(%v, ErrStockout) = %v, want %v", err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package capacity
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"go-slot-scheduler/internal/fault"
+)
+
+// Fake is an in-memory Client. Commitments are ACTIVE as soon as they are
+// created and, like the real API, FLEX commitments can't be deleted in their
+// first minute nor MONTHLY and ANNUAL ones before their end time.
+type Fake struct {
+	// Now is the current time, time.Now if nil.
+	Now func() time.Time
+	// Latency is about how long every call takes.
+	Latency time.Duration
+	// ErrorRate is the share of calls failing with UNAVAILABLE, between 0
+	// and 1.
+	ErrorRate float64
+
+	mu          sync.Mutex
+	commitments map[string]*reservationpb.CapacityCommitment
+}
+
+// NewFake returns a Fake holding no commitments.
+func NewFake() *Fake {
+	return &Fake{commitments: make(map[string]*reservationpb.CapacityCommitment)}
+}
+
+var _ Client = (*Fake)(nil)
+
+// inject delays and fails calls as configured.
+func (f *Fake) inject(ctx context.Context, op string) error {
+	return fault.Injector{Latency: f.Latency, ErrorRate: f.ErrorRate}.Inject(ctx, op)
+}
+
+func (f *Fake) now() time.Time {
+	if f.Now != nil {
+		return f.Now()
+	}
+	return time.Now()
+}
+
+// Add stores c as is, for instance to set up commitments bought by hand.
+func (f *Fake) Add(c *reservationpb.CapacityCommitment) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commitments[c.Name] = proto.Clone(c).(*reservationpb.CapacityCommitment)
+}
+
+func (f *Fake) CreateCapacityCommitment(ctx context.Context, req *reservationpb.CreateCapacityCommitmentRequest) (*reservationpb.CapacityCommitment, error) {
+	if err := f.inject(ctx, "CreateCapacityCommitment"); err != nil {
+		return nil, err
+	}
+	if Region(req.Parent+"/capacityCommitments/") == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid parent %q", req.Parent)
+	}
+	if req.CapacityCommitment.GetSlotCount() < MinSlots || req.CapacityCommitment.GetSlotCount()%MinSlots != 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "slot count must be a positive multiple of %d", MinSlots)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := req.CapacityCommitmentId
+	if id == "" {
+		id = strings.Replace(f.now().Format("20060102150405.000000000"), ".", "", 1)
+	}
+	name := req.Parent + "/capacityCommitments/" + id
+	if _, ok := f.commitments[name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "commitment %s already exists", name)
+	}
+
+	now := f.now()
+	c := proto.Clone(req.CapacityCommitment).(*reservationpb.CapacityCommitment)
+	c.Name = name
+	c.State = reservationpb.CapacityCommitment_ACTIVE
+	c.CommitmentStartTime = timestamppb.New(now)
+	switch c.Plan {
+	case reservationpb.CapacityCommitment_FLEX:
+		c.CommitmentEndTime = timestamppb.New(now.Add(FlexMinDuration))
+	case reservationpb.CapacityCommitment_MONTHLY:
+		c.CommitmentEndTime = timestamppb.New(now.AddDate(0, 0, 30))
+	case reservationpb.CapacityCommitment_ANNUAL:
+		c.CommitmentEndTime = timestamppb.New(now.AddDate(1, 0, 0))
+	}
+	f.commitments[name] = c
+	return proto.Clone(c).(*reservationpb.CapacityCommitment), nil
+}
+
+func (f *Fake) GetCapacityCommitment(ctx context.Context, req *reservationpb.GetCapacityCommitmentRequest) (*reservationpb.CapacityCommitment, error) {
+	if err := f.inject(ctx, "GetCapacityCommitment"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.commitments[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "commitment %s not found", req.Name)
+	}
+	return proto.Clone(c).(*reservationpb.CapacityCommitment), nil
+}
+
+func (f *Fake) DeleteCapacityCommitment(ctx context.Context, req *reservationpb.DeleteCapacityCommitmentRequest) error {
+	if err := f.inject(ctx, "DeleteCapacityCommitment"); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.commitments[req.Name]
+	if !ok {
+		return status.Errorf(codes.NotFound, "commitment %s not found", req.Name)
+	}
+	if c.CommitmentEndTime != nil && f.now().Before(c.CommitmentEndTime.AsTime()) {
+		return status.Errorf(codes.FailedPrecondition, "commitment %s can not be deleted before %s", req.Name, c.CommitmentEndTime.AsTime().Format(time.RFC3339))
+	}
+	delete(f.commitments, req.Name)
+	return nil
+}
+
+func (f *Fake) ListCapacityCommitments(ctx context.Context, req *reservationpb.ListCapacityCommitmentsRequest) ([]*reservationpb.CapacityCommitment, error) {
+	if err := f.inject(ctx, "ListCapacityCommitments"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var list []*reservationpb.CapacityCommitment
+	for name, c := range f.commitments {
+		if strings.HasPrefix(name, req.Parent+"/capacityCommitments/") {
+			list = append(list, proto.Clone(c).(*reservationpb.CapacityCommitment))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
@@ -0,0 +1,121 @@
+// Package client calls the API of the slot scheduler service. Its types and
+// methods are generated from the OpenAPI document the service serves at
+// /openapi.json: run go generate after changing the API.
+//
+//	hc, err := idtoken.NewClient(ctx, url)
+//	...
+//	c := client.New(url, hc)
+//	resp, err := c.AddCapacity(ctx, &client.Payload{Region: "EU", ExtraSlot: 500, Minutes: 120})
+package client
+
+//go:generate go run gen.go
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client calls the API of a slot scheduler service.
+type Client struct {
+	// BaseURL is the URL of the service.
+	BaseURL string
+	// HTTPClient sends the requests. It must authenticate them with an ID
+	// token for the service, unless APIKey is set.
+	HTTPClient *http.Client
+	// APIKey, when set, is sent in X-API-Key, for a key of API_KEYS_JSON.
+	APIKey string
+}
+
+// New returns a Client of the service at baseURL, sending its requests with
+// httpClient, or http.DefaultClient if nil.
+func New(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), HTTPClient: httpClient}
+}
+
+// Error is an error answered by the service.
+type Error struct {
+	StatusCode int
+	APIError
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// do sends body as JSON to path with query, and decodes the data of the
+// response into data. Errors the service answers are returned as *Error.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, data interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		e := &Error{StatusCode: resp.StatusCode}
+		var envelope struct {
+			Error *APIError `json:"error"`
+		}
+		if json.Unmarshal(b, &envelope) == nil && envelope.Error != nil {
+			e.APIError = *envelope.Error
+		} else {
+			e.Message = strings.TrimSpace(string(b))
+		}
+		return e
+	}
+	if data == nil || len(b) == 0 {
+		return nil
+	}
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(b, &envelope); err != nil {
+		return fmt.Errorf("decoding response of %s %s: %v", method, path, err)
+	}
+	if err := json.Unmarshal(envelope.Data, data); err != nil {
+		return fmt.Errorf("decoding response of %s %s: %v", method, path, err)
+	}
+	return nil
+}
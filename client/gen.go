@@ -0,0 +1,353 @@
+//go:build ignore
+
+// gen writes client_gen.go from the OpenAPI document of the service: a
+// method for each operation of the API, leaving out the deprecated ones, the
+// callbacks, the probes, the dashboard and those not answering JSON, and a
+// type for each schema they use.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"go-slot-scheduler/internal/openapi"
+	"go-slot-scheduler/server"
+)
+
+// skippedTags are the tags of the operations left out.
+var skippedTags = map[string]bool{"callbacks": true, "health": true, "ui": true}
+
+// initialisms are written in capitals in Go names.
+var initialisms = map[string]bool{"id": true, "url": true, "api": true, "ms": true, "json": true, "http": true, "ip": true, "iap": true, "usd": true, "utc": true}
+
+type generator struct {
+	doc     *openapi.Document
+	buf     bytes.Buffer
+	imports map[string]bool
+	// used are the schemas the operations use.
+	used map[string]bool
+}
+
+func main() {
+	g := &generator{doc: server.OpenAPI(), imports: map[string]bool{"context": true}, used: map[string]bool{}}
+	ops := g.operations()
+	// Errors of every operation are decoded into APIError.
+	g.use(&openapi.Schema{Ref: "#/components/schemas/APIError"})
+	for _, o := range ops {
+		if o.op.RequestBody != nil {
+			g.use(o.op.RequestBody.Content["application/json"].Schema)
+		}
+		if data, _ := successContent(o.op); data != nil {
+			g.use(data)
+		}
+	}
+	g.types()
+	for _, o := range ops {
+		g.operation(o)
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by gen.go from the OpenAPI document of the service. DO NOT EDIT.\n\npackage client\n\nimport (\n")
+	var imports []string
+	for imp := range g.imports {
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+	for _, imp := range imports {
+		fmt.Fprintf(&out, "%q\n", imp)
+	}
+	fmt.Fprintf(&out, ")\n")
+	out.Write(g.buf.Bytes())
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		log.Fatalf("formatting: %v\n%s", err, out.Bytes())
+	}
+	if err := os.WriteFile("client_gen.go", src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// use marks the schemas s refers to as used.
+func (g *generator) use(s *openapi.Schema) {
+	if s == nil {
+		return
+	}
+	if name := s.RefName(); name != "" {
+		if g.used[name] {
+			return
+		}
+		g.used[name] = true
+		s = g.doc.Components.Schemas[name]
+	}
+	g.use(s.Items)
+	g.use(s.AdditionalProperties)
+	for _, p := range s.Properties {
+		g.use(p.Schema)
+	}
+	for _, o := range s.OneOf {
+		g.use(o)
+	}
+}
+
+// types writes a struct for each schema used.
+func (g *generator) types() {
+	names := make([]string, 0, len(g.used))
+	for name := range g.used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g.printf("\n// %s is the %s schema of the API.\ntype %s %s\n", name, name, name, g.goType(g.doc.Components.Schemas[name], true))
+	}
+}
+
+// goType returns the Go type of values of s, a pointer for those that may
+// be absent unless required.
+func (g *generator) goType(s *openapi.Schema, required bool) string {
+	ptr := ""
+	if s.Nullable || !required {
+		ptr = "*"
+	}
+	switch {
+	case s.Ref != "":
+		if required {
+			return s.RefName()
+		}
+		return "*" + s.RefName()
+	case len(s.OneOf) > 0:
+		g.imports["encoding/json"] = true
+		return "json.RawMessage"
+	}
+	switch s.Type {
+	case "boolean", "integer", "number", "string":
+		if !s.Nullable {
+			ptr = ""
+		}
+		return ptr + scalarType(g, s)
+	case "array":
+		return "[]" + g.goType(s.Items, true)
+	case "object":
+		if s.AdditionalProperties != nil {
+			return "map[string]" + g.goType(s.AdditionalProperties, true)
+		}
+		required := make(map[string]bool, len(s.Required))
+		for _, name := range s.Required {
+			required[name] = true
+		}
+		var b strings.Builder
+		b.WriteString("struct {\n")
+		for _, p := range s.Properties {
+			tag := p.Name
+			if !required[p.Name] {
+				tag += ",omitempty"
+			}
+			fmt.Fprintf(&b, "%s %s `json:%q`\n", goName(p.Name), g.goType(p.Schema, required[p.Name]), tag)
+		}
+		b.WriteString("}")
+		return b.String()
+	}
+	return "interface{}"
+}
+
+// scalarType returns the Go type of the scalar values of s.
+func scalarType(g *generator, s *openapi.Schema) string {
+	switch s.Type {
+	case "boolean":
+		return "bool"
+	case "integer":
+		if s.Format == "int32" {
+			return "int32"
+		}
+		return "int64"
+	case "number":
+		if s.Format == "float" {
+			return "float32"
+		}
+		return "float64"
+	}
+	switch s.Format {
+	case "date-time":
+		g.imports["time"] = true
+		return "time.Time"
+	case "byte":
+		return "[]byte"
+	}
+	return "string"
+}
+
+// comment returns text as a comment wrapped at 77 columns.
+func comment(text string) string {
+	var b strings.Builder
+	line := "//"
+	for _, word := range strings.Fields(text) {
+		if len(line)+1+len(word) > 77 && line != "//" {
+			b.WriteString(line + "\n")
+			line = "//"
+		}
+		line += " " + word
+	}
+	b.WriteString(line + "\n")
+	return b.String()
+}
+
+// goName returns the exported Go name of a snake case or camel case name.
+func goName(name string) string {
+	var b strings.Builder
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '-' || r == '.' }) {
+		if initialisms[strings.ToLower(part)] {
+			b.WriteString(strings.ToUpper(part))
+			continue
+		}
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+type operation struct {
+	method, path string
+	op           *openapi.Operation
+}
+
+// operations returns the operations of the API to write methods for, by
+// operation ID.
+func (g *generator) operations() []operation {
+	var ops []operation
+	for path, item := range g.doc.Paths {
+		for method, op := range item {
+			if op.Deprecated || op.OperationID == "" || len(op.Tags) > 0 && skippedTags[op.Tags[0]] {
+				continue
+			}
+			if _, ok := successContent(op); !ok {
+				continue
+			}
+			ops = append(ops, operation{strings.ToUpper(method), path, op})
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].op.OperationID < ops[j].op.OperationID })
+	return ops
+}
+
+// successContent returns the schema of the data of the success response of
+// op, nil if it has none, and false if it isn't JSON.
+func successContent(op *openapi.Operation) (*openapi.Schema, bool) {
+	for code, resp := range op.Responses {
+		if code == "default" || code[0] != '2' {
+			continue
+		}
+		if len(resp.Content) == 0 {
+			return nil, true
+		}
+		mt, ok := resp.Content["application/json"]
+		if !ok || mt.Schema == nil {
+			return nil, false
+		}
+		for _, p := range mt.Schema.Properties {
+			if p.Name == "data" {
+				return p.Schema, true
+			}
+		}
+		return nil, false
+	}
+	return nil, true
+}
+
+func (g *generator) operation(o operation) {
+	name := goName(o.op.OperationID)
+	data, _ := successContent(o.op)
+
+	args := []string{"ctx context.Context"}
+	pathExpr := fmt.Sprintf("%q", o.path)
+	var query []*openapi.Parameter
+	for _, p := range o.op.Parameters {
+		switch p.In {
+		case "path":
+			args = append(args, p.Name+" string")
+			g.imports["net/url"] = true
+			pathExpr = strings.Replace(pathExpr, "{"+p.Name+"}", `" + url.PathEscape(`+p.Name+`) + "`, 1)
+		case "query":
+			query = append(query, p)
+		}
+	}
+	pathExpr = strings.TrimSuffix(strings.TrimPrefix(pathExpr, `"" + `), ` + ""`)
+	if len(query) > 0 {
+		g.params(name, query)
+		args = append(args, "params *"+name+"Params")
+	}
+	body := "nil"
+	if o.op.RequestBody != nil {
+		args = append(args, "body *"+g.goType(o.op.RequestBody.Content["application/json"].Schema, true))
+		body = "body"
+	}
+
+	doc := fmt.Sprintf("%s calls %s %s, to %s.", name, o.method, o.path, strings.ToLower(o.op.Summary[:1])+o.op.Summary[1:])
+	if o.op.Role != "" {
+		doc += fmt.Sprintf(" It needs the %s role.", o.op.Role)
+	}
+	g.printf("\n%s", comment(doc))
+	result, zero, ref := "", "", ""
+	if data != nil {
+		result = g.goType(data, true)
+		zero, ref = "nil", "&data"
+		if data.Ref != "" {
+			result = "*" + result
+			ref = "data"
+		} else if data.Type == "string" {
+			zero = `""`
+		}
+	}
+	if result == "" {
+		g.printf("func (c *Client) %s(%s) error {\n", name, strings.Join(args, ", "))
+	} else {
+		g.printf("func (c *Client) %s(%s) (%s, error) {\n", name, strings.Join(args, ", "), result)
+	}
+	queryArg := "nil"
+	if len(query) > 0 {
+		queryArg = "params.values()"
+	}
+	switch {
+	case result == "":
+		g.printf("return c.do(ctx, %q, %s, %s, %s, nil)\n}\n", o.method, pathExpr, queryArg, body)
+	case data.Ref != "":
+		g.printf("data := new(%s)\n", data.RefName())
+		g.printf("if err := c.do(ctx, %q, %s, %s, %s, %s); err != nil {\nreturn nil, err\n}\nreturn data, nil\n}\n", o.method, pathExpr, queryArg, body, ref)
+	default:
+		g.printf("var data %s\n", result)
+		g.printf("if err := c.do(ctx, %q, %s, %s, %s, %s); err != nil {\nreturn %s, err\n}\nreturn data, nil\n}\n", o.method, pathExpr, queryArg, body, ref, zero)
+	}
+}
+
+// params writes the struct of the query parameters of the operation name,
+// and its values method.
+func (g *generator) params(name string, query []*openapi.Parameter) {
+	g.imports["net/url"] = true
+	g.printf("\n%stype %sParams struct {\n", comment(fmt.Sprintf("%sParams are the query parameters of %s, sent when not zero.", name, name)), name)
+	for _, p := range query {
+		if p.Description != "" {
+			g.printf("%s", comment(strings.ToUpper(p.Description[:1])+p.Description[1:]+"."))
+		}
+		g.printf("%s %s\n", goName(p.Name), scalarType(g, p.Schema))
+	}
+	g.printf("}\n\nfunc (p *%sParams) values() url.Values {\nq := url.Values{}\nif p == nil {\nreturn q\n}\n", name)
+	for _, p := range query {
+		field := "p." + goName(p.Name)
+		switch p.Schema.Type {
+		case "boolean":
+			g.printf("if %s {\nq.Set(%q, \"true\")\n}\n", field, p.Name)
+		case "integer":
+			g.imports["strconv"] = true
+			g.printf("if %s != 0 {\nq.Set(%q, strconv.FormatInt(int64(%s), 10))\n}\n", field, p.Name, field)
+		default:
+			g.printf("if %s != \"\" {\nq.Set(%q, %s)\n}\n", field, p.Name, field)
+		}
+	}
+	g.printf("return q\n}\n")
+}
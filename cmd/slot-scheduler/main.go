@@ -0,0 +1,106 @@
+// Command slot-scheduler runs the slot scheduler HTTP service.
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"go-slot-scheduler/config"
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/server"
+)
+
+func main() {
+	settings, err := config.Load(os.Args[1:])
+	if err != nil {
+		logging.Fatal("error: %v", err)
+	}
+	if err := server.LoadConfig(settings); err != nil {
+		logging.Fatal("error: %v", err)
+	}
+
+	flushTraces, err := server.InitTracing(context.Background())
+	if err != nil {
+		logging.Fatal("initializing tracing: %v", err)
+	}
+
+	s, err := server.New(context.Background())
+	if err != nil {
+		logging.Fatal("creating clients: %v", err)
+	}
+	if err := s.StartupPreflight(context.Background()); err != nil {
+		logging.Fatal("%v", err)
+	}
+
+	srv := &http.Server{
+		Handler: s.Handler(),
+		Addr:    server.Addr(),
+
+		WriteTimeout: server.WriteTimeout(),
+		ReadTimeout:  30 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	bg, stop := context.WithCancel(context.Background())
+	defer stop()
+	s.Start(bg)
+
+	go func() {
+		logging.Info(context.Background(), "starting server on %s", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal("%v", err)
+		}
+	}()
+
+	// SIGHUP reloads the config file and environment.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if _, err := s.Reload(bg); err != nil {
+				logging.Error(context.Background(), "reloading config: %v", err)
+			}
+		}
+	}()
+
+	// Cloud Run sends SIGTERM before stopping the instance.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	sig := <-c
+	logging.Info(context.Background(), "received %s, draining", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), server.ShutdownTimeout())
+	defer cancel()
+
+	// New requests and purchases are refused while those in flight, and
+	// the deletions and rollbacks they need, finish. The background loops
+	// are only stopped after, so they don't cut their own purchases short.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := srv.Shutdown(ctx); err != nil {
+			logging.Error(context.Background(), "shutting down server: %v", err)
+		}
+	}()
+	if err := s.Drain(ctx); err != nil {
+		logging.Error(context.Background(), "draining: %v", err)
+	}
+	wg.Wait()
+	stop()
+	if err := s.Close(); err != nil {
+		logging.Error(context.Background(), "closing clients: %v", err)
+	}
+	if err := flushTraces(ctx); err != nil {
+		logging.Error(context.Background(), "flushing traces: %v", err)
+	}
+
+	logging.Info(context.Background(), "shutting down")
+	os.Exit(0)
+}
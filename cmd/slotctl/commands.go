@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"go-slot-scheduler/server"
+)
+
+func addCommand() *cobra.Command {
+	var p server.Payload
+	cmd := &cobra.Command{
+		Use:   "add",
+		Short: "Buy slots, deleted again after --minutes or at --until",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := call(cmd.Context(), "POST", "/capacity", p)
+			if err != nil {
+				return err
+			}
+			if output == "json" {
+				return printJSON(data)
+			}
+
+			var resp server.AddCapacityResponse
+			if err := json.Unmarshal(data, &resp); err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "COMMITMENT\tSLOTS\tPLAN\tSTATE\tDELETE AT\tEST. COST")
+			cost := "-"
+			if resp.EstimatedCost != nil {
+				cost = fmt.Sprintf("$%.2f", *resp.EstimatedCost)
+			}
+			name := resp.CommitName
+			if resp.DryRun {
+				name = "(dry run)"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", name, resp.SlotsPurchased, resp.Plan, resp.State, formatTime(resp.DeleteAt), cost)
+			return w.Flush()
+		},
+	}
+	cmd.Flags().StringVar(&p.Region, "region", "", "region or multi-region to buy slots in")
+	cmd.Flags().Int64Var(&p.ExtraSlot, "slots", 0, "slots to buy")
+	cmd.Flags().Int64Var(&p.Minutes, "minutes", 0, "minutes to keep the slots")
+	cmd.Flags().StringVar(&p.Until, "until", "", "RFC3339 time to keep the slots until, instead of --minutes")
+	cmd.Flags().StringVar(&p.Project, "project", "", "admin project, default the service's")
+	cmd.Flags().StringVar(&p.Plan, "plan", "", "FLEX, MONTHLY or ANNUAL, default the service's")
+	cmd.Flags().StringVar(&p.Reason, "reason", "", "why the slots are needed")
+	cmd.Flags().StringVar(&p.Ticket, "ticket", "", "change or incident ticket the slots are bought under")
+	cmd.Flags().StringVar(&p.Requester, "for", "", "who the slots are for, when buying on someone else's behalf")
+	cmd.Flags().StringVar(&p.RequestID, "request-id", "", "idempotency key, retries with the same key buy once")
+	cmd.Flags().BoolVar(&p.DryRun, "dry-run", false, "only report what would be bought")
+	cmd.MarkFlagRequired("region")
+	cmd.MarkFlagRequired("slots")
+	return cmd
+}
+
+func listCommand() *cobra.Command {
+	var region, project string
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List commitments and their pending deletions",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			q := url.Values{}
+			if region != "" {
+				q.Set("region", region)
+			}
+			if project != "" {
+				q.Set("project", project)
+			}
+			path := "/commitments"
+			if len(q) > 0 {
+				path += "?" + q.Encode()
+			}
+			data, err := call(cmd.Context(), "GET", path, nil)
+			if err != nil {
+				return err
+			}
+			if output == "json" {
+				return printJSON(data)
+			}
+
+			var list []server.CommitmentInfo
+			if err := json.Unmarshal(data, &list); err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "COMMITMENT\tREGION\tSLOTS\tPLAN\tSTATE\tSTARTED\tDELETE AT")
+			for _, c := range list {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", c.Name, c.Region, c.SlotCount, c.Plan, c.State, formatTime(c.StartTime), formatTime(c.DeleteAt))
+			}
+			return w.Flush()
+		},
+	}
+	cmd.Flags().StringVar(&region, "region", "", "only list this region, default every configured region")
+	cmd.Flags().StringVar(&project, "project", "", "admin project, default the service's")
+	return cmd
+}
+
+func cancelCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "cancel COMMITMENT",
+		Short: "Cancel the scheduled deletion of a commitment, keeping its slots",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			parts := strings.Split(args[0], "/")
+			if len(parts) != 6 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "capacityCommitments" {
+				return fmt.Errorf("%q is not a commitment name of the form projects/PROJECT/locations/REGION/capacityCommitments/ID", args[0])
+			}
+			path := fmt.Sprintf("/commitments/%s/%s/deletion?project=%s", parts[3], parts[5], url.QueryEscape(parts[1]))
+			data, err := call(cmd.Context(), "DELETE", path, nil)
+			if err != nil {
+				return err
+			}
+			if output == "json" {
+				return printJSON(data)
+			}
+
+			var c server.CommitmentInfo
+			if err := json.Unmarshal(data, &c); err != nil {
+				return err
+			}
+			fmt.Printf("deletion of %s (%d slots) cancelled\n", c.Name, c.SlotCount)
+			return nil
+		},
+	}
+}
+
+func purgeCommand() *cobra.Command {
+	var (
+		p   server.Purge
+		yes bool
+	)
+	cmd := &cobra.Command{
+		Use:   "purge",
+		Short: "Delete every FLEX commitment the service bought, now",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !yes {
+				where := "every region"
+				if p.Region != "" {
+					where = p.Region
+				}
+				return fmt.Errorf("this deletes every FLEX commitment the service bought in %s, pass --yes to go ahead", where)
+			}
+			data, err := call(cmd.Context(), "POST", "/purge", p)
+			if err != nil {
+				return err
+			}
+			if output == "json" {
+				return printJSON(data)
+			}
+
+			var res server.PurgeResult
+			if err := json.Unmarshal(data, &res); err != nil {
+				return err
+			}
+			for _, rel := range res.Released {
+				fmt.Printf("deleted %s (%d slots)\n", rel.Commitment, rel.Slots)
+			}
+			fmt.Printf("%d slots released\n", res.SlotsReleased)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&p.Region, "region", "", "only purge this region, default every region")
+	cmd.Flags().StringVar(&p.Reason, "reason", "", "why the capacity is purged")
+	cmd.Flags().StringVar(&p.Ticket, "ticket", "", "incident ticket the capacity is purged under")
+	cmd.Flags().BoolVar(&yes, "yes", false, "confirm the purge")
+	return cmd
+}
+
+func historyCommand() *cobra.Command {
+	var (
+		window, region, requester, action, ticket, commitment, cursor string
+		limit                                                         int
+	)
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "Show recent purchases, deletions and other scaling actions",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			query := url.Values{"window": {window}, "limit": {fmt.Sprint(limit)}}
+			for name, v := range map[string]string{"region": region, "requester": requester, "action": action, "ticket": ticket, "commitment": commitment, "cursor": cursor} {
+				if v != "" {
+					query.Set(name, v)
+				}
+			}
+			data, err := call(cmd.Context(), "GET", "/history?"+query.Encode(), nil)
+			if err != nil {
+				return err
+			}
+			if output == "json" {
+				return printJSON(data)
+			}
+
+			var page server.HistoryPage
+			if err := json.Unmarshal(data, &page); err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "TIME\tACTION\tREGION\tSLOTS\tCOMMITMENT\tREQUESTER\tERROR")
+			for _, e := range page.Entries {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", formatTime(&e.Time), e.Action, e.Region, e.Slots, e.Commitment, e.Requester, e.Error)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			if page.NextCursor != "" {
+				fmt.Fprintf(os.Stderr, "more with --cursor %s\n", page.NextCursor)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&window, "window", "7d", "how far back to look, a duration or a number of days such as 30d")
+	cmd.Flags().StringVar(&region, "region", "", "only show this region")
+	cmd.Flags().StringVar(&requester, "requester", "", "only show the actions of this requester")
+	cmd.Flags().StringVar(&action, "action", "", "only show this action, such as purchased")
+	cmd.Flags().StringVar(&ticket, "ticket", "", "only show the actions taken under this ticket")
+	cmd.Flags().StringVar(&commitment, "commitment", "", "only show the actions on this commitment")
+	cmd.Flags().IntVar(&limit, "limit", 100, "most entries shown")
+	cmd.Flags().StringVar(&cursor, "cursor", "", "show the page after the one that printed it")
+	return cmd
+}
+
+func simulateCommand() *cobra.Command {
+	var (
+		region, window string
+		committedSlots int64
+		policy         = map[string]*string{}
+		floats         = map[string]*float64{}
+		step           int64
+	)
+	cmd := &cobra.Command{
+		Use:   "simulate",
+		Short: "Replay past slot usage against an autoscaling policy",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Only the flags given override the policy of the service.
+			body := map[string]interface{}{"region": region, "window": window}
+			if cmd.Flags().Changed("committed-slots") {
+				body["committed_slots"] = committedSlots
+			}
+			p := map[string]interface{}{}
+			for name, v := range policy {
+				if cmd.Flags().Changed(name) {
+					p[strings.ReplaceAll(name, "-", "_")] = *v
+				}
+			}
+			for name, v := range floats {
+				if cmd.Flags().Changed(name) {
+					p[strings.ReplaceAll(name, "-", "_")] = *v
+				}
+			}
+			if cmd.Flags().Changed("step") {
+				p["step"] = step
+			}
+			body["policy"] = p
+
+			data, err := call(cmd.Context(), "POST", "/simulate", body)
+			if err != nil {
+				return err
+			}
+			if output == "json" {
+				return printJSON(data)
+			}
+
+			var report server.SimulationReport
+			if err := json.Unmarshal(data, &report); err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "TIME\tACTION\tSLOTS\tHELD\tUSED\tPENDING\tUTILIZATION")
+			for _, a := range report.Actions {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.0f\t%.0f\t%.0f%%\n", formatTime(&a.Time), a.Action, a.Slots, a.Held, a.Used, a.Pending, a.Utilization*100)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			fmt.Printf("\n%d purchases, %d releases, %d expired, %d capped, peak %d slots over %d committed\n",
+				report.Purchases, report.Releases, report.Expired, report.CappedPurchases, report.PeakSlots, report.CommittedSlots)
+			fmt.Printf("%.1f slot hours, $%.2f; %.1f of %.1f queued slot hours avoided\n",
+				report.SlotHours, report.EstimatedCost, report.AvoidedSlotHours, report.QueuedSlotHours)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&region, "region", "", "region or multi-region to replay")
+	cmd.Flags().StringVar(&window, "window", "7d", "how far back to replay, a duration or a number of days such as 14d")
+	cmd.Flags().Int64Var(&committedSlots, "committed-slots", 0, "slots held besides the autoscaler's, default the region's commitments other than FLEX")
+	for name, usage := range map[string]string{
+		"interval": "how often the autoscaler runs",
+		"lookback": "how much usage each run averages",
+		"view":     "INFORMATION_SCHEMA view read",
+		"cooldown": "wait between actions",
+		"max-hold": "when bought commitments are deleted regardless",
+	} {
+		policy[name] = cmd.Flags().String(name, "", usage+", default the service's")
+	}
+	for name, usage := range map[string]string{
+		"up-utilization":   "share of the committed slots used to scale up at",
+		"up-pending":       "pending slots to scale up at",
+		"down-utilization": "share of the committed slots used to scale down under",
+	} {
+		floats[name] = cmd.Flags().Float64(name, 0, usage+", default the service's")
+	}
+	cmd.Flags().Int64Var(&step, "step", 0, "slots bought or released at once, default the service's")
+	cmd.MarkFlagRequired("region")
+	return cmd
+}
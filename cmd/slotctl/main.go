@@ -0,0 +1,166 @@
+// Command slotctl adds, lists and cancels slot capacity through the slot
+// scheduler service.
+//
+//	slotctl add --region EU --slots 500 --minutes 120
+//	slotctl list
+//	slotctl cancel projects/p/locations/EU/capacityCommitments/123
+//	slotctl purge --region EU --yes
+//	slotctl history
+//	slotctl simulate --region EU --window 14d --up-utilization 0.8
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/api/idtoken"
+)
+
+// apiPrefix is the version of the API slotctl calls.
+const apiPrefix = "/v1"
+
+var (
+	serviceURL string
+	token      string
+	apiKey     string
+	output     string
+)
+
+func main() {
+	root := &cobra.Command{
+		Use:           "slotctl",
+		Short:         "Manage BigQuery slot capacity through the slot scheduler",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if serviceURL == "" {
+				return fmt.Errorf("set --url or SLOTCTL_URL to the URL of the service")
+			}
+			serviceURL = strings.TrimSuffix(serviceURL, "/")
+			if output != "table" && output != "json" {
+				return fmt.Errorf("unknown output %q, want table or json", output)
+			}
+			return nil
+		},
+	}
+	root.PersistentFlags().StringVar(&serviceURL, "url", os.Getenv("SLOTCTL_URL"), "URL of the service, default SLOTCTL_URL")
+	root.PersistentFlags().StringVar(&token, "token", os.Getenv("SLOTCTL_TOKEN"), "identity token to call the service with, default SLOTCTL_TOKEN, then the application default credentials or gcloud")
+	root.PersistentFlags().StringVar(&apiKey, "api-key", os.Getenv("SLOTCTL_API_KEY"), "API key to call the service with instead of an identity token, default SLOTCTL_API_KEY")
+	root.PersistentFlags().StringVarP(&output, "output", "o", "table", "output format, table or json")
+
+	root.AddCommand(addCommand(), listCommand(), cancelCommand(), purgeCommand(), historyCommand(), simulateCommand())
+
+	if err := root.ExecuteContext(context.Background()); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// apiError is the error body of the service.
+type apiError struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	Retryable bool                   `json:"retryable"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// call sends body as JSON to path and returns the data of the response.
+func call(ctx context.Context, method, path string, body interface{}) (json.RawMessage, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, serviceURL+apiPrefix+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	} else {
+		tok, err := identityToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Data  json.RawMessage `json:"data"`
+		Error *apiError       `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if envelope.Error != nil {
+		return nil, envelope.Error
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return envelope.Data, nil
+}
+
+// identityToken returns the token to call the service with: --token, else
+// one minted from the application default credentials for the service URL,
+// else one printed by gcloud for user accounts.
+func identityToken(ctx context.Context) (string, error) {
+	if token != "" {
+		return token, nil
+	}
+	if ts, err := idtoken.NewTokenSource(ctx, serviceURL); err == nil {
+		if t, err := ts.Token(); err == nil {
+			return t.AccessToken, nil
+		}
+	}
+	out, err := exec.CommandContext(ctx, "gcloud", "auth", "print-identity-token").Output()
+	if err != nil {
+		return "", fmt.Errorf("getting an identity token, set --token or SLOTCTL_TOKEN: %v", err)
+	}
+	token = strings.TrimSpace(string(out))
+	return token, nil
+}
+
+// printJSON writes data indented.
+func printJSON(data json.RawMessage) error {
+	var b bytes.Buffer
+	if err := json.Indent(&b, data, "", "  "); err != nil {
+		return err
+	}
+	b.WriteString("\n")
+	_, err := b.WriteTo(os.Stdout)
+	return err
+}
+
+// formatTime formats t for tables, - if it is not set.
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,467 @@
+// Package config loads the settings of the slot scheduler from a YAML or
+// JSON file, the environment and flags, each overriding the one before.
+//
+// Settings are named by their environment variables, which the file sets
+// from its sections, such as caps.max_slots for MAX_SLOTS, or by name under
+// env. Flags are the names in lower case with dashes, such as -max-slots.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Sources of a setting.
+const (
+	SourceFile = "file"
+	SourceEnv  = "env"
+	SourceFlag = "flag"
+)
+
+// Names are the settings of the service, by environment variable.
+var Names = []string{
+	"ACCESS_LOG", "ADMIN_PROJECTS_JSON", "ALERT_ACTIONS", "ALERT_TOKEN", "ALLOWED_REGIONS",
+	"API_KEYS_JSON", "AUDIT_TOPIC", "AUTH_AUDIENCES", "AUTH_ROLES_JSON",
+	"AUTOSCALE_COOLDOWN", "AUTOSCALE_DOWN_UTILIZATION", "AUTOSCALE_INTERVAL",
+	"AUTOSCALE_LOOKBACK", "AUTOSCALE_MAX_HOLD", "AUTOSCALE_STEP",
+	"AUTOSCALE_UP_PENDING", "AUTOSCALE_UP_UTILIZATION", "AUTOSCALE_VIEW",
+	"BLACKOUTS_JSON", "BLACKOUT_ADMINS", "BUDGETS_JSON", "BUDGET_STOP_JSON",
+	"BUMP_RESERVATION", "BUMP_TARGET", "CAPACITY_MODE", "CAP_CACHE_TTL", "CAP_OWNED_ONLY", "CAP_PLANS", "CAP_STATES", "CLOUDEVENT_ACTIONS",
+	"COMMITMENT_OVERDUE_AFTER",
+	"COMMIT_SLOT_HOUR_PRICE", "CREATE_QUEUE", "DEFAULT_PLAN", "DELETE_CALLBACK_URL",
+	"DELETE_GUARD_LOOKBACK", "DELETE_GUARD_MAX", "DELETE_GUARD_POSTPONE",
+	"DELETE_GUARD_UTILIZATION", "DELETE_PUBSUB_TOPIC", "DELETE_SCHEDULER",
+	"DELETE_TASK_DISPATCH_DEADLINE", "DELETE_TASK_MAX_ATTEMPTS",
+	"DELETE_TASK_MAX_BACKOFF", "DELETE_TASK_MIN_BACKOFF", "DELETE_WATCHDOG_GRACE",
+	"DELETE_WATCHDOG_INTERVAL", "DELETE_WORKFLOW", "DESIRED_STATE_INTERVAL",
+	"DESIRED_STATE_URL", "DRIFT_INTERVAL", "DRIFT_REMEDIATE", "DRY_RUN",
+	"EMAIL_FROM", "EMAIL_TO", "ENDPOINT_TIMEOUTS_JSON", "EVENTARC_AUDIENCE", "EVENTARC_SERVICE_ACCOUNT",
+	"FAKE_BACKENDS", "FAKE_ERROR_RATE",
+	"FAKE_LATENCY", "FIRESTORE_PROJECT", "FLEX_SLOT_HOUR_PRICE",
+	"FLEX_SLOT_HOUR_PRICES_JSON", "GOOGLE_CHAT_WEBHOOK_URL",
+	"GOOGLE_CLOUD_PROJECT", "IAP_AUDIENCE", "LEDGER_EXPORT_TABLE",
+	"MAX_MINUTES", "MAX_MINUTES_POLICY", "MAX_RESPONSE_BYTES", "MAX_SLOTS", "MAX_SLOTS_JSON",
+	"MERGE_INTERVAL", "NOTIFIERS",
+	"NOTIFY_EVENTS", "NOTIFY_PUBSUB_TOPIC", "OPSGENIE_API_KEY",
+	"OPSGENIE_API_URL", "PAGERDUTY_ROUTING_KEY", "PORT", "PREFLIGHT",
+	"PROFILE_INTERVAL", "PUBSUB_AUDIENCE", "PUBSUB_SERVICE_ACCOUNT",
+	"PUBSUB_VERIFICATION_TOKEN", "QUEUE_CHECK_INTERVAL", "QUEUE_ID", "QUEUE_LOCATION",
+	"QUEUES",
+	"RECONCILE_INTERVAL", "REGIONS", "REQUEST_TIMEOUT", "REQUIRED_METADATA", "RETRY_CODES",
+	"RETRY_INITIAL_BACKOFF", "RETRY_MAX_ATTEMPTS", "RETRY_MAX_BACKOFF",
+	"SCHEDULER_JOBS", "SCHEDULER_JOBS_LOCATION",
+	"SCHEDULER_JOBS_SERVICE_ACCOUNT", "SCHEDULE_INTERVAL", "SELF_URL",
+	"SENDGRID_API_KEY", "SHUTDOWN_TIMEOUT", "SLACK_OPERATORS",
+	"SLACK_SIGNING_SECRET", "SLACK_TEAM_ID", "SLACK_WEBHOOK_URL", "SMTP_ADDR",
+	"SMTP_PASSWORD", "SMTP_USERNAME", "STATE_STORE", "STOCKOUT_FALLBACK",
+	"STOCKOUT_MIN_SLOTS", "TASK_AUDIENCE",
+	"TASK_SERVICE_ACCOUNT", "TRACE_SAMPLE_RATIO", "UI_OPERATORS",
+}
+
+// Secrets are the settings holding keys, tokens and webhook URLs, which
+// are never shown.
+var Secrets = map[string]bool{
+	"ALERT_TOKEN": true, "API_KEYS_JSON": true, "GOOGLE_CHAT_WEBHOOK_URL": true,
+	"OPSGENIE_API_KEY": true, "PAGERDUTY_ROUTING_KEY": true,
+	"PUBSUB_VERIFICATION_TOKEN": true, "SENDGRID_API_KEY": true,
+	"SLACK_SIGNING_SECRET": true, "SLACK_WEBHOOK_URL": true, "SMTP_PASSWORD": true,
+}
+
+// Config is the file of CONFIG_PATH. Fields left out leave their setting to
+// the environment and defaults.
+type Config struct {
+	Project string `yaml:"project"`
+	Port    string `yaml:"port"`
+	// Regions are listed when no region is given, AllowedRegions may be
+	// named by requests.
+	Regions        []string   `yaml:"regions"`
+	AllowedRegions []string   `yaml:"allowed_regions"`
+	Caps           Caps       `yaml:"caps"`
+	Plans          Plans      `yaml:"plans"`
+	Queue          Queue      `yaml:"queue"`
+	Auth           Auth       `yaml:"auth"`
+	Notify         Notify     `yaml:"notify"`
+	Autoscaler     Autoscaler `yaml:"autoscaler"`
+	// Env sets any setting by name, such as RECONCILE_INTERVAL. Lists and
+	// maps are encoded as JSON, for the settings ending in _JSON.
+	Env map[string]interface{} `yaml:"env"`
+}
+
+// Caps bound the capacity held.
+type Caps struct {
+	MaxSlots int64 `yaml:"max_slots"`
+	// Regions are the caps of regions that don't share MaxSlots.
+	Regions    map[string]int64 `yaml:"regions"`
+	MaxMinutes int64            `yaml:"max_minutes"`
+	// MaxMinutesPolicy is what is done with requests for longer:
+	// reject or clamp.
+	MaxMinutesPolicy string `yaml:"max_minutes_policy"`
+	// Plans, States and OwnedOnly pick the commitments counted.
+	Plans     []string `yaml:"plans"`
+	States    []string `yaml:"states"`
+	OwnedOnly *bool    `yaml:"owned_only"`
+	// CacheTTL keeps the slots counted between purchases.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+// Plans are the plan bought by default and the prices purchases are
+// estimated with.
+type Plans struct {
+	Default             string             `yaml:"default"`
+	FlexSlotHourPrice   *float64           `yaml:"flex_slot_hour_price"`
+	FlexSlotHourPrices  map[string]float64 `yaml:"flex_slot_hour_prices"`
+	CommitSlotHourPrice *float64           `yaml:"commit_slot_hour_price"`
+	// CapacityMode is what adding capacity does: buy commitments, or bump
+	// the BumpTarget of the reservation BumpReservation.
+	CapacityMode    string `yaml:"capacity_mode"`
+	BumpReservation string `yaml:"bump_reservation"`
+	BumpTarget      string `yaml:"bump_target"`
+	// StockoutFallback is what FLEX purchases the region has no capacity
+	// for do, buying no less than StockoutMinSlots.
+	StockoutFallback string `yaml:"stockout_fallback"`
+	StockoutMinSlots int64  `yaml:"stockout_min_slots"`
+}
+
+// Queue is where deletions are scheduled.
+type Queue struct {
+	ID        string `yaml:"id"`
+	Location  string `yaml:"location"`
+	Scheduler string `yaml:"scheduler"`
+	// Queues are the queues as {location}/{queue}, in order of preference,
+	// in place of ID and Location.
+	Queues []string `yaml:"queues"`
+	// Create creates the queues that don't exist on startup.
+	Create *bool `yaml:"create"`
+	// ServiceAccount signs the OIDC tokens of delete tasks.
+	ServiceAccount string `yaml:"service_account"`
+	MaxAttempts    int    `yaml:"max_attempts"`
+	// DispatchDeadline, MinBackoff and MaxBackoff are how long delete
+	// tasks wait for the service and between attempts.
+	DispatchDeadline time.Duration `yaml:"dispatch_deadline"`
+	MinBackoff       time.Duration `yaml:"min_backoff"`
+	MaxBackoff       time.Duration `yaml:"max_backoff"`
+}
+
+// Auth is who may call the service.
+type Auth struct {
+	// Roles maps emails, or @domain, to reader, operator or admin.
+	Roles     map[string]string `yaml:"roles"`
+	APIKeys   map[string]APIKey `yaml:"api_keys"`
+	Audiences []string          `yaml:"audiences"`
+	// IAPAudience and UIOperators guard the dashboard without Roles.
+	IAPAudience      string   `yaml:"iap_audience"`
+	UIOperators      []string `yaml:"ui_operators"`
+	RequiredMetadata []string `yaml:"required_metadata"`
+}
+
+// APIKey is the key and role of a legacy caller.
+type APIKey struct {
+	Key  string `yaml:"key" json:"key"`
+	Role string `yaml:"role" json:"role"`
+}
+
+// Notify is who is told about scaling events, and how.
+type Notify struct {
+	// Notifiers are log, slack, chat, pubsub and email.
+	Notifiers            []string `yaml:"notifiers"`
+	Events               []string `yaml:"events"`
+	SlackWebhookURL      string   `yaml:"slack_webhook_url"`
+	GoogleChatWebhookURL string   `yaml:"google_chat_webhook_url"`
+	PubSubTopic          string   `yaml:"pubsub_topic"`
+	Email                Email    `yaml:"email"`
+	PagerDutyRoutingKey  string   `yaml:"pagerduty_routing_key"`
+	OpsgenieAPIKey       string   `yaml:"opsgenie_api_key"`
+}
+
+// Email is the email notifier, through SendGrid or SMTP.
+type Email struct {
+	From           string   `yaml:"from"`
+	To             []string `yaml:"to"`
+	SendGridAPIKey string   `yaml:"sendgrid_api_key"`
+	SMTPAddr       string   `yaml:"smtp_addr"`
+	SMTPUsername   string   `yaml:"smtp_username"`
+	SMTPPassword   string   `yaml:"smtp_password"`
+}
+
+// Autoscaler scales on slot usage, off unless Interval is set.
+type Autoscaler struct {
+	Interval        time.Duration `yaml:"interval"`
+	Lookback        time.Duration `yaml:"lookback"`
+	Cooldown        time.Duration `yaml:"cooldown"`
+	MaxHold         time.Duration `yaml:"max_hold"`
+	UpUtilization   *float64      `yaml:"up_utilization"`
+	UpPending       *float64      `yaml:"up_pending"`
+	DownUtilization *float64      `yaml:"down_utilization"`
+	Step            int64         `yaml:"step"`
+	View            string        `yaml:"view"`
+}
+
+// Settings are the settings of the service once merged.
+type Settings struct {
+	// Path is the config file, empty if there is none.
+	Path   string
+	values map[string]string
+	source map[string]string
+	flags  map[string]string
+}
+
+// Load reads the file named by -config or CONFIG_PATH, if any, then the
+// environment, then the flags of args.
+func Load(args []string) (*Settings, error) {
+	fs := flag.NewFlagSet("slot-scheduler", flag.ExitOnError)
+	path := fs.String("config", os.Getenv("CONFIG_PATH"), "YAML or JSON config file, overridden by the environment and flags")
+	flags := make(map[string]string)
+	for _, name := range Names {
+		name := name
+		fs.Func(FlagName(name), "overrides "+name, func(v string) error {
+			flags[name] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+	return load(*path, flags)
+}
+
+// Reload reads the file and environment again, keeping the flags. On a nil
+// Settings it only reads the environment.
+func (s *Settings) Reload() (*Settings, error) {
+	if s == nil {
+		return load("", nil)
+	}
+	return load(s.Path, s.flags)
+}
+
+func load(path string, flags map[string]string) (*Settings, error) {
+	s := &Settings{Path: path, values: make(map[string]string), source: make(map[string]string), flags: flags}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config: %v", err)
+		}
+		c, err := Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		values, err := c.Settings()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for name, v := range values {
+			s.set(name, v, SourceFile)
+		}
+	}
+	for _, name := range Names {
+		if v := os.Getenv(name); v != "" {
+			s.set(name, v, SourceEnv)
+		}
+	}
+	for name, v := range flags {
+		s.set(name, v, SourceFlag)
+	}
+	return s, nil
+}
+
+func (s *Settings) set(name, v, source string) {
+	s.values[name], s.source[name] = v, source
+}
+
+// Parse decodes a config file, rejecting fields it doesn't know. JSON is
+// read as the YAML it is.
+func Parse(data []byte) (*Config, error) {
+	var c Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Get returns the value of the setting name, empty if it isn't set. It is
+// safe on a nil Settings, which reads the environment.
+func (s *Settings) Get(name string) string {
+	if s == nil {
+		return os.Getenv(name)
+	}
+	return s.values[name]
+}
+
+// Source returns where the setting name came from, empty if it isn't set.
+func (s *Settings) Source(name string) string {
+	if s == nil {
+		if os.Getenv(name) != "" {
+			return SourceEnv
+		}
+		return ""
+	}
+	return s.source[name]
+}
+
+// Changed returns the names of the settings whose values differ between a
+// and b, sorted.
+func Changed(a, b *Settings) []string {
+	var names []string
+	for _, name := range Names {
+		if a.Get(name) != b.Get(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Settings returns the settings c sets, by name.
+func (c *Config) Settings() (map[string]string, error) {
+	m := make(map[string]string)
+	str := func(name, v string) {
+		if v != "" {
+			m[name] = v
+		}
+	}
+	list := func(name string, v []string) {
+		str(name, strings.Join(v, ","))
+	}
+	num := func(name string, v int64) {
+		if v != 0 {
+			m[name] = strconv.FormatInt(v, 10)
+		}
+	}
+	float := func(name string, v *float64) {
+		if v != nil {
+			m[name] = strconv.FormatFloat(*v, 'f', -1, 64)
+		}
+	}
+	dur := func(name string, v time.Duration) {
+		if v != 0 {
+			m[name] = v.String()
+		}
+	}
+	var err error
+	encode := func(name string, v interface{}, empty bool) {
+		if empty {
+			return
+		}
+		data, e := json.Marshal(v)
+		if e != nil && err == nil {
+			err = fmt.Errorf("%s: %v", name, e)
+		}
+		m[name] = string(data)
+	}
+
+	str("GOOGLE_CLOUD_PROJECT", c.Project)
+	str("PORT", c.Port)
+	list("REGIONS", c.Regions)
+	list("ALLOWED_REGIONS", c.AllowedRegions)
+
+	num("MAX_SLOTS", c.Caps.MaxSlots)
+	encode("MAX_SLOTS_JSON", c.Caps.Regions, len(c.Caps.Regions) == 0)
+	num("MAX_MINUTES", c.Caps.MaxMinutes)
+	str("MAX_MINUTES_POLICY", c.Caps.MaxMinutesPolicy)
+	list("CAP_PLANS", c.Caps.Plans)
+	list("CAP_STATES", c.Caps.States)
+	if c.Caps.OwnedOnly != nil {
+		m["CAP_OWNED_ONLY"] = strconv.FormatBool(*c.Caps.OwnedOnly)
+	}
+	dur("CAP_CACHE_TTL", c.Caps.CacheTTL)
+
+	str("DEFAULT_PLAN", c.Plans.Default)
+	float("FLEX_SLOT_HOUR_PRICE", c.Plans.FlexSlotHourPrice)
+	encode("FLEX_SLOT_HOUR_PRICES_JSON", c.Plans.FlexSlotHourPrices, len(c.Plans.FlexSlotHourPrices) == 0)
+	float("COMMIT_SLOT_HOUR_PRICE", c.Plans.CommitSlotHourPrice)
+	str("CAPACITY_MODE", c.Plans.CapacityMode)
+	str("BUMP_RESERVATION", c.Plans.BumpReservation)
+	str("BUMP_TARGET", c.Plans.BumpTarget)
+	str("STOCKOUT_FALLBACK", c.Plans.StockoutFallback)
+	num("STOCKOUT_MIN_SLOTS", c.Plans.StockoutMinSlots)
+
+	str("QUEUE_ID", c.Queue.ID)
+	str("QUEUE_LOCATION", c.Queue.Location)
+	list("QUEUES", c.Queue.Queues)
+	if c.Queue.Create != nil {
+		m["CREATE_QUEUE"] = strconv.FormatBool(*c.Queue.Create)
+	}
+	str("DELETE_SCHEDULER", c.Queue.Scheduler)
+	str("TASK_SERVICE_ACCOUNT", c.Queue.ServiceAccount)
+	num("DELETE_TASK_MAX_ATTEMPTS", int64(c.Queue.MaxAttempts))
+	dur("DELETE_TASK_DISPATCH_DEADLINE", c.Queue.DispatchDeadline)
+	dur("DELETE_TASK_MIN_BACKOFF", c.Queue.MinBackoff)
+	dur("DELETE_TASK_MAX_BACKOFF", c.Queue.MaxBackoff)
+
+	encode("AUTH_ROLES_JSON", c.Auth.Roles, len(c.Auth.Roles) == 0)
+	encode("API_KEYS_JSON", c.Auth.APIKeys, len(c.Auth.APIKeys) == 0)
+	list("AUTH_AUDIENCES", c.Auth.Audiences)
+	str("IAP_AUDIENCE", c.Auth.IAPAudience)
+	list("UI_OPERATORS", c.Auth.UIOperators)
+	list("REQUIRED_METADATA", c.Auth.RequiredMetadata)
+
+	list("NOTIFIERS", c.Notify.Notifiers)
+	list("NOTIFY_EVENTS", c.Notify.Events)
+	str("SLACK_WEBHOOK_URL", c.Notify.SlackWebhookURL)
+	str("GOOGLE_CHAT_WEBHOOK_URL", c.Notify.GoogleChatWebhookURL)
+	str("NOTIFY_PUBSUB_TOPIC", c.Notify.PubSubTopic)
+	str("EMAIL_FROM", c.Notify.Email.From)
+	list("EMAIL_TO", c.Notify.Email.To)
+	str("SENDGRID_API_KEY", c.Notify.Email.SendGridAPIKey)
+	str("SMTP_ADDR", c.Notify.Email.SMTPAddr)
+	str("SMTP_USERNAME", c.Notify.Email.SMTPUsername)
+	str("SMTP_PASSWORD", c.Notify.Email.SMTPPassword)
+	str("PAGERDUTY_ROUTING_KEY", c.Notify.PagerDutyRoutingKey)
+	str("OPSGENIE_API_KEY", c.Notify.OpsgenieAPIKey)
+
+	dur("AUTOSCALE_INTERVAL", c.Autoscaler.Interval)
+	dur("AUTOSCALE_LOOKBACK", c.Autoscaler.Lookback)
+	dur("AUTOSCALE_COOLDOWN", c.Autoscaler.Cooldown)
+	dur("AUTOSCALE_MAX_HOLD", c.Autoscaler.MaxHold)
+	float("AUTOSCALE_UP_UTILIZATION", c.Autoscaler.UpUtilization)
+	float("AUTOSCALE_UP_PENDING", c.Autoscaler.UpPending)
+	float("AUTOSCALE_DOWN_UTILIZATION", c.Autoscaler.DownUtilization)
+	num("AUTOSCALE_STEP", c.Autoscaler.Step)
+	str("AUTOSCALE_VIEW", c.Autoscaler.View)
+
+	// env comes last, for the settings the sections don't name.
+	known := make(map[string]bool, len(Names))
+	for _, name := range Names {
+		known[name] = true
+	}
+	names := make([]string, 0, len(c.Env))
+	for name := range c.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !known[name] {
+			return nil, fmt.Errorf("env: unknown setting %s", name)
+		}
+		switch v := c.Env[name].(type) {
+		case nil:
+		case string:
+			m[name] = v
+		case []interface{}, map[string]interface{}:
+			encode(name, v, false)
+		default:
+			m[name] = fmt.Sprint(v)
+		}
+	}
+	return m, err
+}
+
+// FlagName is the flag of the setting name, such as max-slots for
+// MAX_SLOTS.
+func FlagName(name string) string {
+	return strings.ReplaceAll(strings.ToLower(name), "_", "-")
+}
@@ -0,0 +1,36 @@
+// Package fault slows down and fails calls to the fake backends, so local
+// runs see the latencies and transient errors of the real APIs.
+package fault
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Injector delays every call by about Latency and fails a ErrorRate share of
+// them with UNAVAILABLE. The zero value injects nothing.
+type Injector struct {
+	Latency   time.Duration
+	ErrorRate float64
+}
+
+// Inject waits between half and one and a half times the latency, then
+// returns the error op fails with, if any.
+func (in Injector) Inject(ctx context.Context, op string) error {
+	if in.Latency > 0 {
+		d := in.Latency/2 + time.Duration(rand.Int63n(int64(in.Latency)+1))
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-time.After(d):
+		}
+	}
+	if in.ErrorRate > 0 && rand.Float64() < in.ErrorRate {
+		return status.Errorf(codes.Unavailable, "%s: injected failure", op)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Package logging writes structured log entries Cloud Run turns into Cloud
+// Logging entries, correlated with the trace of the request.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Cloud Logging severities, see
+// https://cloud.google.com/logging/docs/reference/v2/rest/v2/LogEntry#logseverity.
+const (
+	severityInfo     = "INFO"
+	severityWarning  = "WARNING"
+	severityError    = "ERROR"
+	severityCritical = "CRITICAL"
+)
+
+// errorReportingType makes Error Reporting pick up entries without a stack
+// trace, see https://cloud.google.com/error-reporting/docs/formatting-error-messages.
+const errorReportingType = "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent"
+
+// ProjectID is the project traces are recorded in, used to link log
+// entries to their trace.
+var ProjectID string
+
+var logMu sync.Mutex
+
+type logFieldsKey struct{}
+
+// WithFields returns a context whose log entries carry the given key/value
+// pairs, on top of those already attached to ctx.
+func WithFields(ctx context.Context, keyvals ...interface{}) context.Context {
+	parent, _ := ctx.Value(logFieldsKey{}).(map[string]interface{})
+	fields := make(map[string]interface{}, len(parent)+len(keyvals)/2)
+	for k, v := range parent {
+		fields[k] = v
+	}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fields[fmt.Sprint(keyvals[i])] = keyvals[i+1]
+	}
+	return context.WithValue(ctx, logFieldsKey{}, fields)
+}
+
+// Info logs an INFO entry.
+func Info(ctx context.Context, format string, args ...interface{}) {
+	writeLog(ctx, severityInfo, fmt.Sprintf(format, args...))
+}
+
+// Warning logs a WARNING entry.
+func Warning(ctx context.Context, format string, args ...interface{}) {
+	writeLog(ctx, severityWarning, fmt.Sprintf(format, args...))
+}
+
+// Error logs an ERROR entry, which Error Reporting picks up.
+func Error(ctx context.Context, format string, args ...interface{}) {
+	writeLog(ctx, severityError, fmt.Sprintf(format, args...))
+}
+
+// Fatal logs a CRITICAL entry and exits.
+func Fatal(format string, args ...interface{}) {
+	writeLog(context.Background(), severityCritical, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// writeLog writes a single line JSON entry to stdout, which Cloud Run turns
+// into a structured log entry.
+func writeLog(ctx context.Context, severity, msg string) {
+	entry := map[string]interface{}{}
+	if fields, ok := ctx.Value(logFieldsKey{}).(map[string]interface{}); ok {
+		for k, v := range fields {
+			entry[k] = v
+		}
+	}
+	entry["severity"] = severity
+	entry["message"] = msg
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	// Prefer the span of the current operation over the incoming header.
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		entry["logging.googleapis.com/trace"] = fmt.Sprintf("projects/%s/traces/%s", ProjectID, sc.TraceID())
+		entry["logging.googleapis.com/spanId"] = sc.SpanID().String()
+		entry["logging.googleapis.com/trace_sampled"] = sc.IsSampled()
+	}
+	if severity == severityError || severity == severityCritical {
+		entry["@type"] = errorReportingType
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	if err := json.NewEncoder(os.Stdout).Encode(entry); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", severity, msg)
+	}
+}
+
+// Middleware attaches the request ID and Cloud Trace context of the request
+// to the log entries written while handling it.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var keyvals []interface{}
+		if id := r.Header.Get("X-Request-ID"); id != "" {
+			keyvals = append(keyvals, "request_id", id)
+		}
+		// X-Cloud-Trace-Context: TRACE_ID/SPAN_ID;o=OPTIONS
+		if tc := r.Header.Get("X-Cloud-Trace-Context"); tc != "" {
+			traceID := strings.SplitN(tc, "/", 2)[0]
+			keyvals = append(keyvals, "logging.googleapis.com/trace", fmt.Sprintf("projects/%s/traces/%s", ProjectID, traceID))
+			if parts := strings.SplitN(tc, "/", 2); len(parts) == 2 {
+				keyvals = append(keyvals, "logging.googleapis.com/spanId", strings.SplitN(parts[1], ";", 2)[0])
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(WithFields(r.Context(), keyvals...)))
+	})
+}
@@ -0,0 +1,29 @@
+// Package taskspb is the version of the Cloud Tasks API the service is built
+// against: the v2 GA API by default, or v2beta3 with the cloudtasks_v2beta3
+// build tag for projects pinned to it. It has the protobuf types and client
+// of that version under the same names, so the rest of the service doesn't
+// depend on one.
+package taskspb
+
+import (
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Marshal encodes t as JSON. Unlike the binary encoding, whose field numbers
+// differ between v2 and v2beta3, JSON decodes with either version.
+func Marshal(t *Task) ([]byte, error) {
+	return protojson.Marshal(t)
+}
+
+// Unmarshal decodes a task encoded by Marshal, or in the binary v2beta3
+// encoding of the tasks kept before Marshal existed when legacy is set.
+func Unmarshal(b []byte, legacy bool) (*Task, error) {
+	if legacy {
+		return unmarshalV2beta3(b)
+	}
+	var t Task
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(b, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
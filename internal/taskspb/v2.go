@@ -0,0 +1,73 @@
+//go:build !cloudtasks_v2beta3
+
+package taskspb
+
+import (
+	"context"
+
+	cloudtasks "cloud.google.com/go/cloudtasks/apiv2"
+	"google.golang.org/api/option"
+	pb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	betapb "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Version is the Cloud Tasks API version.
+const Version = "v2"
+
+// Client is the Cloud Tasks client.
+type Client = cloudtasks.Client
+
+// NewClient creates a Cloud Tasks client.
+func NewClient(ctx context.Context, opts ...option.ClientOption) (*Client, error) {
+	return cloudtasks.NewClient(ctx, opts...)
+}
+
+type (
+	CreateQueueRequest    = pb.CreateQueueRequest
+	CreateTaskRequest     = pb.CreateTaskRequest
+	DeleteTaskRequest     = pb.DeleteTaskRequest
+	GetQueueRequest       = pb.GetQueueRequest
+	GetTaskRequest        = pb.GetTaskRequest
+	HttpMethod            = pb.HttpMethod
+	HttpRequest           = pb.HttpRequest
+	HttpRequest_OidcToken = pb.HttpRequest_OidcToken
+	ListTasksRequest      = pb.ListTasksRequest
+	OidcToken             = pb.OidcToken
+	Queue                 = pb.Queue
+	Queue_State           = pb.Queue_State
+	RetryConfig           = pb.RetryConfig
+	Task                  = pb.Task
+	UpdateQueueRequest    = pb.UpdateQueueRequest
+)
+
+const (
+	HttpMethod_POST = pb.HttpMethod_POST
+	Queue_RUNNING   = pb.Queue_RUNNING
+	Queue_PAUSED    = pb.Queue_PAUSED
+	Queue_DISABLED  = pb.Queue_DISABLED
+	Task_FULL       = pb.Task_FULL
+)
+
+var HttpMethod_value = pb.HttpMethod_value
+
+// SetHTTPRequest makes t send r, its oneof is named differently in each
+// version.
+func SetHTTPRequest(t *Task, r *HttpRequest) {
+	t.MessageType = &pb.Task_HttpRequest{HttpRequest: r}
+}
+
+// unmarshalV2beta3 decodes a binary v2beta3 task, converting it through its
+// JSON form which both versions share.
+func unmarshalV2beta3(b []byte) (*Task, error) {
+	var old betapb.Task
+	if err := proto.Unmarshal(b, &old); err != nil {
+		return nil, err
+	}
+	j, err := protojson.Marshal(&old)
+	if err != nil {
+		return nil, err
+	}
+	return Unmarshal(j, false)
+}
@@ -0,0 +1,135 @@
+// Package tracing exports spans to Cloud Trace and instruments HTTP handlers
+// and gRPC clients.
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	texporter "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/trace"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// Tracer creates the spans of the service's own operations. It is a no-op
+// until Init installs a tracer provider.
+var Tracer = otel.Tracer("go-slot-scheduler")
+
+// Init exports a ratio share of traces to Cloud Trace in projectID, always
+// following the sampling decision of an incoming trace context. The returned
+// func flushes pending spans.
+func Init(ctx context.Context, projectID string, ratio float64) (func(context.Context) error, error) {
+	exporter, err := texporter.New(texporter.WithProjectID(projectID))
+	if err != nil {
+		return nil, fmt.Errorf("creating cloud trace exporter: %v", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		cloudTraceContext{},
+	))
+	return tp.Shutdown, nil
+}
+
+// Handler starts a server span for every request, continuing the trace of
+// the caller.
+func Handler(h http.Handler) http.Handler {
+	return otelhttp.NewHandler(h, "slot-scheduler", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return r.Method + " " + r.URL.Path
+	}))
+}
+
+// GRPCOptions instrument the gRPC connections of GCP clients, so each API
+// call becomes a child span of the request making it.
+func GRPCOptions() []option.ClientOption {
+	return []option.ClientOption{
+		option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(otelgrpc.UnaryClientInterceptor())),
+		option.WithGRPCDialOption(grpc.WithChainStreamInterceptor(otelgrpc.StreamClientInterceptor())),
+	}
+}
+
+// EndSpan records err, if any, on span and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
+
+const cloudTraceHeader = "X-Cloud-Trace-Context"
+
+// cloudTraceContext propagates the X-Cloud-Trace-Context header set by Cloud
+// Run, Cloud Tasks and Cloud Scheduler: TRACE_ID/SPAN_ID;o=OPTIONS, with the
+// span ID in decimal.
+type cloudTraceContext struct{}
+
+func (cloudTraceContext) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	spanID := sc.SpanID()
+	sampled := 0
+	if sc.IsSampled() {
+		sampled = 1
+	}
+	carrier.Set(cloudTraceHeader, fmt.Sprintf("%s/%d;o=%d", sc.TraceID(), binary.BigEndian.Uint64(spanID[:]), sampled))
+}
+
+func (cloudTraceContext) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	// A W3C traceparent, if present, has already been extracted.
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+
+	header := carrier.Get(cloudTraceHeader)
+	traceHex, rest, ok := strings.Cut(header, "/")
+	if !ok {
+		return ctx
+	}
+	spanDec, opts, _ := strings.Cut(rest, ";")
+
+	var cfg trace.SpanContextConfig
+	b, err := hex.DecodeString(traceHex)
+	if err != nil || len(b) != 16 {
+		return ctx
+	}
+	copy(cfg.TraceID[:], b)
+	span, err := strconv.ParseUint(spanDec, 10, 64)
+	if err != nil {
+		return ctx
+	}
+	binary.BigEndian.PutUint64(cfg.SpanID[:], span)
+	if opts == "o=1" {
+		cfg.TraceFlags = trace.FlagsSampled
+	}
+	cfg.Remote = true
+
+	sc := trace.NewSpanContext(cfg)
+	if !sc.IsValid() {
+		return ctx
+	}
+	return trace.ContextWithRemoteSpanContext(ctx, sc)
+}
+
+func (cloudTraceContext) Fields() []string {
+	return []string{cloudTraceHeader}
+}
@@ -0,0 +1,69 @@
+// Package retry retries GCP calls failing with transient gRPC codes.
+package retry
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// Policy retries GCP calls failing with transient codes, backing off
+// exponentially with full jitter between attempts.
+type Policy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Codes          map[codes.Code]bool
+}
+
+// DefaultCodes are the codes retried unless configured otherwise.
+const DefaultCodes = "UNAVAILABLE,DEADLINE_EXCEEDED"
+
+// Default is the policy used unless configured otherwise.
+var Default = Policy{MaxAttempts: 3, InitialBackoff: 500 * time.Millisecond, MaxBackoff: 10 * time.Second, Codes: map[codes.Code]bool{codes.Unavailable: true, codes.DeadlineExceeded: true}}
+
+// ParseCodes parses a comma separated list of gRPC code names, such as
+// UNAVAILABLE,DEADLINE_EXCEEDED.
+func ParseCodes(v string) (map[codes.Code]bool, error) {
+	set := make(map[codes.Code]bool)
+	for _, name := range strings.Split(v, ",") {
+		var c codes.Code
+		if err := c.UnmarshalJSON([]byte(strconv.Quote(strings.ToUpper(strings.TrimSpace(name))))); err != nil {
+			return nil, err
+		}
+		set[c] = true
+	}
+	return set, nil
+}
+
+// Do calls fn until it succeeds, fails with a code that is not retryable, the
+// attempts are exhausted or ctx is done. fn must be safe to call again after a
+// failure whose outcome is unknown, such as DEADLINE_EXCEEDED.
+func (p Policy) Do(ctx context.Context, op string, fn func(context.Context) error) error {
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= p.MaxAttempts || !p.Codes[status.Code(err)] {
+			return err
+		}
+
+		sleep := time.Duration(rand.Int63n(int64(backoff) + 1))
+		logging.Warning(ctx, "%s failed on attempt %d of %d, retrying in %s: %v", op, attempt, p.MaxAttempts, sleep, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(sleep):
+		}
+
+		if backoff *= 2; backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// holidayLayout is the format of the dates of Profile.Holidays.
+const holidayLayout = "2006-01-02"
+
+// Profile is a level of extra capacity that follows the time of the week:
+// the Slots of the window the time falls in, DefaultSlots outside of them.
+// Windows don't start on Holidays.
+type Profile struct {
+	ID           string          `firestore:"id" json:"id"`
+	Name         string          `firestore:"name" json:"name,omitempty"`
+	Region       string          `firestore:"region" json:"region"`
+	Timezone     string          `firestore:"timezone" json:"timezone,omitempty"` // IANA name, default UTC
+	Windows      []ProfileWindow `firestore:"windows" json:"windows"`
+	DefaultSlots int64           `firestore:"default_slots" json:"default_slots"`
+	// Holidays are dates, as YYYY-MM-DD in Timezone, on which no window
+	// starts.
+	Holidays []string `firestore:"holidays" json:"holidays,omitempty"`
+	Reason   string   `firestore:"reason" json:"reason,omitempty"`
+	Paused   bool     `firestore:"paused" json:"paused"`
+	DryRun   bool     `firestore:"dry_run" json:"dry_run,omitempty"` // log changes without making them
+
+	// Where the delete tasks of the commitments bought for the profile call
+	// back, taken from the request that created it.
+	DeleteURL string `firestore:"delete_url" json:"-"`
+	Audience  string `firestore:"audience" json:"-"`
+
+	CreatedAt time.Time `firestore:"created_at" json:"created_at"`
+	UpdatedAt time.Time `firestore:"updated_at" json:"updated_at"`
+	// TargetSlots and NextChange are the current level and when it changes.
+	TargetSlots *int64     `firestore:"-" json:"target_slots,omitempty"`
+	NextChange  *time.Time `firestore:"-" json:"next_change,omitempty"`
+}
+
+// ProfileWindow keeps Slots from Start to End, as HH:MM, on each of Days
+// (MON to SUN). An End before Start ends the next day.
+type ProfileWindow struct {
+	Days  []string `firestore:"days" json:"days"`
+	Start string   `firestore:"start" json:"start"`
+	End   string   `firestore:"end" json:"end"`
+	Slots int64    `firestore:"slots" json:"slots"`
+}
+
+// Location is the time zone of the windows and holidays.
+func (p *Profile) Location() (*time.Location, error) {
+	if p.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(p.Timezone)
+}
+
+// Validate checks the windows and holidays of p.
+func (p *Profile) Validate() error {
+	if len(p.Windows) == 0 {
+		return fmt.Errorf("a profile needs at least one window")
+	}
+	for i, w := range p.Windows {
+		if _, _, err := w.parse(); err != nil {
+			return fmt.Errorf("window %d: %v", i, err)
+		}
+	}
+	for _, d := range p.Holidays {
+		if _, err := time.Parse(holidayLayout, d); err != nil {
+			return fmt.Errorf("holiday %q is not a YYYY-MM-DD date", d)
+		}
+	}
+	return nil
+}
+
+// parse returns the weekdays of w, and its start and length from midnight.
+func (w *ProfileWindow) parse() (map[time.Weekday]bool, [2]time.Duration, error) {
+	var span [2]time.Duration
+	if len(w.Days) == 0 {
+		return nil, span, fmt.Errorf("needs at least one day")
+	}
+	days := make(map[time.Weekday]bool, len(w.Days))
+	for _, d := range w.Days {
+		n, ok := weekdays[strings.ToUpper(d)]
+		if !ok {
+			return nil, span, fmt.Errorf("unknown day %q, want MON to SUN", d)
+		}
+		days[time.Weekday(n)] = true
+	}
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return nil, span, fmt.Errorf("start must be HH:MM: %v", err)
+	}
+	end, err := time.Parse("15:04", w.End)
+	if err != nil {
+		return nil, span, fmt.Errorf("end must be HH:MM: %v", err)
+	}
+	if !end.After(start) {
+		end = end.Add(24 * time.Hour)
+	}
+	midnight := time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC)
+	span[0], span[1] = start.Sub(midnight), end.Sub(start)
+	return days, span, nil
+}
+
+// Target returns the level of p at now, and when it next changes. The time
+// is zero if it never does.
+func (p *Profile) Target(now time.Time) (int64, time.Time, error) {
+	if err := p.Validate(); err != nil {
+		return 0, time.Time{}, err
+	}
+	loc, err := p.Location()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	holidays := make(map[string]bool, len(p.Holidays))
+	for _, d := range p.Holidays {
+		holidays[d] = true
+	}
+	slots := p.levelAt(now, holidays, loc)
+
+	// The level can only change where a window starts or ends, and every
+	// window starts again within a week of a holiday-free day.
+	now = now.In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	var next time.Time
+	for day := -1; day <= 14; day++ {
+		date := today.AddDate(0, 0, day)
+		for _, w := range p.Windows {
+			days, span, _ := w.parse()
+			if !days[date.Weekday()] {
+				continue
+			}
+			start := clock(date, span[0])
+			for _, at := range []time.Time{start, start.Add(span[1])} {
+				if !at.After(now) || !next.IsZero() && !at.Before(next) {
+					continue
+				}
+				if p.levelAt(at, holidays, loc) != slots {
+					next = at
+				}
+			}
+		}
+	}
+	return slots, next, nil
+}
+
+// levelAt is the highest Slots of the windows open at t, or DefaultSlots if
+// none is. Windows starting on holidays are skipped.
+func (p *Profile) levelAt(t time.Time, holidays map[string]bool, loc *time.Location) int64 {
+	t = t.In(loc)
+	today := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	var (
+		active bool
+		slots  int64
+	)
+	for day := -1; day <= 0; day++ {
+		date := today.AddDate(0, 0, day)
+		if holidays[date.Format(holidayLayout)] {
+			continue
+		}
+		for _, w := range p.Windows {
+			days, span, err := w.parse()
+			if err != nil || !days[date.Weekday()] {
+				continue
+			}
+			start := clock(date, span[0])
+			if !t.Before(start) && t.Before(start.Add(span[1])) {
+				if !active || w.Slots > slots {
+					slots = w.Slots
+				}
+				active = true
+			}
+		}
+	}
+	if !active {
+		return p.DefaultSlots
+	}
+	return slots
+}
+
+// clock is the time d after midnight on date, as read on a clock: the hour
+// that doesn't exist or repeats when daylight saving time changes is not
+// counted.
+func clock(date time.Time, d time.Duration) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), int(d/time.Hour), int(d%time.Hour/time.Minute), 0, 0, date.Location())
+}
+
+// SetTarget fills in the level of p at now and when it next changes.
+func (p *Profile) SetTarget(now time.Time) {
+	slots, next, err := p.Target(now)
+	if err != nil {
+		return
+	}
+	p.TargetSlots = &slots
+	if !next.IsZero() {
+		p.NextChange = &next
+	}
+}
@@ -0,0 +1,164 @@
+// Package scheduler computes when recurring windows of extra capacity fire.
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Schedule is a recurring window of extra capacity. It fires on either a cron
+// expression, lasting Minutes, or on the days and times of a weekly window.
+type Schedule struct {
+	ID       string        `firestore:"id" json:"id"`
+	Name     string        `firestore:"name" json:"name,omitempty"`
+	Cron     string        `firestore:"cron" json:"cron,omitempty"`
+	Minutes  int64         `firestore:"minutes" json:"minutes,omitempty"`
+	Weekly   *WeeklyWindow `firestore:"weekly" json:"weekly,omitempty"`
+	Timezone string        `firestore:"timezone" json:"timezone,omitempty"` // IANA name, default UTC
+	Region   string        `firestore:"region" json:"region"`
+	Project  string        `firestore:"project" json:"project,omitempty"` // admin project, default GOOGLE_CLOUD_PROJECT
+	Slots    int64         `firestore:"slots" json:"slots"`
+	Reason   string        `firestore:"reason" json:"reason,omitempty"`
+	Paused   bool          `firestore:"paused" json:"paused"`
+	DryRun   bool          `firestore:"dry_run" json:"dry_run,omitempty"` // log runs without buying
+
+	// Job is the Cloud Scheduler job running the schedule, if any.
+	Job string `firestore:"job" json:"job,omitempty"`
+
+	// Where the delete tasks of the commitments bought by the schedule call
+	// back, taken from the request that created it.
+	DeleteURL string `firestore:"delete_url" json:"-"`
+	Audience  string `firestore:"audience" json:"-"`
+
+	CreatedAt time.Time  `firestore:"created_at" json:"created_at"`
+	UpdatedAt time.Time  `firestore:"updated_at" json:"updated_at"`
+	LastRun   time.Time  `firestore:"last_run" json:"last_run"`
+	NextRun   *time.Time `firestore:"-" json:"next_run,omitempty"`
+}
+
+// WeeklyWindow adds capacity from Start to End, as HH:MM, on each of Days
+// (MON to SUN). An End before Start ends the next day.
+type WeeklyWindow struct {
+	Days  []string `firestore:"days" json:"days"`
+	Start string   `firestore:"start" json:"start"`
+	End   string   `firestore:"end" json:"end"`
+}
+
+var weekdays = map[string]int{"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6}
+
+// Spec returns when the schedule fires, and for how long each run keeps the
+// capacity. Windows longer than maxWindow are refused, unless it is zero.
+func (sc *Schedule) Spec(maxWindow time.Duration) (cron.Schedule, time.Duration, error) {
+	if (sc.Cron == "") == (sc.Weekly == nil) {
+		return nil, 0, fmt.Errorf("provide either cron or weekly")
+	}
+
+	expr, window := sc.Cron, time.Duration(sc.Minutes)*time.Minute
+	if sc.Weekly != nil {
+		if sc.Minutes != 0 {
+			return nil, 0, fmt.Errorf("minutes only applies to cron schedules")
+		}
+		var err error
+		if expr, window, err = sc.Weekly.Cron(); err != nil {
+			return nil, 0, err
+		}
+	}
+	if window <= 0 {
+		return nil, 0, fmt.Errorf("minutes must be positive")
+	}
+	if maxWindow > 0 && window > maxWindow {
+		return nil, 0, fmt.Errorf("window is longer than %d minutes", int64(maxWindow/time.Minute))
+	}
+
+	sched, err := cron.ParseStandard(expr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("parsing cron %q: %v", expr, err)
+	}
+	return sched, window, nil
+}
+
+// Expression returns the cron expression the schedule fires on, in its
+// Location.
+func (sc *Schedule) Expression() (string, error) {
+	if sc.Weekly != nil {
+		expr, _, err := sc.Weekly.Cron()
+		return expr, err
+	}
+	return sc.Cron, nil
+}
+
+// Cron turns the window into a cron expression and duration.
+func (w *WeeklyWindow) Cron() (string, time.Duration, error) {
+	if len(w.Days) == 0 {
+		return "", 0, fmt.Errorf("weekly needs at least one day")
+	}
+	days := make([]string, 0, len(w.Days))
+	for _, d := range w.Days {
+		n, ok := weekdays[strings.ToUpper(d)]
+		if !ok {
+			return "", 0, fmt.Errorf("unknown day %q, want MON to SUN", d)
+		}
+		days = append(days, fmt.Sprint(n))
+	}
+
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return "", 0, fmt.Errorf("start must be HH:MM: %v", err)
+	}
+	end, err := time.Parse("15:04", w.End)
+	if err != nil {
+		return "", 0, fmt.Errorf("end must be HH:MM: %v", err)
+	}
+	if !end.After(start) {
+		end = end.Add(24 * time.Hour)
+	}
+	return fmt.Sprintf("%d %d * * %s", start.Minute(), start.Hour(), strings.Join(days, ",")), end.Sub(start), nil
+}
+
+// Location is the time zone the schedule fires in.
+func (sc *Schedule) Location() (*time.Location, error) {
+	if sc.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(sc.Timezone)
+}
+
+// SetNextRun fills in the next time sc fires after now.
+func (sc *Schedule) SetNextRun(now time.Time) {
+	sched, _, err := sc.Spec(0)
+	if err != nil || sc.Paused {
+		return
+	}
+	loc, err := sc.Location()
+	if err != nil {
+		return
+	}
+	next := sched.Next(now.In(loc))
+	sc.NextRun = &next
+}
+
+// Due returns the latest time sc should have fired at since its last run, if
+// any.
+func (sc *Schedule) Due(now time.Time) (time.Time, bool) {
+	sched, _, err := sc.Spec(0)
+	if err != nil || sc.Paused {
+		return time.Time{}, false
+	}
+	loc, err := sc.Location()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	last := sc.LastRun
+	if last.Before(sc.UpdatedAt) {
+		last = sc.UpdatedAt
+	}
+	var due time.Time
+	for next := sched.Next(last.In(loc)); !next.IsZero() && !next.After(now); next = sched.Next(next) {
+		due = next
+	}
+	return due, !due.IsZero()
+}
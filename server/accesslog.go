@@ -0,0 +1,226 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// probePaths are polled by Cloud Run and scrapers, their requests are only
+// logged when they fail.
+var probePaths = map[string]bool{"/healthz": true, "/readyz": true, metricsPath: true}
+
+// errResponseTooLarge is returned to handlers writing past MAX_RESPONSE_BYTES.
+var errResponseTooLarge = errors.New("response too large")
+
+// responseWriter records the status and size of a response for the access
+// log, and lets streamed responses through.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// accessLog logs every request once answered, with its status, size and
+// latency as the httpRequest of the entry, which Cloud Logging shows like
+// those of its load balancer. Probes are only logged when they fail, and
+// server errors are warnings. ACCESS_LOG=false turns it off.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !accessLogEnabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rw := &responseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		if probePaths[r.URL.Path] && rw.status < 400 {
+			return
+		}
+
+		latency := time.Since(start)
+		fields := []interface{}{"httpRequest", map[string]interface{}{
+			"requestMethod": r.Method,
+			"requestUrl":    r.URL.RequestURI(),
+			"status":        rw.status,
+			"responseSize":  fmt.Sprint(rw.size),
+			"latency":       fmt.Sprintf("%.3fs", latency.Seconds()),
+			"remoteIp":      remoteIP(r),
+			"userAgent":     r.UserAgent(),
+			"protocol":      r.Proto,
+		}}
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				fields = append(fields, "route", tmpl)
+			}
+		}
+		ctx := logging.WithFields(r.Context(), fields...)
+		if rw.status >= 500 {
+			logging.Warning(ctx, "%s %s %d %d bytes in %s", r.Method, r.URL.Path, rw.status, rw.size, latency.Round(time.Millisecond))
+			return
+		}
+		logging.Info(ctx, "%s %s %d %d bytes in %s", r.Method, r.URL.Path, rw.status, rw.size, latency.Round(time.Millisecond))
+	})
+}
+
+// recoverPanics answers a 500 INTERNAL to a request whose handler panics,
+// logging the panic with its stack trace for Error Reporting, so one bad
+// request doesn't take the instance and those in flight down with it.
+// http.ErrAbortHandler is let through, it aborts the response on purpose.
+// It runs inside limitResponses, whose held back status it can still
+// replace.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &responseWriter{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			// Error Reporting groups entries by the stack trace in their
+			// message.
+			logging.Error(r.Context(), "panic: %v\n\n%s", p, debug.Stack())
+			if rw.status != 0 {
+				// The response is under way, cut it short, unless nothing
+				// of it was sent yet.
+				if h, ok := w.(holdingWriter); !ok || !h.release() {
+					panic(http.ErrAbortHandler)
+				}
+			}
+			writeError(rw, http.StatusInternalServerError, codeInternal, "internal error handling %s %s", r.Method, r.URL.Path)
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// limitResponses refuses to send responses over MAX_RESPONSE_BYTES, which
+// Cloud Run would cut anyway: one written at once, as writeJSON does, is
+// answered as a 500 RESPONSE_TOO_LARGE instead, and one written in parts
+// is cut at the limit. Streams of events aren't limited.
+func limitResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maxResponseBytes <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		lw := &limitWriter{ResponseWriter: w, r: r}
+		next.ServeHTTP(lw, r)
+		lw.finish()
+	})
+}
+
+// holdingWriter holds back the status of a response until its body is
+// written.
+type holdingWriter interface {
+	// release drops the status held back, so another can be written, and
+	// reports whether it could: false once the response was sent.
+	release() bool
+}
+
+// limitWriter holds back the status of a response until its first write,
+// so a body over the limit can be answered with an error instead.
+type limitWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	status  int
+	sent    bool
+	written int64
+	over    bool
+}
+
+func (w *limitWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *limitWriter) Write(b []byte) (int, error) {
+	if w.over {
+		return 0, errResponseTooLarge
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	streamed := strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+	if !streamed && w.written+int64(len(b)) > maxResponseBytes {
+		w.over = true
+		if !w.sent {
+			w.sent = true
+			writeAPIError(w.ResponseWriter, http.StatusInternalServerError, &APIError{
+				Code:    codeResponseTooLarge,
+				Message: fmt.Sprintf("the response of %s %s is over %d bytes, narrow it down with filters or pages", w.r.Method, w.r.URL.Path, maxResponseBytes),
+				Details: map[string]interface{}{"max_response_bytes": maxResponseBytes},
+			})
+		}
+		logging.Error(w.r.Context(), "response of %s %s over MAX_RESPONSE_BYTES (%d) was not sent in full", w.r.Method, w.r.URL.Path, maxResponseBytes)
+		return 0, errResponseTooLarge
+	}
+	w.send()
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *limitWriter) Flush() {
+	w.send()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// send writes the status held back, once.
+func (w *limitWriter) send() {
+	if w.sent || w.status == 0 {
+		return
+	}
+	w.sent = true
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *limitWriter) release() bool {
+	if w.sent {
+		return false
+	}
+	w.status = 0
+	return true
+}
+
+// finish sends the status of a response without a body.
+func (w *limitWriter) finish() {
+	w.send()
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	reservation "cloud.google.com/go/bigquery/reservation/apiv1"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+
+	"go-slot-scheduler/internal/tracing"
+)
+
+// adminProject is a BigQuery admin project capacity may be bought in besides
+// projectID, with its own caps and, optionally, its own credentials.
+type adminProject struct {
+	// MaxSlots caps the project, 0 uses MAX_SLOTS.
+	MaxSlots int64 `json:"max_slots"`
+	// RegionMaxSlots caps single regions of the project.
+	RegionMaxSlots map[string]int64 `json:"region_max_slots"`
+	// CredentialsFile is a service account key file to call the project with.
+	CredentialsFile string `json:"credentials_file"`
+	// ImpersonateServiceAccount is a service account the project is called as.
+	ImpersonateServiceAccount string `json:"impersonate_service_account"`
+}
+
+// parseAdminProjects parses ADMIN_PROJECTS_JSON, e.g.
+// {"analytics-admin":{"max_slots":1000,"impersonate_service_account":"slots@analytics-admin.iam.gserviceaccount.com"}}.
+func parseAdminProjects(v string) (map[string]adminProject, error) {
+	var projects map[string]adminProject
+	if err := json.Unmarshal([]byte(v), &projects); err != nil {
+		return nil, err
+	}
+	for id, p := range projects {
+		if p.MaxSlots < 0 {
+			return nil, fmt.Errorf("max_slots of %s can not be negative", id)
+		}
+		for region, slots := range p.RegionMaxSlots {
+			if slots <= 0 {
+				return nil, fmt.Errorf("cap of %s in %s must be greater than zero", id, region)
+			}
+		}
+		if p.CredentialsFile != "" && p.ImpersonateServiceAccount != "" {
+			return nil, fmt.Errorf("%s can have credentials_file or impersonate_service_account, not both", id)
+		}
+	}
+	return projects, nil
+}
+
+// validAdminProject reports whether capacity may be bought in project.
+func validAdminProject(project string) bool {
+	if project == projectID {
+		return true
+	}
+	_, ok := adminProjects[project]
+	return ok
+}
+
+// maxSlotsFor is the cap of region in project. Other admin projects fall
+// back to their max_slots, then to the caps of projectID.
+func maxSlotsFor(project, region string) int64 {
+	if p, ok := adminProjects[project]; ok && project != projectID {
+		if slots, ok := p.RegionMaxSlots[region]; ok {
+			return slots
+		}
+		if p.MaxSlots > 0 {
+			return p.MaxSlots
+		}
+	}
+	l := live()
+	if slots, ok := l.RegionMaxSlots[region]; ok {
+		return slots
+	}
+	return l.MaxSlots
+}
+
+// newProjectClients creates reservation clients for the admin projects with
+// their own credentials. The others share the default client.
+func newProjectClients(ctx context.Context) (map[string]*reservation.Client, error) {
+	clients := make(map[string]*reservation.Client)
+	for id, p := range adminProjects {
+		opts := tracing.GRPCOptions()
+		switch {
+		case p.CredentialsFile != "":
+			opts = append(opts, option.WithCredentialsFile(p.CredentialsFile))
+		case p.ImpersonateServiceAccount != "":
+			ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+				TargetPrincipal: p.ImpersonateServiceAccount,
+				Scopes:          []string{"https://www.googleapis.com/auth/cloud-platform"},
+			})
+			if err != nil {
+				closeClients(clients)
+				return nil, fmt.Errorf("impersonating %s for %s: %v", p.ImpersonateServiceAccount, id, err)
+			}
+			opts = append(opts, option.WithTokenSource(ts))
+		default:
+			continue
+		}
+		c, err := reservation.NewClient(ctx, opts...)
+		if err != nil {
+			closeClients(clients)
+			return nil, fmt.Errorf("creating reservation client of %s: %v", id, err)
+		}
+		clients[id] = c
+	}
+	return clients, nil
+}
+
+func closeClients(clients map[string]*reservation.Client) {
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
+// reservationsFor returns the client to call the reservation API with for a
+// resource name or parent, projects/{project}/...
+func (s *Server) reservationsFor(name string) *reservation.Client {
+	if c, ok := s.projectReservations[resourceProject(name)]; ok {
+		return c
+	}
+	return s.reservations
+}
+
+// resourceProject extracts the project of a resource name.
+func resourceProject(name string) string {
+	parts := strings.SplitN(name, "/", 3)
+	if len(parts) < 2 || parts[0] != "projects" {
+		return ""
+	}
+	return parts[1]
+}
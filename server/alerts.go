@@ -0,0 +1,162 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+)
+
+// AlertAction is the capacity added when an alert policy fires, configured
+// per policy name with ALERT_ACTIONS, or when an event is sent to an action
+// of CLOUDEVENT_ACTIONS.
+type AlertAction struct {
+	Region  string `json:"region"`
+	Slots   int64  `json:"slots"`
+	Minutes int64  `json:"minutes"`
+}
+
+// parseAlertActions parses ALERT_ACTIONS, a JSON object of alert policy
+// display names to actions, or CLOUDEVENT_ACTIONS, of action names.
+func parseAlertActions(v string) (map[string]AlertAction, error) {
+	actions := make(map[string]AlertAction)
+	if err := json.Unmarshal([]byte(v), &actions); err != nil {
+		return nil, err
+	}
+	for policy, a := range actions {
+		if a.Region == "" {
+			a.Region = defaultRegion
+		}
+		if a.Slots <= 0 {
+			return nil, fmt.Errorf("%q: slots must be positive", policy)
+		}
+		if maxMinutes := live().MaxMinutes; a.Minutes <= 0 || a.Minutes > maxMinutes {
+			return nil, fmt.Errorf("%q: minutes must be between 1 and %d", policy, maxMinutes)
+		}
+		actions[policy] = a
+	}
+	return actions, nil
+}
+
+// AlertNotification is the payload of a Cloud Monitoring webhook, see
+// https://cloud.google.com/monitoring/support/notification-options#webhooks.
+type AlertNotification struct {
+	Version  string `json:"version"`
+	Incident struct {
+		IncidentID    string `json:"incident_id"`
+		PolicyName    string `json:"policy_name"`
+		ConditionName string `json:"condition_name"`
+		State         string `json:"state"`
+		StartedAt     int64  `json:"started_at"`
+		Summary       string `json:"summary"`
+		URL           string `json:"url"`
+	} `json:"incident"`
+}
+
+// scaleOnAlertHandler adds the capacity configured for the policy of an
+// opened incident. Closed incidents and unmapped policies are acknowledged
+// without action, so Cloud Monitoring doesn't retry them.
+func (s *Server) scaleOnAlertHandler(w http.ResponseWriter, r *http.Request) {
+	if !validAlertToken(r) {
+		logging.Warning(r.Context(), "rejected %s request: invalid token", r.URL.Path)
+		writeError(w, http.StatusUnauthorized, codeUnauthenticated, "unauthorized")
+		return
+	}
+
+	var n AlertNotification
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	inc := n.Incident
+	r = r.WithContext(logging.WithFields(r.Context(), "incident", inc.IncidentID, "policy", inc.PolicyName))
+	if inc.State != "open" {
+		logging.Info(r.Context(), "ignoring %s incident %s", inc.State, inc.IncidentID)
+		writeJSON(w, http.StatusOK, "ignored")
+		return
+	}
+	action, ok := alertActions[inc.PolicyName]
+	if !ok {
+		logging.Info(r.Context(), "no action configured for alert policy %q", inc.PolicyName)
+		writeJSON(w, http.StatusOK, "ignored")
+		return
+	}
+	if inc.IncidentID == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "incident_id not provided")
+		return
+	}
+
+	// Notifications are retried and can be sent to several channels, act
+	// on each incident once.
+	logging.Info(r.Context(), "alert policy %q fired", inc.PolicyName)
+	s.runAction(w, r, "alert/"+inc.IncidentID, inc.PolicyName, action, "alert/"+inc.PolicyName,
+		fmt.Sprintf("incident %s: %s", inc.IncidentID, inc.Summary))
+}
+
+// runAction adds the capacity of the action name once for key, answering
+// what was bought. Repeated keys are acknowledged without action.
+func (s *Server) runAction(w http.ResponseWriter, r *http.Request, key, name string, action AlertAction, requester, reason string) {
+	_, fresh, err := s.store.ReserveIdempotencyKey(r.Context(), key, hashKey(name), idempotencyTTL)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	if !fresh {
+		logging.Info(r.Context(), "%s already handled", key)
+		writeJSON(w, http.StatusOK, "already handled")
+		return
+	}
+
+	logging.Info(r.Context(), "adding %d slots in %s for %d minutes", action.Slots, action.Region, action.Minutes)
+	resp, err := s.purchase(r.Context(), purchaseRequest{
+		Region:    action.Region,
+		Slots:     action.Slots,
+		Plan:      reservationpb.CapacityCommitment_FLEX,
+		DeleteAt:  time.Now().Add(time.Duration(action.Minutes) * time.Minute),
+		DeleteURL: deleteURL(r),
+		Audience:  deleteAudience(r),
+		Requester: requester,
+		Reason:    reason,
+	})
+	if err != nil && !errors.Is(err, capacity.ErrMaxSlots) {
+		if rerr := s.store.ReleaseIdempotencyKey(detached{r.Context()}, key); rerr != nil {
+			logging.Error(r.Context(), "releasing key %s: %v", key, rerr)
+		}
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	if err := s.store.CompleteIdempotencyKey(detached{r.Context()}, key, resp); err != nil {
+		logging.Error(r.Context(), "completing key %s: %v", key, err)
+	}
+	if resp == nil {
+		logging.Warning(r.Context(), "%v", err)
+		writeJSON(w, http.StatusOK, "max_slot exceeded")
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// validAlertToken checks the ALERT_TOKEN shared with the notification
+// channel, given as the token query parameter or the basic auth password.
+// Without ALERT_TOKEN no request is valid.
+func validAlertToken(r *http.Request) bool {
+	if alertToken == "" {
+		return false
+	}
+	token := r.URL.Query().Get("token")
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(alertToken)) == 1
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+)
+
+// Error codes of the API. Callers should branch on these rather than on the
+// HTTP status or the message.
+const (
+	codeInvalidRequest       = "INVALID_REQUEST"
+	codeInvalidRegion        = "INVALID_REGION"
+	codeInvalidProject       = "INVALID_PROJECT"
+	codeUnauthenticated      = "UNAUTHENTICATED"
+	codeNotFound             = "NOT_FOUND"
+	codeCommitNotFound       = "COMMIT_NOT_FOUND"
+	codeDeleteTaskNotFound   = "DELETE_TASK_NOT_FOUND"
+	codeAlreadyExists        = "ALREADY_EXISTS"
+	codeAtMaxCapacity        = "AT_MAX_CAPACITY"
+	codeCommitmentFailed     = "COMMITMENT_FAILED"
+	codeStockout             = "CAPACITY_UNAVAILABLE"
+	codeQuotaExceeded        = "QUOTA_EXCEEDED"
+	codeBudgetExceeded       = "BUDGET_EXCEEDED"
+	codeBlackout             = "BLACKOUT"
+	codePurchasesFrozen      = "PURCHASES_FROZEN"
+	codeQueuePaused          = "QUEUE_PAUSED"
+	codeForbidden            = "FORBIDDEN"
+	codeNotOwned             = "COMMITMENT_NOT_OWNED"
+	codeDeleteTooSoon        = "DELETE_TOO_SOON"
+	codeIdempotencyMismatch  = "IDEMPOTENCY_KEY_MISMATCH"
+	codeInProgress           = "REQUEST_IN_PROGRESS"
+	codeTaskCreateFailed     = "TASK_CREATE_FAILED"
+	codeTaskNotDue           = "TASK_NOT_DUE"
+	codeNotImplemented       = "NOT_IMPLEMENTED"
+	codeShuttingDown         = "SHUTTING_DOWN"
+	codeDeadlineExceeded     = "DEADLINE_EXCEEDED"
+	codeResponseTooLarge     = "RESPONSE_TOO_LARGE"
+	codeInvalidConfig        = "INVALID_CONFIG"
+	codeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+	codeInternal             = "INTERNAL"
+)
+
+// retryableCodes are the codes of errors the same request may succeed after.
+var retryableCodes = map[string]bool{
+	codeBlackout:      true,
+	codeStockout:      true,
+	codeQuotaExceeded: true,
+	codeQueuePaused:   true,
+	codeDeleteTooSoon: true,
+	codeInProgress:    true,
+	codeTaskNotDue:    true,
+	codeShuttingDown:  true,
+	codeInternal:      true,
+}
+
+// APIError is the body of every error response, {"error": {...}}.
+type APIError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	Retryable bool        `json:"retryable"`
+}
+
+func (e *APIError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// writeError writes an error response with code and a formatted message.
+func writeError(w http.ResponseWriter, status int, code string, format string, args ...interface{}) {
+	writeAPIError(w, status, &APIError{Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// writePurchaseError writes the error of a purchase.
+func writePurchaseError(w http.ResponseWriter, err error) {
+	var overBudget *budgetExceededError
+	if errors.As(err, &overBudget) {
+		writeAPIError(w, http.StatusConflict, &APIError{
+			Code:    codeBudgetExceeded,
+			Message: err.Error(),
+			Details: map[string]interface{}{"budget": overBudget.Budget, "spent": overBudget.Spent, "cost": overBudget.Cost},
+		})
+		return
+	}
+	var blacked *blackoutError
+	if errors.As(err, &blacked) {
+		// The same request goes through once the blackout ends.
+		writeAPIError(w, http.StatusLocked, &APIError{
+			Code:    codeBlackout,
+			Message: err.Error(),
+			Details: map[string]interface{}{"blackout": blacked.Blackout.Name, "until": blacked.Until},
+		})
+		return
+	}
+	var frozen *frozenError
+	if errors.As(err, &frozen) {
+		// Nothing goes through until an admin lifts the freeze.
+		writeAPIError(w, http.StatusLocked, &APIError{
+			Code:    codePurchasesFrozen,
+			Message: err.Error(),
+			Details: map[string]interface{}{"freeze": frozen.Freeze},
+		})
+		return
+	}
+	var capped *capacity.CapReachedError
+	if errors.As(err, &capped) {
+		// Nothing frees up by retrying, callers should back off until
+		// capacity is released.
+		writeAPIError(w, http.StatusConflict, &APIError{
+			Code:    codeAtMaxCapacity,
+			Message: err.Error(),
+			Details: map[string]interface{}{"total_slots": capped.Total, "max_slots": capped.MaxSlots, "headroom": capped.Headroom(), "requested_slots": capped.Requested},
+		})
+		return
+	}
+	var failed *capacity.FailedError
+	if errors.As(err, &failed) {
+		// The slots were never provisioned, buying again may succeed.
+		writeAPIError(w, http.StatusBadGateway, &APIError{
+			Code:    codeCommitmentFailed,
+			Message: err.Error(),
+			Details: map[string]interface{}{"commitment": failed.Name, "failure_status": map[string]interface{}{"code": failed.Status.Code().String(), "message": failed.Status.Message()}},
+		})
+		return
+	}
+	if errors.Is(err, capacity.ErrStockout) {
+		// The region may have the capacity later, or a fallback would buy
+		// less.
+		writeError(w, http.StatusServiceUnavailable, codeStockout, "%v", err)
+		return
+	}
+	if errors.Is(err, capacity.ErrQuotaExceeded) {
+		// Buying elsewhere runs into the same quota, back off instead.
+		writeError(w, http.StatusTooManyRequests, codeQuotaExceeded, "%v", err)
+		return
+	}
+	var paused *queuePausedError
+	if errors.As(err, &paused) {
+		// Buying would hold the slots until someone deletes them.
+		writeAPIError(w, http.StatusServiceUnavailable, &APIError{
+			Code:    codeQueuePaused,
+			Message: err.Error(),
+			Details: map[string]interface{}{"queue": paused.Status},
+		})
+		return
+	}
+	if errors.Is(err, errDraining) {
+		// Another instance takes the request.
+		writeError(w, http.StatusServiceUnavailable, codeShuttingDown, "%v", err)
+		return
+	}
+	var uncertain *capacity.UncertainError
+	if errors.As(err, &uncertain) {
+		// Buying again may buy the slots twice.
+		writeAPIError(w, http.StatusGatewayTimeout, &APIError{
+			Code:    codeDeadlineExceeded,
+			Message: err.Error(),
+			Details: map[string]interface{}{"commitment": uncertain.Name},
+		})
+		return
+	}
+	var rollback *rollbackError
+	if errors.As(err, &rollback) {
+		// Buying again is only safe once the commitment is gone.
+		writeAPIError(w, http.StatusInternalServerError, &APIError{
+			Code:      codeTaskCreateFailed,
+			Message:   err.Error(),
+			Details:   map[string]interface{}{"commitment": rollback.Commitment, "rolled_back": rollback.RolledBack, "recorded": rollback.Recorded},
+			Retryable: rollback.RolledBack,
+		})
+		return
+	}
+	writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+}
+
+// writeAPIError writes e with status, marking it retryable if its code is.
+func writeAPIError(w http.ResponseWriter, status int, e *APIError) {
+	if retryableCodes[e.Code] {
+		e.Retryable = true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"error": e}); err != nil {
+		logging.Error(context.Background(), "writing response: %v", err)
+	}
+}
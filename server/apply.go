@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/scheduler"
+)
+
+// applyProfilePrefix starts the ids of the profiles managed by /apply, one
+// per region.
+const applyProfilePrefix = "prof-apply-"
+
+// DesiredState is the extra capacity wanted, as a profile per region. Regions
+// left out of it lose the profile an earlier apply gave them.
+type DesiredState struct {
+	Regions []*scheduler.Profile `json:"regions"`
+	// DryRun only plans the changes.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// ApplyPlan is what an apply changed, or would change on a dry run.
+type ApplyPlan struct {
+	DryRun  bool          `json:"dry_run"`
+	Regions []*RegionPlan `json:"regions"`
+	Errors  []string      `json:"errors,omitempty"`
+}
+
+// RegionPlan is the change to the extra capacity of one region.
+type RegionPlan struct {
+	Region  string `json:"region"`
+	Profile string `json:"profile"`
+	// Change to the profile: created, updated, unchanged or deleted.
+	Change string `json:"change"`
+	// Run is what was bought, kept or released to reach its level now.
+	Run *ProfileRun `json:"run,omitempty"`
+}
+
+// applyProfileID is the id of the profile /apply manages for region.
+func applyProfileID(region string) string {
+	return applyProfilePrefix + strings.ToLower(region)
+}
+
+// validate checks every profile of d, of which there is one per region.
+func (d *DesiredState) validate() error {
+	var v validator
+	seen := make(map[string]bool)
+	for i, p := range d.Regions {
+		field := fmt.Sprintf("regions[%d]", i)
+		if !v.check(p != nil, field, "must be a profile") {
+			continue
+		}
+		if err := validateProfile(p); err != nil {
+			var verr *validationError
+			if !errors.As(err, &verr) {
+				return err
+			}
+			for _, f := range verr.Fields {
+				v.check(false, field+"."+f.Field, "%s", f.Message)
+			}
+			continue
+		}
+		v.check(!seen[p.Region], field+".region", "%s is given twice", p.Region)
+		seen[p.Region] = true
+	}
+	return v.err()
+}
+
+// sameProfile reports whether a and b keep the same levels.
+func sameProfile(a, b *scheduler.Profile) bool {
+	spec := func(p *scheduler.Profile) scheduler.Profile {
+		s := scheduler.Profile{
+			Name:         p.Name,
+			Region:       p.Region,
+			Timezone:     p.Timezone,
+			Windows:      p.Windows,
+			DefaultSlots: p.DefaultSlots,
+			Holidays:     p.Holidays,
+			Reason:       p.Reason,
+			Paused:       p.Paused,
+			DryRun:       p.DryRun,
+		}
+		if len(s.Holidays) == 0 {
+			s.Holidays = nil
+		}
+		return s
+	}
+	return reflect.DeepEqual(spec(a), spec(b))
+}
+
+// applyHandler brings the profiles managed by /apply to the desired state
+// and their regions to its level now, reporting what changed.
+func (s *Server) applyHandler(w http.ResponseWriter, r *http.Request) {
+	var d DesiredState
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := d.validate(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	for _, p := range d.Regions {
+		p.DeleteURL = deleteURL(r)
+		p.Audience = deleteAudience(r)
+	}
+
+	plan, err := s.apply(r.Context(), &d, time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	code := http.StatusOK
+	if len(plan.Errors) > 0 {
+		code = http.StatusInternalServerError
+	}
+	writeJSON(w, code, plan)
+}
+
+// apply diffs d against the profiles managed by /apply, creates, updates and
+// deletes them to match, and levels the capacity of each region. The
+// capacity of a region left out is released as far as its commitments
+// allow, the rest is left to its delete tasks. A dry run changes nothing.
+func (s *Server) apply(ctx context.Context, d *DesiredState, now time.Time) (*ApplyPlan, error) {
+	dry := d.DryRun || dryRun
+	if !dry {
+		// One apply at a time, the last one wins.
+		unlock, err := s.store.Lock(ctx, "apply", scheduleLockTTL)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	list, err := s.store.ListProfiles(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing profiles: %v", err)
+	}
+	managed := make(map[string]*scheduler.Profile)
+	for _, p := range list {
+		if strings.HasPrefix(p.ID, applyProfilePrefix) {
+			managed[p.ID] = p
+		}
+	}
+
+	plan := &ApplyPlan{DryRun: dry, Regions: []*RegionPlan{}}
+	for _, p := range d.Regions {
+		p.ID = applyProfileID(p.Region)
+		ctx := logging.WithFields(ctx, "profile", p.ID, "region", p.Region)
+		rp := &RegionPlan{Region: p.Region, Profile: p.ID, Change: "created"}
+		plan.Regions = append(plan.Regions, rp)
+
+		p.CreatedAt, p.UpdatedAt = now, now
+		if old, ok := managed[p.ID]; ok {
+			delete(managed, p.ID)
+			p.CreatedAt, rp.Change = old.CreatedAt, "updated"
+			if sameProfile(old, p) {
+				p.UpdatedAt, rp.Change = old.UpdatedAt, "unchanged"
+			}
+		}
+		if !dry && rp.Change != "unchanged" {
+			if err := s.store.PutProfile(ctx, p); err != nil {
+				plan.Errors = append(plan.Errors, fmt.Sprintf("saving %s: %v", p.ID, err))
+				continue
+			}
+			logging.Info(ctx, "profile %s %s by apply", p.ID, rp.Change)
+		}
+		if p.Paused {
+			continue
+		}
+
+		if !dry {
+			rp.Run, err = s.applyProfile(ctx, p.ID, now)
+		} else {
+			rp.Run, err = s.planProfile(ctx, p, now)
+		}
+		if err != nil {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("running %s: %v", p.ID, err))
+		}
+	}
+
+	// What is left was applied before and is no longer wanted.
+	removed := make([]*scheduler.Profile, 0, len(managed))
+	for _, p := range managed {
+		removed = append(removed, p)
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i].ID < removed[j].ID })
+	for _, p := range removed {
+		ctx := logging.WithFields(ctx, "profile", p.ID, "region", p.Region)
+		rp := &RegionPlan{Region: p.Region, Profile: p.ID, Change: "deleted"}
+		plan.Regions = append(plan.Regions, rp)
+		if rp.Run, err = s.removeProfile(ctx, p, now, dry); err != nil {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("deleting %s: %v", p.ID, err))
+		}
+	}
+	return plan, nil
+}
+
+// planProfile works out what leveling p at now would do, without doing it.
+func (s *Server) planProfile(ctx context.Context, p *scheduler.Profile, now time.Time) (*ProfileRun, error) {
+	target, until, err := p.Target(now)
+	if err != nil {
+		return nil, err
+	}
+	dry := *p
+	dry.DryRun = true
+	return s.levelProfile(ctx, &dry, target, until, now)
+}
+
+// removeProfile deletes p, then releases what was bought for it.
+func (s *Server) removeProfile(ctx context.Context, p *scheduler.Profile, now time.Time, dry bool) (*ProfileRun, error) {
+	if dry {
+		planned := *p
+		planned.DryRun = true
+		return s.levelProfile(ctx, &planned, 0, time.Time{}, now)
+	}
+
+	unlock, err := s.store.Lock(ctx, "profile/"+p.ID, scheduleLockTTL)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := s.store.DeleteProfile(ctx, p.ID); err != nil {
+		return nil, err
+	}
+	logging.Info(ctx, "profile %s deleted by apply", p.ID)
+	return s.levelProfile(ctx, p, 0, time.Time{}, now)
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+)
+
+// assignmentMoveBackPath is called by the task moving an assignment back at
+// the end of its window.
+const assignmentMoveBackPath = assignmentsPath + "/move/back"
+
+// AssignmentMove moves the assignment of Assignee for JobType from the
+// reservation From to the reservation To of Region for Minutes.
+type AssignmentMove struct {
+	Region   string `json:"region"`
+	Assignee string `json:"assignee"` // projects/{id}, folders/{id} or organizations/{id}
+	JobType  string `json:"job_type"` // QUERY (default), PIPELINE or ML_EXTERNAL
+	From     string `json:"from"`     // reservation ID
+	To       string `json:"to"`       // reservation ID
+	Minutes  int64  `json:"minutes"`
+	RequestMetadata
+}
+
+// AssignmentMoveResponse is the assignment moved and when it is moved back,
+// no time or task when the move was a move back.
+type AssignmentMoveResponse struct {
+	Assignment   AssignmentInfo `json:"assignment"`
+	MoveBackTo   string         `json:"move_back_to,omitempty"`
+	MoveBackAt   *time.Time     `json:"move_back_at,omitempty"`
+	MoveBackTask string         `json:"move_back_task,omitempty"`
+}
+
+// AssignmentMoveBack is the body of a move back task: Assignment goes back
+// to Reservation, unless it was moved or deleted since.
+type AssignmentMoveBack struct {
+	Assignment  string `json:"assignment"`
+	Reservation string `json:"reservation"`
+	Assignee    string `json:"assignee"`
+	JobType     string `json:"job_type"`
+}
+
+// moveTaskPrefix is the start of the names of the tasks moving back the
+// assignment of assignee for jobType in region.
+func (s *Server) moveTaskPrefix(region, assignee string, jobType reservationpb.Assignment_JobType) string {
+	return s.revertTaskPrefix("move", region, hashKey(assignee + "/" + jobType.String())[:20])
+}
+
+// moveAssignmentHandler moves a project's assignment to another reservation
+// for a window, scheduling a task to move it back, so some projects can run
+// on burst capacity for a while. The move is one MoveAssignment call: the
+// API creates the new assignment before deleting the old one, so the
+// assignee never runs on on-demand slots in between. Moving it again during
+// the window keeps the reservation of before the first move to go back to,
+// and moves back at the later of the two ends; moving it to that reservation
+// ends the window.
+func (s *Server) moveAssignmentHandler(w http.ResponseWriter, r *http.Request) {
+	var req AssignmentMove
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	var v validator
+	v.region("region", &req.Region)
+	v.check(validAssignee(req.Assignee), "assignee", "must be projects/{id}, folders/{id} or organizations/{id}")
+	jobType, err := parseJobType(req.JobType)
+	v.check(err == nil, "job_type", "%v", err)
+	v.check(req.From != "", "from", "required")
+	if v.check(req.To != "", "to", "required") {
+		v.check(req.To != req.From, "to", "must not be from")
+	}
+	v.minutes("minutes", &req.Minutes)
+	req.RequestMetadata.validate(&v)
+	if err := v.err(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	from, to := reservationName(req.Region, req.From), reservationName(req.Region, req.To)
+	who, caller := req.who(r)
+	ctx := logging.WithFields(r.Context(), "assignee", req.Assignee)
+
+	unlock, err := s.store.Lock(ctx, "assignment/"+req.Region+"/"+req.Assignee+"/"+jobType.String(), purchaseLockTTL)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "waiting for assignment lock: %v", err)
+		logging.Error(ctx, "waiting for assignment lock: %v", err)
+		return
+	}
+	defer unlock()
+
+	assignments, err := s.listAssignments(ctx, from)
+	if err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+	var current *AssignmentInfo
+	for i, a := range assignments {
+		if a.Assignee == req.Assignee && a.JobType == jobType.String() {
+			current = &assignments[i]
+			break
+		}
+	}
+	if current == nil {
+		writeError(w, http.StatusNotFound, codeNotFound, "%s has no %s assignment in %s", req.Assignee, jobType, from)
+		return
+	}
+
+	var pending AssignmentMoveBack
+	prefix := s.moveTaskPrefix(req.Region, req.Assignee, jobType)
+	pendingTask, pendingAt, err := s.pendingRevert(ctx, prefix, &pending)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(ctx, "finding move back task: %v", err)
+		return
+	}
+	moveBackTo, moveBackAt := from, time.Now().Add(time.Duration(req.Minutes)*time.Minute)
+	if pendingTask != "" {
+		moveBackTo = pending.Reservation
+		if pendingAt.After(moveBackAt) {
+			moveBackAt = pendingAt
+		}
+	}
+
+	moved, err := s.moveAssignment(ctx, current.Name, to)
+	if err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+	resp := AssignmentMoveResponse{Assignment: assignmentInfo(to, moved)}
+	if to == moveBackTo {
+		// Moved back by hand, the window is over.
+		if err := s.queue.Delete(ctx, pendingTask); err != nil && status.Code(err) != codes.NotFound {
+			logging.Error(ctx, "deleting move back task %s: %v", pendingTask, err)
+		}
+		logging.Info(ctx, "%s %s assignment moved back from %s to %s", req.Assignee, jobType, from, to)
+		s.record(ctx, LedgerEntry{Action: actionAssignmentMovedBack, Region: req.Region, Reservation: to, Requester: who, Caller: caller, Reason: req.Reason, Ticket: req.Ticket})
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	back := AssignmentMoveBack{Assignment: moved.Name, Reservation: moveBackTo, Assignee: req.Assignee, JobType: jobType.String()}
+	task, err := s.queue.CreateHTTP(ctx, fmt.Sprintf("%s%d", prefix, moveBackAt.Unix()), taskURL(r, assignmentMoveBackPath), deleteAudience(r), back, moveBackAt)
+	if err != nil {
+		// Never leave the assignment moved without a move back.
+		if _, merr := s.moveAssignment(ctx, moved.Name, from); merr != nil {
+			logging.Error(ctx, "moving the assignment of %s back to %s: %v", req.Assignee, from, merr)
+		}
+		writeError(w, http.StatusInternalServerError, codeInternal, "scheduling move back: %v", err)
+		logging.Error(ctx, "scheduling move back of %s: %v", req.Assignee, err)
+		return
+	}
+	if pendingTask != "" && pendingTask != task.Name {
+		if err := s.queue.Delete(ctx, pendingTask); err != nil && status.Code(err) != codes.NotFound {
+			logging.Error(ctx, "deleting move back task %s: %v", pendingTask, err)
+		}
+	}
+	resp.MoveBackTo, resp.MoveBackAt, resp.MoveBackTask = moveBackTo, &moveBackAt, task.Name
+
+	logging.Info(ctx, "%s %s assignment moved from %s to %s until %s", req.Assignee, jobType, from, to, moveBackAt.Format(time.RFC3339))
+	s.record(ctx, LedgerEntry{Action: actionAssignmentMoved, Region: req.Region, Reservation: to, Requester: who, Caller: caller, Reason: req.Reason, Ticket: req.Ticket})
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// assignmentMoveBackHandler moves an assignment back at the end of its
+// window. An assignment moved or deleted since is left as it is.
+func (s *Server) assignmentMoveBackHandler(w http.ResponseWriter, r *http.Request) {
+	var back AssignmentMoveBack
+	if err := json.NewDecoder(r.Body).Decode(&back); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+	region := capacity.Region(back.Reservation)
+	ctx := logging.WithFields(r.Context(), "assignee", back.Assignee)
+
+	unlock, err := s.store.Lock(ctx, "assignment/"+region+"/"+back.Assignee+"/"+back.JobType, purchaseLockTTL)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "waiting for assignment lock: %v", err)
+		logging.Error(ctx, "waiting for assignment lock: %v", err)
+		return
+	}
+	defer unlock()
+
+	_, err = s.moveAssignment(ctx, back.Assignment, back.Reservation)
+	if status.Code(err) == codes.NotFound {
+		logging.Warning(ctx, "assignment %s was moved or deleted since, leaving it", back.Assignment)
+		writeJSON(w, http.StatusOK, "assignment moved or deleted since the window started")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(ctx, "moving assignment back: %v", err)
+		return
+	}
+	logging.Info(ctx, "%s %s assignment moved back to %s", back.Assignee, back.JobType, back.Reservation)
+	s.record(ctx, LedgerEntry{Action: actionAssignmentMovedBack, Region: region, Reservation: back.Reservation, Requester: requesterAssignmentMove})
+	writeJSON(w, http.StatusOK, "assignment moved back")
+}
+
+// moveAssignment moves the assignment name to the reservation. It isn't
+// retried, a retried move would fail because the assignment is gone from
+// name.
+func (s *Server) moveAssignment(ctx context.Context, name, reservation string) (*reservationpb.Assignment, error) {
+	return s.reservationsFor(name).MoveAssignment(ctx, &reservationpb.MoveAssignmentRequest{Name: name, DestinationId: reservation})
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/api/iterator"
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// AssignmentRequest assigns a project, folder or organization to a
+// reservation for one job type.
+type AssignmentRequest struct {
+	Region      string `json:"region"`
+	Reservation string `json:"reservation"` // reservation ID
+	Assignee    string `json:"assignee"`    // projects/{id}, folders/{id} or organizations/{id}
+	JobType     string `json:"job_type"`    // QUERY (default), PIPELINE or ML_EXTERNAL
+}
+
+// parseJobType maps a job type name to the assignment job types.
+func parseJobType(name string) (reservationpb.Assignment_JobType, error) {
+	if name == "" {
+		return reservationpb.Assignment_QUERY, nil
+	}
+	jobType := reservationpb.Assignment_JobType(reservationpb.Assignment_JobType_value[strings.ToUpper(name)])
+	if jobType == reservationpb.Assignment_JOB_TYPE_UNSPECIFIED {
+		return jobType, fmt.Errorf("unsupported job_type %q, want QUERY, PIPELINE or ML_EXTERNAL", name)
+	}
+	return jobType, nil
+}
+
+// validAssignee reports whether assignee names a project, folder or
+// organization.
+func validAssignee(assignee string) bool {
+	kind, id, ok := strings.Cut(assignee, "/")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		return false
+	}
+	return kind == "projects" || kind == "folders" || kind == "organizations"
+}
+
+func (s *Server) createAssignmentHandler(w http.ResponseWriter, r *http.Request) {
+	var req AssignmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	var v validator
+	v.region("region", &req.Region)
+	v.check(req.Reservation != "", "reservation", "required")
+	v.check(validAssignee(req.Assignee), "assignee", "must be projects/{id}, folders/{id} or organizations/{id}")
+	jobType, err := parseJobType(req.JobType)
+	v.check(err == nil, "job_type", "%v", err)
+	if err := v.err(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	reservation := reservationName(req.Region, req.Reservation)
+	a, err := s.createAssignment(r.Context(), reservation, req.Assignee, jobType)
+	if err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+	logging.Info(r.Context(), "%s assigned to %s for %s jobs", req.Assignee, reservation, jobType)
+	writeJSON(w, http.StatusCreated, assignmentInfo(reservation, a))
+}
+
+func (s *Server) deleteAssignmentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := reservationName(vars["region"], vars["reservation"]) + "/assignments/" + vars["id"]
+	if err := s.deleteAssignment(r.Context(), name); err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+	logging.Info(r.Context(), "assignment %s deleted", name)
+	writeJSON(w, http.StatusOK, "assignment deleted")
+}
+
+// resolveAssignmentHandler returns the assignments that apply to the
+// assignee query parameter in a region: its own, or those of its closest
+// ancestor folder or organization, one per job type.
+func (s *Server) resolveAssignmentHandler(w http.ResponseWriter, r *http.Request) {
+	assignee := r.URL.Query().Get("assignee")
+	if !validAssignee(assignee) {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "assignee must be projects/{id}, folders/{id} or organizations/{id}")
+		return
+	}
+	region := r.URL.Query().Get("region")
+	var v validator
+	v.region("region", &region)
+	if err := v.err(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	parent := fmt.Sprintf("projects/%s/locations/%s", projectID, region)
+	var list []AssignmentInfo
+	err := retryPolicy.Do(r.Context(), "SearchAllAssignments", func(ctx context.Context) error {
+		list = []AssignmentInfo{}
+		it := s.reservationsFor(parent).SearchAllAssignments(ctx, &reservationpb.SearchAllAssignmentsRequest{
+			Parent: parent,
+			Query:  "assignee=" + assignee,
+		})
+		for {
+			a, err := it.Next()
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			list = append(list, assignmentInfo(assignmentReservation(a.Name), a))
+		}
+	})
+	if err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// assignmentReservation is the reservation an assignment name belongs to.
+func assignmentReservation(assignment string) string {
+	return path.Dir(path.Dir(assignment))
+}
+
+// createAssignment isn't retried, a retried create would fail because the
+// assignee already is assigned.
+func (s *Server) createAssignment(ctx context.Context, reservation, assignee string, jobType reservationpb.Assignment_JobType) (*reservationpb.Assignment, error) {
+	return s.reservationsFor(reservation).CreateAssignment(ctx, &reservationpb.CreateAssignmentRequest{
+		Parent: reservation,
+		Assignment: &reservationpb.Assignment{
+			Assignee: assignee,
+			JobType:  jobType,
+		},
+	})
+}
+
+func (s *Server) deleteAssignment(ctx context.Context, name string) error {
+	return retryPolicy.Do(ctx, "DeleteAssignment", func(ctx context.Context) error {
+		return s.reservationsFor(name).DeleteAssignment(ctx, &reservationpb.DeleteAssignmentRequest{Name: name})
+	})
+}
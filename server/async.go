@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// operationsPath reports on the requests run in the background.
+const operationsPath = "/operations"
+
+const (
+	// operationTTL is how long an operation is kept after it started.
+	operationTTL = 24 * time.Hour
+	// asyncTimeout bounds a request run in the background. An operation
+	// still RUNNING after it was last updated this long ago is reported
+	// INTERRUPTED, its instance is gone.
+	asyncTimeout = 30 * time.Minute
+)
+
+// AsyncOperation states.
+const (
+	operationRunning     = "RUNNING"
+	operationSucceeded   = "SUCCEEDED"
+	operationFailed      = "FAILED"
+	operationInterrupted = "INTERRUPTED"
+)
+
+var errOperationNotFound = errors.New("operation not found")
+
+// AsyncOperation is a request run in the background: its steps so far, and
+// once done the status and data or error it answered.
+type AsyncOperation struct {
+	ID        string   `json:"id" firestore:"id"`
+	Method    string   `json:"method" firestore:"method"`
+	Path      string   `json:"path" firestore:"path"`
+	State     string   `json:"state" firestore:"state"`
+	Progress  []string `json:"progress" firestore:"progress"`
+	Requester string   `json:"requester,omitempty" firestore:"requester"`
+	Status    int      `json:"status,omitempty" firestore:"status"`
+	// Body is the response as answered, read into Result or Error.
+	Body      string          `json:"-" firestore:"body"`
+	Result    json.RawMessage `json:"result,omitempty" firestore:"-"`
+	Error     *APIError       `json:"error,omitempty" firestore:"-"`
+	CreatedAt time.Time       `json:"created_at" firestore:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at" firestore:"updated_at"`
+	DoneAt    *time.Time      `json:"done_at,omitempty" firestore:"done_at"`
+	ExpireAt  time.Time       `json:"-" firestore:"expire_at"`
+}
+
+// progressKey holds the func recording the steps of the operation a
+// context is part of.
+type progressKey struct{}
+
+// reportProgress adds a step to the operation ctx is part of, if it is run
+// in the background.
+func reportProgress(ctx context.Context, format string, args ...interface{}) {
+	if report, ok := ctx.Value(progressKey{}).(func(string)); ok {
+		report(fmt.Sprintf(format, args...))
+	}
+}
+
+// wantsAsync reports whether r asks to be run in the background, with
+// Prefer: respond-async or ?async=true.
+func wantsAsync(r *http.Request) bool {
+	for _, prefer := range r.Header.Values("Prefer") {
+		for _, p := range strings.Split(prefer, ",") {
+			if strings.EqualFold(strings.TrimSpace(p), "respond-async") {
+				return true
+			}
+		}
+	}
+	async, _ := strconv.ParseBool(r.URL.Query().Get("async"))
+	return async
+}
+
+// async runs h in the background when the request asks for it, for those
+// that may outlast HTTP timeouts, waiting for commitments to be ACTIVE or
+// buying in many regions. It answers 202 with the operation, its URL in
+// Location, and stores what h answers in it once done. The operation is
+// drained on shutdown like the purchases, and marked INTERRUPTED if still
+// running when the drain times out.
+func (s *Server) async(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !wantsAsync(r) {
+			h(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+			return
+		}
+		id, err := randomHex(16)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+			return
+		}
+		now := time.Now()
+		op := &AsyncOperation{ID: id, Method: r.Method, Path: r.URL.Path, State: operationRunning, Progress: []string{}, Requester: requester(r), CreatedAt: now, UpdatedAt: now, ExpireAt: now.Add(operationTTL)}
+		ctx := logging.WithFields(detached{r.Context()}, "operation", id)
+
+		tracked, done, err := s.ops.begin("operation "+id, LedgerEntry{Requester: op.Requester}, false)
+		if err != nil {
+			writePurchaseError(w, err)
+			return
+		}
+		if err := s.store.PutOperation(ctx, op); err != nil {
+			done()
+			writeError(w, http.StatusInternalServerError, codeInternal, "storing operation: %v", err)
+			logging.Error(ctx, "storing operation: %v", err)
+			return
+		}
+		first := *op
+
+		// Steps, the result and an interruption by shutdown update op in
+		// turn.
+		var mu sync.Mutex
+		update := func(f func()) {
+			mu.Lock()
+			defer mu.Unlock()
+			if op.State != operationRunning {
+				return
+			}
+			f()
+			op.UpdatedAt = time.Now()
+			if err := s.store.PutOperation(ctx, op); err != nil {
+				logging.Error(ctx, "storing operation: %v", err)
+			}
+		}
+		tracked.mu.Lock()
+		tracked.interrupt = func(reason string) {
+			update(func() {
+				op.State, op.Progress = operationInterrupted, append(op.Progress, reason)
+			})
+		}
+		tracked.mu.Unlock()
+
+		runCtx, cancel := context.WithTimeout(ctx, asyncTimeout)
+		runCtx = context.WithValue(runCtx, progressKey{}, func(step string) {
+			update(func() { op.Progress = append(op.Progress, step) })
+		})
+		req := r.Clone(runCtx)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.Header.Del("Prefer")
+		q := req.URL.Query()
+		q.Del("async")
+		req.URL.RawQuery = q.Encode()
+
+		go func() {
+			defer done()
+			defer cancel()
+			rec := newResponseBuffer()
+			defer func() {
+				// Nothing recovers a panic outside the request.
+				p := recover()
+				if p == nil {
+					return
+				}
+				logging.Error(ctx, "operation %s panicked: %v\n\n%s", id, p, debug.Stack())
+				body, err := json.Marshal(map[string]interface{}{"error": &APIError{Code: codeInternal, Message: fmt.Sprint(p)}})
+				if err != nil {
+					logging.Error(ctx, "encoding error of operation %s: %v", id, err)
+				}
+				update(func() {
+					op.State, op.Status, op.Body = operationFailed, http.StatusInternalServerError, string(body)
+				})
+			}()
+			h(rec, req)
+			update(func() {
+				op.State, op.Status, op.Body = operationSucceeded, rec.status(), rec.body.String()
+				if rec.status()/100 != 2 {
+					op.State = operationFailed
+				}
+				doneAt := time.Now()
+				op.DoneAt = &doneAt
+			})
+			logging.Info(ctx, "operation %s %s %s done with status %d", id, op.Method, op.Path, rec.status())
+		}()
+
+		logging.Info(ctx, "running %s %s in the background as operation %s", r.Method, r.URL.Path, id)
+		w.Header().Set("Location", v1Prefix+operationsPath+"/"+id)
+		writeJSON(w, http.StatusAccepted, first)
+	}
+}
+
+// responseBuffer keeps the response of a handler served in process, such as
+// in the background or for a region of a batch.
+type responseBuffer struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: make(http.Header)}
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(code int) {
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	if b.code == 0 {
+		b.code = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// status is the status answered, 200 when the handler wrote nothing.
+func (b *responseBuffer) status() int {
+	if b.code == 0 {
+		return http.StatusOK
+	}
+	return b.code
+}
+
+// getOperationHandler reports the progress of an operation, and once done
+// what its request answered. Only admins see the operations of others, which
+// are not found for anyone else.
+func (s *Server) getOperationHandler(w http.ResponseWriter, r *http.Request) {
+	op, err := s.store.GetOperation(r.Context(), mux.Vars(r)["id"])
+	if err == nil && !hasRole(r, roleAdmin) {
+		if p := principalOf(r.Context()); p == nil || p.Name != op.Requester {
+			err = errOperationNotFound
+		}
+	}
+	if errors.Is(err, errOperationNotFound) {
+		writeError(w, http.StatusNotFound, codeNotFound, "operation %s not found", mux.Vars(r)["id"])
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "getting operation: %v", err)
+		return
+	}
+	if op.Progress == nil {
+		op.Progress = []string{}
+	}
+	if op.State == operationRunning && time.Since(op.UpdatedAt) > asyncTimeout {
+		op.State = operationInterrupted
+	}
+	if op.Body != "" {
+		var body struct {
+			Data  json.RawMessage `json:"data"`
+			Error *APIError       `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(op.Body), &body); err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternal, "reading result: %v", err)
+			return
+		}
+		op.Result, op.Error = body.Data, body.Error
+	}
+	writeJSON(w, http.StatusOK, op)
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetOperationOnlyByRequesterOrAdmin(t *testing.T) {
+	s, _ := newAuthServer(t)
+	now := time.Now()
+	op := &AsyncOperation{ID: "op1", Method: http.MethodPost, Path: v1Prefix + capacityPath, State: operationSucceeded, Requester: "key/" + roleOperator.String(), Status: http.StatusOK, Body: `{"data":{"commit_name":"c1"}}`, CreatedAt: now, UpdatedAt: now, ExpireAt: now.Add(operationTTL)}
+	if err := s.store.PutOperation(context.Background(), op); err != nil {
+		t.Fatalf("PutOperation: %v", err)
+	}
+
+	for _, tc := range []struct {
+		caller role
+		want   int
+	}{
+		{roleReader, http.StatusNotFound},
+		{roleOperator, http.StatusOK},
+		{roleAdmin, http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, v1Prefix+operationsPath+"/op1", nil)
+		req.Header.Set("X-API-Key", testKeys[tc.caller])
+		w := httptest.NewRecorder()
+		s.router().ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s getting the operation of an operator = %d %s, want %d", tc.caller, w.Code, w.Body, tc.want)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	pubsub "google.golang.org/api/pubsub/v1"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+const (
+	// auditMaxPayload is how much of a request body an audit event keeps.
+	auditMaxPayload = 64 << 10
+	// auditMaxResponse is how much of an error response is read for its
+	// code and message.
+	auditMaxResponse = 8 << 10
+	// auditPublishTimeout bounds the publishing of one audit event.
+	auditPublishTimeout = 10 * time.Second
+)
+
+// Outcomes of an audited request.
+const (
+	auditSuccess = "success"
+	auditDenied  = "denied"
+	auditFailure = "failure"
+)
+
+// AuditEvent describes a mutating request to the service: who made it, what
+// they asked for and what came of it. It is published as JSON to
+// AUDIT_TOPIC.
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	// Caller is the authenticated caller, else the identity its token
+	// claims, "internal" for tasks the service runs itself.
+	Caller    string `json:"caller,omitempty"`
+	Role      string `json:"role,omitempty"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Route     string `json:"route,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Trace     string `json:"trace,omitempty"`
+	RemoteIP  string `json:"remote_ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	// Payload is the request body, as JSON when it is, else as a string.
+	// The query string is left out, it can carry tokens.
+	Payload          json.RawMessage `json:"payload,omitempty"`
+	PayloadTruncated bool            `json:"payload_truncated,omitempty"`
+	Status           int             `json:"status"`
+	// Outcome is success, denied (401 and 403) or failure.
+	Outcome    string    `json:"outcome"`
+	Error      *APIError `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// auditSink publishes audit events to AUDIT_TOPIC, in the background so
+// requests don't wait on Pub/Sub. Events that can't be published are logged
+// in full instead.
+type auditSink struct {
+	topic string // projects/{project}/topics/{topic}
+	// service is nil with FAKE_BACKENDS, which only logs events.
+	service *pubsub.Service
+	wg      sync.WaitGroup
+}
+
+// newAuditSink returns the sink of AUDIT_TOPIC, nil if it isn't set.
+func newAuditSink(ctx context.Context) (*auditSink, error) {
+	if auditTopic == "" {
+		return nil, nil
+	}
+	topic := auditTopic
+	if !strings.HasPrefix(topic, "projects/") {
+		topic = fmt.Sprintf("projects/%s/topics/%s", projectID, topic)
+	}
+	if fakeBackends {
+		logging.Warning(ctx, "AUDIT_TOPIC is not published to with FAKE_BACKENDS, audit events are logged")
+		return &auditSink{topic: topic}, nil
+	}
+	svc, err := pubsub.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating pubsub client: %v", err)
+	}
+	return &auditSink{topic: topic, service: svc}, nil
+}
+
+// publish sends e to the topic in the background.
+func (a *auditSink) publish(ctx context.Context, e *AuditEvent) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		logging.Error(ctx, "encoding audit event of %s %s: %v", e.Method, e.Path, err)
+		return
+	}
+	if a.service == nil {
+		logging.Info(ctx, "audit event: %s", data)
+		return
+	}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		// Published even if the request is gone.
+		ctx, cancel := context.WithTimeout(detached{ctx}, auditPublishTimeout)
+		defer cancel()
+		_, err := a.service.Projects.Topics.Publish(a.topic, &pubsub.PublishRequest{
+			Messages: []*pubsub.PubsubMessage{{
+				Data:       base64.StdEncoding.EncodeToString(data),
+				Attributes: map[string]string{"method": e.Method, "route": e.Route, "outcome": e.Outcome},
+			}},
+		}).Context(ctx).Do()
+		if err != nil {
+			logging.Error(ctx, "publishing audit event to %s: %v: %s", a.topic, err, data)
+		}
+	}()
+}
+
+// Close waits for the events being published. It is a no-op on a nil sink.
+func (a *auditSink) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.wg.Wait()
+	return nil
+}
+
+type auditKey struct{}
+
+// auditCaller notes p as the caller of the audited request of ctx, for
+// authorize, which authenticates it deeper in the handler chain.
+func auditCaller(ctx context.Context, p *principal) {
+	if e, ok := ctx.Value(auditKey{}).(*AuditEvent); ok {
+		e.Caller, e.Role = p.Name, p.Role.String()
+	}
+}
+
+// auditRecorder keeps the status of a response, and the start of its body
+// when it is an error.
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *auditRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if room := auditMaxResponse - w.body.Len(); w.status >= 400 && room > 0 {
+		if len(b) < room {
+			room = len(b)
+		}
+		w.body.Write(b[:room])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// audit publishes an AuditEvent for every request of next that isn't a GET,
+// HEAD or OPTIONS, when AUDIT_TOPIC is set.
+func (s *Server) audit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.auditSink == nil || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		e := &AuditEvent{
+			Time:      start,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			RequestID: r.Header.Get("X-Request-ID"),
+			Trace:     strings.SplitN(r.Header.Get("X-Cloud-Trace-Context"), "/", 2)[0],
+			RemoteIP:  remoteIP(r),
+			UserAgent: r.UserAgent(),
+		}
+		if route := mux.CurrentRoute(r); route != nil {
+			e.Route, _ = route.GetPathTemplate()
+		}
+
+		// The body is read ahead and handed on whole to next.
+		payload, err := io.ReadAll(io.LimitReader(r.Body, auditMaxPayload+1))
+		if err != nil {
+			logging.Warning(r.Context(), "reading body of %s for audit: %v", r.URL.Path, err)
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(payload), r.Body), r.Body}
+		if len(payload) > auditMaxPayload {
+			payload, e.PayloadTruncated = payload[:auditMaxPayload], true
+		}
+		e.Payload = auditPayload(payload)
+
+		rec := &auditRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), auditKey{}, e)))
+
+		e.DurationMS = time.Since(start).Milliseconds()
+		if e.Status = rec.status; e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		if e.Caller == "" {
+			if isInternalCall(r.Context()) {
+				e.Caller = "internal"
+			} else {
+				e.Caller = requester(r)
+			}
+		}
+		switch {
+		case e.Status < 400:
+			e.Outcome = auditSuccess
+		case e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden:
+			e.Outcome = auditDenied
+		default:
+			e.Outcome = auditFailure
+		}
+		if e.Status >= 400 {
+			var resp struct {
+				Error *APIError `json:"error"`
+			}
+			if json.Unmarshal(rec.body.Bytes(), &resp) == nil {
+				e.Error = resp.Error
+			}
+		}
+		s.auditSink.publish(r.Context(), e)
+	})
+}
+
+// auditPayload is body as JSON: itself if it is JSON, else a string.
+func auditPayload(body []byte) json.RawMessage {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return body
+	}
+	s, _ := json.Marshal(string(body))
+	return s
+}
+
+// remoteIP is the address of the client of r, the first of X-Forwarded-For
+// behind Cloud Run's front end.
+func remoteIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		return strings.TrimSpace(strings.SplitN(fwd, ",", 2)[0])
+	}
+	if i := strings.LastIndex(r.RemoteAddr, ":"); i >= 0 {
+		return r.RemoteAddr[:i]
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/idtoken"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// requireTasksOIDC only lets through requests carrying a Google-signed OIDC
+// token minted for the delete task service account, which is what Cloud Tasks
+// attaches to the tasks created by launchDeleteTask.
+func requireTasksOIDC(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := verifyTasksToken(r); err != nil {
+			logging.Warning(r.Context(), "rejected %s request: %v", r.URL.Path, err)
+			writeError(w, http.StatusUnauthorized, codeUnauthenticated, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func verifyTasksToken(r *http.Request) error {
+	if fakeBackends {
+		// The fake queue sends no token.
+		return nil
+	}
+	if isInternalCall(r.Context()) {
+		return nil
+	}
+	if taskServiceAcct == "" {
+		return errors.New("no task service account to verify the token against")
+	}
+	return verifyOIDCToken(r, deleteAudience(r), taskServiceAcct)
+}
+
+type internalCallKey struct{}
+
+// withInternalCall marks the requests made with ctx as tasks the service runs
+// itself, which carry no token.
+func withInternalCall(ctx context.Context) context.Context {
+	return context.WithValue(ctx, internalCallKey{}, true)
+}
+
+// isInternalCall reports whether ctx is of a task run by the service itself.
+func isInternalCall(ctx context.Context) bool {
+	internal, _ := ctx.Value(internalCallKey{}).(bool)
+	return internal
+}
+
+// verifyOIDCToken checks that r carries a Google-signed OIDC token minted for
+// audience, and, unless email is empty, for the service account email.
+func verifyOIDCToken(r *http.Request, audience, email string) error {
+	authz := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authz, "Bearer ")
+	if token == "" || token == authz {
+		return fmt.Errorf("missing bearer token")
+	}
+
+	payload, err := idtoken.Validate(r.Context(), token, audience)
+	if err != nil {
+		return fmt.Errorf("validating token: %v", err)
+	}
+
+	got, _ := payload.Claims["email"].(string)
+	verified, _ := payload.Claims["email_verified"].(bool)
+	if !verified || got == "" {
+		return fmt.Errorf("token has no verified email")
+	}
+	if email != "" && got != email {
+		return fmt.Errorf("token issued to %s, want %s", got, email)
+	}
+	return nil
+}
+
+// deleteAudience returns the audience delete tasks are minted for. Without an
+// explicit TASK_AUDIENCE it is DELETE_CALLBACK_URL, or the URL of the
+// unversioned delete route, so tasks queued before /v1 still verify.
+func deleteAudience(r *http.Request) string {
+	if taskAudience != "" {
+		return taskAudience
+	}
+	if deleteCallbackURL != "" {
+		return deleteCallbackURL
+	}
+	return taskURL(r, deleteCapacityPath)
+}
+
+// taskURL is the URL tasks reach path of the service on: under SELF_URL when
+// set, otherwise on the host r was sent to. r may be nil when SELF_URL is set.
+func taskURL(r *http.Request, path string) string {
+	if selfURL != "" {
+		return selfURL + path
+	}
+	return "https://" + r.Host + path
+}
+
+// deleteURL is the URL delete tasks call, DELETE_CALLBACK_URL when set. r may
+// be nil when DELETE_CALLBACK_URL or SELF_URL is set.
+func deleteURL(r *http.Request) string {
+	if deleteCallbackURL != "" {
+		return deleteCallbackURL
+	}
+	return taskURL(r, v1Prefix+deleteCommitmentPath)
+}
+
+// Roles of callers, each allowed what the ones below it are.
+type role int
+
+const (
+	roleNone role = iota
+	// roleReader lists and reports.
+	roleReader
+	// roleOperator buys, extends and changes schedules and profiles.
+	roleOperator
+	// roleAdmin deletes and cancels.
+	roleAdmin
+)
+
+var roleNames = map[string]role{"reader": roleReader, "operator": roleOperator, "admin": roleAdmin}
+
+func (r role) String() string {
+	for name, v := range roleNames {
+		if v == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+// apiKey is a static key of a legacy caller, from API_KEYS_JSON.
+type apiKey struct {
+	Key  string `json:"key"`
+	Role string `json:"role"`
+
+	role role
+}
+
+// parseAuth reads AUTH_ROLES_JSON, which maps emails, or @domain for every
+// account of a domain, to a role, and API_KEYS_JSON, which maps the names of
+// legacy callers to their key and role.
+func parseAuth() error {
+	authAudiences = nil
+	authRoles = make(map[string]role)
+	if v := getenv("AUTH_ROLES_JSON"); v != "" {
+		var names map[string]string
+		if err := json.Unmarshal([]byte(v), &names); err != nil {
+			return fmt.Errorf("cannot parse AUTH_ROLES_JSON: %v", err)
+		}
+		for who, name := range names {
+			r, ok := roleNames[name]
+			if !ok {
+				return fmt.Errorf("AUTH_ROLES_JSON: unknown role %q of %s, want reader, operator or admin", name, who)
+			}
+			authRoles[who] = r
+		}
+	}
+	apiKeys = make(map[string]*apiKey)
+	if v := getenv("API_KEYS_JSON"); v != "" {
+		if err := json.Unmarshal([]byte(v), &apiKeys); err != nil {
+			return fmt.Errorf("cannot parse API_KEYS_JSON: %v", err)
+		}
+		for name, k := range apiKeys {
+			var ok bool
+			if k.role, ok = roleNames[k.Role]; !ok {
+				return fmt.Errorf("API_KEYS_JSON: unknown role %q of %s, want reader, operator or admin", k.Role, name)
+			}
+			if len(k.Key) < 16 {
+				return fmt.Errorf("API_KEYS_JSON: key of %s must be at least 16 characters", name)
+			}
+		}
+	}
+	if v := getenv("AUTH_AUDIENCES"); v != "" {
+		for _, aud := range strings.Split(v, ",") {
+			authAudiences = append(authAudiences, strings.TrimSuffix(strings.TrimSpace(aud), "/"))
+		}
+	}
+	return nil
+}
+
+// authEnabled reports whether callers need a role. Without AUTH_ROLES_JSON
+// and API_KEYS_JSON every endpoint is open, left to Cloud Run IAM.
+func authEnabled() bool {
+	return len(authRoles) > 0 || len(apiKeys) > 0
+}
+
+// principal is an authenticated caller.
+type principal struct {
+	// Name is the email of the caller, or key/{name} for an API key.
+	Name string
+	Role role
+}
+
+type principalKey struct{}
+
+// principalOf returns the caller authenticated for ctx, nil if none was.
+func principalOf(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return p
+}
+
+// roleOf is the role of email: its own, else its domain's. The service
+// accounts the service's own tasks and jobs call it with are operators.
+func roleOf(email string) role {
+	if r, ok := authRoles[email]; ok {
+		return r
+	}
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		if r, ok := authRoles[email[at:]]; ok {
+			return r
+		}
+	}
+	if email == taskServiceAcct || schedulerJobs && email == schedulerJobsServiceAcct {
+		return roleOperator
+	}
+	return roleNone
+}
+
+// authenticate identifies the caller of r by its X-API-Key, its IAP signed
+// header when IAP_AUDIENCE is set, or its Google-signed ID token, minted for
+// an audience of the service.
+func authenticate(r *http.Request) (*principal, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		for name, k := range apiKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(k.Key)) == 1 {
+				return &principal{Name: "key/" + name, Role: k.role}, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown API key")
+	}
+	if iapAudience != "" && r.Header.Get("X-Goog-IAP-JWT-Assertion") != "" {
+		email, err := iapUser(r)
+		if err != nil {
+			return nil, err
+		}
+		return &principal{Name: email, Role: roleOf(email)}, nil
+	}
+
+	authz := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authz, "Bearer ")
+	if token == "" || token == authz {
+		return nil, fmt.Errorf("missing bearer token or API key")
+	}
+	payload, err := idtoken.Validate(r.Context(), token, "")
+	if err != nil {
+		return nil, fmt.Errorf("validating token: %v", err)
+	}
+	if !validAudience(r, payload.Audience) {
+		return nil, fmt.Errorf("token is for %s, not this service", payload.Audience)
+	}
+	email, _ := payload.Claims["email"].(string)
+	verified, _ := payload.Claims["email_verified"].(bool)
+	if !verified || email == "" {
+		return nil, fmt.Errorf("token has no verified email")
+	}
+	return &principal{Name: email, Role: roleOf(email)}, nil
+}
+
+// iapUser is the email of the user of r in its IAP signed header, validated
+// against IAP_AUDIENCE.
+func iapUser(r *http.Request) (string, error) {
+	assertion := r.Header.Get("X-Goog-IAP-JWT-Assertion")
+	if assertion == "" {
+		return "", fmt.Errorf("missing IAP assertion")
+	}
+	payload, err := idtoken.Validate(r.Context(), assertion, iapAudience)
+	if err != nil {
+		return "", fmt.Errorf("validating IAP assertion: %v", err)
+	}
+	email, _ := payload.Claims["email"].(string)
+	if email == "" {
+		return "", fmt.Errorf("IAP assertion has no email")
+	}
+	return email, nil
+}
+
+// validAudience reports whether tokens for aud are meant for the service:
+// aud is one of AUTH_AUDIENCES, SELF_URL, TASK_AUDIENCE or the URL r was
+// sent to, or the URL of one of their paths.
+func validAudience(r *http.Request, aud string) bool {
+	audiences := append([]string{selfURL, "https://" + r.Host}, authAudiences...)
+	if taskAudience != "" {
+		audiences = append(audiences, taskAudience)
+	}
+	for _, a := range audiences {
+		if a != "" && (aud == a || strings.HasPrefix(aud, a+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize lets callers with at least min through to next. Calls the
+// service makes itself, and every call when auth is off, go through.
+func authorize(min role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled() || isInternalCall(r.Context()) {
+			next(w, r)
+			return
+		}
+		p, err := authenticate(r)
+		if err != nil {
+			logging.Warning(r.Context(), "rejected %s request: %v", r.URL.Path, err)
+			writeError(w, http.StatusUnauthorized, codeUnauthenticated, "unauthorized")
+			return
+		}
+		auditCaller(r.Context(), p)
+		if p.Role < min {
+			logging.Warning(r.Context(), "%s is %s, %s %s needs %s", p.Name, p.Role, r.Method, r.URL.Path, min)
+			writeError(w, http.StatusForbidden, codeForbidden, "%s needs the %s role", r.URL.Path, min)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// hasRole reports whether the caller of r has at least min, always true when
+// auth is off.
+func hasRole(r *http.Request, min role) bool {
+	if !authEnabled() || isInternalCall(r.Context()) {
+		return true
+	}
+	p := principalOf(r.Context())
+	return p != nil && p.Role >= min
+}
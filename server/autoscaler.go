@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+)
+
+// requesterAutoscaler is the requester of actions taken by the autoscaler.
+const requesterAutoscaler = "autoscaler"
+
+// autoscalePolicy decides when the autoscaler buys or releases FLEX
+// commitments, from the slot usage of the last Lookback.
+type autoscalePolicy struct {
+	Interval time.Duration
+	Lookback time.Duration
+	// View is the INFORMATION_SCHEMA jobs timeline view queried, such as
+	// JOBS_TIMELINE_BY_PROJECT or JOBS_TIMELINE_BY_ORGANIZATION.
+	View string
+	// Scale up when usage reaches UpUtilization of the committed slots, or
+	// jobs are waiting for UpPending slots.
+	UpUtilization float64
+	UpPending     float64
+	// Scale down when usage is under DownUtilization with nothing pending.
+	DownUtilization float64
+	Step            int64
+	Cooldown        time.Duration
+	// MaxHold deletes bought commitments the autoscaler fails to release.
+	MaxHold time.Duration
+}
+
+// parseAutoscalePolicy reads the AUTOSCALE_* environment. The autoscaler is
+// off unless AUTOSCALE_INTERVAL is set.
+func parseAutoscalePolicy() (autoscalePolicy, error) {
+	p := autoscalePolicy{
+		Lookback:        10 * time.Minute,
+		View:            "JOBS_TIMELINE_BY_PROJECT",
+		UpUtilization:   0.9,
+		UpPending:       100,
+		DownUtilization: 0.3,
+		Step:            100,
+		Cooldown:        10 * time.Minute,
+		MaxHold:         4 * time.Hour,
+	}
+
+	durations := map[string]*time.Duration{
+		"AUTOSCALE_INTERVAL": &p.Interval,
+		"AUTOSCALE_LOOKBACK": &p.Lookback,
+		"AUTOSCALE_COOLDOWN": &p.Cooldown,
+		"AUTOSCALE_MAX_HOLD": &p.MaxHold,
+	}
+	for name, d := range durations {
+		if v := getenv(name); v != "" {
+			var err error
+			if *d, err = time.ParseDuration(v); err != nil {
+				return p, fmt.Errorf("cannot parse %s: %v", name, err)
+			}
+		}
+	}
+	floats := map[string]*float64{
+		"AUTOSCALE_UP_UTILIZATION":   &p.UpUtilization,
+		"AUTOSCALE_UP_PENDING":       &p.UpPending,
+		"AUTOSCALE_DOWN_UTILIZATION": &p.DownUtilization,
+	}
+	for name, f := range floats {
+		if v := getenv(name); v != "" {
+			var err error
+			if *f, err = strconv.ParseFloat(v, 64); err != nil {
+				return p, fmt.Errorf("cannot parse %s: %v", name, err)
+			}
+		}
+	}
+	if v := getenv("AUTOSCALE_STEP"); v != "" {
+		var err error
+		if p.Step, err = strconv.ParseInt(v, 10, 64); err != nil || p.Step < 100 {
+			return p, fmt.Errorf("AUTOSCALE_STEP must be at least 100 slots")
+		}
+	}
+	if v := getenv("AUTOSCALE_VIEW"); v != "" {
+		p.View = strings.ToUpper(v)
+	}
+
+	if p.DownUtilization >= p.UpUtilization {
+		return p, fmt.Errorf("AUTOSCALE_DOWN_UTILIZATION must be below AUTOSCALE_UP_UTILIZATION")
+	}
+	if p.MaxHold > time.Duration(live().MaxMinutes)*time.Minute {
+		return p, fmt.Errorf("AUTOSCALE_MAX_HOLD is longer than MAX_MINUTES")
+	}
+	return p, nil
+}
+
+// scaleDecision is what the autoscaler does on a tick.
+type scaleDecision int
+
+const (
+	scaleHold scaleDecision = iota
+	scaleUp
+	scaleDown
+)
+
+// decide scales up when usage reaches the up threshold of the committed
+// slots or enough work is pending, and down when usage is under the down
+// threshold with nothing pending. It also returns the utilization, 1 when
+// nothing is committed.
+func (p autoscalePolicy) decide(used, pending float64, committed int64) (scaleDecision, float64) {
+	utilization := 1.0
+	if committed > 0 {
+		utilization = used / float64(committed)
+	}
+	switch {
+	case pending >= p.UpPending || (committed > 0 && utilization >= p.UpUtilization):
+		return scaleUp, utilization
+	case pending == 0 && utilization < p.DownUtilization:
+		return scaleDown, utilization
+	}
+	return scaleHold, utilization
+}
+
+// canRelease reports whether releasing slots of the committed ones keeps
+// usage under the scale up threshold.
+func (p autoscalePolicy) canRelease(used float64, committed, slots int64) bool {
+	remaining := committed - slots
+	return remaining > 0 && used/float64(remaining) < p.UpUtilization
+}
+
+// slotUsage is the average slot usage of a region over the lookback.
+type slotUsage struct {
+	Used    float64 `bigquery:"used_slots"`
+	Pending float64 `bigquery:"pending_units"`
+}
+
+// autoscaler remembers when it last acted on each region.
+type autoscaler struct {
+	mu         sync.Mutex
+	lastAction map[string]time.Time
+}
+
+// runAutoscaler scales every configured region each interval until ctx is
+// done.
+func (s *Server) runAutoscaler(ctx context.Context, p autoscalePolicy) {
+	logging.Info(ctx, "autoscaling %v every %s", regions, p.Interval)
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, region := range regions {
+				ctx := logging.WithFields(ctx, "region", region)
+				if err := s.autoscaleRegion(ctx, p, region); err != nil {
+					logging.Error(ctx, "autoscaling %s: %v", region, err)
+				}
+			}
+		}
+	}
+}
+
+// autoscaleRegion buys or releases a step of FLEX capacity in region when its
+// usage crosses the policy thresholds and the region is out of cooldown.
+func (s *Server) autoscaleRegion(ctx context.Context, p autoscalePolicy, region string) error {
+	s.autoscaler.mu.Lock()
+	last := s.autoscaler.lastAction[region]
+	s.autoscaler.mu.Unlock()
+	if time.Since(last) < p.Cooldown {
+		return nil
+	}
+
+	usage, err := s.slotUsage(ctx, p.View, p.Lookback, region)
+	if err != nil {
+		return fmt.Errorf("querying slot usage: %v", err)
+	}
+	parent := fmt.Sprintf("projects/%s/locations/%s", projectID, region)
+	commitments, err := s.capacity.List(ctx, parent)
+	if err != nil {
+		return fmt.Errorf("listing commitments: %v", err)
+	}
+	var committed int64
+	for _, c := range commitments {
+		committed += c.SlotCount
+	}
+
+	decision, utilization := p.decide(usage.Used, usage.Pending, committed)
+	logging.Info(ctx, "%s uses %.0f of %d slots (%.0f%%), %.0f pending", region, usage.Used, committed, utilization*100, usage.Pending)
+
+	switch decision {
+	case scaleUp:
+		_, err := s.purchase(ctx, purchaseRequest{
+			Region:    region,
+			Slots:     p.Step,
+			Plan:      reservationpb.CapacityCommitment_FLEX,
+			DeleteAt:  time.Now().Add(p.MaxHold),
+			DeleteURL: deleteURL(nil),
+			Audience:  deleteAudience(nil),
+			Requester: requesterAutoscaler,
+			Reason:    fmt.Sprintf("utilization %.0f%%, %.0f slots pending", utilization*100, usage.Pending),
+		})
+		if errors.Is(err, capacity.ErrMaxSlots) {
+			logging.Info(ctx, "%s is at its slot cap, not scaling up", region)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+	case scaleDown:
+		released, err := s.releaseOwnedFlex(ctx, p, region, usage.Used, committed)
+		if err != nil || !released {
+			return err
+		}
+
+	default:
+		return nil
+	}
+
+	s.autoscaler.mu.Lock()
+	s.autoscaler.lastAction[region] = time.Now()
+	s.autoscaler.mu.Unlock()
+	return nil
+}
+
+// releaseOwnedFlex deletes the oldest FLEX commitment bought by the service in
+// region whose removal keeps usage under the scale up threshold.
+func (s *Server) releaseOwnedFlex(ctx context.Context, p autoscalePolicy, region string, used float64, committed int64) (bool, error) {
+	recs, err := s.store.ListCommitments(ctx)
+	if err != nil {
+		return false, fmt.Errorf("listing recorded commitments: %v", err)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].CreatedAt.Before(recs[j].CreatedAt) })
+
+	for _, rec := range recs {
+		if rec.Region != region || resourceProject(rec.Name) != projectID || rec.Plan != reservationpb.CapacityCommitment_FLEX.String() {
+			continue
+		}
+		if time.Since(rec.CreatedAt) < capacity.FlexMinDuration {
+			continue
+		}
+		if !p.canRelease(used, committed, rec.SlotCount) {
+			continue
+		}
+
+		ctx := logging.WithFields(ctx, "commit", rec.Name, "slots", rec.SlotCount)
+		logging.Info(ctx, "releasing commitment %s of %d slots", rec.Name, rec.SlotCount)
+		if err := s.deleteCapacity(ctx, rec.Name); err != nil {
+			s.record(ctx, LedgerEntry{Action: actionDeleteFailed, Commitment: rec.Name, Slots: rec.SlotCount, Requester: requesterAutoscaler, Error: err.Error()})
+			return false, err
+		}
+		s.record(ctx, LedgerEntry{Action: actionDeleted, Commitment: rec.Name, Slots: rec.SlotCount, Requester: requesterAutoscaler})
+		s.dropDeleteTask(ctx, rec.Name)
+		return true, nil
+	}
+	return false, nil
+}
+
+// slotUsage averages the slot usage and pending work of region's jobs in the
+// INFORMATION_SCHEMA view over the last lookback.
+func (s *Server) slotUsage(ctx context.Context, view string, lookback time.Duration, region string) (*slotUsage, error) {
+	seconds := int64(lookback.Seconds())
+	q := s.bigquery.Query(fmt.Sprintf(`
+SELECT
+  IFNULL(SUM(period_slot_ms) / (1000 * @seconds), 0) AS used_slots,
+  IFNULL(SUM(period_estimated_runnable_units) / @seconds, 0) AS pending_units
+FROM `+"`region-%s`.INFORMATION_SCHEMA.%s"+`
+WHERE period_start >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL @seconds SECOND)
+  AND (statement_type IS NULL OR statement_type != 'SCRIPT')`, strings.ToLower(region), view))
+	q.Location = region
+	q.Parameters = []bigquery.QueryParameter{{Name: "seconds", Value: seconds}}
+
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var usage slotUsage
+	if err := it.Next(&usage); err != nil && err != iterator.Done {
+		return nil, err
+	}
+	return &usage, nil
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// capacityBatchPath buys capacity in several regions in one request.
+const capacityBatchPath = capacityPath + "/batch"
+
+// maxBatchRegions bounds the regions of one batch.
+const maxBatchRegions = 10
+
+// CapacityBatch buys capacity in several regions at once: the slots of each
+// of Regions, with the rest of the payload applying to them all.
+type CapacityBatch struct {
+	Regions []RegionSlots `json:"regions"`
+	Payload
+}
+
+// RegionSlots are the slots a batch buys in a region.
+type RegionSlots struct {
+	Region    string `json:"region"`
+	ExtraSlot int64  `json:"extra_slot"`
+}
+
+// BatchResult is the outcome of the purchase of one region of a batch, as
+// the add capacity request of the region alone would have answered: its
+// status, and the commitment bought, the request queued until a blackout
+// ends or the error.
+type BatchResult struct {
+	Region string               `json:"region"`
+	Status int                  `json:"status"`
+	Data   *AddCapacityResponse `json:"data,omitempty"`
+	Queued *QueuedRequest       `json:"queued,omitempty"`
+	Error  *APIError            `json:"error,omitempty"`
+}
+
+// CapacityBatchResponse has the results of a batch in the order of its
+// regions, and the slots asked for and bought in all of them.
+type CapacityBatchResponse struct {
+	Results        []BatchResult `json:"results"`
+	SlotsRequested int64         `json:"slots_requested"`
+	SlotsPurchased int64         `json:"slots_purchased"`
+}
+
+// addCapacityBatchHandler buys the slots of each region of a batch
+// concurrently, each region going through the checks, caps, fallbacks and
+// deletion scheduling of an add capacity request of its own, so workloads
+// spanning regions get their capacity everywhere at once. It answers 200
+// when every region succeeded, 207 with the result of each otherwise. An
+// idempotency key applies to each region, suffixed with it.
+func (s *Server) addCapacityBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var b CapacityBatch
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	var v validator
+	if v.check(len(b.Regions) > 0, "regions", "required") {
+		v.check(len(b.Regions) <= maxBatchRegions, "regions", "can not list more than %d regions", maxBatchRegions)
+	}
+	v.check(b.Region == "" && b.ExtraSlot == 0, "region", "give the region and extra_slot of each of regions")
+	seen := make(map[string]bool)
+	for i := range b.Regions {
+		field := fmt.Sprintf("regions[%d].region", i)
+		if !v.check(b.Regions[i].Region != "", field, "required") {
+			continue
+		}
+		v.region(field, &b.Regions[i].Region)
+		v.check(!seen[b.Regions[i].Region], field, "%s is listed twice", b.Regions[i].Region)
+		seen[b.Regions[i].Region] = true
+	}
+	if err := v.err(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = b.RequestID
+	}
+	resp := CapacityBatchResponse{Results: make([]BatchResult, len(b.Regions))}
+	var wg sync.WaitGroup
+	for i, rs := range b.Regions {
+		p := b.Payload
+		p.Region, p.ExtraSlot = rs.Region, rs.ExtraSlot
+		if key != "" {
+			p.RequestID = key + "/" + rs.Region
+		}
+		resp.SlotsRequested += rs.ExtraSlot
+		wg.Add(1)
+		go func(i int, p Payload) {
+			defer wg.Done()
+			resp.Results[i] = s.addRegionCapacity(r, p)
+			reportProgress(r.Context(), "%s answered %d", p.Region, resp.Results[i].Status)
+		}(i, p)
+	}
+	wg.Wait()
+
+	code := http.StatusOK
+	for _, res := range resp.Results {
+		if res.Data != nil {
+			resp.SlotsPurchased += res.Data.SlotsPurchased
+		}
+		if res.Status/100 != 2 {
+			code = http.StatusMultiStatus
+		}
+	}
+	logging.Info(r.Context(), "batch bought %d of %d slots in %d regions", resp.SlotsPurchased, resp.SlotsRequested, len(b.Regions))
+	writeJSON(w, code, resp)
+}
+
+// addRegionCapacity serves the add capacity request p of a batch in
+// process, as if it had been sent on its own.
+func (s *Server) addRegionCapacity(r *http.Request, p Payload) BatchResult {
+	req := r.Clone(r.Context())
+	req.Header.Del("Idempotency-Key")
+	rec := newResponseBuffer()
+	s.addCapacityFromPayload(rec, req, p)
+
+	res := BatchResult{Region: p.Region, Status: rec.status()}
+	var body struct {
+		Data  json.RawMessage `json:"data"`
+		Error *APIError       `json:"error"`
+	}
+	if err := json.Unmarshal(rec.body.Bytes(), &body); err != nil {
+		res.Error = &APIError{Code: codeInternal, Message: fmt.Sprintf("reading result: %v", err), Retryable: true}
+		return res
+	}
+	var err error
+	switch {
+	case body.Error != nil:
+		res.Error = body.Error
+	case rec.status() == http.StatusAccepted:
+		err = json.Unmarshal(body.Data, &res.Queued)
+	default:
+		err = json.Unmarshal(body.Data, &res.Data)
+	}
+	if err != nil {
+		res.Error = &APIError{Code: codeInternal, Message: fmt.Sprintf("reading result: %v", err), Retryable: true}
+	}
+	return res
+}
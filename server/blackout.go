@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// blackout is a window in which no capacity is bought, such as a billing
+// close or a maintenance. It is either one-off, From to To, or recurs on a
+// cron expression for Minutes.
+type blackout struct {
+	Name     string `json:"name"`
+	Region   string `json:"region,omitempty"` // every region if empty
+	From     string `json:"from,omitempty"`   // RFC3339
+	To       string `json:"to,omitempty"`     // RFC3339
+	Cron     string `json:"cron,omitempty"`
+	Minutes  int64  `json:"minutes,omitempty"`
+	Timezone string `json:"timezone,omitempty"` // of Cron, default UTC
+	// Queue holds add_capacity requests until the window ends instead of
+	// rejecting them.
+	Queue bool `json:"queue,omitempty"`
+
+	from, to time.Time
+	sched    cron.Schedule
+	loc      *time.Location
+}
+
+// parseBlackouts parses BLACKOUTS_JSON, e.g.
+// [{"name":"billing close","cron":"0 18 28 * *","minutes":2160,"queue":true}].
+func parseBlackouts(v string) ([]*blackout, error) {
+	var list []*blackout
+	if err := json.Unmarshal([]byte(v), &list); err != nil {
+		return nil, err
+	}
+	for i, b := range list {
+		if b.Name == "" {
+			b.Name = fmt.Sprintf("blackout %d", i)
+		}
+		if b.Region != "" {
+			name, ok := knownRegions[strings.ToLower(b.Region)]
+			if !ok {
+				return nil, fmt.Errorf("%s: unknown region %q", b.Name, b.Region)
+			}
+			b.Region = name
+		}
+		if (b.Cron == "") == (b.From == "" && b.To == "") {
+			return nil, fmt.Errorf("%s: provide either cron and minutes, or from and to", b.Name)
+		}
+		if b.Cron == "" {
+			var err error
+			if b.from, err = time.Parse(time.RFC3339, b.From); err != nil {
+				return nil, fmt.Errorf("%s: from must be an RFC3339 timestamp", b.Name)
+			}
+			if b.to, err = time.Parse(time.RFC3339, b.To); err != nil {
+				return nil, fmt.Errorf("%s: to must be an RFC3339 timestamp", b.Name)
+			}
+			if !b.to.After(b.from) {
+				return nil, fmt.Errorf("%s: to must be after from", b.Name)
+			}
+			continue
+		}
+		if b.Minutes <= 0 {
+			return nil, fmt.Errorf("%s: minutes must be positive", b.Name)
+		}
+		var err error
+		if b.sched, err = cron.ParseStandard(b.Cron); err != nil {
+			return nil, fmt.Errorf("%s: parsing cron %q: %v", b.Name, b.Cron, err)
+		}
+		b.loc = time.UTC
+		if b.Timezone != "" {
+			if b.loc, err = time.LoadLocation(b.Timezone); err != nil {
+				return nil, fmt.Errorf("%s: %v", b.Name, err)
+			}
+		}
+	}
+	return list, nil
+}
+
+// end returns when b ends if it is on at now.
+func (b *blackout) end(now time.Time) (time.Time, bool) {
+	if b.sched == nil {
+		return b.to, !now.Before(b.from) && now.Before(b.to)
+	}
+	window := time.Duration(b.Minutes) * time.Minute
+	var end time.Time
+	for start := b.sched.Next(now.In(b.loc).Add(-window)); !start.After(now); start = b.sched.Next(start) {
+		end = start.Add(window)
+	}
+	return end, end.After(now)
+}
+
+// activeBlackout returns the blackout on in region at now, if any, and when
+// it ends. Of overlapping blackouts the one ending last is returned.
+func activeBlackout(region string, now time.Time) (*blackout, time.Time) {
+	var (
+		found *blackout
+		until time.Time
+	)
+	for _, b := range live().Blackouts {
+		if b.Region != "" && b.Region != region {
+			continue
+		}
+		if end, ok := b.end(now); ok && end.After(until) {
+			found, until = b, end
+		}
+	}
+	return found, until
+}
+
+// blackoutError is returned when capacity is asked for during a blackout.
+type blackoutError struct {
+	Blackout *blackout
+	Until    time.Time
+}
+
+func (e *blackoutError) Error() string {
+	return fmt.Sprintf("scaling is forbidden during %s until %s", e.Blackout.Name, e.Until.Format(time.RFC3339))
+}
+
+// checkBlackout rejects req with a blackoutError during a blackout of its
+// region, unless it overrides it.
+func (s *Server) checkBlackout(ctx context.Context, req purchaseRequest) error {
+	b, until := activeBlackout(req.Region, time.Now())
+	if b == nil {
+		return nil
+	}
+	if req.Override {
+		logging.Warning(ctx, "%s overrides %s", req.Requester, b.Name)
+		s.record(ctx, LedgerEntry{Action: actionBlackoutOverridden, Region: req.Region, Slots: req.Slots, Plan: req.Plan.String(), Requester: req.Requester, Caller: req.Caller, Reason: blackoutReason(req.Reason, b), Ticket: req.Ticket})
+		return nil
+	}
+	err := &blackoutError{Blackout: b, Until: until}
+	if !req.DryRun && !dryRun {
+		s.record(ctx, LedgerEntry{Action: actionBlackedOut, Region: req.Region, Slots: req.Slots, Plan: req.Plan.String(), Requester: req.Requester, Caller: req.Caller, Reason: req.Reason, Ticket: req.Ticket, Error: err.Error()})
+	}
+	return err
+}
+
+// blackoutReason is the ledger reason of an action taken during b.
+func blackoutReason(reason string, b *blackout) string {
+	if reason == "" {
+		return "during " + b.Name
+	}
+	return reason + ", during " + b.Name
+}
+
+// isBlackoutAdmin reports whether the caller of r may override blackouts:
+// one of BLACKOUT_ADMINS authenticated by authorize, with an API key, an ID
+// token or an IAP signed header. Callers that weren't verified never may.
+func isBlackoutAdmin(r *http.Request) bool {
+	p := principalOf(r.Context())
+	return p != nil && live().BlackoutAdmins[p.Name]
+}
+
+// QueuedRequest is the response to an add_capacity request held until a
+// blackout ends.
+type QueuedRequest struct {
+	Blackout string    `json:"blackout"`
+	RunAt    time.Time `json:"run_at"`
+	Task     string    `json:"task"`
+}
+
+// queueAddCapacity holds p until the blackout b ends at until, by sending it
+// to the v1 capacity route again from a task, and returns the request queued.
+// It reports false, having written nothing, if b doesn't queue requests or p
+// would be meaningless by then, and a nil request if queueing failed.
+func (s *Server) queueAddCapacity(w http.ResponseWriter, r *http.Request, p Payload, b *blackout, until time.Time) (*QueuedRequest, bool) {
+	if !b.Queue {
+		return nil, false
+	}
+	if p.Until != "" {
+		if at, err := time.Parse(time.RFC3339, p.Until); err == nil && !at.After(until) {
+			return nil, false
+		}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		return nil, true
+	}
+	// Replayed by the task, the request would be recorded as the task's.
+	who, caller := p.who(r)
+	p.Requester = who
+	// The key of p is held by this request, the task has its own so that it
+	// buys once however often it is sent.
+	p.RequestID = "queued/" + id
+	url := taskURL(r, v1Prefix+capacityPath)
+	audience := taskAudience
+	if audience == "" {
+		audience = url
+	}
+	task, err := s.queue.CreateHTTP(r.Context(), s.queue.TaskName("queued-"+id), url, audience, p, until)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "queueing request until %s ends: %v", b.Name, err)
+		logging.Error(r.Context(), "queueing request until %s ends: %v", b.Name, err)
+		return nil, true
+	}
+	logging.Info(r.Context(), "request queued until %s ends at %s", b.Name, until.Format(time.RFC3339))
+	s.record(r.Context(), LedgerEntry{Action: actionBlackoutQueued, Region: p.Region, Slots: p.ExtraSlot, Requester: who, Caller: caller, Reason: blackoutReason(p.Reason, b), Ticket: p.Ticket})
+	queued := &QueuedRequest{Blackout: b.Name, RunAt: until, Task: task.Name}
+	writeJSON(w, http.StatusAccepted, queued)
+	return queued, true
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// budget bounds the spend on the capacity bought by the service over a day
+// or a month (UTC), in USD or slot hours, in Region or in every region.
+type budget struct {
+	Period string  `json:"period"` // daily or monthly
+	Unit   string  `json:"unit"`   // usd or slot_hours
+	Region string  `json:"region,omitempty"`
+	Hard   float64 `json:"hard,omitempty"` // purchases going over it are rejected
+	Soft   float64 `json:"soft,omitempty"` // going over it is recorded as a warning
+}
+
+func (b budget) String() string {
+	s := b.Period + " " + b.Unit + " budget"
+	if b.Region != "" {
+		s += " of " + b.Region
+	}
+	return s
+}
+
+// period returns the day or month now is in.
+func (b budget) period(now time.Time) (from, to time.Time) {
+	now = now.UTC()
+	if b.Period == "monthly" {
+		from = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return from, from.AddDate(0, 1, 0)
+	}
+	from = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return from, from.AddDate(0, 0, 1)
+}
+
+// spent reads the spend of report the budget is about.
+func (b budget) spent(report *CostReport) float64 {
+	if b.Region != "" {
+		rc, ok := report.ByRegion[b.Region]
+		if !ok {
+			return 0
+		}
+		if b.Unit == "usd" {
+			return rc.EstimatedCost
+		}
+		return rc.SlotHours
+	}
+	if b.Unit == "usd" {
+		return report.EstimatedCost
+	}
+	return report.SlotHours
+}
+
+// parseBudgets parses BUDGETS_JSON, e.g.
+// [{"period":"daily","unit":"usd","hard":500,"soft":400}].
+func parseBudgets(v string) ([]budget, error) {
+	var list []budget
+	if err := json.Unmarshal([]byte(v), &list); err != nil {
+		return nil, err
+	}
+	for i, b := range list {
+		if b.Period != "daily" && b.Period != "monthly" {
+			return nil, fmt.Errorf("budget %d: period must be daily or monthly", i)
+		}
+		if b.Unit != "usd" && b.Unit != "slot_hours" {
+			return nil, fmt.Errorf("budget %d: unit must be usd or slot_hours", i)
+		}
+		if b.Hard < 0 || b.Soft < 0 || b.Hard == 0 && b.Soft == 0 {
+			return nil, fmt.Errorf("budget %d: set a positive hard or soft cap", i)
+		}
+		if b.Hard > 0 && b.Soft > b.Hard {
+			return nil, fmt.Errorf("budget %d: soft cap can not be above the hard cap", i)
+		}
+	}
+	return list, nil
+}
+
+// budgetExceededError is returned when a purchase would go over a hard cap.
+type budgetExceededError struct {
+	Budget budget
+	Spent  float64
+	Cost   float64
+}
+
+func (e *budgetExceededError) Error() string {
+	return fmt.Sprintf("%s exceeded: %.2f committed, the purchase adds %.2f, hard cap is %.2f", e.Budget, e.Spent, e.Cost, e.Budget.Hard)
+}
+
+// checkBudgets rejects req with a budgetExceededError if it would take the
+// spend of a period over a hard cap, and records a warning when it takes it
+// over a soft cap. Spend counts what the commitments held in the period cost
+// until their scheduled deletion, and req is counted at its full size.
+func (s *Server) checkBudgets(ctx context.Context, req purchaseRequest) error {
+	l := live()
+	if len(l.Budgets) == 0 {
+		return nil
+	}
+
+	// A dry run only reports what it would do.
+	record := s.record
+	if req.DryRun || dryRun {
+		record = func(context.Context, LedgerEntry) {}
+	}
+
+	now := time.Now()
+	earliest := now
+	for _, b := range l.Budgets {
+		if from, _ := b.period(now); from.Before(earliest) {
+			earliest = from
+		}
+	}
+	entries, err := s.store.ListEvents(ctx, earliest.Add(-time.Duration(l.MaxMinutes)*time.Minute))
+	if err != nil {
+		return fmt.Errorf("reading ledger for budgets: %v", err)
+	}
+
+	for _, b := range l.Budgets {
+		if b.Region != "" && b.Region != req.Region {
+			continue
+		}
+		from, to := b.period(now)
+		spent := b.spent(costReport(entries, from, to, true))
+
+		until := to
+		if !req.DeleteAt.IsZero() && req.DeleteAt.Before(to) {
+			until = req.DeleteAt
+		}
+		cost := float64(req.Slots) * until.Sub(now).Hours()
+		if b.Unit == "usd" {
+			price, ok := slotHourPrice(req.Region, req.Plan.String())
+			if !ok {
+				continue
+			}
+			cost *= price
+		}
+
+		if b.Hard > 0 && spent+cost > b.Hard {
+			logging.Warning(ctx, "purchase rejected, %s would be exceeded", b)
+			record(ctx, LedgerEntry{Action: actionBudgetExceeded, Region: req.Region, Slots: req.Slots, Plan: req.Plan.String(), Requester: req.Requester, Caller: req.Caller, Reason: req.Reason, Ticket: req.Ticket, Error: fmt.Sprintf("%s: %.2f + %.2f over %.2f", b, spent, cost, b.Hard)})
+			return &budgetExceededError{Budget: b, Spent: spent, Cost: cost}
+		}
+		if b.Soft > 0 && spent < b.Soft && spent+cost >= b.Soft {
+			logging.Warning(ctx, "%s soft cap of %.2f crossed: %.2f committed", b, b.Soft, spent+cost)
+			record(ctx, LedgerEntry{Action: actionBudgetWarning, Region: req.Region, Slots: req.Slots, Plan: req.Plan.String(), Requester: req.Requester, Caller: req.Caller, Ticket: req.Ticket, Reason: fmt.Sprintf("%s soft cap of %.2f crossed: %.2f committed", b, b.Soft, spent+cost)})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// requesterBudgetStop is the requester of the deletions of an emergency
+// scale-down.
+const requesterBudgetStop = "budget_stop"
+
+// budgetStopPolicy is BUDGET_STOP_JSON, what is done when a Cloud Billing
+// budget notification reports the cost over a threshold, e.g.
+// {"budgets":["bigquery-slots"],"threshold":1,"floor":{"US":100}}.
+type budgetStopPolicy struct {
+	// Budgets are the IDs or display names of the budgets acted on, every
+	// budget notified about when empty.
+	Budgets []string `json:"budgets,omitempty"`
+	// Threshold is the fraction of the budget amount the cost must reach,
+	// 1 by default.
+	Threshold float64 `json:"threshold"`
+	// Floor are the slots of the FLEX commitments bought by the service
+	// kept per region, none by default.
+	Floor map[string]int64 `json:"floor,omitempty"`
+}
+
+// parseBudgetStop parses BUDGET_STOP_JSON.
+func parseBudgetStop(v string) (*budgetStopPolicy, error) {
+	var p budgetStopPolicy
+	if err := json.Unmarshal([]byte(v), &p); err != nil {
+		return nil, err
+	}
+	if p.Threshold == 0 {
+		p.Threshold = 1
+	}
+	if p.Threshold < 0 {
+		return nil, fmt.Errorf("threshold must be positive")
+	}
+	for region, slots := range p.Floor {
+		if slots < 0 || slots%slotIncrement != 0 {
+			return nil, fmt.Errorf("floor of %s must be a multiple of %d, zero or more", region, slotIncrement)
+		}
+	}
+	return &p, nil
+}
+
+// watches reports whether the policy acts on the budget of id or name.
+func (p *budgetStopPolicy) watches(id, name string) bool {
+	if len(p.Budgets) == 0 {
+		return true
+	}
+	for _, b := range p.Budgets {
+		if b == id || b == name {
+			return true
+		}
+	}
+	return false
+}
+
+// BudgetNotification is the data of a Cloud Billing budget notification,
+// see https://cloud.google.com/billing/docs/how-to/budgets-programmatic-notifications.
+type BudgetNotification struct {
+	BudgetDisplayName      string   `json:"budgetDisplayName"`
+	AlertThresholdExceeded *float64 `json:"alertThresholdExceeded,omitempty"`
+	CostAmount             float64  `json:"costAmount"`
+	CostIntervalStart      string   `json:"costIntervalStart"`
+	BudgetAmount           float64  `json:"budgetAmount"`
+	BudgetAmountType       string   `json:"budgetAmountType"`
+	CurrencyCode           string   `json:"currencyCode"`
+}
+
+// Freeze refuses every purchase until an admin lifts it.
+type Freeze struct {
+	Since  time.Time `firestore:"since" json:"since"`
+	Reason string    `firestore:"reason" json:"reason"`
+	// Budget is the ID of the budget that was exceeded.
+	Budget string `firestore:"budget" json:"budget,omitempty"`
+	// Interval is the costIntervalStart of the notification, the start of
+	// the billing interval the budget was exceeded in.
+	Interval string `firestore:"interval" json:"interval,omitempty"`
+	// LiftedAt and LiftedBy tell when and by whom the freeze was lifted.
+	// Notifications of Budget in the same Interval are ignored since.
+	LiftedAt *time.Time `firestore:"lifted_at" json:"lifted_at,omitempty"`
+	LiftedBy string     `firestore:"lifted_by" json:"lifted_by,omitempty"`
+}
+
+// liftKey identifies the budget and billing interval of f, which are not
+// frozen again once f is lifted.
+func (f *Freeze) liftKey() string {
+	return f.Budget + "/" + f.Interval
+}
+
+// frozenError is returned for purchases while a Freeze is in force.
+type frozenError struct {
+	Freeze *Freeze
+}
+
+func (e *frozenError) Error() string {
+	return fmt.Sprintf("purchases are frozen since %s: %s", e.Freeze.Since.Format(time.RFC3339), e.Freeze.Reason)
+}
+
+// checkFreeze rejects req with a frozenError while purchases are frozen.
+func (s *Server) checkFreeze(ctx context.Context, req purchaseRequest) error {
+	f, err := s.store.GetFreeze(ctx)
+	if err != nil {
+		return fmt.Errorf("reading freeze: %v", err)
+	}
+	if f == nil {
+		return nil
+	}
+	err = &frozenError{Freeze: f}
+	if !req.DryRun && !dryRun {
+		s.record(ctx, LedgerEntry{Action: actionFrozenOut, Region: req.Region, Slots: req.Slots, Plan: req.Plan.String(), Requester: req.Requester, Caller: req.Caller, Reason: req.Reason, Ticket: req.Ticket, Error: err.Error()})
+	}
+	return err
+}
+
+// BudgetStopResult is what an emergency scale-down did.
+type BudgetStopResult struct {
+	Freeze *Freeze `json:"freeze"`
+	// Released are the slots deleted, down to the floor of each region.
+	Released []ReleasedSlots `json:"released"`
+}
+
+// budgetPushHandler acts on the Cloud Billing budget notifications pushed by
+// a Pub/Sub subscription to the budget's topic. Once the cost of a budget of
+// BUDGET_STOP_JSON reaches its threshold, purchases are frozen and the FLEX
+// commitments bought by the service deleted down to the floor. Notifications
+// under the threshold, of other budgets or without BUDGET_STOP_JSON are
+// acknowledged without action. Notifications that can't be verified, with
+// neither PUBSUB_SERVICE_ACCOUNT nor PUBSUB_VERIFICATION_TOKEN, are refused.
+func (s *Server) budgetPushHandler(w http.ResponseWriter, r *http.Request) {
+	if err := verifyPushRequest(r, billingPushPath); err != nil {
+		logging.Warning(r.Context(), "rejected %s request: %v", r.URL.Path, err)
+		writeError(w, http.StatusUnauthorized, codeUnauthenticated, "unauthorized")
+		return
+	}
+
+	var env PushEnvelope
+	if err := json.NewDecoder(r.Body).Decode(&env); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	var n BudgetNotification
+	if err := json.Unmarshal(env.Message.Data, &n); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "decoding message %s: %v", env.Message.MessageID, err)
+		return
+	}
+	budgetID := env.Message.Attributes["budgetId"]
+	r = r.WithContext(logging.WithFields(r.Context(), "pubsub_message", env.Message.MessageID, "budget", budgetID))
+
+	policy := budgetStop
+	if policy == nil || !policy.watches(budgetID, n.BudgetDisplayName) {
+		writeJSON(w, http.StatusOK, "ignored")
+		return
+	}
+	if n.BudgetAmount <= 0 || n.CostAmount < policy.Threshold*n.BudgetAmount {
+		logging.Info(r.Context(), "budget %q at %.2f of %.2f %s", n.BudgetDisplayName, n.CostAmount, n.BudgetAmount, n.CurrencyCode)
+		writeJSON(w, http.StatusOK, "under threshold")
+		return
+	}
+
+	// The cost notified is that of the interval so far, so it stays over
+	// the threshold until the next interval.
+	lifted, err := s.store.FreezeLifted(r.Context(), budgetID, n.CostIntervalStart)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "reading lifted freezes: %v", err)
+		logging.Error(r.Context(), "reading lifted freezes: %v", err)
+		return
+	}
+	if lifted {
+		logging.Info(r.Context(), "budget %q at %.2f of %.2f %s, its freeze since %s was lifted", n.BudgetDisplayName, n.CostAmount, n.BudgetAmount, n.CurrencyCode, n.CostIntervalStart)
+		writeJSON(w, http.StatusOK, "freeze lifted for this interval")
+		return
+	}
+
+	reason := fmt.Sprintf("budget %q exceeded: %.2f of %.2f %s since %s", n.BudgetDisplayName, n.CostAmount, n.BudgetAmount, n.CurrencyCode, n.CostIntervalStart)
+	res, err := s.emergencyScaleDown(r.Context(), policy, &Freeze{Since: time.Now(), Reason: reason, Budget: budgetID, Interval: n.CostIntervalStart})
+	if err != nil {
+		// Pub/Sub redelivers the notification, and the next ones of the
+		// budget try again.
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// emergencyScaleDown freezes purchases with f, unless they already are, and
+// deletes the FLEX commitments bought by the service down to the floor of
+// policy.
+// Budgets are notified about several times a day, so it is run again until
+// the freeze is lifted, catching commitments that couldn't be deleted yet.
+func (s *Server) emergencyScaleDown(ctx context.Context, policy *budgetStopPolicy, f *Freeze) (*BudgetStopResult, error) {
+	created, err := s.store.CreateFreeze(ctx, f)
+	if err != nil {
+		return nil, fmt.Errorf("freezing purchases: %v", err)
+	}
+	if created {
+		logging.Warning(ctx, "freezing purchases: %s", f.Reason)
+		s.record(ctx, LedgerEntry{Action: actionFreezeStarted, Requester: requesterBudgetStop, Reason: f.Reason})
+	} else if f, err = s.store.GetFreeze(ctx); err != nil {
+		return nil, fmt.Errorf("reading freeze: %v", err)
+	}
+	res := &BudgetStopResult{Freeze: f, Released: []ReleasedSlots{}}
+
+	recs, err := s.store.ListCommitments(ctx)
+	if err != nil {
+		return res, fmt.Errorf("listing recorded commitments: %v", err)
+	}
+	owned := make(map[string]int64)
+	for _, rec := range recs {
+		if resourceProject(rec.Name) == projectID && rec.Plan == reservationpb.CapacityCommitment_FLEX.String() {
+			owned[rec.Region] += rec.SlotCount
+		}
+	}
+	regions := make([]string, 0, len(owned))
+	for region := range owned {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	for _, region := range regions {
+		excess := owned[region] - policy.Floor[region]
+		if excess < slotIncrement {
+			continue
+		}
+		logging.Warning(ctx, "releasing %d of the %d FLEX slots bought in %s", excess, owned[region], region)
+		released, err := s.releaseOwned(ctx, projectID, region, excess, requesterBudgetStop)
+		res.Released = append(res.Released, released...)
+		if err != nil {
+			return res, fmt.Errorf("releasing slots in %s: %v", region, err)
+		}
+	}
+	return res, nil
+}
+
+// getFreezeHandler answers the freeze in force, a 404 if purchases are not
+// frozen.
+func (s *Server) getFreezeHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := s.store.GetFreeze(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "reading freeze: %v", err)
+		return
+	}
+	if f == nil {
+		writeError(w, http.StatusNotFound, codeNotFound, "purchases are not frozen")
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+// liftFreezeHandler lets purchases through again, answering the freeze
+// lifted. Its budget is not frozen again in the same billing interval.
+func (s *Server) liftFreezeHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := s.store.LiftFreeze(r.Context(), requester(r), time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "lifting freeze: %v", err)
+		return
+	}
+	if f == nil {
+		writeError(w, http.StatusNotFound, codeNotFound, "purchases are not frozen")
+		return
+	}
+	logging.Warning(r.Context(), "purchases unfrozen by %s", requester(r))
+	s.record(r.Context(), LedgerEntry{Action: actionFreezeLifted, Requester: requester(r), Reason: f.Reason})
+	writeJSON(w, http.StatusOK, f)
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/tasks"
+)
+
+// burstTeardownGrace is how long after the teardown a burst commitment's own
+// delete task fires, in case the teardown task never completes. The
+// commitment can only go once the reservation stops using its slots.
+const burstTeardownGrace = 15 * time.Minute
+
+// BurstRequest buys FLEX slots for Minutes, puts them in the reservation
+// Reservation, creating it if needed, and assigns Projects to it.
+type BurstRequest struct {
+	Region      string   `json:"region"`
+	Slots       int64    `json:"slots"`
+	Minutes     int64    `json:"minutes"`
+	Reservation string   `json:"reservation"` // reservation ID
+	Projects    []string `json:"projects"`    // project IDs or projects/{id}
+	JobType     string   `json:"job_type"`    // QUERY (default), PIPELINE or ML_EXTERNAL
+	DryRun      bool     `json:"dry_run,omitempty"`
+	// IgnoreIdleSlots, if set, is the ignore_idle_slots of the reservation
+	// until the teardown.
+	IgnoreIdleSlots *bool `json:"ignore_idle_slots,omitempty"`
+	RequestMetadata
+}
+
+// BurstResponse describes what burstHandler set up and when it is undone.
+type BurstResponse struct {
+	Commitment         *AddCapacityResponse `json:"commitment"`
+	Reservation        ReservationInfo      `json:"reservation"`
+	CreatedReservation bool                 `json:"created_reservation"`
+	Assignments        []AssignmentInfo     `json:"assignments"`
+	TeardownAt         time.Time            `json:"teardown_at"`
+	TeardownTask       string               `json:"teardown_task,omitempty"`
+	Errors             []string             `json:"errors,omitempty"`
+}
+
+// BurstTeardown is the body of a teardown task, what a burst has to undo.
+type BurstTeardown struct {
+	Commitment         string   `json:"commitment"`
+	Reservation        string   `json:"reservation"`
+	Slots              int64    `json:"slots"`
+	CreatedReservation bool     `json:"created_reservation"`
+	Assignments        []string `json:"assignments"`
+	// RestoreIgnoreIdleSlots is the ignore_idle_slots the burst changed,
+	// put back by the teardown.
+	RestoreIgnoreIdleSlots *bool `json:"restore_ignore_idle_slots,omitempty"`
+	// RequestID is the X-Request-ID of the burst, the teardown is logged and
+	// recorded under it.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (s *Server) burstHandler(w http.ResponseWriter, r *http.Request) {
+	var req BurstRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	var v validator
+	v.region("region", &req.Region)
+	v.slots("slots", req.Slots)
+	v.minutes("minutes", &req.Minutes)
+	v.check(req.Reservation != "", "reservation", "required")
+	req.RequestMetadata.validate(&v)
+	jobType, err := parseJobType(req.JobType)
+	v.check(err == nil, "job_type", "%v", err)
+	assignees := make([]string, 0, len(req.Projects))
+	for i, p := range req.Projects {
+		if !strings.HasPrefix(p, "projects/") {
+			p = "projects/" + p
+		}
+		if v.check(validAssignee(p), fmt.Sprintf("projects[%d]", i), "invalid project %q", p) {
+			assignees = append(assignees, p)
+		}
+	}
+	if err := v.err(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	r = r.WithContext(logging.WithFields(r.Context(), "region", req.Region, "slots_requested", req.Slots, "reservation", req.Reservation))
+
+	teardownAt := time.Now().Add(time.Duration(req.Minutes) * time.Minute)
+	who, caller := req.who(r)
+	commit, err := s.purchase(r.Context(), purchaseRequest{
+		Region:    req.Region,
+		Slots:     req.Slots,
+		Plan:      reservationpb.CapacityCommitment_FLEX,
+		DeleteAt:  teardownAt.Add(burstTeardownGrace),
+		DeleteURL: deleteURL(r),
+		Audience:  deleteAudience(r),
+		Requester: who,
+		Caller:    caller,
+		Reason:    req.Reason,
+		Ticket:    req.Ticket,
+		DryRun:    req.DryRun,
+	})
+	if err != nil {
+		writePurchaseError(w, err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+
+	resp := &BurstResponse{Commitment: commit, Assignments: []AssignmentInfo{}, TeardownAt: teardownAt}
+	if commit.DryRun {
+		logging.Info(r.Context(), "dry run: would add %d slots to reservation %s and assign %v", commit.SlotsPurchased, req.Reservation, assignees)
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	teardown := BurstTeardown{Commitment: commit.CommitName, Reservation: reservationName(req.Region, req.Reservation), RequestID: requestIDOf(r.Context())}
+
+	// From here on every step is undone by the teardown task, so it is
+	// scheduled whatever fails.
+	res, created, err := s.growReservation(r.Context(), req.Region, req.Reservation, commit.SlotsPurchased)
+	if err != nil {
+		resp.Errors = append(resp.Errors, fmt.Sprintf("adding %d slots to reservation %s: %v", commit.SlotsPurchased, teardown.Reservation, err))
+	} else {
+		reportProgress(r.Context(), "added %d slots to reservation %s", commit.SlotsPurchased, res.Name)
+		teardown.Slots = commit.SlotsPurchased
+		teardown.CreatedReservation = created
+		if req.IgnoreIdleSlots != nil && *req.IgnoreIdleSlots != res.IgnoreIdleSlots {
+			old := res.IgnoreIdleSlots
+			if updated, err := s.setIgnoreIdleSlots(r.Context(), res.Name, *req.IgnoreIdleSlots); err != nil {
+				resp.Errors = append(resp.Errors, fmt.Sprintf("setting ignore_idle_slots of %s: %v", res.Name, err))
+			} else {
+				res = updated
+				teardown.RestoreIgnoreIdleSlots = &old
+			}
+		}
+		resp.Reservation = reservationInfo(res)
+		resp.CreatedReservation = created
+
+		for _, assignee := range assignees {
+			a, err := s.createAssignment(r.Context(), res.Name, assignee, jobType)
+			if err != nil {
+				resp.Errors = append(resp.Errors, fmt.Sprintf("assigning %s to %s: %v", assignee, res.Name, err))
+				continue
+			}
+			teardown.Assignments = append(teardown.Assignments, a.Name)
+			resp.Assignments = append(resp.Assignments, assignmentInfo(res.Name, a))
+		}
+	}
+
+	taskName := s.queue.TaskName("teardown-" + tasks.DeleteTaskID(commit.CommitName))
+	task, err := s.queue.CreateHTTP(r.Context(), taskName, taskURL(r, burstPath+"/teardown"), deleteAudience(r), teardown, teardownAt)
+	if err != nil {
+		// The commitment still has its own delete task, only the reservation
+		// and assignments are left behind.
+		resp.Errors = append(resp.Errors, fmt.Sprintf("scheduling teardown: %v", err))
+		logging.Error(r.Context(), "scheduling burst teardown of %s: %v", commit.CommitName, err)
+		writeJSON(w, http.StatusInternalServerError, resp)
+		return
+	}
+	resp.TeardownTask = task.Name
+	reportProgress(r.Context(), "teardown scheduled at %s", teardownAt.Format(time.RFC3339))
+	logging.Info(r.Context(), "burst of %d slots in %s until %s", commit.SlotsPurchased, teardown.Reservation, teardownAt.Format(time.RFC3339))
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// burstTeardownHandler undoes a burst: it removes the assignments, restores
+// the ignore_idle_slots of the reservation if the burst changed it, takes the
+// slots back out of the reservation, deleting it if the burst created it and
+// nothing else uses it, and deletes the commitment. Every step tolerates
+// having been done before, so Cloud Tasks can retry on failure.
+func (s *Server) burstTeardownHandler(w http.ResponseWriter, r *http.Request) {
+	var t BurstTeardown
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+	r = r.WithContext(logging.WithFields(withRequest(r.Context(), t.RequestID), "commit", t.Commitment, "reservation", t.Reservation))
+
+	if err := s.teardownBurst(r.Context(), t); err != nil {
+		var tooSoon *capacity.DeleteTooSoonError
+		if errors.As(err, &tooSoon) {
+			// Cloud Tasks retries on 503, tell it when it's worth it.
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(time.Until(tooSoon.RetryAt).Seconds())), 10))
+			writeError(w, http.StatusServiceUnavailable, codeDeleteTooSoon, "%v", err)
+		} else {
+			writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		}
+		logging.Error(r.Context(), "tearing down burst: %v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, "burst torn down")
+}
+
+func (s *Server) teardownBurst(ctx context.Context, t BurstTeardown) error {
+	for _, name := range t.Assignments {
+		if err := s.deleteAssignment(ctx, name); err != nil && status.Code(err) != codes.NotFound {
+			return fmt.Errorf("deleting assignment %s: %v", name, err)
+		}
+		logging.Info(ctx, "assignment %s deleted", name)
+	}
+
+	if t.RestoreIgnoreIdleSlots != nil {
+		_, err := s.setIgnoreIdleSlots(ctx, t.Reservation, *t.RestoreIgnoreIdleSlots)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return fmt.Errorf("restoring ignore_idle_slots of %s: %v", t.Reservation, err)
+		}
+		logging.Info(ctx, "ignore_idle_slots of %s restored to %t", t.Reservation, *t.RestoreIgnoreIdleSlots)
+	}
+
+	if t.Slots > 0 {
+		if err := s.shrinkReservation(ctx, t); err != nil {
+			return fmt.Errorf("removing %d slots from reservation %s: %v", t.Slots, t.Reservation, err)
+		}
+	}
+
+	err := s.deleteCapacity(ctx, t.Commitment)
+	switch code := status.Code(err); {
+	case err == nil:
+		s.record(ctx, LedgerEntry{Action: actionDeleted, Commitment: t.Commitment, Slots: t.Slots, Requester: requesterBurst})
+	case code == codes.NotFound:
+		if err := s.store.ForgetCommitment(ctx, t.Commitment); err != nil {
+			logging.Error(ctx, "forgetting commitment %s: %v", t.Commitment, err)
+		}
+	default:
+		s.record(ctx, LedgerEntry{Action: actionDeleteFailed, Commitment: t.Commitment, Requester: requesterBurst, Error: err.Error()})
+		return fmt.Errorf("deleting commitment %s: %w", t.Commitment, err)
+	}
+	s.dropDeleteTask(ctx, t.Commitment)
+	return nil
+}
+
+// growReservation adds slots to the reservation id of region, creating it if
+// it doesn't exist.
+func (s *Server) growReservation(ctx context.Context, region, id string, slots int64) (res *reservationpb.Reservation, created bool, err error) {
+	name := reservationName(region, id)
+	unlock, err := s.store.Lock(ctx, "reservation/"+name, purchaseLockTTL)
+	if err != nil {
+		return nil, false, fmt.Errorf("waiting for reservation lock: %v", err)
+	}
+	defer unlock()
+
+	err = retryPolicy.Do(ctx, "GetReservation", func(ctx context.Context) (err error) {
+		res, err = s.reservationsFor(name).GetReservation(ctx, &reservationpb.GetReservationRequest{Name: name})
+		return err
+	})
+	if status.Code(err) == codes.NotFound {
+		// A reservation ID can only be taken once, so creation isn't retried.
+		res, err = s.reservationsFor(name).CreateReservation(ctx, &reservationpb.CreateReservationRequest{
+			Parent:        fmt.Sprintf("projects/%s/locations/%s", projectID, region),
+			ReservationId: id,
+			Reservation:   &reservationpb.Reservation{SlotCapacity: slots},
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		logging.Info(ctx, "reservation %s created with %d slots", res.Name, res.SlotCapacity)
+		return res, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	res, err = s.updateReservation(ctx, &reservationpb.Reservation{Name: name, SlotCapacity: res.SlotCapacity + slots}, &fieldmaskpb.FieldMask{Paths: []string{"slot_capacity"}})
+	if err != nil {
+		return nil, false, err
+	}
+	logging.Info(ctx, "reservation %s grown to %d slots", res.Name, res.SlotCapacity)
+	return res, false, nil
+}
+
+// shrinkReservation takes the slots of a burst back out of its reservation,
+// once even if the teardown is retried, and deletes the reservation when the
+// burst created it and it is left empty.
+func (s *Server) shrinkReservation(ctx context.Context, t BurstTeardown) error {
+	unlock, err := s.store.Lock(ctx, "reservation/"+t.Reservation, purchaseLockTTL)
+	if err != nil {
+		return fmt.Errorf("waiting for reservation lock: %v", err)
+	}
+	defer unlock()
+
+	var res *reservationpb.Reservation
+	err = retryPolicy.Do(ctx, "GetReservation", func(ctx context.Context) (err error) {
+		res, err = s.reservationsFor(t.Reservation).GetReservation(ctx, &reservationpb.GetReservationRequest{Name: t.Reservation})
+		return err
+	})
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	key := "burst/" + hashKey(t.Commitment)
+	if _, fresh, err := s.store.ReserveIdempotencyKey(ctx, key, "", idempotencyTTL); err != nil {
+		return err
+	} else if fresh {
+		capacity := res.SlotCapacity - t.Slots
+		if capacity < 0 {
+			capacity = 0
+		}
+		if res, err = s.updateReservation(ctx, &reservationpb.Reservation{Name: t.Reservation, SlotCapacity: capacity}, &fieldmaskpb.FieldMask{Paths: []string{"slot_capacity"}}); err != nil {
+			if err := s.store.ReleaseIdempotencyKey(ctx, key); err != nil {
+				logging.Error(ctx, "releasing key of reservation shrink: %v", err)
+			}
+			return err
+		}
+		logging.Info(ctx, "reservation %s shrunk to %d slots", res.Name, res.SlotCapacity)
+	}
+
+	if !t.CreatedReservation || res.SlotCapacity > 0 {
+		return nil
+	}
+	assignments, err := s.listAssignments(ctx, t.Reservation)
+	if err != nil {
+		return err
+	}
+	if len(assignments) > 0 {
+		logging.Info(ctx, "keeping empty reservation %s, it has %d other assignments", t.Reservation, len(assignments))
+		return nil
+	}
+	err = retryPolicy.Do(ctx, "DeleteReservation", func(ctx context.Context) error {
+		return s.reservationsFor(t.Reservation).DeleteReservation(ctx, &reservationpb.DeleteReservationRequest{Name: t.Reservation})
+	})
+	if err != nil && status.Code(err) != codes.NotFound {
+		return err
+	}
+	logging.Info(ctx, "reservation %s deleted", t.Reservation)
+	return nil
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/capacity"
+)
+
+// parseCapacityFilter reads the filter from CAP_PLANS, CAP_STATES (default
+// ACTIVE,PENDING, failed commitments hold no slots) and CAP_OWNED_ONLY.
+func parseCapacityFilter() (capacity.Filter, error) {
+	f := capacity.Filter{
+		States: map[reservationpb.CapacityCommitment_State]bool{
+			reservationpb.CapacityCommitment_ACTIVE:  true,
+			reservationpb.CapacityCommitment_PENDING: true,
+		},
+	}
+
+	if v := getenv("CAP_PLANS"); v != "" {
+		f.Plans = make(map[reservationpb.CapacityCommitment_CommitmentPlan]bool)
+		for _, name := range strings.Split(v, ",") {
+			plan := reservationpb.CapacityCommitment_CommitmentPlan(reservationpb.CapacityCommitment_CommitmentPlan_value[strings.ToUpper(strings.TrimSpace(name))])
+			if plan == reservationpb.CapacityCommitment_COMMITMENT_PLAN_UNSPECIFIED {
+				return f, fmt.Errorf("CAP_PLANS: unknown plan %q", name)
+			}
+			f.Plans[plan] = true
+		}
+	}
+	if v := getenv("CAP_STATES"); v != "" {
+		f.States = make(map[reservationpb.CapacityCommitment_State]bool)
+		for _, name := range strings.Split(v, ",") {
+			state := reservationpb.CapacityCommitment_State(reservationpb.CapacityCommitment_State_value[strings.ToUpper(strings.TrimSpace(name))])
+			if state == reservationpb.CapacityCommitment_STATE_UNSPECIFIED {
+				return f, fmt.Errorf("CAP_STATES: unknown state %q, want ACTIVE, PENDING or FAILED", name)
+			}
+			f.States[state] = true
+		}
+	}
+	if v := getenv("CAP_OWNED_ONLY"); v != "" {
+		var err error
+		if f.OwnedOnly, err = strconv.ParseBool(v); err != nil {
+			return f, fmt.Errorf("cannot parse CAP_OWNED_ONLY: %v", err)
+		}
+	}
+	return f, nil
+}
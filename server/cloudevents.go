@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// CloudEvents media types, see
+// https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/formats/json-format.md.
+const (
+	cloudEventsJSON      = "application/cloudevents+json"
+	cloudEventsBatchJSON = "application/cloudevents-batch+json"
+	// messagePublishedType is the type of the events Eventarc sends for
+	// Pub/Sub messages, whose data is a PushEnvelope.
+	messagePublishedType = "google.cloud.pubsub.topic.v1.messagePublished"
+)
+
+// CloudEvent is a CloudEvents 1.0 event, as sent in structured mode. In
+// binary mode its attributes are ce- headers and its data the body.
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      []byte          `json:"data_base64,omitempty"`
+}
+
+var errBatchedEvents = errors.New("batched CloudEvents are not supported, send one event per request")
+
+// readCloudEvent reads the CloudEvent of r, in structured mode when r has
+// the CloudEvents JSON content type and in binary mode when it has a
+// ce-specversion header. It returns nil if r is not a CloudEvent.
+func readCloudEvent(r *http.Request) (*CloudEvent, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var e CloudEvent
+	switch {
+	case mediaType == cloudEventsBatchJSON:
+		return nil, errBatchedEvents
+	case mediaType == cloudEventsJSON:
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			return nil, err
+		}
+		if len(e.DataBase64) > 0 {
+			e.Data = e.DataBase64
+		}
+	case r.Header.Get("ce-specversion") != "":
+		e = CloudEvent{
+			SpecVersion:     r.Header.Get("ce-specversion"),
+			ID:              r.Header.Get("ce-id"),
+			Source:          r.Header.Get("ce-source"),
+			Type:            r.Header.Get("ce-type"),
+			Subject:         r.Header.Get("ce-subject"),
+			Time:            r.Header.Get("ce-time"),
+			DataContentType: r.Header.Get("Content-Type"),
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		e.Data = data
+	default:
+		return nil, nil
+	}
+	if e.SpecVersion != "1.0" {
+		return nil, fmt.Errorf("unsupported CloudEvents specversion %q", e.SpecVersion)
+	}
+	if e.ID == "" || e.Source == "" || e.Type == "" {
+		return nil, fmt.Errorf("CloudEvent needs id, source and type")
+	}
+	return &e, nil
+}
+
+// payload decodes the Payload of the data of e, unwrapping the message of
+// Pub/Sub events. Without a request_id of its own it is deduplicated on the
+// Pub/Sub message ID, or the source and ID of e.
+func (e *CloudEvent) payload() (Payload, error) {
+	var p Payload
+	data := e.Data
+	if e.Type == messagePublishedType {
+		var env PushEnvelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			return p, fmt.Errorf("decoding event %s: %v", e.ID, err)
+		}
+		data = env.Message.Data
+		if env.Message.MessageID != "" {
+			p.RequestID = "pubsub/" + env.Message.MessageID
+		}
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, fmt.Errorf("decoding data of event %s: %v", e.ID, err)
+	}
+	if p.RequestID == "" {
+		p.RequestID = e.key()
+	}
+	return p, nil
+}
+
+// key identifies e: the source and ID of an event are unique.
+func (e *CloudEvent) key() string {
+	return "cloudevent/" + e.Source + "/" + e.ID
+}
+
+// decodePayload decodes the Payload of r, sent as plain JSON or as the data
+// of a CloudEvent in either mode. It answers the error and returns false if
+// it can't.
+func decodePayload(w http.ResponseWriter, r *http.Request) (Payload, bool) {
+	defer r.Body.Close()
+	var p Payload
+	e, err := readCloudEvent(r)
+	switch {
+	case err == errBatchedEvents:
+		writeError(w, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "%v", err)
+		return p, false
+	case err != nil:
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return p, false
+	case e != nil:
+		if p, err = e.payload(); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+			return p, false
+		}
+		logging.Info(r.Context(), "payload from %s event %s of %s", e.Type, e.ID, e.Source)
+		return p, true
+	}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return p, false
+	}
+	return p, true
+}
+
+// cloudEventHandler adds the capacity configured in CLOUDEVENT_ACTIONS for
+// the action of the path when an Eventarc trigger sends it an event, such as
+// a BigQuery audit log or a budget notification. The data of the event is
+// not read, the trigger filters the events. Each event is acted on once.
+func (s *Server) cloudEventHandler(w http.ResponseWriter, r *http.Request) {
+	if err := verifyEventarcRequest(r); err != nil {
+		logging.Warning(r.Context(), "rejected %s request: %v", r.URL.Path, err)
+		writeError(w, http.StatusUnauthorized, codeUnauthenticated, "unauthorized")
+		return
+	}
+
+	e, err := readCloudEvent(r)
+	defer r.Body.Close()
+	switch {
+	case err == errBatchedEvents:
+		writeError(w, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "%v", err)
+		return
+	case err != nil:
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	case e == nil:
+		writeError(w, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "want a CloudEvent, in binary mode or as %s", cloudEventsJSON)
+		return
+	}
+
+	name := mux.Vars(r)["action"]
+	r = r.WithContext(logging.WithFields(r.Context(), "event", e.ID, "event_type", e.Type, "event_source", e.Source))
+	action, ok := cloudEventActions[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNotFound, "no action %q in CLOUDEVENT_ACTIONS", name)
+		return
+	}
+
+	reason := fmt.Sprintf("%s event %s from %s", e.Type, e.ID, e.Source)
+	if e.Subject != "" {
+		reason += ": " + e.Subject
+	}
+	logging.Info(r.Context(), "%s, running action %q", reason, name)
+	s.runAction(w, r, e.key(), name, action, "cloudevent/"+name, reason)
+}
+
+// verifyEventarcRequest checks the OIDC token Eventarc attaches to events
+// for EVENTARC_SERVICE_ACCOUNT, minted for the URL of the service unless
+// EVENTARC_AUDIENCE is set. Without EVENTARC_SERVICE_ACCOUNT every request
+// is refused.
+func verifyEventarcRequest(r *http.Request) error {
+	if eventarcServiceAcct == "" {
+		return errors.New("EVENTARC_SERVICE_ACCOUNT is not set")
+	}
+	audience := eventarcAudience
+	if audience == "" {
+		audience = "https://" + r.Host
+	}
+	return verifyOIDCToken(r, audience, eventarcServiceAcct)
+}
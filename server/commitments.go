@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/internal/taskspb"
+	"go-slot-scheduler/tasks"
+)
+
+// CommitmentInfo is a capacity commitment as reported by listCommitmentsHandler.
+type CommitmentInfo struct {
+	Name          string     `json:"name"`
+	Region        string     `json:"region"`
+	SlotCount     int64      `json:"slot_count"`
+	Plan          string     `json:"plan"`
+	State         string     `json:"state"`
+	StartTime     *time.Time `json:"start_time,omitempty"`
+	PendingDelete bool       `json:"pending_delete"`
+	DeleteAt      *time.Time `json:"delete_at,omitempty"`
+	DeleteTask    string     `json:"delete_task,omitempty"`
+}
+
+// listCommitmentsHandler lists the active commitments of the admin project
+// for the region query parameter, or for every configured region when it is
+// omitted. The project query parameter picks another admin project, and the
+// state parameter commitments in another state, or in any with "all".
+func (s *Server) listCommitmentsHandler(w http.ResponseWriter, r *http.Request) {
+	project := projectID
+	if v := r.URL.Query().Get("project"); v != "" {
+		if !validAdminProject(v) {
+			writeError(w, http.StatusBadRequest, codeInvalidProject, "project %q is not an admin project of the service", v)
+			return
+		}
+		project = v
+	}
+	var v validator
+	listRegions := regions
+	if region := r.URL.Query().Get("region"); region != "" {
+		v.region("region", &region)
+		listRegions = []string{region}
+	}
+	state := strings.ToUpper(r.URL.Query().Get("state"))
+	switch state {
+	case "":
+		state = reservationpb.CapacityCommitment_ACTIVE.String()
+	case "ALL":
+		state = ""
+	default:
+		_, ok := reservationpb.CapacityCommitment_State_value[state]
+		v.check(ok && state != reservationpb.CapacityCommitment_STATE_UNSPECIFIED.String(), "state", "unknown state %q, want ACTIVE, PENDING, FAILED or all", r.URL.Query().Get("state"))
+	}
+	if err := v.err(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	pending, err := s.pendingDeletes(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "listing delete tasks: %v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+
+	commitments := []CommitmentInfo{}
+	for _, region := range listRegions {
+		parent := fmt.Sprintf("projects/%s/locations/%s", project, region)
+		list, err := s.capacity.List(r.Context(), parent)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternal, "listing commitments in %s: %v", region, err)
+			logging.Error(r.Context(), "%v", err)
+			return
+		}
+		for _, c := range list {
+			if state != "" && c.State.String() != state {
+				continue
+			}
+			commitments = append(commitments, commitmentInfo(c, pending[c.Name]))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, commitments)
+}
+
+// commitmentInfo describes c and its delete task, if there is one.
+func commitmentInfo(c *reservationpb.CapacityCommitment, task *taskspb.Task) CommitmentInfo {
+	info := CommitmentInfo{
+		Name:      c.Name,
+		Region:    capacity.Region(c.Name),
+		SlotCount: c.SlotCount,
+		Plan:      c.Plan.String(),
+		State:     c.State.String(),
+	}
+	if c.CommitmentStartTime != nil {
+		start := c.CommitmentStartTime.AsTime()
+		info.StartTime = &start
+	}
+	if task != nil {
+		deleteAt := task.ScheduleTime.AsTime()
+		info.PendingDelete = true
+		info.DeleteAt = &deleteAt
+		info.DeleteTask = task.Name
+	}
+	return info
+}
+
+// pendingDeletes returns the delete tasks waiting in the queue, keyed by the
+// name of the commitment they will delete.
+func (s *Server) pendingDeletes(ctx context.Context) (map[string]*taskspb.Task, error) {
+	list, err := s.queue.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pending := make(map[string]*taskspb.Task)
+	for _, task := range list {
+		req := task.GetHttpRequest()
+		if req == nil || !isDeleteURL(req.Url) {
+			continue
+		}
+		var c Commit
+		if err := json.Unmarshal(req.Body, &c); err != nil || c.CommitID == "" {
+			continue
+		}
+		pending[c.CommitID] = task
+	}
+	return pending, nil
+}
+
+// isDeleteURL reports whether a task calling url deletes a commitment, on
+// the v1 route, the unversioned one it replaced or DELETE_CALLBACK_URL.
+func isDeleteURL(url string) bool {
+	if deleteCallbackURL != "" && url == deleteCallbackURL {
+		return true
+	}
+	return strings.HasSuffix(url, v1Prefix+deleteCommitmentPath) || strings.HasSuffix(url, deleteCapacityPath)
+}
+
+// queueName is the full resource name of the delete task queue.
+func queueName() string {
+	return tasks.QueueName(projectID, queueLocation, queue)
+}
+
+// queueNames are the full resource names of the delete task queues: the
+// queue and those of QUEUES it fails over to.
+func queueNames() []string {
+	return append([]string{queueName()}, failoverQueues...)
+}
+
+// queueParts returns the location and ID of the queue name.
+func queueParts(name string) (location, id string) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 6 {
+		return "", name
+	}
+	return parts[3], parts[5]
+}
@@ -0,0 +1,717 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/config"
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/retry"
+)
+
+const (
+	addCapacityPath     = "/add_capacity"
+	deleteCapacityPath  = "/del_capacity"
+	commitmentsPath     = "/commitments"
+	cancelDeletePath    = "/cancel_delete"
+	extendCapacityPath  = "/extend_capacity"
+	reconcilePath       = "/reconcile"
+	schedulesPath       = "/schedules"
+	scaleOnAlertPath    = "/scale_on_alert"
+	pubsubPushPath      = "/pubsub/push"
+	cloudEventsPath     = "/cloudevents"
+	billingPushPath     = "/billing/push"
+	scaleToPath         = "/scale_to"
+	mergePath           = "/merge"
+	reservationsPath    = "/reservations"
+	assignmentsPath     = "/assignments"
+	burstPath           = "/burst"
+	costPath            = "/cost"
+	regionsPath         = "/regions"
+	historyPath         = "/history"
+	taskPushPath        = "/tasks/push"
+	profilesPath        = "/profiles"
+	groupsPath          = "/groups"
+	applyPath           = "/apply"
+	driftPath           = "/drift"
+	recommendationsPath = "/recommendations"
+	simulatePath        = "/simulate"
+	uiPath              = "/ui"
+	eventsPath          = "/events"
+	preflightPath       = "/preflight"
+	reloadPath          = "/admin/reload"
+	configPath          = "/config"
+	freezePath          = "/freeze"
+	purgePath           = "/purge"
+	openAPIPath         = "/openapi.json"
+	slackCommandPath    = "/slack/command"
+
+	defaultRegion     = "US"
+	defaultMinute     = int64(1)
+	defaultMaxMinutes = int64(7 * 24 * 60)
+)
+
+var (
+	adminProjects                 map[string]adminProject
+	queue, queueLocation          string
+	failoverQueues                []string
+	createQueue                   bool
+	port, projectID               string
+	shutdownTimeout               time.Duration
+	requestTimeout                time.Duration
+	endpointTimeouts              map[string]time.Duration
+	accessLogEnabled              bool
+	maxResponseBytes              int64
+	preflightMode                 string
+	defaultServiceAcct            string
+	taskServiceAcct, taskAudience string
+	defaultPlan                   reservationpb.CapacityCommitment_CommitmentPlan
+	capacityMode                  string
+	bumpReservationID, bumpTarget string
+	stockoutFallback              string
+	stockoutMinSlots              int64
+	capCacheTTL                   time.Duration
+	stateStoreKind                string
+	reconcileInterval             time.Duration
+	watchdogInterval              time.Duration
+	watchdogGrace                 time.Duration
+	queueCheckInterval            time.Duration
+	mergeInterval                 time.Duration
+	profileInterval               time.Duration
+	desiredStateURL               string
+	desiredStateInterval          time.Duration
+	driftInterval                 time.Duration
+	driftRemediate                bool
+	ledgerExportTable             string
+	alertActions                  map[string]AlertAction
+	alertToken                    string
+	cloudEventActions             map[string]AlertAction
+	eventarcServiceAcct           string
+	eventarcAudience              string
+	budgetStop                    *budgetStopPolicy
+	pubsubServiceAcct             string
+	selfURL, deleteCallbackURL    string
+	autoscale                     autoscalePolicy
+	guard                         deleteGuard
+	pubsubAudience                string
+	pubsubVerificationToken       string
+	traceSampleRatio              float64
+	retryPolicy                   retry.Policy
+	firestoreProject              string
+	dryRun                        bool
+	uiOperators                   map[string]bool
+	slackSigningSecret            string
+	slackTeamID                   string
+	slackOperators                map[string]bool
+	iapAudience                   string
+	authRoles                     map[string]role
+	apiKeys                       map[string]*apiKey
+	authAudiences                 []string
+	requiredMetadata              map[string]bool
+	auditTopic                    string
+	deleteTaskMaxAttempts         int
+	deleteTaskDispatchDeadline    time.Duration
+	deleteTaskMinBackoff          time.Duration
+	deleteTaskMaxBackoff          time.Duration
+	overdueAfter                  time.Duration
+	regions                       []string
+	fakeBackends                  bool
+	fakeLatency                   time.Duration
+	fakeErrorRate                 float64
+	deleteScheduler               string
+	deleteWorkflow, deleteTopic   string
+	schedulerJobs                 bool
+	schedulerJobsLocation         string
+	schedulerJobsServiceAcct      string
+)
+
+// settings are those LoadConfig or the last reload read, from the config
+// file, environment and flags.
+var settings atomic.Pointer[config.Settings]
+
+// startupSettings are those LoadConfig read, which reloads don't change.
+var startupSettings *config.Settings
+
+// getenv returns the setting name. Only loading and reloading read them,
+// the handlers use what they parsed.
+func getenv(name string) string {
+	return settings.Load().Get(name)
+}
+
+// LoadConfig reads the configuration of the service from s, the config file
+// merged with the environment and flags.
+func LoadConfig(s *config.Settings) error {
+	settings.Store(s)
+	startupSettings = s
+	var err error
+	if s != nil && s.Path != "" {
+		logging.Info(context.Background(), "read config file %s", s.Path)
+	}
+	// In-memory reservation and Cloud Tasks APIs, for development
+	if err := parseFakeBackends(); err != nil {
+		return err
+	}
+
+	// Run from BigQuery Admin project
+	if projectID = getenv("GOOGLE_CLOUD_PROJECT"); projectID == "" && fakeBackends {
+		projectID = "fake-project"
+	} else if projectID == "" {
+		projectID, err = metadata.ProjectID()
+		if err != nil {
+			return errors.New("projectID is not provided")
+		}
+	}
+	logging.ProjectID = projectID
+
+	if !fakeBackends {
+		defaultServiceAcct, err = metadata.Email("")
+		if err != nil {
+			logging.Warning(context.Background(), "unable to retrieve service account, provide with ENV")
+		}
+	}
+
+	// Service account Cloud Tasks signs delete task OIDC tokens as, and the
+	// only identity allowed to call deleteCapacityPath.
+	if taskServiceAcct = getenv("TASK_SERVICE_ACCOUNT"); taskServiceAcct == "" {
+		taskServiceAcct = defaultServiceAcct
+	}
+	if taskServiceAcct == "" && !fakeBackends {
+		// Without it any Google-signed token for the delete URL would do.
+		return errors.New("TASK_SERVICE_ACCOUNT is not provided and the service account of the instance can't be retrieved")
+	}
+	taskAudience = getenv("TASK_AUDIENCE")
+
+	if port = getenv("PORT"); port == "" {
+		port = "8080"
+	}
+
+	// How long requests and scaling operations in flight get to finish on
+	// SIGTERM, under the 10 seconds Cloud Run waits before killing the
+	// instance
+	shutdownTimeout = 9 * time.Second
+	if v := getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		if shutdownTimeout, err = time.ParseDuration(v); err != nil || shutdownTimeout <= 0 {
+			return fmt.Errorf("SHUTDOWN_TIMEOUT must be a positive duration")
+		}
+	}
+
+	// How long a request gets to answer before a 504, under the minute the
+	// server gives it to write the response
+	requestTimeout = 55 * time.Second
+	if v := getenv("REQUEST_TIMEOUT"); v != "" {
+		if requestTimeout, err = time.ParseDuration(v); err != nil || requestTimeout < 0 {
+			return fmt.Errorf("REQUEST_TIMEOUT must be a duration, 0 for none")
+		}
+	}
+
+	// Timeouts of the routes that don't use REQUEST_TIMEOUT, e.g.
+	// {"POST /v1/capacity":"3m"}
+	endpointTimeouts = nil
+	if v := getenv("ENDPOINT_TIMEOUTS_JSON"); v != "" {
+		if endpointTimeouts, err = parseEndpointTimeouts(v); err != nil {
+			return err
+		}
+	}
+
+	// Whether every request is logged once answered
+	accessLogEnabled = true
+	if v := getenv("ACCESS_LOG"); v != "" {
+		if accessLogEnabled, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("cannot parse ACCESS_LOG: %v", err)
+		}
+	}
+
+	// Largest response sent, the 32 MiB Cloud Run allows by default
+	maxResponseBytes = 32 << 20
+	if v := getenv("MAX_RESPONSE_BYTES"); v != "" {
+		if maxResponseBytes, err = strconv.ParseInt(v, 10, 64); err != nil || maxResponseBytes < 0 {
+			return errors.New("MAX_RESPONSE_BYTES must be a number of bytes, 0 for no limit")
+		}
+	}
+
+	// How long the slots counted toward a cap are kept between purchases,
+	// 0 (default) lists the commitments on every purchase
+	if v := getenv("CAP_CACHE_TTL"); v != "" {
+		if capCacheTTL, err = time.ParseDuration(v); err != nil || capCacheTTL < 0 {
+			return fmt.Errorf("CAP_CACHE_TTL must be a duration, 0 or more")
+		}
+	}
+
+	// Caps, budgets, blackouts, the schedule interval and the events
+	// notified, which a reload changes
+	l, err := parseLiveConfig()
+	if err != nil {
+		return err
+	}
+	liveSettings.Store(l)
+
+	// Prices purchases are estimated with
+	if err := parsePrices(); err != nil {
+		return err
+	}
+
+	// Regions requests may name
+	parseRegions()
+
+	// When failed deletions page someone
+	if err := parseDeleteAlerting(); err != nil {
+		return err
+	}
+
+	// Who may buy, extend and cancel from the dashboard, and the IAP it is
+	// served behind
+	uiOperators = make(map[string]bool)
+	if v := getenv("UI_OPERATORS"); v != "" {
+		for _, email := range strings.Split(v, ",") {
+			uiOperators[strings.TrimSpace(email)] = true
+		}
+	}
+	iapAudience = getenv("IAP_AUDIENCE")
+
+	// Roles of callers by email and API key, off unless AUTH_ROLES_JSON or
+	// API_KEYS_JSON is set
+	if err := parseAuth(); err != nil {
+		return err
+	}
+	if len(uiOperators) > 0 && iapAudience == "" && !authEnabled() && !fakeBackends {
+		return fmt.Errorf("UI_OPERATORS needs IAP_AUDIENCE to verify the users of the dashboard, or roles with AUTH_ROLES_JSON")
+	}
+
+	// Which of requester, reason and ticket every purchase has to give, so
+	// the ledger can tell who bought capacity and why
+	requiredMetadata = make(map[string]bool)
+	if v := getenv("REQUIRED_METADATA"); v != "" {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			switch field {
+			case "requester", "reason", "ticket":
+				requiredMetadata[field] = true
+			default:
+				return fmt.Errorf("REQUIRED_METADATA: unknown field %q, want requester, reason or ticket", field)
+			}
+		}
+	}
+
+	// Where every mutating request is published for the security pipeline,
+	// a topic ID or projects/{project}/topics/{topic}
+	auditTopic = getenv("AUDIT_TOPIC")
+
+	// The /slots slash command, off unless SLACK_SIGNING_SECRET is set, and
+	// the Slack users who may buy with it
+	slackSigningSecret = getenv("SLACK_SIGNING_SECRET")
+	slackTeamID = getenv("SLACK_TEAM_ID")
+	slackOperators = make(map[string]bool)
+	if v := getenv("SLACK_OPERATORS"); v != "" {
+		for _, id := range strings.Split(v, ",") {
+			slackOperators[strings.TrimSpace(id)] = true
+		}
+	}
+
+	// Validate and log every purchase and delete without making them
+	if v := getenv("DRY_RUN"); v != "" {
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("cannot parse DRY_RUN: %v", err)
+		}
+	}
+
+	// Admin projects other than GOOGLE_CLOUD_PROJECT capacity may be bought in
+	if v := getenv("ADMIN_PROJECTS_JSON"); v != "" {
+		if adminProjects, err = parseAdminProjects(v); err != nil {
+			return fmt.Errorf("ADMIN_PROJECTS_JSON: %v", err)
+		}
+	}
+
+	defaultPlan = reservationpb.CapacityCommitment_FLEX
+	if v := getenv("DEFAULT_PLAN"); v != "" {
+		if defaultPlan, err = capacity.ParsePlan(v); err != nil {
+			return fmt.Errorf("DEFAULT_PLAN: %v", err)
+		}
+	}
+
+	// What adding capacity does: buy commitments (default), or bump the
+	// reservation BUMP_RESERVATION of the region for the BUMP_TARGET slots
+	switch capacityMode = getenv("CAPACITY_MODE"); capacityMode {
+	case "":
+		capacityMode = capacityModeCommitments
+	case capacityModeCommitments:
+	case capacityModeReservation:
+		if bumpReservationID = getenv("BUMP_RESERVATION"); bumpReservationID == "" {
+			return fmt.Errorf("CAPACITY_MODE=%s needs BUMP_RESERVATION", capacityModeReservation)
+		}
+	default:
+		return fmt.Errorf("unknown CAPACITY_MODE %q, want %s or %s", capacityMode, capacityModeCommitments, capacityModeReservation)
+	}
+	switch bumpTarget = getenv("BUMP_TARGET"); bumpTarget {
+	case "":
+		bumpTarget = bumpTargetBaseline
+	case bumpTargetBaseline, bumpTargetAutoscale, bumpTargetBoth:
+	default:
+		return fmt.Errorf("unknown BUMP_TARGET %q, want %s, %s or %s", bumpTarget, bumpTargetBaseline, bumpTargetAutoscale, bumpTargetBoth)
+	}
+
+	// What FLEX purchases the region has no capacity for do: fail (default),
+	// or buy smaller commitments, down to STOCKOUT_MIN_SLOTS
+	switch stockoutFallback = getenv("STOCKOUT_FALLBACK"); stockoutFallback {
+	case "":
+		stockoutFallback = fallbackNone
+	case fallbackNone, fallbackShrink, fallbackSplit:
+	default:
+		return fmt.Errorf("unknown STOCKOUT_FALLBACK %q, want %s, %s or %s", stockoutFallback, fallbackNone, fallbackShrink, fallbackSplit)
+	}
+	stockoutMinSlots = capacity.MinSlots
+	if v := getenv("STOCKOUT_MIN_SLOTS"); v != "" {
+		if stockoutMinSlots, err = strconv.ParseInt(v, 10, 64); err != nil || stockoutMinSlots <= 0 || stockoutMinSlots%slotIncrement != 0 {
+			return fmt.Errorf("STOCKOUT_MIN_SLOTS must be a positive multiple of %d", slotIncrement)
+		}
+	}
+
+	// Where idempotency keys are kept: memory (default) or firestore
+	switch stateStoreKind = getenv("STATE_STORE"); stateStoreKind {
+	case "":
+		stateStoreKind = "memory"
+	case "memory", "firestore":
+	default:
+		return fmt.Errorf("unknown STATE_STORE %q, want memory or firestore", stateStoreKind)
+	}
+	if firestoreProject = getenv("FIRESTORE_PROJECT"); firestoreProject == "" {
+		firestoreProject = projectID
+	}
+
+	// BigQuery table the ledger is streamed to, off unless set
+	if ledgerExportTable = getenv("LEDGER_EXPORT_TABLE"); ledgerExportTable != "" {
+		if _, _, _, err := parseExportTable(ledgerExportTable); err != nil {
+			return err
+		}
+	}
+
+	// How often orphaned commitments are looked for, 0 disables the loop
+	reconcileInterval = 15 * time.Minute
+	if v := getenv("RECONCILE_INTERVAL"); v != "" {
+		if reconcileInterval, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("cannot parse RECONCILE_INTERVAL: %v", err)
+		}
+	}
+
+	// How often deletions missed by their task are looked for, and how long
+	// after they were due, 0 disables the loop
+	watchdogInterval = 5 * time.Minute
+	if v := getenv("DELETE_WATCHDOG_INTERVAL"); v != "" {
+		if watchdogInterval, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("cannot parse DELETE_WATCHDOG_INTERVAL: %v", err)
+		}
+	}
+	watchdogGrace = 15 * time.Minute
+	if v := getenv("DELETE_WATCHDOG_GRACE"); v != "" {
+		if watchdogGrace, err = time.ParseDuration(v); err != nil || watchdogGrace < 0 {
+			return fmt.Errorf("cannot parse DELETE_WATCHDOG_GRACE: %q", v)
+		}
+	}
+
+	// How often the state of the delete queue is checked, 0 disables the
+	// loop
+	queueCheckInterval = time.Minute
+	if v := getenv("QUEUE_CHECK_INTERVAL"); v != "" {
+		if queueCheckInterval, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("cannot parse QUEUE_CHECK_INTERVAL: %v", err)
+		}
+	}
+
+	// How often capacity profiles are brought to their level, 0 disables the
+	// loop
+	profileInterval = time.Minute
+	if v := getenv("PROFILE_INTERVAL"); v != "" {
+		if profileInterval, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("cannot parse PROFILE_INTERVAL: %v", err)
+		}
+	}
+
+	// How often drift from the profiles and schedules is looked for, off by
+	// default, and whether it is fixed or only reported
+	if v := getenv("DRIFT_INTERVAL"); v != "" {
+		if driftInterval, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("cannot parse DRIFT_INTERVAL: %v", err)
+		}
+	}
+	if v := getenv("DRIFT_REMEDIATE"); v != "" {
+		if driftRemediate, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("cannot parse DRIFT_REMEDIATE: %v", err)
+		}
+	}
+
+	// How often commitments are merged, off by default
+	if v := getenv("MERGE_INTERVAL"); v != "" {
+		if mergeInterval, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("cannot parse MERGE_INTERVAL: %v", err)
+		}
+	}
+
+	// Capacity added by scaleOnAlertPath per alert policy, and the token the
+	// notification channel must present
+	if v := getenv("ALERT_ACTIONS"); v != "" {
+		if alertActions, err = parseAlertActions(v); err != nil {
+			return fmt.Errorf("ALERT_ACTIONS: %v", err)
+		}
+	}
+	alertToken = getenv("ALERT_TOKEN")
+	if alertActions != nil && alertToken == "" {
+		logging.Warning(context.Background(), "ALERT_ACTIONS is set without ALERT_TOKEN, %s is not served", scaleOnAlertPath)
+	}
+
+	// Identity Pub/Sub push subscriptions authenticate as on pubsubPushPath
+	pubsubServiceAcct = getenv("PUBSUB_SERVICE_ACCOUNT")
+	pubsubAudience = getenv("PUBSUB_AUDIENCE")
+	pubsubVerificationToken = getenv("PUBSUB_VERIFICATION_TOKEN")
+
+	// Capacity added by cloudEventsPath per action, and the identity Eventarc
+	// triggers authenticate as
+	if v := getenv("CLOUDEVENT_ACTIONS"); v != "" {
+		if cloudEventActions, err = parseAlertActions(v); err != nil {
+			return fmt.Errorf("CLOUDEVENT_ACTIONS: %v", err)
+		}
+	}
+	eventarcServiceAcct = getenv("EVENTARC_SERVICE_ACCOUNT")
+	if cloudEventActions != nil && eventarcServiceAcct == "" {
+		logging.Warning(context.Background(), "CLOUDEVENT_ACTIONS is set without EVENTARC_SERVICE_ACCOUNT, %s is not served", cloudEventsPath)
+	}
+	eventarcAudience = getenv("EVENTARC_AUDIENCE")
+
+	// What a budget notification pushed to billingPushPath does once over
+	// its threshold, nothing by default
+	if v := getenv("BUDGET_STOP_JSON"); v != "" {
+		if budgetStop, err = parseBudgetStop(v); err != nil {
+			return fmt.Errorf("BUDGET_STOP_JSON: %v", err)
+		}
+		// Anyone able to push a notification could delete the slots.
+		if !pushVerified() {
+			return errors.New("BUDGET_STOP_JSON needs PUBSUB_SERVICE_ACCOUNT or PUBSUB_VERIFICATION_TOKEN to verify the notifications pushed to " + billingPushPath)
+		}
+	}
+
+	// Base URL tasks call the service on, and the URL of delete tasks. Without
+	// them the host of the request buying the capacity is used, which may not
+	// be reachable behind a load balancer or custom domain.
+	selfURL = strings.TrimSuffix(getenv("SELF_URL"), "/")
+	if selfURL == "" && fakeBackends {
+		// The fake queue calls back over plain HTTP.
+		selfURL = "http://localhost:" + port
+	}
+	deleteCallbackURL = getenv("DELETE_CALLBACK_URL")
+
+	// Slot usage based autoscaling, off unless AUTOSCALE_INTERVAL is set
+	if autoscale, err = parseAutoscalePolicy(); err != nil {
+		return err
+	}
+	if autoscale.Interval > 0 && selfURL == "" && deleteCallbackURL == "" {
+		return errors.New("SELF_URL or DELETE_CALLBACK_URL is required by the autoscaler")
+	}
+
+	// Desired state pulled from GCS or a URL and applied, off unless
+	// DESIRED_STATE_URL is set
+	desiredStateURL = getenv("DESIRED_STATE_URL")
+	desiredStateInterval = 5 * time.Minute
+	if v := getenv("DESIRED_STATE_INTERVAL"); v != "" {
+		if desiredStateInterval, err = time.ParseDuration(v); err != nil || desiredStateInterval <= 0 {
+			return errors.New("DESIRED_STATE_INTERVAL must be a positive duration")
+		}
+	}
+	if desiredStateURL != "" {
+		gcs := strings.HasPrefix(desiredStateURL, "gs://")
+		if gcs && !strings.Contains(strings.TrimPrefix(desiredStateURL, "gs://"), "/") || !gcs && !strings.HasPrefix(desiredStateURL, "https://") && !strings.HasPrefix(desiredStateURL, "http://") {
+			return errors.New("DESIRED_STATE_URL must be a gs://bucket/object or http(s) URL")
+		}
+		if selfURL == "" && deleteCallbackURL == "" {
+			return errors.New("SELF_URL or DELETE_CALLBACK_URL is required by DESIRED_STATE_URL")
+		}
+	}
+
+	// Scheduled deletions postponed while the region is busy, off unless
+	// DELETE_GUARD_UTILIZATION is set
+	if guard, err = parseDeleteGuard(); err != nil {
+		return err
+	}
+
+	// Share of requests traced to Cloud Trace, 0 disables tracing
+	if v := getenv("TRACE_SAMPLE_RATIO"); v != "" {
+		if traceSampleRatio, err = strconv.ParseFloat(v, 64); err != nil || traceSampleRatio < 0 || traceSampleRatio > 1 {
+			return errors.New("TRACE_SAMPLE_RATIO must be between 0 and 1")
+		}
+	}
+
+	// Retries of reservation and Cloud Tasks calls failing with transient codes
+	retryPolicy = retry.Default
+	if v := getenv("RETRY_MAX_ATTEMPTS"); v != "" {
+		if retryPolicy.MaxAttempts, err = strconv.Atoi(v); err != nil || retryPolicy.MaxAttempts <= 0 {
+			return errors.New("RETRY_MAX_ATTEMPTS must be a positive integer")
+		}
+	}
+	if v := getenv("RETRY_INITIAL_BACKOFF"); v != "" {
+		if retryPolicy.InitialBackoff, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("cannot parse RETRY_INITIAL_BACKOFF: %v", err)
+		}
+	}
+	if v := getenv("RETRY_MAX_BACKOFF"); v != "" {
+		if retryPolicy.MaxBackoff, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("cannot parse RETRY_MAX_BACKOFF: %v", err)
+		}
+	}
+	retryCodes := retry.DefaultCodes
+	if v := getenv("RETRY_CODES"); v != "" {
+		retryCodes = v
+	}
+	if retryPolicy.Codes, err = retry.ParseCodes(retryCodes); err != nil {
+		return fmt.Errorf("RETRY_CODES: %v", err)
+	}
+
+	// Where delete tasks are scheduled: cloudtasks (default), timer,
+	// workflows or pubsub
+	if err := parseDeleteScheduler(); err != nil {
+		return err
+	}
+	if err := parseDeleteTaskRetry(); err != nil {
+		return err
+	}
+
+	// Only Cloud Tasks needs a real queue, the other backends use its name to
+	// name tasks.
+	// QUEUES lists the queue and those it fails over to instead.
+	failoverQueues = nil
+	if v := getenv("QUEUES"); v != "" {
+		if err := parseQueues(v); err != nil {
+			return err
+		}
+	} else {
+		if queue = getenv("QUEUE_ID"); queue == "" && fakeBackends {
+			queue = "fake-queue"
+		} else if queue == "" && deleteScheduler != schedulerCloudTasks {
+			queue = "slot-scheduler"
+		} else if queue == "" {
+			return errors.New("QUEUE_ID can not be empty. Create and provide a queue id")
+		}
+
+		if queueLocation = getenv("QUEUE_LOCATION"); queueLocation == "" && fakeBackends {
+			queueLocation = "us-central1"
+		} else if queueLocation == "" && deleteScheduler != schedulerCloudTasks {
+			queueLocation = "local"
+		} else if queueLocation == "" {
+			return errors.New("QUEUE_REGION can not be empty. Provide queue region")
+		}
+	}
+
+	// Whether startup creates the queues that don't exist
+	if v := getenv("CREATE_QUEUE"); v != "" {
+		if createQueue, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("cannot parse CREATE_QUEUE: %v", err)
+		}
+		if createQueue && deleteScheduler != schedulerCloudTasks {
+			return errors.New("CREATE_QUEUE needs DELETE_SCHEDULER=cloudtasks")
+		}
+	}
+
+	// Whether startup checks the queue and permissions, and fails on them
+	if preflightMode, err = parsePreflightMode(getenv("PREFLIGHT")); err != nil {
+		return err
+	}
+
+	// Cloud Scheduler jobs running the schedules, off by default
+	if err := parseSchedulerJobs(); err != nil {
+		return err
+	}
+
+	// Regions listed when no region is given, e.g. REGIONS=US,EU
+	regions = []string{defaultRegion}
+	if v := getenv("REGIONS"); v != "" {
+		regions = strings.Split(v, ",")
+	}
+	return nil
+}
+
+// parseLiveConfig reads the settings a reload applies.
+func parseLiveConfig() (*liveConfig, error) {
+	l := &liveConfig{}
+	var err error
+	if l.MaxSlots, err = strconv.ParseInt(getenv("MAX_SLOTS"), 10, 64); err != nil {
+		return nil, errors.New("cannot parse MAX_SLOTS")
+	} else if l.MaxSlots <= 0 {
+		return nil, errors.New("MAX_SLOTS can not be less than or equal to zero")
+	}
+
+	// Caps of regions that don't share MAX_SLOTS, e.g. {"US":2000,"EU":1000}
+	if v := getenv("MAX_SLOTS_JSON"); v != "" {
+		if err := json.Unmarshal([]byte(v), &l.RegionMaxSlots); err != nil {
+			return nil, fmt.Errorf("cannot parse MAX_SLOTS_JSON: %v", err)
+		}
+		for region, slots := range l.RegionMaxSlots {
+			if slots <= 0 {
+				return nil, fmt.Errorf("MAX_SLOTS_JSON: cap of %s must be greater than zero", region)
+			}
+		}
+	}
+
+	// Longest a purchased commitment may be kept before its delete task fires
+	l.MaxMinutes = defaultMaxMinutes
+	if v := getenv("MAX_MINUTES"); v != "" {
+		if l.MaxMinutes, err = strconv.ParseInt(v, 10, 64); err != nil || l.MaxMinutes <= 0 {
+			return nil, errors.New("MAX_MINUTES must be a positive integer")
+		}
+	}
+	// What is done with requests for longer than MAX_MINUTES
+	switch v := getenv("MAX_MINUTES_POLICY"); v {
+	case "", "reject":
+	case "clamp":
+		l.ClampMinutes = true
+	default:
+		return nil, fmt.Errorf("MAX_MINUTES_POLICY must be reject or clamp, not %q", v)
+	}
+
+	// Commitments counted toward MAX_SLOTS
+	if l.CapFilter, err = parseCapacityFilter(); err != nil {
+		return nil, err
+	}
+
+	// Caps on the spend of a day or month
+	if v := getenv("BUDGETS_JSON"); v != "" {
+		if l.Budgets, err = parseBudgets(v); err != nil {
+			return nil, fmt.Errorf("BUDGETS_JSON: %v", err)
+		}
+	}
+
+	// Windows in which no capacity is bought, and who may override them
+	if v := getenv("BLACKOUTS_JSON"); v != "" {
+		if l.Blackouts, err = parseBlackouts(v); err != nil {
+			return nil, fmt.Errorf("BLACKOUTS_JSON: %v", err)
+		}
+	}
+	l.BlackoutAdmins = make(map[string]bool)
+	if v := getenv("BLACKOUT_ADMINS"); v != "" {
+		for _, email := range strings.Split(v, ",") {
+			l.BlackoutAdmins[strings.TrimSpace(email)] = true
+		}
+	}
+
+	// How often schedules are checked for due runs, 0 pauses the loop
+	l.ScheduleInterval = time.Minute
+	if v := getenv("SCHEDULE_INTERVAL"); v != "" {
+		if l.ScheduleInterval, err = time.ParseDuration(v); err != nil || l.ScheduleInterval < 0 {
+			return nil, fmt.Errorf("cannot parse SCHEDULE_INTERVAL: %q", v)
+		}
+	}
+
+	// Which scaling events operators are told about, see newNotifier for
+	// where
+	events := defaultNotifyEvents
+	if v := getenv("NOTIFY_EVENTS"); v != "" {
+		events = v
+	}
+	l.NotifyEvents = parseNotifyEvents(events)
+	return l, nil
+}
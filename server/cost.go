@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+)
+
+// defaultFlexSlotHourPrice is the on-demand FLEX rate in USD: $4 per 100
+// slots per hour.
+const defaultFlexSlotHourPrice = 0.04
+
+// defaultCommitSlotHourPrice is the rate of a monthly commitment in USD:
+// $2,000 per 100 slots per month.
+const defaultCommitSlotHourPrice = 0.0274
+
+// defaultCostWindow is the window of /cost when none is given.
+const defaultCostWindow = 30 * 24 * time.Hour
+
+var (
+	flexSlotHourPrice   = defaultFlexSlotHourPrice
+	flexSlotHourPrices  map[string]float64
+	commitSlotHourPrice = defaultCommitSlotHourPrice
+)
+
+// parsePrices reads FLEX_SLOT_HOUR_PRICE, the USD price of a FLEX slot hour,
+// FLEX_SLOT_HOUR_PRICES_JSON, the prices of regions charged differently,
+// e.g. {"EU":0.044}, and COMMIT_SLOT_HOUR_PRICE, the price of a slot hour of
+// the commitment recommended as a baseline.
+func parsePrices() error {
+	if v := getenv("FLEX_SLOT_HOUR_PRICE"); v != "" {
+		var err error
+		if flexSlotHourPrice, err = strconv.ParseFloat(v, 64); err != nil || flexSlotHourPrice < 0 {
+			return fmt.Errorf("FLEX_SLOT_HOUR_PRICE must be a positive number")
+		}
+	}
+	if v := getenv("FLEX_SLOT_HOUR_PRICES_JSON"); v != "" {
+		if err := json.Unmarshal([]byte(v), &flexSlotHourPrices); err != nil {
+			return fmt.Errorf("cannot parse FLEX_SLOT_HOUR_PRICES_JSON: %v", err)
+		}
+	}
+	if v := getenv("COMMIT_SLOT_HOUR_PRICE"); v != "" {
+		var err error
+		if commitSlotHourPrice, err = strconv.ParseFloat(v, 64); err != nil || commitSlotHourPrice < 0 {
+			return fmt.Errorf("COMMIT_SLOT_HOUR_PRICE must be a positive number")
+		}
+	}
+	return nil
+}
+
+// slotHourPrice is the USD price of a slot hour of plan in region. Only FLEX
+// is priced, the other plans are paid for up front.
+func slotHourPrice(region string, plan string) (float64, bool) {
+	if plan != reservationpb.CapacityCommitment_FLEX.String() {
+		return 0, false
+	}
+	if price, ok := flexSlotHourPrices[region]; ok {
+		return price, true
+	}
+	return flexSlotHourPrice, true
+}
+
+// estimateCost is the USD cost of keeping slots of plan in region for d, if
+// plan is priced.
+func estimateCost(region, plan string, slots int64, d time.Duration) *float64 {
+	price, ok := slotHourPrice(region, plan)
+	if !ok || d <= 0 {
+		return nil
+	}
+	cost := roundCents(float64(slots) * d.Hours() * price)
+	return &cost
+}
+
+func roundCents(usd float64) float64 {
+	return math.Round(usd*100) / 100
+}
+
+// CostReport is the spend of the commitments bought by the service over a
+// window, worked out from the ledger.
+type CostReport struct {
+	From          time.Time              `json:"from"`
+	To            time.Time              `json:"to"`
+	SlotHours     float64                `json:"slot_hours"`
+	EstimatedCost float64                `json:"estimated_cost"`
+	Currency      string                 `json:"currency"`
+	ByRegion      map[string]*RegionCost `json:"by_region"`
+}
+
+// RegionCost is the spend in one region.
+type RegionCost struct {
+	SlotHours     float64 `json:"slot_hours"`
+	EstimatedCost float64 `json:"estimated_cost"`
+}
+
+// parseWindow parses a Go duration, or a number of days such as 30d.
+func parseWindow(v string) (time.Duration, error) {
+	if days := strings.TrimSuffix(v, "d"); days != v {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid window %q", v)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid window %q", v)
+	}
+	return d, nil
+}
+
+// costHandler totals the spend of the last window query parameter (default
+// 30d). Commitments bought before the window and still held in it are only
+// seen if they were bought within MAX_MINUTES of its start.
+func (s *Server) costHandler(w http.ResponseWriter, r *http.Request) {
+	window := defaultCostWindow
+	if v := r.URL.Query().Get("window"); v != "" {
+		var err error
+		if window, err = parseWindow(v); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+			return
+		}
+	}
+
+	to := time.Now()
+	from := to.Add(-window)
+	entries, err := s.store.ListEvents(r.Context(), from.Add(-time.Duration(live().MaxMinutes)*time.Minute))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "reading ledger: %v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, costReport(entries, from, to, false))
+}
+
+// costReport replays the ledger entries, oldest first, to find how many
+// slots each commitment held and for how long within from and to. With
+// project, commitments still held are charged until their scheduled
+// deletion rather than until to.
+func costReport(entries []*LedgerEntry, from, to time.Time, project bool) *CostReport {
+	report := &CostReport{From: from, To: to, Currency: "USD", ByRegion: make(map[string]*RegionCost)}
+
+	type holding struct {
+		region, plan string
+		slots        int64
+		since        time.Time
+		deleteAt     time.Time
+	}
+	charge := func(h *holding, until time.Time) {
+		start := h.since
+		if start.Before(from) {
+			start = from
+		}
+		if until.After(to) {
+			until = to
+		}
+		if !until.After(start) {
+			return
+		}
+		rc, ok := report.ByRegion[h.region]
+		if !ok {
+			rc = &RegionCost{}
+			report.ByRegion[h.region] = rc
+		}
+		slotHours := float64(h.slots) * until.Sub(start).Hours()
+		rc.SlotHours += slotHours
+		report.SlotHours += slotHours
+		if price, ok := slotHourPrice(h.region, h.plan); ok {
+			rc.EstimatedCost += slotHours * price
+			report.EstimatedCost += slotHours * price
+		}
+	}
+
+	held := make(map[string]*holding)
+	for _, e := range entries {
+		switch e.Action {
+		case actionPurchased, actionMergeCreated:
+			region := e.Region
+			if region == "" {
+				region = capacity.Region(e.Commitment)
+			}
+			held[e.Commitment] = &holding{region: region, plan: e.Plan, slots: e.Slots, since: e.Time}
+		case actionSplit:
+			// The piece split off is deleted right away.
+			if h, ok := held[e.Commitment]; ok {
+				charge(h, e.Time)
+				h.slots -= e.Slots
+				h.since = e.Time
+			}
+		case actionDeleteScheduled, actionDeleteRescheduled:
+			if h, ok := held[e.Commitment]; ok && e.DeleteAt != nil {
+				h.deleteAt = *e.DeleteAt
+			}
+		case actionDeleteCancelled:
+			if h, ok := held[e.Commitment]; ok {
+				h.deleteAt = time.Time{}
+			}
+		case actionDeleted, actionForgotten, actionRolledBack, actionMerged:
+			if h, ok := held[e.Commitment]; ok {
+				charge(h, e.Time)
+				delete(held, e.Commitment)
+			}
+		}
+	}
+	for _, h := range held {
+		if project && !h.deleteAt.IsZero() {
+			charge(h, h.deleteAt)
+		} else {
+			charge(h, to)
+		}
+	}
+
+	report.SlotHours = math.Round(report.SlotHours*100) / 100
+	report.EstimatedCost = roundCents(report.EstimatedCost)
+	for _, rc := range report.ByRegion {
+		rc.SlotHours = math.Round(rc.SlotHours*100) / 100
+		rc.EstimatedCost = roundCents(rc.EstimatedCost)
+	}
+	return report
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/tasks"
+)
+
+// deleteGuard postpones scheduled deletions that would leave the region short
+// of the slots its jobs are using.
+type deleteGuard struct {
+	// Utilization of the slots left after a deletion from which it is
+	// postponed, 0 disables the guard.
+	Utilization float64
+	// Lookback is how far back usage is averaged.
+	Lookback time.Duration
+	// Postpone is how much later a deletion is tried again.
+	Postpone time.Duration
+	// Max is how long after its scheduled time a deletion goes through
+	// regardless of usage.
+	Max time.Duration
+}
+
+// PostponedDelete is the response to a delete task postponed by the guard.
+type PostponedDelete struct {
+	Commitment     string    `json:"commitment"`
+	DeleteAt       time.Time `json:"delete_at"`
+	UsedSlots      float64   `json:"used_slots"`
+	RemainingSlots int64     `json:"remaining_slots"`
+}
+
+// parseDeleteGuard reads the DELETE_GUARD_* environment. The guard is off
+// unless DELETE_GUARD_UTILIZATION is set.
+func parseDeleteGuard() (deleteGuard, error) {
+	g := deleteGuard{
+		Lookback: 10 * time.Minute,
+		Postpone: 30 * time.Minute,
+		Max:      4 * time.Hour,
+	}
+	if v := getenv("DELETE_GUARD_UTILIZATION"); v != "" {
+		var err error
+		if g.Utilization, err = strconv.ParseFloat(v, 64); err != nil || g.Utilization < 0 {
+			return g, fmt.Errorf("DELETE_GUARD_UTILIZATION must be a positive share, such as 0.8")
+		}
+	}
+	durations := map[string]*time.Duration{
+		"DELETE_GUARD_LOOKBACK": &g.Lookback,
+		"DELETE_GUARD_POSTPONE": &g.Postpone,
+		"DELETE_GUARD_MAX":      &g.Max,
+	}
+	for name, d := range durations {
+		if v := getenv(name); v != "" {
+			var err error
+			if *d, err = time.ParseDuration(v); err != nil {
+				return g, fmt.Errorf("cannot parse %s: %v", name, err)
+			}
+		}
+	}
+	if g.Postpone <= 0 {
+		return g, fmt.Errorf("DELETE_GUARD_POSTPONE must be positive")
+	}
+	return g, nil
+}
+
+// postponeDelete moves the deletion of c guard.Postpone later when the slots
+// its region would have left are used past guard.Utilization, until
+// guard.Max after it was first due. It reports whether it did, having written
+// the response. Usage that can't be read doesn't hold the deletion back.
+func (s *Server) postponeDelete(w http.ResponseWriter, r *http.Request, c Commit) bool {
+	if guard.Utilization == 0 || s.bigquery == nil || c.Slots > 0 {
+		return false
+	}
+	ctx := r.Context()
+
+	recs, err := s.store.ListCommitments(ctx)
+	if err != nil {
+		logging.Warning(ctx, "not checking usage before deleting %s: %v", c.CommitID, err)
+		return false
+	}
+	var rec *CommitmentRecord
+	for _, known := range recs {
+		if known.Name == c.CommitID {
+			rec = known
+			break
+		}
+	}
+	if rec == nil || rec.DeleteAt.IsZero() {
+		return false
+	}
+	due := rec.PostponedFrom
+	if due.IsZero() {
+		due = rec.DeleteAt
+	}
+	now := time.Now()
+	last := due.Add(guard.Max)
+	// Never past MAX_MINUTES, the reconciler would delete it then anyway.
+	if limit := maxDeleteAt(rec); !limit.IsZero() && limit.Before(last) {
+		last = limit
+	}
+	if !now.Before(last) {
+		if !rec.PostponedFrom.IsZero() {
+			logging.Warning(ctx, "deletion of %s postponed for %s already, deleting", c.CommitID, guard.Max)
+		}
+		return false
+	}
+	next := now.Add(guard.Postpone)
+	if next.After(last) {
+		next = last
+	}
+
+	region := capacity.Region(c.CommitID)
+	usage, err := s.slotUsage(ctx, autoscale.View, guard.Lookback, region)
+	if err != nil {
+		logging.Warning(ctx, "not checking usage before deleting %s: %v", c.CommitID, err)
+		return false
+	}
+	commitments, err := s.capacity.List(ctx, capacity.Parent(resourceProject(c.CommitID), region))
+	if err != nil {
+		logging.Warning(ctx, "not checking usage before deleting %s: %v", c.CommitID, err)
+		return false
+	}
+	remaining := -rec.SlotCount
+	for _, commit := range commitments {
+		remaining += commit.SlotCount
+	}
+	if usage.Used == 0 || remaining > 0 && usage.Used < guard.Utilization*float64(remaining) {
+		return false
+	}
+
+	reason := fmt.Sprintf("%.0f slots used, %d would be left", usage.Used, remaining)
+	task, err := s.launchDeleteTask(ctx, s.queue.RescheduledTaskName(c.CommitID, next), c.CommitID, rec.DeleteURL, rec.Audience, next)
+	if err != nil {
+		logging.Error(ctx, "postponing deletion of %s: %v", c.CommitID, err)
+		return false
+	}
+	rec.PostponedFrom, rec.DeleteAt = due, next
+	if _, ok := s.queue.(*tasks.Queues); ok {
+		rec.Queue = tasks.QueueOf(task.Name)
+	}
+	if err := s.store.PutCommitment(ctx, rec); err != nil {
+		logging.Error(ctx, "recording postponed deletion of %s: %v", c.CommitID, err)
+	}
+	logging.Warning(ctx, "deletion of %s postponed to %s: %s", c.CommitID, next.Format(time.RFC3339), reason)
+	s.record(ctx, LedgerEntry{Action: actionDeletePostponed, Commitment: c.CommitID, Slots: rec.SlotCount, DeleteAt: &next, Requester: requester(r), Reason: reason})
+	writeJSON(w, http.StatusOK, PostponedDelete{Commitment: c.CommitID, DeleteAt: next, UsedSlots: usage.Used, RemainingSlots: remaining})
+	return true
+}
@@ -0,0 +1,450 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+	"google.golang.org/api/workflowexecutions/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/internal/taskspb"
+	"go-slot-scheduler/internal/tracing"
+	"go-slot-scheduler/tasks"
+)
+
+// Backends delete tasks and the other callbacks of the service are
+// scheduled with, see DELETE_SCHEDULER.
+const (
+	schedulerCloudTasks = "cloudtasks"
+	schedulerTimer      = "timer"
+	schedulerWorkflows  = "workflows"
+	schedulerPubSub     = "pubsub"
+)
+
+// parseDeleteScheduler reads DELETE_SCHEDULER, and the workflow or topic of
+// the backends needing one.
+func parseDeleteScheduler() error {
+	switch deleteScheduler = getenv("DELETE_SCHEDULER"); deleteScheduler {
+	case "":
+		deleteScheduler = schedulerCloudTasks
+	case schedulerCloudTasks, schedulerTimer:
+	case schedulerWorkflows:
+		// projects/{project}/locations/{location}/workflows/{workflow}
+		if deleteWorkflow = getenv("DELETE_WORKFLOW"); deleteWorkflow == "" {
+			return errors.New("DELETE_SCHEDULER=workflows needs DELETE_WORKFLOW")
+		}
+	case schedulerPubSub:
+		// projects/{project}/topics/{topic}
+		if deleteTopic = getenv("DELETE_PUBSUB_TOPIC"); deleteTopic == "" {
+			return errors.New("DELETE_SCHEDULER=pubsub needs DELETE_PUBSUB_TOPIC")
+		}
+		if !pushVerified() {
+			return errors.New("DELETE_SCHEDULER=pubsub needs PUBSUB_SERVICE_ACCOUNT or PUBSUB_VERIFICATION_TOKEN to verify the pushed tasks")
+		}
+	default:
+		return fmt.Errorf("unknown DELETE_SCHEDULER %q, want cloudtasks, timer, workflows or pubsub", deleteScheduler)
+	}
+	return nil
+}
+
+// parseQueues reads QUEUES, the delete queues as {location}/{queue} in
+// order of preference: the first replaces QUEUE_LOCATION and QUEUE_ID, the
+// others are failed over to.
+func parseQueues(v string) error {
+	if deleteScheduler != schedulerCloudTasks {
+		return errors.New("QUEUES needs DELETE_SCHEDULER=cloudtasks")
+	}
+	seen := make(map[string]bool)
+	for i, q := range strings.Split(v, ",") {
+		location, id, ok := strings.Cut(strings.TrimSpace(q), "/")
+		if !ok || location == "" || id == "" || strings.Contains(id, "/") {
+			return fmt.Errorf("QUEUES must list {location}/{queue}, not %q", q)
+		}
+		name := tasks.QueueName(projectID, location, id)
+		if seen[name] {
+			return fmt.Errorf("QUEUES lists %s twice", q)
+		}
+		seen[name] = true
+		if i == 0 {
+			queueLocation, queue = location, id
+			continue
+		}
+		failoverQueues = append(failoverQueues, name)
+	}
+	return nil
+}
+
+// Bounds Cloud Tasks puts on the dispatch deadline of HTTP tasks.
+const (
+	minDispatchDeadline = 15 * time.Second
+	maxDispatchDeadline = 30 * time.Minute
+)
+
+// parseDeleteTaskRetry reads DELETE_TASK_DISPATCH_DEADLINE, how long a delete
+// task waits for the service, and DELETE_TASK_MIN_BACKOFF and
+// DELETE_TASK_MAX_BACKOFF, the waits between its attempts.
+func parseDeleteTaskRetry() error {
+	deleteTaskDispatchDeadline = 0
+	if v := getenv("DELETE_TASK_DISPATCH_DEADLINE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < minDispatchDeadline || d > maxDispatchDeadline {
+			return fmt.Errorf("DELETE_TASK_DISPATCH_DEADLINE must be a duration between %s and %s", minDispatchDeadline, maxDispatchDeadline)
+		}
+		deleteTaskDispatchDeadline = d
+	}
+	for name, d := range map[string]*time.Duration{"DELETE_TASK_MIN_BACKOFF": &deleteTaskMinBackoff, "DELETE_TASK_MAX_BACKOFF": &deleteTaskMaxBackoff} {
+		*d = 0
+		if v := getenv(name); v != "" {
+			var err error
+			if *d, err = time.ParseDuration(v); err != nil || *d <= 0 {
+				return fmt.Errorf("%s must be a positive duration", name)
+			}
+		}
+	}
+	if deleteTaskMinBackoff > 0 && deleteTaskMaxBackoff > 0 && deleteTaskMinBackoff > deleteTaskMaxBackoff {
+		return errors.New("DELETE_TASK_MIN_BACKOFF is longer than DELETE_TASK_MAX_BACKOFF")
+	}
+	return nil
+}
+
+// deleteTaskRetry is the retry config of the queue set by the
+// DELETE_TASK_* settings.
+func deleteTaskRetry() tasks.RetryConfig {
+	return tasks.RetryConfig{MaxAttempts: deleteTaskMaxAttempts, MinBackoff: deleteTaskMinBackoff, MaxBackoff: deleteTaskMaxBackoff}
+}
+
+// taskQueues returns the Cloud Tasks queues delete tasks are created in.
+func (s *Server) taskQueues() []*tasks.Queue {
+	switch q := s.queue.(type) {
+	case *tasks.Queue:
+		return []*tasks.Queue{q}
+	case *tasks.Queues:
+		return q.Queues
+	}
+	return nil
+}
+
+// createQueues creates the Cloud Tasks queues that don't exist yet with
+// CREATE_QUEUE, retrying their tasks as the DELETE_TASK_* settings say, or
+// as tasks.DefaultRetry for those not set.
+func (s *Server) createQueues(ctx context.Context) error {
+	if !createQueue || deleteScheduler != schedulerCloudTasks {
+		return nil
+	}
+	for _, q := range s.taskQueues() {
+		created, err := q.CreateQueue(ctx, deleteTaskRetry())
+		if err != nil {
+			return fmt.Errorf("creating queue %s, which needs cloudtasks.queues.create: %v", q.Name, err)
+		}
+		if created {
+			logging.Info(ctx, "created queue %s", q.Name)
+		}
+	}
+	return nil
+}
+
+// applyDeleteTaskRetry sets the retry config of the Cloud Tasks queues from
+// the DELETE_TASK_* settings, so failed deletions, such as those before the
+// FLEX minimum of a minute, are retried long enough. Failing to, without
+// the cloudtasks.queues.update permission, leaves a queue as it is.
+func (s *Server) applyDeleteTaskRetry(ctx context.Context) {
+	rc := deleteTaskRetry()
+	if deleteScheduler != schedulerCloudTasks || rc.IsZero() {
+		return
+	}
+	for _, q := range s.taskQueues() {
+		if err := q.SetRetry(ctx, rc); err != nil {
+			logging.Warning(ctx, "setting the retry config of %s: %v", q.Name, err)
+			continue
+		}
+		logging.Info(ctx, "retry config of %s set: %d attempts, backoff %s to %s", q.Name, rc.MaxAttempts, rc.MinBackoff, rc.MaxBackoff)
+	}
+}
+
+// newTaskClient creates the client of the DELETE_SCHEDULER backend.
+func (s *Server) newTaskClient(ctx context.Context) (tasks.Client, error) {
+	switch deleteScheduler {
+	case schedulerTimer:
+		s.timer = tasks.NewTimer(s.runTask)
+		s.timer.MaxAttempts = deleteTaskMaxAttempts
+		s.timer.MinBackoff, s.timer.MaxBackoff = deleteTaskMinBackoff, deleteTaskMaxBackoff
+		s.timer.Store = timerStore{s.store}
+		return s.timer, nil
+	case schedulerWorkflows:
+		svc, err := workflowexecutions.NewService(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("creating workflow executions client: %v", err)
+		}
+		return &tasks.Workflows{Service: svc, Workflow: deleteWorkflow}, nil
+	case schedulerPubSub:
+		svc, err := pubsub.NewService(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("creating pubsub client: %v", err)
+		}
+		s.pushTasks = &pubsubTasks{store: s.store, service: svc, topic: deleteTopic}
+		return s.pushTasks, nil
+	default:
+		tc, err := taskspb.NewClient(ctx, tracing.GRPCOptions()...)
+		if err != nil {
+			return nil, fmt.Errorf("creating cloud tasks client: %v", err)
+		}
+		s.tasks = tc
+		return tasks.NewClient(tc), nil
+	}
+}
+
+// pubsubTasks is a tasks.Client keeping pending tasks in the state store and
+// publishing their names to a topic. A push subscription of the topic to
+// taskPushPath runs them: messages of tasks not due yet are refused, so they
+// come back after the retry backoff of the subscription.
+type pubsubTasks struct {
+	store   stateStore
+	service *pubsub.Service
+	topic   string // projects/{project}/topics/{topic}
+}
+
+var _ tasks.Client = (*pubsubTasks)(nil)
+
+func (q *pubsubTasks) CreateTask(ctx context.Context, req *taskspb.CreateTaskRequest) (*taskspb.Task, error) {
+	t := proto.Clone(req.Task).(*taskspb.Task)
+	if t.Name == "" {
+		id, err := randomHex(8)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "%v", err)
+		}
+		t.Name = req.Parent + "/tasks/" + id
+	}
+	if t.ScheduleTime == nil {
+		t.ScheduleTime = timestamppb.New(time.Now())
+	}
+	t.CreateTime = timestamppb.New(time.Now())
+	rec, err := taskRecord(t)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+
+	err = q.store.PutTask(ctx, rec)
+	if errors.Is(err, errTaskExists) {
+		return nil, status.Errorf(codes.AlreadyExists, "task %s already exists", t.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = q.service.Projects.Topics.Publish(q.topic, &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{{
+			Data:       base64.StdEncoding.EncodeToString([]byte(t.Name)),
+			Attributes: map[string]string{"schedule_time": t.ScheduleTime.AsTime().Format(time.RFC3339)},
+		}},
+	}).Context(ctx).Do()
+	if err != nil {
+		if derr := q.store.DeleteTask(ctx, t.Name); derr != nil {
+			logging.Error(ctx, "removing unpublished task %s: %v", t.Name, derr)
+		}
+		return nil, fmt.Errorf("publishing task %s: %v", t.Name, err)
+	}
+	return t, nil
+}
+
+func (q *pubsubTasks) GetTask(ctx context.Context, req *taskspb.GetTaskRequest) (*taskspb.Task, error) {
+	rec, err := q.store.GetTask(ctx, req.Name)
+	if errors.Is(err, errTaskNotFound) {
+		return nil, status.Errorf(codes.NotFound, "task %s not found", req.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeTask(rec)
+}
+
+// DeleteTask forgets the task, its message is acknowledged without running
+// it when pushed.
+func (q *pubsubTasks) DeleteTask(ctx context.Context, req *taskspb.DeleteTaskRequest) error {
+	err := q.store.DeleteTask(ctx, req.Name)
+	if errors.Is(err, errTaskNotFound) {
+		return status.Errorf(codes.NotFound, "task %s not found", req.Name)
+	}
+	return err
+}
+
+// ListTasks returns the pending tasks of the queue in the order they are
+// scheduled.
+func (q *pubsubTasks) ListTasks(ctx context.Context, req *taskspb.ListTasksRequest) ([]*taskspb.Task, error) {
+	recs, err := q.store.ListTasks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var list []*taskspb.Task
+	for _, rec := range recs {
+		if !strings.HasPrefix(rec.Name, req.Parent+"/tasks/") {
+			continue
+		}
+		t, err := decodeTask(rec)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ScheduleTime.AsTime().Before(list[j].ScheduleTime.AsTime())
+	})
+	return list, nil
+}
+
+func taskRecord(t *taskspb.Task) (*TaskRecord, error) {
+	b, err := taskspb.Marshal(t)
+	if err != nil {
+		return nil, fmt.Errorf("encoding task %s: %v", t.Name, err)
+	}
+	return &TaskRecord{Name: t.Name, ScheduleTime: t.ScheduleTime.AsTime(), Task: b, Format: taskFormatJSON}, nil
+}
+
+func decodeTask(rec *TaskRecord) (*taskspb.Task, error) {
+	t, err := taskspb.Unmarshal(rec.Task, rec.Format != taskFormatJSON)
+	if err != nil {
+		return nil, fmt.Errorf("decoding task %s: %v", rec.Name, err)
+	}
+	return t, nil
+}
+
+// timerStore keeps the tasks of DELETE_SCHEDULER=timer in the state store,
+// so the deletions pending when the process stops are reloaded at startup.
+type timerStore struct {
+	store stateStore
+}
+
+var _ tasks.TimerStore = timerStore{}
+
+func (ts timerStore) PutTask(ctx context.Context, t *taskspb.Task) error {
+	rec, err := taskRecord(t)
+	if err != nil {
+		return err
+	}
+	err = ts.store.PutTask(ctx, rec)
+	if errors.Is(err, errTaskExists) {
+		return status.Errorf(codes.AlreadyExists, "task %s already exists", t.Name)
+	}
+	return err
+}
+
+func (ts timerStore) DeleteTask(ctx context.Context, name string) error {
+	if err := ts.store.DeleteTask(ctx, name); err != nil && !errors.Is(err, errTaskNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (ts timerStore) ListTasks(ctx context.Context) ([]*taskspb.Task, error) {
+	recs, err := ts.store.ListTasks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*taskspb.Task, 0, len(recs))
+	for _, rec := range recs {
+		t, err := decodeTask(rec)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, nil
+}
+
+// taskPushHandler runs the task named by a message of the DELETE_PUBSUB_TOPIC
+// push subscription once it is due. Answering with an error has Pub/Sub
+// deliver the message again later.
+func (s *Server) taskPushHandler(w http.ResponseWriter, r *http.Request) {
+	if s.pushTasks == nil {
+		writeError(w, http.StatusNotImplemented, codeNotImplemented, "%s needs DELETE_SCHEDULER=pubsub", r.URL.Path)
+		return
+	}
+	if err := verifyPushRequest(r, taskPushPath); err != nil {
+		logging.Warning(r.Context(), "rejected %s request: %v", r.URL.Path, err)
+		writeError(w, http.StatusUnauthorized, codeUnauthenticated, "unauthorized")
+		return
+	}
+
+	var env PushEnvelope
+	if err := json.NewDecoder(r.Body).Decode(&env); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	name := string(env.Message.Data)
+	ctx := logging.WithFields(r.Context(), "task", name, "pubsub_message", env.Message.MessageID)
+	rec, err := s.store.GetTask(ctx, name)
+	if errors.Is(err, errTaskNotFound) {
+		// Deleted, or already run.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "getting task: %v", err)
+		logging.Error(ctx, "getting task %s: %v", name, err)
+		return
+	}
+	if wait := time.Until(rec.ScheduleTime); wait > 0 {
+		writeError(w, http.StatusServiceUnavailable, codeTaskNotDue, "task %s is due in %s", name, wait.Round(time.Second))
+		return
+	}
+
+	t, err := decodeTask(rec)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(ctx, "%v", err)
+		return
+	}
+	if attempt, err := strconv.Atoi(r.Header.Get("X-Goog-Delivery-Attempt")); err == nil {
+		t.DispatchCount = int32(attempt - 1)
+	}
+	if err := s.runTask(ctx, t); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(ctx, "running task %s: %v", name, err)
+		return
+	}
+	if err := s.store.DeleteTask(ctx, name); err != nil && !errors.Is(err, errTaskNotFound) {
+		logging.Error(ctx, "removing task %s: %v", name, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runTask serves the HTTP request of t in process, with the headers Cloud
+// Tasks adds. Only the path of its URL matters.
+func (s *Server) runTask(ctx context.Context, t *taskspb.Task) error {
+	h := t.GetHttpRequest()
+	if h == nil {
+		return fmt.Errorf("task %s has no HTTP request", t.Name)
+	}
+	req, err := http.NewRequestWithContext(withInternalCall(ctx), h.HttpMethod.String(), h.Url, bytes.NewReader(h.Body))
+	if err != nil {
+		return err
+	}
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+	parts := strings.Split(t.Name, "/")
+	req.Header.Set("X-CloudTasks-TaskName", parts[len(parts)-1])
+	req.Header.Set("X-CloudTasks-TaskRetryCount", strconv.Itoa(int(t.DispatchCount)))
+
+	w := newResponseBuffer()
+	s.Handler().ServeHTTP(w, req)
+	if w.status()/100 != 2 {
+		return fmt.Errorf("%s %s: %d %s", req.Method, req.URL.Path, w.status(), strings.TrimSpace(w.body.String()))
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// errDraining refuses purchases once the server is shutting down.
+var errDraining = errors.New("the instance is shutting down, try again")
+
+// operation is a purchase or deletion in flight.
+type operation struct {
+	what    string
+	started time.Time
+	mu      sync.Mutex
+	// entry is recorded if the operation is still running when the drain
+	// times out.
+	entry LedgerEntry
+	// interrupt, if set, is called instead for a request run in the
+	// background, whose purchases and deletions are recorded on their own.
+	interrupt func(reason string)
+}
+
+// update changes what is recorded of o if it is interrupted, such as the
+// commitment once it is bought.
+func (o *operation) update(f func(e *LedgerEntry)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	f(&o.entry)
+}
+
+// operations tracks the scaling operations in flight, so shutdown can wait
+// for them. The zero value is ready to use.
+type operations struct {
+	mu       sync.Mutex
+	inFlight map[*operation]bool
+	draining bool
+	// idle is closed once draining and nothing is in flight.
+	idle chan struct{}
+}
+
+// begin tracks an operation described by e until the returned func is
+// called. Once draining it is refused with errDraining, unless it must run
+// regardless, as deletions and the rollbacks of purchases do.
+func (ops *operations) begin(what string, e LedgerEntry, mustRun bool) (*operation, func(), error) {
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	if ops.draining && !mustRun {
+		return nil, nil, errDraining
+	}
+	if ops.inFlight == nil {
+		ops.inFlight = make(map[*operation]bool)
+	}
+	op := &operation{what: what, started: time.Now(), entry: e}
+	ops.inFlight[op] = true
+	return op, func() {
+		ops.mu.Lock()
+		defer ops.mu.Unlock()
+		delete(ops.inFlight, op)
+		if ops.draining && len(ops.inFlight) == 0 && ops.idle != nil {
+			close(ops.idle)
+			ops.idle = nil
+		}
+	}, nil
+}
+
+// drain refuses new operations and returns a channel closed once those in
+// flight are done.
+func (ops *operations) drain() <-chan struct{} {
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	ops.draining = true
+	idle := make(chan struct{})
+	if len(ops.inFlight) == 0 {
+		close(idle)
+	} else {
+		ops.idle = idle
+	}
+	return idle
+}
+
+// isDraining reports whether drain was called.
+func (ops *operations) isDraining() bool {
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	return ops.draining
+}
+
+// running returns the operations still in flight.
+func (ops *operations) running() []*operation {
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	list := make([]*operation, 0, len(ops.inFlight))
+	for op := range ops.inFlight {
+		list = append(list, op)
+	}
+	return list
+}
+
+// Drain stops new purchases and waits for the purchases and deletions in
+// flight, with the rollbacks they may need, until ctx is done. Those still
+// running then are recorded in the ledger as interrupted, for the reconciler
+// and whoever reads it to pick up.
+func (s *Server) Drain(ctx context.Context) error {
+	idle := s.ops.drain()
+	if n := len(s.ops.running()); n > 0 {
+		logging.Info(ctx, "draining %d scaling operations", n)
+	}
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+	}
+	running := s.ops.running()
+	for _, op := range running {
+		op.mu.Lock()
+		e, interrupt := op.entry, op.interrupt
+		op.mu.Unlock()
+		if interrupt != nil {
+			logging.Error(ctx, "%s interrupted by shutdown", op.what)
+			interrupt(fmt.Sprintf("interrupted by the shutdown of its instance %s after it started", time.Since(op.started).Round(time.Second)))
+			continue
+		}
+		e.Time = time.Time{}
+		e.Action = actionInterrupted
+		e.Error = fmt.Sprintf("%s still running %s after it started, when the instance shut down", op.what, time.Since(op.started).Round(time.Second))
+		logging.Error(ctx, "%s in %s interrupted by shutdown: %s", op.what, e.Region, e.Error)
+		s.record(ctx, e)
+	}
+	return fmt.Errorf("%d scaling operations interrupted", len(running))
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/scheduler"
+)
+
+// Kinds of drift between the capacity wanted and the capacity held.
+const (
+	// driftMissing is capacity a profile or schedule should hold and doesn't.
+	driftMissing = "missing_capacity"
+	// driftExtra is capacity a profile holds past its level.
+	driftExtra = "extra_capacity"
+	// driftUnmanaged is a FLEX commitment the service didn't buy.
+	driftUnmanaged = "unmanaged_commitment"
+	// driftDeleteMissed is a commitment alive past its delete time.
+	driftDeleteMissed = "delete_not_fired"
+)
+
+// requesterDrift is the requester of actions taken to remediate drift.
+const requesterDrift = "drift"
+
+// Drift is one difference between the capacity wanted and the capacity held.
+type Drift struct {
+	Kind       string `json:"kind"`
+	Region     string `json:"region"`
+	Source     string `json:"source,omitempty"` // profile/{id} or schedule/{id}
+	Commitment string `json:"commitment,omitempty"`
+	Slots      int64  `json:"slots"` // missing or extra
+	Detail     string `json:"detail"`
+	Remediated bool   `json:"remediated,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	// remediate fixes the drift, nil if it is only reported.
+	remediate func(ctx context.Context) error
+}
+
+// DriftReport lists the drift found by a pass.
+type DriftReport struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Drift     []*Drift  `json:"drift"`
+	Errors    []string  `json:"errors,omitempty"`
+}
+
+// runDriftDetector looks for drift every interval until ctx is done,
+// remediating it with DRIFT_REMEDIATE.
+func (s *Server) runDriftDetector(ctx context.Context, interval time.Duration) {
+	logging.Info(ctx, "looking for drift every %s, remediate %t", interval, driftRemediate)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			res, err := s.detectDrift(ctx, driftRemediate)
+			if err != nil {
+				logging.Error(ctx, "looking for drift: %v", err)
+				continue
+			}
+			if len(res.Drift) > 0 {
+				logging.Warning(ctx, "found %d drifts", len(res.Drift))
+			}
+		}
+	}
+}
+
+// driftHandler reports drift, and remediates it with ?remediate=true.
+func (s *Server) driftHandler(w http.ResponseWriter, r *http.Request) {
+	remediate := false
+	if v := r.URL.Query().Get("remediate"); v != "" {
+		var err error
+		if remediate, err = strconv.ParseBool(v); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "remediate must be true or false")
+			return
+		}
+	}
+	if remediate && !hasRole(r, roleOperator) {
+		writeError(w, http.StatusForbidden, codeForbidden, "remediating drift needs the %s role", roleOperator)
+		return
+	}
+	res, err := s.detectDrift(r.Context(), remediate)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// detectDrift compares the levels of the profiles and the windows of the
+// schedules with the commitments held, and the commitments held with what
+// the service bought and when it was to delete them. Changes less than
+// reconcileGrace old are left to the loops making them. With remediate, the
+// drift the service owns is fixed: profiles are leveled, schedules bought
+// for the rest of their window, and overdue commitments deleted. Operators
+// are notified of what is found either way.
+func (s *Server) detectDrift(ctx context.Context, remediate bool) (*DriftReport, error) {
+	recs, err := s.store.ListCommitments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing recorded commitments: %v", err)
+	}
+	profiles, err := s.store.ListProfiles(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing profiles: %v", err)
+	}
+	schedules, err := s.store.ListSchedules(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing schedules: %v", err)
+	}
+
+	now := time.Now()
+	res := &DriftReport{CheckedAt: now, Drift: []*Drift{}}
+	for _, p := range profiles {
+		if d, err := s.profileDrift(ctx, p, now); err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("checking profile %s: %v", p.ID, err))
+		} else if d != nil {
+			res.Drift = append(res.Drift, d)
+		}
+	}
+	for _, sc := range schedules {
+		if d := s.scheduleDrift(sc, recs, now); d != nil {
+			res.Drift = append(res.Drift, d)
+		}
+	}
+	held, errs := s.commitmentDrift(ctx, recs, profiles, schedules, now)
+	res.Drift = append(res.Drift, held...)
+	res.Errors = append(res.Errors, errs...)
+
+	if remediate && dryRun {
+		logging.Info(ctx, "dry run: not remediating drift")
+		remediate = false
+	}
+	if remediate {
+		for _, d := range res.Drift {
+			if d.remediate == nil {
+				continue
+			}
+			ctx := logging.WithFields(ctx, "region", d.Region)
+			if err := d.remediate(ctx); err != nil {
+				d.Error = err.Error()
+				logging.Error(ctx, "remediating %s of %s: %v", d.Kind, d.Source+d.Commitment, err)
+				continue
+			}
+			d.Remediated = true
+		}
+	}
+
+	if len(res.Drift) > 0 {
+		summaries := make([]string, 0, len(res.Drift))
+		for _, d := range res.Drift {
+			summary := d.Detail
+			if d.Remediated {
+				summary += " (remediated)"
+			}
+			summaries = append(summaries, summary)
+		}
+		s.notify(ctx, Event{
+			Type:    eventDrift,
+			Summary: fmt.Sprintf("%d drifts found: %s", len(res.Drift), strings.Join(summaries, "; ")),
+		})
+	}
+	return res, nil
+}
+
+// profileDrift compares what is held for p with its level, if it has held
+// for reconcileGrace.
+func (s *Server) profileDrift(ctx context.Context, p *scheduler.Profile, now time.Time) (*Drift, error) {
+	if p.Paused || p.DryRun {
+		return nil, nil
+	}
+	target, _, err := p.Target(now)
+	if err != nil {
+		return nil, err
+	}
+	if before, _, err := p.Target(now.Add(-reconcileGrace)); err != nil || before != target {
+		return nil, err
+	}
+	held, err := s.profileCommitments(ctx, p, now)
+	if err != nil {
+		return nil, err
+	}
+	var slots int64
+	for _, rec := range held {
+		slots += rec.SlotCount
+	}
+
+	d := &Drift{Region: p.Region, Source: "profile/" + p.ID}
+	switch {
+	case slots < target:
+		d.Kind, d.Slots = driftMissing, target-slots
+		d.Detail = fmt.Sprintf("profile %s holds %d of its %d slots in %s", p.ID, slots, target, p.Region)
+	case slots-target >= slotIncrement:
+		d.Kind, d.Slots = driftExtra, slots-target
+		d.Detail = fmt.Sprintf("profile %s holds %d slots in %s, %d over its level", p.ID, slots, p.Region, slots-target)
+	default:
+		return nil, nil
+	}
+	id := p.ID
+	d.remediate = func(ctx context.Context) error {
+		_, err := s.applyProfile(ctx, id, time.Now())
+		return err
+	}
+	return d, nil
+}
+
+// scheduleDrift reports the slots missing from the window sc is in, if its
+// last run is more than reconcileGrace ago.
+func (s *Server) scheduleDrift(sc *scheduler.Schedule, recs []*CommitmentRecord, now time.Time) *Drift {
+	if sc.Paused || sc.DryRun || sc.LastRun.IsZero() || now.Sub(sc.LastRun) < reconcileGrace {
+		return nil
+	}
+	_, window, err := sc.Spec(0)
+	if err != nil {
+		return nil
+	}
+	end := sc.LastRun.Add(window)
+	if !now.Before(end) {
+		return nil
+	}
+	requester := "schedule/" + sc.ID
+	var held int64
+	for _, rec := range recs {
+		if rec.Requester == requester && rec.DeleteAt.After(now) {
+			held += rec.SlotCount
+		}
+	}
+	if held >= sc.Slots {
+		return nil
+	}
+
+	missing := (sc.Slots - held + slotIncrement - 1) / slotIncrement * slotIncrement
+	d := &Drift{
+		Kind:   driftMissing,
+		Region: sc.Region,
+		Source: requester,
+		Slots:  missing,
+		Detail: fmt.Sprintf("schedule %s holds %d of its %d slots in %s until %s", sc.ID, held, sc.Slots, sc.Region, end.Format(time.RFC3339)),
+	}
+	d.remediate = func(ctx context.Context) error {
+		deleteAt := end
+		if earliest := time.Now().Add(time.Duration(defaultMinute) * time.Minute); deleteAt.Before(earliest) {
+			deleteAt = earliest
+		}
+		_, err := s.purchase(ctx, purchaseRequest{
+			Project:   sc.Project,
+			Region:    sc.Region,
+			Slots:     missing,
+			Plan:      reservationpb.CapacityCommitment_FLEX,
+			DeleteAt:  deleteAt,
+			DeleteURL: sc.DeleteURL,
+			Audience:  sc.Audience,
+			Requester: requester,
+			Reason:    sc.Reason,
+		})
+		return err
+	}
+	return d
+}
+
+// commitmentDrift lists the commitments of the regions the service manages
+// and reports those alive past their delete time, which are deleted on
+// remediation, and the FLEX commitments it didn't buy, which are only
+// reported since capacity bought by other means is never touched.
+func (s *Server) commitmentDrift(ctx context.Context, recs []*CommitmentRecord, profiles []*scheduler.Profile, schedules []*scheduler.Schedule, now time.Time) ([]*Drift, []string) {
+	known := make(map[string]*CommitmentRecord, len(recs))
+	regions := make(map[string]bool)
+	for _, rec := range recs {
+		known[rec.Name] = rec
+		if resourceProject(rec.Name) == projectID {
+			regions[rec.Region] = true
+		}
+	}
+	for _, p := range profiles {
+		regions[p.Region] = true
+	}
+	for _, sc := range schedules {
+		if sc.Project == "" || sc.Project == projectID {
+			regions[sc.Region] = true
+		}
+	}
+	names := make([]string, 0, len(regions))
+	for region := range regions {
+		names = append(names, region)
+	}
+	sort.Strings(names)
+
+	var (
+		drift []*Drift
+		errs  []string
+	)
+	for _, region := range names {
+		list, err := s.capacity.List(ctx, capacity.Parent(projectID, region))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("listing commitments in %s: %v", region, err))
+			continue
+		}
+		for _, c := range list {
+			rec, ok := known[c.Name]
+			if !ok {
+				if c.Plan == reservationpb.CapacityCommitment_FLEX && now.Sub(c.CommitmentStartTime.AsTime()) > reconcileGrace {
+					drift = append(drift, &Drift{
+						Kind:       driftUnmanaged,
+						Region:     region,
+						Commitment: c.Name,
+						Slots:      c.SlotCount,
+						Detail:     fmt.Sprintf("%s of %d FLEX slots in %s was not bought by the service", c.Name, c.SlotCount, region),
+					})
+				}
+				continue
+			}
+			if rec.DeleteAt.IsZero() || !now.After(rec.DeleteAt.Add(overdueAfter)) {
+				continue
+			}
+			d := &Drift{
+				Kind:       driftDeleteMissed,
+				Region:     region,
+				Source:     rec.Requester,
+				Commitment: c.Name,
+				Slots:      c.SlotCount,
+				Detail:     fmt.Sprintf("%s of %d slots in %s is alive %s past its delete time", c.Name, c.SlotCount, region, now.Sub(rec.DeleteAt).Round(time.Minute)),
+			}
+			name, slots := c.Name, c.SlotCount
+			d.remediate = func(ctx context.Context) error {
+				if err := s.deleteCapacity(ctx, name); err != nil {
+					s.record(ctx, LedgerEntry{Action: actionDeleteFailed, Commitment: name, Slots: slots, Requester: requesterDrift, Error: err.Error()})
+					return err
+				}
+				s.record(ctx, LedgerEntry{Action: actionDeleted, Commitment: name, Slots: slots, Requester: requesterDrift})
+				s.resolveIncident(ctx, name)
+				return nil
+			}
+			drift = append(drift, d)
+		}
+	}
+	return drift, errs
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+)
+
+// DryRunDelete is what a dry run delete request would have deleted.
+type DryRunDelete struct {
+	Commitment string `json:"commitment"`
+	Slots      int64  `json:"slots"`
+	Split      bool   `json:"split"`
+	// DeleteAt is when the delete can happen, now unless the commitment is
+	// still in its minimum duration.
+	DeleteAt time.Time `json:"delete_at"`
+	DryRun   bool      `json:"dry_run"`
+}
+
+// dryPurchase works out what purchase would buy for req without buying it.
+func (s *Server) dryPurchase(ctx context.Context, req purchaseRequest) (*AddCapacityResponse, error) {
+	parent := fmt.Sprintf("projects/%s/locations/%s", req.Project, req.Region)
+	limit := maxSlotsFor(req.Project, req.Region)
+	slots, total, err := s.capacity.Available(ctx, parent, req.Slots, limit)
+	if err != nil {
+		return nil, fmt.Errorf("getting project slots: %v", err)
+	}
+	if slots <= 0 {
+		logging.Info(ctx, "dry run: %s is at its slot cap, nothing would be bought", req.Region)
+		return nil, &capacity.CapReachedError{Parent: parent, Requested: req.Slots, Total: total, MaxSlots: limit}
+	}
+	if slots <= 100 {
+		slots = 100 // minimum commitment is 100 slots
+	}
+
+	resp := &AddCapacityResponse{
+		SlotsRequested: req.Slots,
+		SlotsPurchased: slots,
+		Plan:           req.Plan.String(),
+		DryRun:         true,
+	}
+	if !req.DeleteAt.IsZero() {
+		resp.DeleteAt = timePtr(req.DeleteAt)
+		resp.EstimatedCost = estimateCost(req.Region, resp.Plan, slots, time.Until(req.DeleteAt))
+		logging.Info(ctx, "dry run: would buy %d %s slots in %s until %s", slots, req.Plan, parent, req.DeleteAt.Format(time.RFC3339))
+	} else {
+		logging.Info(ctx, "dry run: would buy %d %s slots in %s and keep them", slots, req.Plan, parent)
+	}
+	return resp, nil
+}
+
+// dryDelete reports what a delete request for c would delete.
+func (s *Server) dryDelete(w http.ResponseWriter, r *http.Request, c Commit) {
+	commit, err := s.capacity.Get(r.Context(), c.CommitID)
+	if status.Code(err) == codes.NotFound {
+		writeJSON(w, http.StatusOK, "commitment already deleted or expired")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+
+	d := &DryRunDelete{Commitment: commit.Name, Slots: commit.SlotCount, DeleteAt: time.Now(), DryRun: true}
+	if c.Slots > 0 && c.Slots < commit.SlotCount {
+		if c.Slots%slotIncrement != 0 || commit.Plan != reservationpb.CapacityCommitment_FLEX || commit.SlotCount-c.Slots < slotIncrement {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "%d slots can not be split off %s of %d %s slots", c.Slots, commit.Name, commit.SlotCount, commit.Plan)
+			return
+		}
+		d.Slots, d.Split = c.Slots, true
+	}
+	if at, ok := s.capacity.EarliestDelete(r.Context(), commit.Name); ok {
+		d.DeleteAt = at
+	}
+	logging.Info(r.Context(), "dry run: would delete %d slots of %s at %s", d.Slots, commit.Name, d.DeleteAt.Format(time.RFC3339))
+	writeJSON(w, http.StatusOK, d)
+}
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+)
+
+// autoscaleIncrement is the granularity of the autoscale max of edition
+// reservations.
+const autoscaleIncrement = 50
+
+// autoscaleRevertPath is called by the task reverting an autoscale bump.
+const autoscaleRevertPath = reservationsPath + "/autoscale/revert"
+
+// The edition and autoscale fields of reservations came with BigQuery
+// editions, after the genproto types the service is built with. They are
+// read from and written to the unknown fields of the message, which the
+// client sends and keeps as they are.
+const (
+	reservationAutoscaleField  protowire.Number = 7
+	reservationEditionField    protowire.Number = 17
+	autoscaleCurrentSlotsField protowire.Number = 1
+	autoscaleMaxSlotsField     protowire.Number = 2
+)
+
+// editions are the names of the values of the Edition enum.
+var editions = []string{"EDITION_UNSPECIFIED", "STANDARD", "ENTERPRISE", "ENTERPRISE_PLUS"}
+
+// AutoscaleInfo is the autoscaling of an edition reservation, up to MaxSlots
+// on top of its baseline.
+type AutoscaleInfo struct {
+	CurrentSlots int64 `json:"current_slots"`
+	MaxSlots     int64 `json:"max_slots"`
+}
+
+// parseEdition returns the Edition value of name, in any case.
+func parseEdition(name string) (uint64, bool) {
+	for i, e := range editions {
+		if i > 0 && strings.EqualFold(name, e) {
+			return uint64(i), true
+		}
+	}
+	return 0, false
+}
+
+// eachField calls f with the number, type and value of every field of the
+// encoded message b.
+func eachField(b []byte, f func(num protowire.Number, typ protowire.Type, v []byte)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return
+		}
+		m := protowire.ConsumeFieldValue(num, typ, b[n:])
+		if m < 0 {
+			return
+		}
+		f(num, typ, b[n:n+m])
+		b = b[n+m:]
+	}
+}
+
+// editionFields returns the edition of r, empty for reservations of the
+// flat-rate model, and its autoscaling, nil without.
+func editionFields(r *reservationpb.Reservation) (edition string, autoscale *AutoscaleInfo) {
+	eachField(r.ProtoReflect().GetUnknown(), func(num protowire.Number, typ protowire.Type, v []byte) {
+		switch {
+		case num == reservationEditionField && typ == protowire.VarintType:
+			if e, _ := protowire.ConsumeVarint(v); e > 0 && e < uint64(len(editions)) {
+				edition = editions[e]
+			}
+		case num == reservationAutoscaleField && typ == protowire.BytesType:
+			msg, _ := protowire.ConsumeBytes(v)
+			autoscale = &AutoscaleInfo{}
+			eachField(msg, func(num protowire.Number, typ protowire.Type, v []byte) {
+				if typ != protowire.VarintType {
+					return
+				}
+				n, _ := protowire.ConsumeVarint(v)
+				switch num {
+				case autoscaleCurrentSlotsField:
+					autoscale.CurrentSlots = int64(n)
+				case autoscaleMaxSlotsField:
+					autoscale.MaxSlots = int64(n)
+				}
+			})
+		}
+	})
+	return edition, autoscale
+}
+
+// setEditionFields sets the edition of r, unless empty, and the autoscale
+// max, unless nil. edition must be valid.
+func setEditionFields(r *reservationpb.Reservation, edition string, maxSlots *int64) {
+	b := r.ProtoReflect().GetUnknown()
+	if e, ok := parseEdition(edition); ok {
+		b = protowire.AppendTag(b, reservationEditionField, protowire.VarintType)
+		b = protowire.AppendVarint(b, e)
+	}
+	if maxSlots != nil {
+		a := protowire.AppendTag(nil, autoscaleMaxSlotsField, protowire.VarintType)
+		a = protowire.AppendVarint(a, uint64(*maxSlots))
+		b = protowire.AppendTag(b, reservationAutoscaleField, protowire.BytesType)
+		b = protowire.AppendBytes(b, a)
+	}
+	r.ProtoReflect().SetUnknown(b)
+}
+
+// validateEditionFields checks the edition and autoscale max of req.
+func (req *ReservationRequest) validateEditionFields(v *validator) {
+	if req.Edition != "" {
+		_, ok := parseEdition(req.Edition)
+		v.check(ok, "edition", "must be STANDARD, ENTERPRISE or ENTERPRISE_PLUS")
+	}
+	if req.AutoscaleMaxSlots != nil {
+		v.check(*req.AutoscaleMaxSlots >= 0 && *req.AutoscaleMaxSlots%autoscaleIncrement == 0, "autoscale_max_slots", "must be a multiple of %d, zero or more", autoscaleIncrement)
+	}
+}
+
+// AutoscaleBump raises the autoscale max of an edition reservation to
+// MaxSlots for Minutes.
+type AutoscaleBump struct {
+	MaxSlots int64 `json:"max_slots"`
+	Minutes  int64 `json:"minutes"`
+	RequestMetadata
+}
+
+// AutoscaleBumpResponse is the bumped reservation and when it is reverted.
+type AutoscaleBumpResponse struct {
+	Reservation ReservationInfo `json:"reservation"`
+	RevertTo    int64           `json:"revert_to"`
+	RevertAt    time.Time       `json:"revert_at"`
+	RevertTask  string          `json:"revert_task"`
+}
+
+// AutoscaleRevert is the body of a revert task: the autoscale max of
+// Reservation goes back to MaxSlots, unless it was changed from BumpedTo
+// since.
+type AutoscaleRevert struct {
+	Reservation string `json:"reservation"`
+	MaxSlots    int64  `json:"max_slots"`
+	BumpedTo    int64  `json:"bumped_to"`
+}
+
+// revertTaskPrefix is the start of the names of the tasks reverting a
+// change of kind, such as autoscale, to the reservation id of region.
+func (s *Server) revertTaskPrefix(kind, region, id string) string {
+	return s.queue.TaskName(fmt.Sprintf("%s-%s-%s-", kind, region, id))
+}
+
+// pendingRevert finds the pending task whose name starts with prefix,
+// decoding its body into body. It returns its name and time, or an empty
+// name if there is none.
+func (s *Server) pendingRevert(ctx context.Context, prefix string, body interface{}) (string, time.Time, error) {
+	list, err := s.queue.List(ctx)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("listing tasks: %v", err)
+	}
+	for _, t := range list {
+		if !strings.HasPrefix(t.Name, prefix) {
+			continue
+		}
+		if err := json.Unmarshal(t.GetHttpRequest().GetBody(), body); err != nil {
+			return "", time.Time{}, fmt.Errorf("decoding task %s: %v", t.Name, err)
+		}
+		return t.Name, t.ScheduleTime.AsTime(), nil
+	}
+	return "", time.Time{}, nil
+}
+
+// bumpAutoscaleHandler raises the autoscale max of an edition reservation
+// for a window, scheduling a task to put it back. Bumping a reservation
+// already bumped keeps the max of before the first bump to revert to, and
+// reverts at the later of the two ends.
+func (s *Server) bumpAutoscaleHandler(w http.ResponseWriter, r *http.Request) {
+	var req AutoscaleBump
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+	var v validator
+	v.check(req.MaxSlots > 0 && req.MaxSlots%autoscaleIncrement == 0, "max_slots", "must be a positive multiple of %d", autoscaleIncrement)
+	v.minutes("minutes", &req.Minutes)
+	req.RequestMetadata.validate(&v)
+	if err := v.err(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	name := reservationName(vars["region"], vars["id"])
+	who, caller := req.who(r)
+	ctx := logging.WithFields(r.Context(), "reservation", name)
+
+	unlock, err := s.store.Lock(ctx, "reservation/"+name, purchaseLockTTL)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "waiting for reservation lock: %v", err)
+		logging.Error(ctx, "waiting for reservation lock: %v", err)
+		return
+	}
+	defer unlock()
+
+	var res *reservationpb.Reservation
+	err = retryPolicy.Do(ctx, "GetReservation", func(ctx context.Context) (err error) {
+		res, err = s.reservationsFor(name).GetReservation(ctx, &reservationpb.GetReservationRequest{Name: name})
+		return err
+	})
+	if err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+	edition, autoscale := editionFields(res)
+	if edition == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "reservation %s has no edition, only edition reservations autoscale", name)
+		return
+	}
+	current := int64(0)
+	if autoscale != nil {
+		current = autoscale.MaxSlots
+	}
+
+	var pending AutoscaleRevert
+	pendingTask, pendingAt, err := s.pendingRevert(ctx, s.revertTaskPrefix("autoscale", vars["region"], vars["id"]), &pending)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(ctx, "finding revert task: %v", err)
+		return
+	}
+	revertTo, revertAt := current, time.Now().Add(time.Duration(req.Minutes)*time.Minute)
+	if pendingTask != "" {
+		revertTo = pending.MaxSlots
+		if pendingAt.After(revertAt) {
+			revertAt = pendingAt
+		}
+	} else if req.MaxSlots <= current {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "the autoscale max of %s is %d already", name, current)
+		return
+	}
+
+	res, err = s.setAutoscaleMax(ctx, name, req.MaxSlots)
+	if err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+	rev := AutoscaleRevert{Reservation: name, MaxSlots: revertTo, BumpedTo: req.MaxSlots}
+	taskName := fmt.Sprintf("%s%d", s.revertTaskPrefix("autoscale", vars["region"], vars["id"]), revertAt.Unix())
+	task, err := s.queue.CreateHTTP(ctx, taskName, taskURL(r, autoscaleRevertPath), deleteAudience(r), rev, revertAt)
+	if err != nil {
+		// Never leave the max raised without a revert.
+		if _, rerr := s.setAutoscaleMax(ctx, name, current); rerr != nil {
+			logging.Error(ctx, "putting the autoscale max of %s back to %d: %v", name, current, rerr)
+		}
+		writeError(w, http.StatusInternalServerError, codeInternal, "scheduling revert: %v", err)
+		logging.Error(ctx, "scheduling autoscale revert of %s: %v", name, err)
+		return
+	}
+	if pendingTask != "" && pendingTask != task.Name {
+		if err := s.queue.Delete(ctx, pendingTask); err != nil && status.Code(err) != codes.NotFound {
+			logging.Error(ctx, "deleting revert task %s: %v", pendingTask, err)
+		}
+	}
+
+	logging.Info(ctx, "autoscale max of %s bumped from %d to %d until %s", name, current, req.MaxSlots, revertAt.Format(time.RFC3339))
+	s.record(ctx, LedgerEntry{Action: actionAutoscaleBumped, Region: vars["region"], Reservation: name, Slots: req.MaxSlots, Requester: who, Caller: caller, Reason: req.Reason, Ticket: req.Ticket})
+	writeJSON(w, http.StatusOK, AutoscaleBumpResponse{Reservation: reservationInfo(res), RevertTo: revertTo, RevertAt: revertAt, RevertTask: task.Name})
+}
+
+// autoscaleRevertHandler puts the autoscale max of a bumped reservation
+// back. A max changed since the bump, or a reservation deleted, is left as
+// it is.
+func (s *Server) autoscaleRevertHandler(w http.ResponseWriter, r *http.Request) {
+	var rev AutoscaleRevert
+	if err := json.NewDecoder(r.Body).Decode(&rev); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+	ctx := logging.WithFields(r.Context(), "reservation", rev.Reservation)
+
+	unlock, err := s.store.Lock(ctx, "reservation/"+rev.Reservation, purchaseLockTTL)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "waiting for reservation lock: %v", err)
+		logging.Error(ctx, "waiting for reservation lock: %v", err)
+		return
+	}
+	defer unlock()
+
+	var res *reservationpb.Reservation
+	err = retryPolicy.Do(ctx, "GetReservation", func(ctx context.Context) (err error) {
+		res, err = s.reservationsFor(rev.Reservation).GetReservation(ctx, &reservationpb.GetReservationRequest{Name: rev.Reservation})
+		return err
+	})
+	if status.Code(err) == codes.NotFound {
+		writeJSON(w, http.StatusOK, "reservation deleted")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(ctx, "getting reservation: %v", err)
+		return
+	}
+	if _, autoscale := editionFields(res); autoscale == nil || autoscale.MaxSlots != rev.BumpedTo {
+		logging.Warning(ctx, "autoscale max of %s changed since it was bumped to %d, leaving it", rev.Reservation, rev.BumpedTo)
+		writeJSON(w, http.StatusOK, "autoscale max changed since the bump")
+		return
+	}
+
+	if _, err := s.setAutoscaleMax(ctx, rev.Reservation, rev.MaxSlots); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(ctx, "reverting autoscale max: %v", err)
+		return
+	}
+	logging.Info(ctx, "autoscale max of %s reverted from %d to %d", rev.Reservation, rev.BumpedTo, rev.MaxSlots)
+	s.record(ctx, LedgerEntry{Action: actionAutoscaleReverted, Region: capacity.Region(rev.Reservation), Reservation: rev.Reservation, Slots: rev.MaxSlots, Requester: requesterAutoscaleBump})
+	writeJSON(w, http.StatusOK, "autoscale max reverted")
+}
+
+// setAutoscaleMax sets the autoscale max of the reservation name.
+func (s *Server) setAutoscaleMax(ctx context.Context, name string, maxSlots int64) (*reservationpb.Reservation, error) {
+	res := &reservationpb.Reservation{Name: name}
+	setEditionFields(res, "", &maxSlots)
+	return s.updateReservation(ctx, res, &fieldmaskpb.FieldMask{Paths: []string{"autoscale.max_slots"}})
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"go-slot-scheduler/config"
+)
+
+// redacted replaces the values of secret settings.
+const redacted = "REDACTED"
+
+// EffectiveConfig is the configuration the service runs with, once the
+// config file, environment, flags and defaults are merged and the last
+// reload applied.
+type EffectiveConfig struct {
+	Project    string          `json:"project"`
+	ConfigPath string          `json:"config_path,omitempty"`
+	Regions    []string        `json:"regions"`
+	Caps       CapsConfig      `json:"caps"`
+	Plan       string          `json:"default_plan"`
+	Mode       CapacityMode    `json:"capacity_mode"`
+	Stockout   StockoutConfig  `json:"stockout"`
+	Queue      QueueConfig     `json:"queue"`
+	Autoscaler AutoscaleConfig `json:"autoscaler"`
+	Budgets    []budget        `json:"budgets"`
+	Blackouts  []*blackout     `json:"blackouts"`
+	StateStore string          `json:"state_store"`
+	Preflight  string          `json:"preflight"`
+	// Timeouts are those of requests: "default" and the routes of
+	// ENDPOINT_TIMEOUTS_JSON, 0s for none.
+	Timeouts map[string]string `json:"timeouts"`
+	// MaxResponseBytes is the largest response sent, 0 for no limit.
+	MaxResponseBytes int64 `json:"max_response_bytes"`
+	// Intervals are those of the background loops, 0s when off.
+	Intervals map[string]string `json:"intervals"`
+	Features  map[string]bool   `json:"features"`
+	// Settings are those set, with where they came from.
+	Settings []SettingValue `json:"settings"`
+}
+
+// CapsConfig are the caps purchases are held to.
+type CapsConfig struct {
+	MaxSlots   int64 `json:"max_slots"`
+	MaxMinutes int64 `json:"max_minutes"`
+	// ClampMinutes is set when requests for more than MaxMinutes are
+	// shortened rather than rejected.
+	ClampMinutes bool `json:"clamp_minutes,omitempty"`
+	// Regions are the caps of REGIONS and of the regions of MAX_SLOTS_JSON.
+	Regions map[string]int64 `json:"regions"`
+	// AdminProjects are the caps of the regions of each admin project.
+	AdminProjects map[string]map[string]int64 `json:"admin_projects,omitempty"`
+	// CountedPlans and CountedStates are the commitments counted toward the
+	// caps, every one when empty.
+	CountedPlans  []string `json:"counted_plans,omitempty"`
+	CountedStates []string `json:"counted_states,omitempty"`
+	OwnedOnly     bool     `json:"owned_only"`
+	// CacheTTL is how long the slots counted are kept between purchases.
+	CacheTTL string `json:"cache_ttl,omitempty"`
+}
+
+// CapacityMode is what adding capacity does, with the reservation bumped
+// and what of it in reservation mode.
+type CapacityMode struct {
+	Mode        string `json:"mode"`
+	Reservation string `json:"bump_reservation,omitempty"`
+	Target      string `json:"bump_target,omitempty"`
+}
+
+// StockoutConfig is what FLEX purchases the region has no capacity for do.
+type StockoutConfig struct {
+	Fallback string `json:"fallback"`
+	MinSlots int64  `json:"min_slots"`
+}
+
+// QueueConfig is where deletions are scheduled.
+type QueueConfig struct {
+	Name string `json:"name"`
+	// Failover are the queues of QUEUES delete tasks fail over to.
+	Failover []string `json:"failover,omitempty"`
+	// Create is whether missing queues are created on startup.
+	Create         bool   `json:"create_queue,omitempty"`
+	Scheduler      string `json:"delete_scheduler"`
+	ServiceAccount string `json:"task_service_account,omitempty"`
+	MaxAttempts    int    `json:"delete_task_max_attempts,omitempty"`
+	// DispatchDeadline, MinBackoff and MaxBackoff are those set on delete
+	// tasks and their queue, the defaults of the queue when empty.
+	DispatchDeadline string `json:"delete_task_dispatch_deadline,omitempty"`
+	MinBackoff       string `json:"delete_task_min_backoff,omitempty"`
+	MaxBackoff       string `json:"delete_task_max_backoff,omitempty"`
+	Workflow         string `json:"delete_workflow,omitempty"`
+	Topic            string `json:"delete_pubsub_topic,omitempty"`
+	RetryAttempts    int    `json:"retry_max_attempts"`
+	RetryMaxBackoff  string `json:"retry_max_backoff"`
+}
+
+// AutoscaleConfig are the thresholds of the autoscaler.
+type AutoscaleConfig struct {
+	Enabled         bool    `json:"enabled"`
+	Interval        string  `json:"interval"`
+	Lookback        string  `json:"lookback"`
+	View            string  `json:"view"`
+	UpUtilization   float64 `json:"up_utilization"`
+	UpPending       float64 `json:"up_pending"`
+	DownUtilization float64 `json:"down_utilization"`
+	Step            int64   `json:"step"`
+	Cooldown        string  `json:"cooldown"`
+	MaxHold         string  `json:"max_hold"`
+}
+
+// SettingValue is a setting as read, with secrets redacted.
+type SettingValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Source is file, env or flag.
+	Source string `json:"source"`
+	// RestartRequired is set when a reload changed a setting that only
+	// takes effect on a restart, Value is then not the one in use.
+	RestartRequired bool `json:"restart_required,omitempty"`
+}
+
+// effectiveConfig returns the configuration the service runs with.
+func effectiveConfig() *EffectiveConfig {
+	l := live()
+	c := &EffectiveConfig{
+		Project: projectID,
+		Regions: regions,
+		Caps: CapsConfig{
+			MaxSlots:     l.MaxSlots,
+			MaxMinutes:   l.MaxMinutes,
+			ClampMinutes: l.ClampMinutes,
+			Regions:      make(map[string]int64),
+			OwnedOnly:    l.CapFilter.OwnedOnly,
+			CacheTTL:     durationString(capCacheTTL),
+		},
+		Plan:     defaultPlan.String(),
+		Mode:     CapacityMode{Mode: capacityMode, Reservation: bumpReservationID, Target: bumpTarget},
+		Stockout: StockoutConfig{Fallback: stockoutFallback, MinSlots: stockoutMinSlots},
+		Queue: QueueConfig{
+			Name:             queueName(),
+			Failover:         failoverQueues,
+			Create:           createQueue,
+			Scheduler:        deleteScheduler,
+			ServiceAccount:   taskServiceAcct,
+			MaxAttempts:      deleteTaskMaxAttempts,
+			DispatchDeadline: durationString(deleteTaskDispatchDeadline),
+			MinBackoff:       durationString(deleteTaskMinBackoff),
+			MaxBackoff:       durationString(deleteTaskMaxBackoff),
+			Workflow:         deleteWorkflow,
+			Topic:            deleteTopic,
+			RetryAttempts:    retryPolicy.MaxAttempts,
+			RetryMaxBackoff:  retryPolicy.MaxBackoff.String(),
+		},
+		Autoscaler: AutoscaleConfig{
+			Enabled:         autoscale.Interval > 0,
+			Interval:        autoscale.Interval.String(),
+			Lookback:        autoscale.Lookback.String(),
+			View:            autoscale.View,
+			UpUtilization:   autoscale.UpUtilization,
+			UpPending:       autoscale.UpPending,
+			DownUtilization: autoscale.DownUtilization,
+			Step:            autoscale.Step,
+			Cooldown:        autoscale.Cooldown.String(),
+			MaxHold:         autoscale.MaxHold.String(),
+		},
+		Budgets:          append([]budget{}, l.Budgets...),
+		Blackouts:        append([]*blackout{}, l.Blackouts...),
+		StateStore:       stateStoreKind,
+		Preflight:        preflightMode,
+		Timeouts:         endpointTimeoutSettings(),
+		MaxResponseBytes: maxResponseBytes,
+		Intervals: map[string]string{
+			"reconcile": reconcileInterval.String(),
+			"watchdog":  watchdogInterval.String(),
+			"queue":     queueCheckInterval.String(),
+			"schedule":  l.ScheduleInterval.String(),
+			"profile":   profileInterval.String(),
+			"merge":     mergeInterval.String(),
+			"drift":     driftInterval.String(),
+		},
+		Features: map[string]bool{
+			"dry_run":         dryRun,
+			"fake_backends":   fakeBackends,
+			"auth":            authEnabled(),
+			"iap":             iapAudience != "",
+			"audit":           auditTopic != "",
+			"slack_command":   slackSigningSecret != "",
+			"budget_stop":     budgetStop != nil,
+			"scheduler_jobs":  schedulerJobs,
+			"ledger_export":   ledgerExportTable != "",
+			"delete_guard":    guard.Utilization > 0,
+			"desired_state":   desiredStateURL != "",
+			"drift_remediate": driftRemediate,
+			"tracing":         traceSampleRatio > 0,
+			"access_log":      accessLogEnabled,
+		},
+	}
+	if desiredStateURL != "" {
+		c.Intervals["desired_state"] = desiredStateInterval.String()
+	}
+
+	for _, region := range capRegions(regions, l.RegionMaxSlots) {
+		c.Caps.Regions[region] = maxSlotsFor(projectID, region)
+	}
+	for id, p := range adminProjects {
+		if c.Caps.AdminProjects == nil {
+			c.Caps.AdminProjects = make(map[string]map[string]int64)
+		}
+		caps := make(map[string]int64)
+		for _, region := range capRegions(regions, l.RegionMaxSlots, p.RegionMaxSlots) {
+			caps[region] = maxSlotsFor(id, region)
+		}
+		c.Caps.AdminProjects[id] = caps
+	}
+	for plan := range l.CapFilter.Plans {
+		c.Caps.CountedPlans = append(c.Caps.CountedPlans, plan.String())
+	}
+	sort.Strings(c.Caps.CountedPlans)
+	for state := range l.CapFilter.States {
+		c.Caps.CountedStates = append(c.Caps.CountedStates, state.String())
+	}
+	sort.Strings(c.Caps.CountedStates)
+
+	s := settings.Load()
+	if s != nil {
+		c.ConfigPath = s.Path
+	}
+	c.Settings = []SettingValue{}
+	for _, name := range config.Names {
+		v := s.Get(name)
+		if v == "" {
+			continue
+		}
+		sv := SettingValue{Name: name, Value: v, Source: s.Source(name)}
+		sv.RestartRequired = !reloadedSettings[name] && v != startupSettings.Get(name)
+		if config.Secrets[name] {
+			sv.Value = redacted
+		}
+		c.Settings = append(c.Settings, sv)
+	}
+	return c
+}
+
+// capRegions returns the regions of list and of the keys of the caps, once
+// each and sorted.
+func capRegions(list []string, caps ...map[string]int64) []string {
+	seen := make(map[string]bool)
+	for _, region := range list {
+		seen[region] = true
+	}
+	for _, m := range caps {
+		for region := range m {
+			seen[region] = true
+		}
+	}
+	out := make([]string, 0, len(seen))
+	for region := range seen {
+		out = append(out, region)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// configHandler returns the effective configuration, with secrets redacted,
+// to tell why a request was capped without reading the deployment.
+func (s *Server) configHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, effectiveConfig())
+}
+
+// durationString formats d, empty when zero.
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
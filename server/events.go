@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+const (
+	// defaultStreamActions are the ledger actions streamed by /events unless
+	// the action query parameter picks others.
+	defaultStreamActions = actionPurchased + "," + actionCapped + "," + actionDeleteScheduled + "," + actionDeleted + "," + actionDeleteFailed
+	// eventStreamDuration is how long a stream stays open, under the write
+	// timeout of the server. Clients reconnect with the id of the last event
+	// they got and miss nothing.
+	eventStreamDuration = 50 * time.Second
+	// eventHeartbeat is how often an idle stream is written to, so proxies
+	// keep it open.
+	eventHeartbeat = 15 * time.Second
+	// eventBuffer is how many entries a slow stream can fall behind before
+	// it is closed.
+	eventBuffer = 64
+)
+
+// eventHub fans the entries recorded by this instance out to the open
+// streams. The zero value is ready to use.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan LedgerEntry]bool
+}
+
+// subscribe returns a channel receiving the entries recorded from now, and
+// a func to stop receiving them. The channel is closed if the subscriber
+// falls behind.
+func (h *eventHub) subscribe() (<-chan LedgerEntry, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[chan LedgerEntry]bool)
+	}
+	ch := make(chan LedgerEntry, eventBuffer)
+	h.subs[ch] = true
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.subs[ch] {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish sends e to every subscriber, dropping those too far behind.
+func (h *eventHub) publish(ctx context.Context, e LedgerEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			logging.Warning(ctx, "event stream fell behind, closing it")
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// eventsHandler streams ledger entries as server-sent events, named after
+// their action, as they are recorded. The action query parameter lists the
+// actions streamed (default purchases, caps, and deletions scheduled, done
+// and failed), "all" for every one, and region picks one region. A client
+// reconnecting with Last-Event-ID first gets what was recorded since.
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	var v validator
+	actions := make(map[string]bool)
+	list := params.Get("action")
+	if list == "" {
+		list = defaultStreamActions
+	}
+	for _, a := range strings.Split(list, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			actions[a] = true
+		}
+	}
+	region := params.Get("region")
+	if region != "" {
+		v.region("region", &region)
+	}
+	var since time.Time
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339Nano, id)
+		v.check(err == nil, "Last-Event-ID", "must be the id of an event")
+	}
+	if err := v.err(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, codeInternal, "streaming is not supported")
+		return
+	}
+	wanted := func(e *LedgerEntry) bool {
+		return (actions["all"] || actions[e.Action]) && (region == "" || e.Region == region)
+	}
+
+	// Subscribed before catching up, so nothing falls in between.
+	ctx := r.Context()
+	entries, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", time.Second/time.Millisecond)
+
+	var last time.Time
+	send := func(e *LedgerEntry) error {
+		if !e.Time.After(last) || !wanted(e) {
+			return nil
+		}
+		last = e.Time
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.Time.Format(time.RFC3339Nano), e.Action, data)
+		return err
+	}
+
+	if !since.IsZero() {
+		last = since
+		missed, err := s.store.ListEvents(ctx, since)
+		if err != nil {
+			logging.Error(ctx, "reading ledger since %s: %v", since.Format(time.RFC3339Nano), err)
+		}
+		for _, e := range missed {
+			if err := send(e); err != nil {
+				return
+			}
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	end := time.NewTimer(eventStreamDuration)
+	defer end.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-end.C:
+			return
+		case e, ok := <-entries:
+			if !ok {
+				// Fell behind, the client catches up on reconnecting.
+				return
+			}
+			if err := send(&e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/tasks"
+)
+
+const (
+	// defaultFakeLatency is about how long calls to the fake backends take.
+	defaultFakeLatency = 200 * time.Millisecond
+	// fakeDispatchInterval is how often due fake tasks are sent.
+	fakeDispatchInterval = time.Second
+)
+
+// parseFakeBackends reads FAKE_BACKENDS, and the FAKE_LATENCY and
+// FAKE_ERROR_RATE of the fakes.
+func parseFakeBackends() error {
+	var err error
+	if v := getenv("FAKE_BACKENDS"); v != "" {
+		if fakeBackends, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("cannot parse FAKE_BACKENDS: %v", err)
+		}
+	}
+	fakeLatency = defaultFakeLatency
+	if v := getenv("FAKE_LATENCY"); v != "" {
+		if fakeLatency, err = time.ParseDuration(v); err != nil || fakeLatency < 0 {
+			return fmt.Errorf("cannot parse FAKE_LATENCY %q", v)
+		}
+	}
+	if v := getenv("FAKE_ERROR_RATE"); v != "" {
+		if fakeErrorRate, err = strconv.ParseFloat(v, 64); err != nil || fakeErrorRate < 0 || fakeErrorRate > 1 {
+			return fmt.Errorf("FAKE_ERROR_RATE must be between 0 and 1")
+		}
+	}
+	return nil
+}
+
+// newFake returns a Server buying and deleting commitments in memory, whose
+// delete tasks are sent back to the service by an in-process queue. Only
+// the commitment and task endpoints work, the others answer 501.
+func newFake(ctx context.Context) (*Server, error) {
+	var (
+		store stateStore = newMemStore()
+		err   error
+	)
+	if stateStoreKind == "firestore" {
+		if store, err = newFirestoreStore(ctx, firestoreProject); err != nil {
+			return nil, fmt.Errorf("creating firestore client: %v", err)
+		}
+	}
+
+	n, err := newNotifier(ctx)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("creating notifier: %v", err)
+	}
+
+	fc := capacity.NewFake()
+	fc.Latency, fc.ErrorRate = fakeLatency, fakeErrorRate
+	ft := tasks.NewFake()
+	ft.Latency, ft.ErrorRate = fakeLatency, fakeErrorRate
+	ft.MaxAttempts = deleteTaskMaxAttempts
+	ft.MinBackoff, ft.MaxBackoff = deleteTaskMinBackoff, deleteTaskMaxBackoff
+
+	s := &Server{
+		store:      store,
+		autoscaler: autoscaler{lastAction: make(map[string]time.Time)},
+		notifier:   n,
+		pagers:     newPagers(),
+		fakeTasks:  ft,
+	}
+	s.useBackends(func(string) capacity.Client { return fc }, ft)
+	logging.Warning(ctx, "FAKE_BACKENDS is set, commitments and tasks only exist in memory")
+	if ledgerExportTable != "" {
+		logging.Warning(ctx, "LEDGER_EXPORT_TABLE is ignored with FAKE_BACKENDS")
+	}
+	s.auditSink, _ = newAuditSink(ctx)
+	return s, nil
+}
+
+// needsReservationAPI answers 501 to requests of h when the reservation API
+// is faked, since the fake only holds commitments.
+func (s *Server) needsReservationAPI(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.reservations == nil {
+			writeError(w, http.StatusNotImplemented, codeNotImplemented, "%s is not available with FAKE_BACKENDS", r.URL.Path)
+			return
+		}
+		h(w, r)
+	}
+}
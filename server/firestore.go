@@ -0,0 +1,581 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/scheduler"
+)
+
+const (
+	idempotencyCollection = "idempotency_keys"
+	commitmentCollection  = "commitments"
+	ledgerCollection      = "ledger"
+	lockCollection        = "locks"
+	scheduleCollection    = "schedules"
+	taskCollection        = "tasks"
+	profileCollection     = "profiles"
+	freezeCollection      = "freezes"
+	totalCollection       = "slot_totals"
+	operationCollection   = "operations"
+	// freezeDoc is the document of the freeze in force.
+	freezeDoc = "purchases"
+)
+
+// errLockHeld is returned by the lock transaction while another holder has
+// an unexpired lease.
+var errLockHeld = errors.New("lock held")
+
+// lease is a lock held by Holder until ExpireAt.
+type lease struct {
+	Name     string    `firestore:"name"`
+	Holder   string    `firestore:"holder"`
+	ExpireAt time.Time `firestore:"expire_at"`
+}
+
+// firestoreStore is a stateStore shared by every instance of the service. Add
+// a TTL policy on the expire_at field to have Firestore purge old keys.
+type firestoreStore struct {
+	client *firestore.Client
+}
+
+func newFirestoreStore(ctx context.Context, project string) (*firestoreStore, error) {
+	client, err := firestore.NewClient(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	return &firestoreStore{client: client}, nil
+}
+
+func (f *firestoreStore) ReserveIdempotencyKey(ctx context.Context, key, requestHash string, lease time.Duration) (*IdempotencyRecord, bool, error) {
+	doc := f.client.Collection(idempotencyCollection).Doc(hashKey(key))
+
+	now := time.Now()
+	rec := &IdempotencyRecord{Key: key, RequestHash: requestHash, CreatedAt: now, ExpireAt: now.Add(lease)}
+	_, err := doc.Create(ctx, rec)
+	if err == nil {
+		return rec, true, nil
+	}
+	if status.Code(err) != codes.AlreadyExists {
+		return nil, false, err
+	}
+
+	// Take over a record that expired, or a claim whose lease ran out, but
+	// was not yet purged by the TTL policy in a transaction, so only one of
+	// concurrent claims wins it.
+	var replayed *IdempotencyRecord
+	err = f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		replayed = nil
+		snap, err := tx.Get(doc)
+		if status.Code(err) == codes.NotFound {
+			// Released since the create failed.
+			return tx.Create(doc, rec)
+		}
+		if err != nil {
+			return err
+		}
+		var existing IdempotencyRecord
+		if err := snap.DataTo(&existing); err != nil {
+			return err
+		}
+		if now.Before(existing.ExpireAt) {
+			replayed = &existing
+			return nil
+		}
+		return tx.Update(doc, []firestore.Update{
+			{Path: "key", Value: rec.Key},
+			{Path: "request_hash", Value: rec.RequestHash},
+			{Path: "response", Value: nil},
+			{Path: "created_at", Value: rec.CreatedAt},
+			{Path: "expire_at", Value: rec.ExpireAt},
+		}, firestore.LastUpdateTime(snap.UpdateTime))
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if replayed != nil {
+		return replayed, false, nil
+	}
+	return rec, true, nil
+}
+
+func (f *firestoreStore) CompleteIdempotencyKey(ctx context.Context, key string, resp *AddCapacityResponse) error {
+	_, err := f.client.Collection(idempotencyCollection).Doc(hashKey(key)).Update(ctx, []firestore.Update{
+		{Path: "response", Value: resp},
+		{Path: "expire_at", Value: time.Now().Add(idempotencyTTL)},
+	})
+	return err
+}
+
+func (f *firestoreStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	_, err := f.client.Collection(idempotencyCollection).Doc(hashKey(key)).Delete(ctx)
+	return err
+}
+
+func (f *firestoreStore) PutCommitment(ctx context.Context, rec *CommitmentRecord) error {
+	_, err := f.client.Collection(commitmentCollection).Doc(hashKey(rec.Name)).Set(ctx, rec)
+	return err
+}
+
+func (f *firestoreStore) SetCommitmentDeleteAt(ctx context.Context, name string, deleteAt time.Time) error {
+	_, err := f.client.Collection(commitmentCollection).Doc(hashKey(name)).Update(ctx, []firestore.Update{
+		{Path: "delete_at", Value: deleteAt},
+	})
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	return err
+}
+
+func (f *firestoreStore) SetCommitmentQueue(ctx context.Context, name, queue string) error {
+	_, err := f.client.Collection(commitmentCollection).Doc(hashKey(name)).Update(ctx, []firestore.Update{
+		{Path: "queue", Value: queue},
+	})
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	return err
+}
+
+func (f *firestoreStore) ListCommitments(ctx context.Context) ([]*CommitmentRecord, error) {
+	docs, err := f.client.Collection(commitmentCollection).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*CommitmentRecord, 0, len(docs))
+	for _, doc := range docs {
+		var rec CommitmentRecord
+		if err := doc.DataTo(&rec); err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", doc.Ref.ID, err)
+		}
+		list = append(list, &rec)
+	}
+	return list, nil
+}
+
+func (f *firestoreStore) ForgetCommitment(ctx context.Context, name string) error {
+	_, err := f.client.Collection(commitmentCollection).Doc(hashKey(name)).Delete(ctx)
+	return err
+}
+
+func (f *firestoreStore) RecordEvent(ctx context.Context, e *LedgerEntry) error {
+	_, err := f.client.Collection(ledgerCollection).NewDoc().Create(ctx, e)
+	return err
+}
+
+func (f *firestoreStore) ListEvents(ctx context.Context, since time.Time) ([]*LedgerEntry, error) {
+	docs, err := f.client.Collection(ledgerCollection).Where("time", ">=", since).OrderBy("time", firestore.Asc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*LedgerEntry, 0, len(docs))
+	for _, doc := range docs {
+		var e LedgerEntry
+		if err := doc.DataTo(&e); err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", doc.Ref.ID, err)
+		}
+		list = append(list, &e)
+	}
+	return list, nil
+}
+
+// QueryEvents reads the ledger back from the end of the time range and
+// filters it here, which needs no composite index.
+func (f *firestoreStore) QueryEvents(ctx context.Context, q EventQuery) ([]*LedgerEntry, error) {
+	if q.Commitment != "" {
+		return f.commitmentEvents(ctx, q)
+	}
+	query := f.client.Collection(ledgerCollection).OrderBy("time", firestore.Desc)
+	if !q.From.IsZero() {
+		query = query.Where("time", ">=", q.From)
+	}
+	switch {
+	case !q.At.IsZero():
+		query = query.Where("time", "<=", q.At)
+	case !q.To.IsZero():
+		query = query.Where("time", "<", q.To)
+	}
+
+	page := eventPage{q: q, list: []*LedgerEntry{}}
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return page.list, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var e LedgerEntry
+		if err := doc.DataTo(&e); err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", doc.Ref.ID, err)
+		}
+		if page.add(&e) {
+			return page.list, nil
+		}
+	}
+}
+
+// commitmentEvents answers q for the few entries of one commitment, read
+// with an equality filter and sorted here rather than scanning the ledger.
+func (f *firestoreStore) commitmentEvents(ctx context.Context, q EventQuery) ([]*LedgerEntry, error) {
+	docs, err := f.client.Collection(ledgerCollection).Where("commitment", "==", q.Commitment).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*LedgerEntry, 0, len(docs))
+	for _, doc := range docs {
+		var e LedgerEntry
+		if err := doc.DataTo(&e); err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", doc.Ref.ID, err)
+		}
+		entries = append(entries, &e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+
+	page := eventPage{q: q, list: []*LedgerEntry{}}
+	for _, e := range entries {
+		if page.add(e) {
+			break
+		}
+	}
+	return page.list, nil
+}
+
+func (f *firestoreStore) PutSchedule(ctx context.Context, sc *scheduler.Schedule) error {
+	_, err := f.client.Collection(scheduleCollection).Doc(sc.ID).Set(ctx, sc)
+	return err
+}
+
+func (f *firestoreStore) GetSchedule(ctx context.Context, id string) (*scheduler.Schedule, error) {
+	snap, err := f.client.Collection(scheduleCollection).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, errScheduleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sc scheduler.Schedule
+	if err := snap.DataTo(&sc); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", id, err)
+	}
+	return &sc, nil
+}
+
+func (f *firestoreStore) ListSchedules(ctx context.Context) ([]*scheduler.Schedule, error) {
+	docs, err := f.client.Collection(scheduleCollection).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*scheduler.Schedule, 0, len(docs))
+	for _, doc := range docs {
+		var sc scheduler.Schedule
+		if err := doc.DataTo(&sc); err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", doc.Ref.ID, err)
+		}
+		list = append(list, &sc)
+	}
+	return list, nil
+}
+
+func (f *firestoreStore) DeleteSchedule(ctx context.Context, id string) error {
+	_, err := f.client.Collection(scheduleCollection).Doc(id).Delete(ctx)
+	return err
+}
+
+func (f *firestoreStore) PutProfile(ctx context.Context, p *scheduler.Profile) error {
+	_, err := f.client.Collection(profileCollection).Doc(p.ID).Set(ctx, p)
+	return err
+}
+
+func (f *firestoreStore) GetProfile(ctx context.Context, id string) (*scheduler.Profile, error) {
+	snap, err := f.client.Collection(profileCollection).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, errProfileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p scheduler.Profile
+	if err := snap.DataTo(&p); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", id, err)
+	}
+	return &p, nil
+}
+
+func (f *firestoreStore) ListProfiles(ctx context.Context) ([]*scheduler.Profile, error) {
+	docs, err := f.client.Collection(profileCollection).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*scheduler.Profile, 0, len(docs))
+	for _, doc := range docs {
+		var p scheduler.Profile
+		if err := doc.DataTo(&p); err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", doc.Ref.ID, err)
+		}
+		list = append(list, &p)
+	}
+	return list, nil
+}
+
+func (f *firestoreStore) DeleteProfile(ctx context.Context, id string) error {
+	_, err := f.client.Collection(profileCollection).Doc(id).Delete(ctx)
+	return err
+}
+
+func (f *firestoreStore) PutTask(ctx context.Context, rec *TaskRecord) error {
+	_, err := f.client.Collection(taskCollection).Doc(hashKey(rec.Name)).Create(ctx, rec)
+	if status.Code(err) == codes.AlreadyExists {
+		return errTaskExists
+	}
+	return err
+}
+
+func (f *firestoreStore) GetTask(ctx context.Context, name string) (*TaskRecord, error) {
+	snap, err := f.client.Collection(taskCollection).Doc(hashKey(name)).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, errTaskNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec TaskRecord
+	if err := snap.DataTo(&rec); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", name, err)
+	}
+	return &rec, nil
+}
+
+func (f *firestoreStore) ListTasks(ctx context.Context) ([]*TaskRecord, error) {
+	docs, err := f.client.Collection(taskCollection).OrderBy("schedule_time", firestore.Asc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*TaskRecord, 0, len(docs))
+	for _, doc := range docs {
+		var rec TaskRecord
+		if err := doc.DataTo(&rec); err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", doc.Ref.ID, err)
+		}
+		list = append(list, &rec)
+	}
+	return list, nil
+}
+
+// DeleteTask fails if the task is gone, so of two instances running it only
+// one finishes it.
+func (f *firestoreStore) DeleteTask(ctx context.Context, name string) error {
+	_, err := f.client.Collection(taskCollection).Doc(hashKey(name)).Delete(ctx, firestore.Exists)
+	if status.Code(err) == codes.NotFound {
+		return errTaskNotFound
+	}
+	return err
+}
+
+func (f *firestoreStore) CreateFreeze(ctx context.Context, fr *Freeze) (bool, error) {
+	_, err := f.client.Collection(freezeCollection).Doc(freezeDoc).Create(ctx, fr)
+	if status.Code(err) == codes.AlreadyExists {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (f *firestoreStore) GetFreeze(ctx context.Context) (*Freeze, error) {
+	snap, err := f.client.Collection(freezeCollection).Doc(freezeDoc).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var fr Freeze
+	if err := snap.DataTo(&fr); err != nil {
+		return nil, fmt.Errorf("decoding freeze: %v", err)
+	}
+	return &fr, nil
+}
+
+func (f *firestoreStore) LiftFreeze(ctx context.Context, by string, at time.Time) (*Freeze, error) {
+	doc := f.client.Collection(freezeCollection).Doc(freezeDoc)
+	var lifted *Freeze
+	err := f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		lifted = nil
+		snap, err := tx.Get(doc)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var fr Freeze
+		if err := snap.DataTo(&fr); err != nil {
+			return fmt.Errorf("decoding freeze: %v", err)
+		}
+		fr.LiftedBy, fr.LiftedAt = by, &at
+		if err := tx.Set(f.client.Collection(freezeCollection).Doc(liftedDoc(&fr)), &fr); err != nil {
+			return err
+		}
+		lifted = &fr
+		return tx.Delete(doc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lifted, nil
+}
+
+func (f *firestoreStore) FreezeLifted(ctx context.Context, budget, interval string) (bool, error) {
+	_, err := f.client.Collection(freezeCollection).Doc(liftedDoc(&Freeze{Budget: budget, Interval: interval})).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// liftedDoc is the document of the record of the lifted freeze fr.
+func liftedDoc(fr *Freeze) string {
+	return "lifted-" + hashKey(fr.liftKey())
+}
+
+func (f *firestoreStore) GetTotal(ctx context.Context, parent string) (int64, time.Time, bool, error) {
+	snap, err := f.client.Collection(totalCollection).Doc(hashKey(parent)).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return 0, time.Time{}, false, nil
+	}
+	if err != nil {
+		return 0, time.Time{}, false, err
+	}
+	var t slotTotal
+	if err := snap.DataTo(&t); err != nil {
+		return 0, time.Time{}, false, fmt.Errorf("decoding slot total: %v", err)
+	}
+	return t.Total, t.ListedAt, true, nil
+}
+
+func (f *firestoreStore) PutTotal(ctx context.Context, parent string, total int64, listedAt time.Time) error {
+	_, err := f.client.Collection(totalCollection).Doc(hashKey(parent)).Set(ctx, &slotTotal{Parent: parent, Total: total, ListedAt: listedAt})
+	return err
+}
+
+func (f *firestoreStore) DropTotal(ctx context.Context, parent string) error {
+	_, err := f.client.Collection(totalCollection).Doc(hashKey(parent)).Delete(ctx)
+	return err
+}
+
+func (f *firestoreStore) PutOperation(ctx context.Context, op *AsyncOperation) error {
+	_, err := f.client.Collection(operationCollection).Doc(op.ID).Set(ctx, op)
+	return err
+}
+
+func (f *firestoreStore) GetOperation(ctx context.Context, id string) (*AsyncOperation, error) {
+	if id == "" || strings.Contains(id, "/") {
+		return nil, errOperationNotFound
+	}
+	snap, err := f.client.Collection(operationCollection).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, errOperationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var op AsyncOperation
+	if err := snap.DataTo(&op); err != nil {
+		return nil, fmt.Errorf("decoding operation %s: %v", id, err)
+	}
+	if time.Now().After(op.ExpireAt) {
+		// Expired but not yet purged by the TTL policy.
+		return nil, errOperationNotFound
+	}
+	return &op, nil
+}
+
+// Lock takes a lease on a document of the locks collection, retrying while
+// another instance holds it.
+func (f *firestoreStore) Lock(ctx context.Context, name string, ttl time.Duration) (func(), error) {
+	doc := f.client.Collection(lockCollection).Doc(hashKey(name))
+	holder, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err := f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			snap, err := tx.Get(doc)
+			switch {
+			case status.Code(err) == codes.NotFound:
+			case err != nil:
+				return err
+			default:
+				var l lease
+				if err := snap.DataTo(&l); err != nil {
+					return err
+				}
+				if time.Now().Before(l.ExpireAt) {
+					return errLockHeld
+				}
+			}
+			return tx.Set(doc, &lease{Name: name, Holder: holder, ExpireAt: time.Now().Add(ttl)})
+		})
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errLockHeld) {
+			return nil, fmt.Errorf("acquiring lock %s: %v", name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("acquiring lock %s: %v", name, ctx.Err())
+		case <-time.After(lockRetryInterval):
+		}
+	}
+
+	unlock := func() {
+		// Release even if the request is gone, rather than wait for the ttl.
+		ctx, cancel := context.WithTimeout(detached{ctx}, 10*time.Second)
+		defer cancel()
+		err := f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			snap, err := tx.Get(doc)
+			if status.Code(err) == codes.NotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			var l lease
+			if err := snap.DataTo(&l); err != nil {
+				return err
+			}
+			if l.Holder != holder {
+				// Our lease expired and was taken over.
+				return nil
+			}
+			return tx.Delete(doc)
+		})
+		if err != nil {
+			logging.Error(ctx, "releasing lock %s: %v", name, err)
+		}
+	}
+	return unlock, nil
+}
+
+func (f *firestoreStore) Close() error {
+	return f.client.Close()
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/storage/v1"
+	"gopkg.in/yaml.v3"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// maxDesiredStateSize bounds the desired state document read.
+const maxDesiredStateSize = 1 << 20
+
+// desiredStateSource is where the desired state is pulled from: a gs://
+// object or an http(s) URL.
+type desiredStateSource struct {
+	url string
+	// objects reads gs:// objects, nil for other URLs.
+	objects *storage.ObjectsService
+}
+
+// fetch reads the document and its revision: the generation of a GCS object,
+// otherwise the ETag of the response or, without one, a hash of the document.
+func (src *desiredStateSource) fetch(ctx context.Context) ([]byte, string, error) {
+	if src.objects != nil {
+		bucket, name, _ := strings.Cut(strings.TrimPrefix(src.url, "gs://"), "/")
+		obj, err := src.objects.Get(bucket, name).Context(ctx).Do()
+		if err != nil {
+			return nil, "", err
+		}
+		resp, err := src.objects.Get(bucket, name).Generation(obj.Generation).Context(ctx).Download()
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxDesiredStateSize))
+		return body, fmt.Sprint(obj.Generation), err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDesiredStateSize))
+	if err != nil {
+		return nil, "", err
+	}
+	if etag := strings.Trim(resp.Header.Get("ETag"), `"`); etag != "" {
+		return body, etag, nil
+	}
+	sum := sha256.Sum256(body)
+	return body, hex.EncodeToString(sum[:6]), nil
+}
+
+// parseDesiredState reads a desired state document, in YAML with the field
+// names of the JSON taken by /apply, or in JSON.
+func parseDesiredState(body []byte) (*DesiredState, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	// Through JSON, for the field names and types of the API.
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var d DesiredState
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, err
+	}
+	return &d, d.validate()
+}
+
+// runGitOps applies the desired state at desiredStateURL every interval until
+// ctx is done, once it has changed. The first pull always applies it.
+func (s *Server) runGitOps(ctx context.Context, interval time.Duration) {
+	src := &desiredStateSource{url: desiredStateURL}
+	if strings.HasPrefix(desiredStateURL, "gs://") {
+		svc, err := storage.NewService(ctx)
+		if err != nil {
+			logging.Error(ctx, "creating storage client, not applying %s: %v", desiredStateURL, err)
+			return
+		}
+		src.objects = svc.Objects
+	}
+	logging.Info(ctx, "applying desired state from %s every %s", desiredStateURL, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var (
+		applied string
+		err     error
+	)
+	for {
+		if applied, err = s.syncDesiredState(ctx, src, applied); err != nil {
+			logging.Error(ctx, "applying desired state from %s: %v", desiredStateURL, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncDesiredState pulls the desired state from src and applies it, unless
+// it is still at revision applied. It returns the revision not to apply
+// again: the one applied, recorded in the ledger, or one that can't be read.
+func (s *Server) syncDesiredState(ctx context.Context, src *desiredStateSource, applied string) (string, error) {
+	body, rev, err := src.fetch(ctx)
+	if err != nil {
+		return applied, fmt.Errorf("pulling: %v", err)
+	}
+	if rev == applied {
+		return applied, nil
+	}
+	ctx = logging.WithFields(ctx, "revision", rev)
+	d, err := parseDesiredState(body)
+	if err != nil {
+		// Not tried again until it changes.
+		s.record(ctx, LedgerEntry{Action: actionDesiredStateFailed, Requester: "gitops", Revision: rev, Error: err.Error()})
+		return rev, fmt.Errorf("revision %s: %v", rev, err)
+	}
+	for _, p := range d.Regions {
+		p.DeleteURL = deleteURL(nil)
+		p.Audience = deleteAudience(nil)
+	}
+
+	plan, err := s.apply(ctx, d, time.Now())
+	if err != nil {
+		return applied, err
+	}
+	if len(plan.Errors) > 0 {
+		// Tried again on the next pull.
+		s.record(ctx, LedgerEntry{Action: actionDesiredStateFailed, Requester: "gitops", Revision: rev, Error: strings.Join(plan.Errors, "; ")})
+		return applied, fmt.Errorf("revision %s: %s", rev, strings.Join(plan.Errors, "; "))
+	}
+	changes := make([]string, 0, len(plan.Regions))
+	for _, rp := range plan.Regions {
+		changes = append(changes, rp.Region+" "+rp.Change)
+	}
+	if plan.DryRun {
+		changes = append([]string{"dry run"}, changes...)
+	}
+	logging.Info(ctx, "desired state at revision %s applied: %s", rev, strings.Join(changes, ", "))
+	s.record(ctx, LedgerEntry{Action: actionDesiredStateApplied, Requester: "gitops", Revision: rev, Reason: strings.Join(changes, ", ")})
+	return rev, nil
+}
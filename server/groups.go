@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+)
+
+// maxGroupStages bounds how many commitments one request is bought as.
+const maxGroupStages = 50
+
+// groupStage is one of the commitments of a group bought for one request.
+type groupStage struct {
+	Slots    int64
+	DeleteAt time.Time
+}
+
+// chunk splits each stage into commitments of at most size slots.
+func chunk(stages []groupStage, size int64) []groupStage {
+	if size <= 0 {
+		return stages
+	}
+	var chunks []groupStage
+	for _, stage := range stages {
+		for left := stage.Slots; left > 0; left -= size {
+			chunks = append(chunks, groupStage{Slots: min(size, left), DeleteAt: stage.DeleteAt})
+		}
+	}
+	return chunks
+}
+
+// chunkSlots checks the chunk size of p, which must split it into at most
+// maxGroupStages commitments.
+func (v *validator) chunkSlots(p *Payload) {
+	if p.ChunkSlots == 0 {
+		return
+	}
+	if !v.check(p.ChunkSlots > 0 && p.ChunkSlots%slotIncrement == 0, "chunk_slots", "must be a positive multiple of %d", slotIncrement) {
+		return
+	}
+	v.check((p.ExtraSlot+p.ChunkSlots-1)/p.ChunkSlots+int64(len(p.RampDown)) <= maxGroupStages, "chunk_slots", "splits the request into more than %d commitments", maxGroupStages)
+}
+
+// purchaseGroup buys a commitment per stage, each deleted at its own time,
+// all recorded as one group, and sums them up in one response listing each
+// as a stage. When the cap is reached part way, what was bought so far is
+// returned. Stages bought before another failure keep their delete tasks.
+func (s *Server) purchaseGroup(ctx context.Context, req purchaseRequest, stages []groupStage) (*AddCapacityResponse, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	req.Group = "grp-" + id
+	ctx = logging.WithFields(ctx, "group", req.Group)
+
+	resp := &AddCapacityResponse{Group: req.Group, SlotsRequested: req.Slots, Plan: req.Plan.String(), DryRun: req.DryRun || dryRun}
+	for i, stage := range stages {
+		stageReq := req
+		stageReq.Slots, stageReq.DeleteAt = stage.Slots, stage.DeleteAt
+		bought, err := s.purchase(ctx, stageReq)
+		if errors.Is(err, capacity.ErrMaxSlots) && i > 0 {
+			logging.Warning(ctx, "stage %d of %d of group %s not bought: %v", i+1, len(stages), req.Group, err)
+			break
+		}
+		if err != nil {
+			if i > 0 {
+				logging.Error(ctx, "stage %d of %d of group %s failed, %d slots bought before it are kept until their deletion", i+1, len(stages), req.Group, resp.SlotsPurchased)
+			}
+			return nil, err
+		}
+		resp.addStage(bought)
+	}
+	return resp, nil
+}
+
+// addStage adds the commitment bought to the group of resp.
+func (resp *AddCapacityResponse) addStage(bought *AddCapacityResponse) {
+	resp.Stages = append(resp.Stages, bought)
+	if resp.CommitName == "" {
+		resp.CommitName, resp.State = bought.CommitName, bought.State
+	}
+	resp.SlotsPurchased += bought.SlotsPurchased
+	if bought.DeleteAt != nil && (resp.DeleteAt == nil || bought.DeleteAt.After(*resp.DeleteAt)) {
+		resp.DeleteAt = bought.DeleteAt
+	}
+	if bought.EstimatedCost != nil {
+		cost := *bought.EstimatedCost
+		if resp.EstimatedCost != nil {
+			cost = math.Round((cost+*resp.EstimatedCost)*100) / 100
+		}
+		resp.EstimatedCost = &cost
+	}
+}
+
+// GroupStatus is the state of the commitments of a group still held.
+type GroupStatus struct {
+	Group       string           `json:"group"`
+	Slots       int64            `json:"slots"`
+	Commitments []CommitmentInfo `json:"commitments"`
+}
+
+// GroupRelease is what releasing a group deleted.
+type GroupRelease struct {
+	Group    string          `json:"group"`
+	Released []ReleasedSlots `json:"released"`
+	Errors   []string        `json:"errors,omitempty"`
+}
+
+// groupCommitments returns the records of the commitments of group, or
+// errGroupNotFound if none is held.
+func (s *Server) groupCommitments(ctx context.Context, group string) ([]*CommitmentRecord, error) {
+	recs, err := s.store.ListCommitments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing recorded commitments: %v", err)
+	}
+	var list []*CommitmentRecord
+	for _, rec := range recs {
+		if rec.Group == group {
+			list = append(list, rec)
+		}
+	}
+	if len(list) == 0 {
+		return nil, errGroupNotFound
+	}
+	return list, nil
+}
+
+var errGroupNotFound = errors.New("no commitment of the group is held")
+
+func (s *Server) getGroupHandler(w http.ResponseWriter, r *http.Request) {
+	group := mux.Vars(r)["id"]
+	recs, err := s.groupCommitments(r.Context(), group)
+	if err != nil {
+		writeGroupError(w, r, err)
+		return
+	}
+	pending, err := s.pendingDeletes(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "listing delete tasks: %v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+
+	status := GroupStatus{Group: group, Commitments: []CommitmentInfo{}}
+	for _, rec := range recs {
+		c, err := s.capacity.Get(r.Context(), rec.Name)
+		if err != nil {
+			// Gone already, the reconciler forgets it.
+			logging.Warning(r.Context(), "getting %s of group %s: %v", rec.Name, group, err)
+			continue
+		}
+		status.Slots += c.SlotCount
+		status.Commitments = append(status.Commitments, commitmentInfo(c, pending[c.Name]))
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// releaseGroupHandler deletes every commitment of a group now, cancelling
+// their scheduled deletions.
+func (s *Server) releaseGroupHandler(w http.ResponseWriter, r *http.Request) {
+	group := mux.Vars(r)["id"]
+	ctx := logging.WithFields(r.Context(), "group", group)
+	recs, err := s.groupCommitments(ctx, group)
+	if err != nil {
+		writeGroupError(w, r, err)
+		return
+	}
+
+	res := GroupRelease{Group: group, Released: []ReleasedSlots{}}
+	for _, rec := range recs {
+		rel, err := s.releaseSlots(ctx, rec, rec.SlotCount, requester(r), true)
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("releasing %s: %v", rec.Name, err))
+			logging.Error(ctx, "releasing %s of group %s: %v", rec.Name, group, err)
+			continue
+		}
+		res.Released = append(res.Released, *rel)
+	}
+	code := http.StatusOK
+	if len(res.Errors) > 0 {
+		code = http.StatusInternalServerError
+	}
+	writeJSON(w, code, res)
+}
+
+func writeGroupError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errGroupNotFound) {
+		writeError(w, http.StatusNotFound, codeNotFound, "%v", err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+	logging.Error(r.Context(), "%v", err)
+}
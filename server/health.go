@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/internal/taskspb"
+)
+
+// readinessTimeout bounds the checks of a readiness probe.
+const readinessTimeout = 5 * time.Second
+
+// Statuses of the health endpoints and their checks.
+const (
+	healthOK          = "ok"
+	healthReady       = "ready"
+	healthUnavailable = "unavailable"
+	healthDraining    = "draining"
+	healthSkipped     = "skipped"
+)
+
+// DependencyStatus is the outcome of one readiness check.
+type DependencyStatus struct {
+	Status    string `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+// Readiness is the response of /readyz.
+type Readiness struct {
+	Status string                       `json:"status"`
+	Checks map[string]*DependencyStatus `json:"checks"`
+}
+
+// writeHealth writes v as the bare JSON probes and load balancers expect.
+func writeHealth(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Error(context.Background(), "writing response: %v", err)
+	}
+}
+
+// healthzHandler is the liveness probe: it only fails when a client
+// connection has shut down, which restarting the instance fixes. It calls
+// nothing, so a dependency being down doesn't get instances restarted.
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.healthy(); err != nil {
+		logging.Error(r.Context(), "%v", err)
+		writeHealth(w, http.StatusServiceUnavailable, map[string]string{"status": healthUnavailable, "error": err.Error()})
+		return
+	}
+	writeHealth(w, http.StatusOK, map[string]string{"status": healthOK})
+}
+
+// readyzHandler is the readiness probe: it checks the reservation API
+// answers, the Cloud Tasks queue exists and is RUNNING, and the state store
+// holding the ledger can be read, and reports each. The instance is not
+// ready while any of them fails, or while it drains.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := map[string]func(context.Context) (status, detail string, err error){
+		"reservation_api": s.checkReservationAPI,
+		"task_queue":      s.checkTaskQueue,
+		"state_store":     s.checkStateStore,
+	}
+	resp := &Readiness{Status: healthReady, Checks: make(map[string]*DependencyStatus, len(checks))}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) (string, string, error)) {
+			defer wg.Done()
+			start := time.Now()
+			status, detail, err := check(ctx)
+			st := &DependencyStatus{Status: status, Detail: detail, LatencyMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				st.Status, st.Detail = healthUnavailable, err.Error()
+				logging.Warning(ctx, "readiness check %s failed: %v", name, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			resp.Checks[name] = st
+			if err != nil {
+				resp.Status = healthUnavailable
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	if s.ops.isDraining() {
+		resp.Status = healthDraining
+	}
+	code := http.StatusOK
+	if resp.Status != healthReady {
+		code = http.StatusServiceUnavailable
+	}
+	writeHealth(w, code, resp)
+}
+
+// checkReservationAPI lists the commitments of the first region.
+func (s *Server) checkReservationAPI(ctx context.Context) (status, detail string, err error) {
+	if _, err := s.capacity.List(ctx, capacity.Parent(projectID, regions[0])); err != nil {
+		return "", "", err
+	}
+	if s.reservations == nil {
+		return healthOK, "FAKE_BACKENDS", nil
+	}
+	return healthOK, "", nil
+}
+
+// checkTaskQueue gets the Cloud Tasks queues, skipped with another
+// DELETE_SCHEDULER. It fails unless one of them is RUNNING.
+func (s *Server) checkTaskQueue(ctx context.Context) (status, detail string, err error) {
+	if s.tasks == nil {
+		if s.fakeTasks != nil {
+			return healthOK, "FAKE_BACKENDS", nil
+		}
+		return healthSkipped, "DELETE_SCHEDULER=" + deleteScheduler, nil
+	}
+	var running, stopped []string
+	for _, name := range queueNames() {
+		q, err := s.tasks.GetQueue(ctx, &taskspb.GetQueueRequest{Name: name})
+		if err != nil {
+			stopped = append(stopped, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		s.observeQueue(ctx, name, q.State)
+		if q.State == taskspb.Queue_RUNNING {
+			running = append(running, name)
+			continue
+		}
+		st, _ := s.queues.get(name)
+		stopped = append(stopped, fmt.Sprintf("queue %s is %s since %s", name, q.State, st.Since.Format(time.RFC3339)))
+	}
+	switch {
+	case len(running) == 0:
+		return "", "", fmt.Errorf("%s, purchases are refused", strings.Join(stopped, "; "))
+	case len(stopped) > 0:
+		return healthOK, fmt.Sprintf("RUNNING, failing over from %s", strings.Join(stopped, "; ")), nil
+	}
+	return healthOK, taskspb.Queue_RUNNING.String(), nil
+}
+
+// checkStateStore reads the end of the ledger.
+func (s *Server) checkStateStore(ctx context.Context) (status, detail string, err error) {
+	if _, err := s.store.ListEvents(ctx, time.Now()); err != nil {
+		return "", "", err
+	}
+	return healthOK, stateStoreKind, nil
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// claimIdempotencyKey claims the Idempotency-Key header (or request_id field)
+// of an add request. If the key was seen before, it writes the original
+// response, or an error while that request is in flight or the payload
+// differs, and returns false. Keys are scoped to the authenticated caller, so
+// one caller cannot replay the responses of another. The claim of a request
+// that never completes, its instance gone, lapses after idempotencyLease.
+//
+// finish must be called with the response once the request completes, or nil
+// if it failed, which releases the key so the request can be retried.
+func (s *Server) claimIdempotencyKey(w http.ResponseWriter, r *http.Request, p *Payload) (finish func(*AddCapacityResponse), ok bool) {
+	noop := func(*AddCapacityResponse) {}
+
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = p.RequestID
+	}
+	if key == "" {
+		return noop, true
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		return noop, false
+	}
+	hash := hashKey(string(body))
+
+	stored := key
+	if p := principalOf(r.Context()); p != nil {
+		stored = p.Name + "/" + key
+	}
+	rec, fresh, err := s.store.ReserveIdempotencyKey(r.Context(), stored, hash, idempotencyLease(r.Context()))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "reserving idempotency key: %v", err)
+		logging.Error(r.Context(), "%v", err)
+		return noop, false
+	}
+
+	if !fresh {
+		switch {
+		case rec.RequestHash != hash:
+			writeError(w, http.StatusConflict, codeIdempotencyMismatch, "idempotency key %q was used with a different payload", key)
+		case rec.Response == nil:
+			writeError(w, http.StatusConflict, codeInProgress, "request with idempotency key %q is in progress", key)
+		case rec.Response.Queued != nil:
+			logging.Info(r.Context(), "replaying queued request with idempotency key %q", key)
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeJSON(w, http.StatusAccepted, rec.Response.Queued)
+		default:
+			logging.Info(r.Context(), "replaying request with idempotency key %q", key)
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeJSON(w, http.StatusOK, rec.Response)
+		}
+		return noop, false
+	}
+
+	return func(resp *AddCapacityResponse) {
+		// The request context may already be cancelled by the time the
+		// handler returns.
+		ctx := detached{r.Context()}
+		if resp != nil {
+			// Keep the key claimed even if the result can't be stored, so
+			// retries are refused rather than buying again.
+			if err := s.store.CompleteIdempotencyKey(ctx, stored, resp); err != nil {
+				logging.Error(ctx, "storing result for idempotency key %q: %v", key, err)
+			}
+			return
+		}
+		if err := s.store.ReleaseIdempotencyKey(ctx, stored); err != nil {
+			logging.Error(ctx, "releasing idempotency key %q: %v", key, err)
+		}
+	}, true
+}
+
+// idempotencyLease is how long a request made with ctx holds its key before
+// it completes: until its deadline, or asyncTimeout in the background, and the
+// time it may take past it to record or roll back what it bought.
+func idempotencyLease(ctx context.Context) time.Duration {
+	lease := asyncTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		lease = time.Until(deadline)
+	}
+	return lease + settleTimeout + rollbackTimeout
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-slot-scheduler/tasks"
+)
+
+// claim claims the Idempotency-Key key for p, as the purchase handlers do.
+func claim(s *Server, key string, p *Payload) (*httptest.ResponseRecorder, func(*AddCapacityResponse), bool) {
+	r := httptest.NewRequest(http.MethodPost, "/v1/commitments", nil)
+	r.Header.Set("Idempotency-Key", key)
+	w := httptest.NewRecorder()
+	finish, ok := s.claimIdempotencyKey(w, r, p)
+	return w, finish, ok
+}
+
+func newIdempotencyServer(t *testing.T) *Server {
+	s, _ := newTestServer(t, tasks.NewFake(), &testClock{now: time.Now()}, nil)
+	return s
+}
+
+func TestClaimIdempotencyKeyReplays(t *testing.T) {
+	s := newIdempotencyServer(t)
+	p := &Payload{Region: "US", ExtraSlot: 100, Minutes: 60}
+
+	_, finish, ok := claim(s, "k1", p)
+	if !ok {
+		t.Fatal("first claim of k1 refused")
+	}
+	finish(&AddCapacityResponse{CommitName: "projects/p/locations/US/capacityCommitments/c1", SlotsPurchased: 100})
+
+	w, _, ok := claim(s, "k1", p)
+	if ok {
+		t.Fatal("second claim of k1 with the same payload was not replayed")
+	}
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("replay = %d, Idempotent-Replayed %q, want 200 and true", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if body := w.Body.String(); !strings.Contains(body, `"commit_name":"projects/p/locations/US/capacityCommitments/c1"`) {
+		t.Errorf("replay body = %s, want the stored response", body)
+	}
+}
+
+func TestClaimIdempotencyKeyDifferentPayload(t *testing.T) {
+	s := newIdempotencyServer(t)
+
+	_, finish, ok := claim(s, "k1", &Payload{Region: "US", ExtraSlot: 100, Minutes: 60})
+	if !ok {
+		t.Fatal("first claim of k1 refused")
+	}
+	finish(&AddCapacityResponse{CommitName: "c1"})
+
+	w, _, ok := claim(s, "k1", &Payload{Region: "US", ExtraSlot: 200, Minutes: 60})
+	if ok {
+		t.Fatal("claim of k1 with another payload was accepted")
+	}
+	if w.Code != http.StatusConflict {
+		t.Errorf("claim with another payload = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestClaimIdempotencyKeyReleasedOnFailure(t *testing.T) {
+	s := newIdempotencyServer(t)
+	p := &Payload{Region: "US", ExtraSlot: 100, Minutes: 60}
+
+	_, finish, ok := claim(s, "k1", p)
+	if !ok {
+		t.Fatal("first claim of k1 refused")
+	}
+	if w, _, ok := claim(s, "k1", p); ok || w.Code != http.StatusConflict {
+		t.Errorf("claim of k1 in progress = %v, %d, want refused with %d", ok, w.Code, http.StatusConflict)
+	}
+	finish(nil)
+
+	if w, _, ok := claim(s, "k1", p); !ok {
+		t.Errorf("claim of k1 after finish(nil) refused with %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestClaimIdempotencyKeyLeaseLapses(t *testing.T) {
+	ctx := context.Background()
+	m := newMemStore()
+
+	if _, fresh, err := m.ReserveIdempotencyKey(ctx, "k1", "h", time.Millisecond); err != nil || !fresh {
+		t.Fatalf("first claim of k1 = %v, %v, want fresh", fresh, err)
+	}
+	if _, fresh, _ := m.ReserveIdempotencyKey(ctx, "k2", "h", time.Hour); !fresh {
+		t.Fatal("first claim of k2 refused")
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// The claim of k1 was never completed, its instance gone.
+	if _, fresh, err := m.ReserveIdempotencyKey(ctx, "k1", "h", time.Hour); err != nil || !fresh {
+		t.Errorf("claim of k1 after its lease = %v, %v, want fresh", fresh, err)
+	}
+	if _, fresh, _ := m.ReserveIdempotencyKey(ctx, "k2", "h", time.Hour); fresh {
+		t.Error("claim of k2 taken over within its lease")
+	}
+
+	if err := m.CompleteIdempotencyKey(ctx, "k1", &AddCapacityResponse{CommitName: "c1"}); err != nil {
+		t.Fatalf("CompleteIdempotencyKey: %v", err)
+	}
+	if rec := m.keys["k1"]; time.Until(rec.ExpireAt) < idempotencyTTL-time.Minute {
+		t.Errorf("completed k1 expires at %s, want %s from now", rec.ExpireAt, idempotencyTTL)
+	}
+
+	if _, _, err := m.ReserveIdempotencyKey(ctx, "k3", "h", -time.Second); err != nil {
+		t.Fatalf("claim of k3: %v", err)
+	}
+	m.ReserveIdempotencyKey(ctx, "k4", "h", time.Hour)
+	if _, ok := m.keys["k3"]; ok {
+		t.Error("expired k3 not pruned by the next claim")
+	}
+}
+
+func TestQueuedAddClaimsKeyFirst(t *testing.T) {
+	now := time.Now().UTC()
+	s, _ := newTestServer(t, tasks.NewFake(), &testClock{now: now}, map[string]string{
+		"BLACKOUTS_JSON": fmt.Sprintf(`[{"name":"close","from":%q,"to":%q,"queue":true}]`, now.Add(-time.Hour).Format(time.RFC3339), now.Add(time.Hour).Format(time.RFC3339)),
+	})
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, v1Prefix+capacityPath, strings.NewReader(`{"region":"US","extra_slot":100,"minutes":60}`))
+		req.Header.Set("Idempotency-Key", "k1")
+		w := httptest.NewRecorder()
+		s.router().ServeHTTP(w, req)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("add %d during a queueing blackout = %d %s, want %d", i+1, w.Code, w.Body, http.StatusAccepted)
+		}
+		if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != (i > 0) {
+			t.Errorf("add %d replayed = %v", i+1, replayed)
+		}
+	}
+
+	queued, err := s.queue.List(context.Background())
+	if err != nil {
+		t.Fatalf("ListTasks: %v", err)
+	}
+	if len(queued) != 1 {
+		t.Errorf("the retried add was queued %d times, want once", len(queued))
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+)
+
+// idleSlotsRevertPath is called by the task ending an ignore_idle_slots
+// window.
+const idleSlotsRevertPath = reservationsPath + "/ignore_idle_slots/revert"
+
+// IdleSlotsWindow sets the ignore_idle_slots of a reservation, true by
+// default, for Minutes. A reservation ignoring idle slots neither uses the
+// idle slots of others nor lends its own.
+type IdleSlotsWindow struct {
+	IgnoreIdleSlots *bool `json:"ignore_idle_slots,omitempty"`
+	Minutes         int64 `json:"minutes"`
+	RequestMetadata
+}
+
+// IdleSlotsWindowResponse is the reservation changed and when it is
+// reverted.
+type IdleSlotsWindowResponse struct {
+	Reservation ReservationInfo `json:"reservation"`
+	RevertTo    bool            `json:"revert_to"`
+	RevertAt    time.Time       `json:"revert_at"`
+	RevertTask  string          `json:"revert_task"`
+}
+
+// IdleSlotsRevert is the body of a revert task: the ignore_idle_slots of
+// Reservation goes back to IgnoreIdleSlots, unless it was changed from SetTo
+// since.
+type IdleSlotsRevert struct {
+	Reservation     string `json:"reservation"`
+	IgnoreIdleSlots bool   `json:"ignore_idle_slots"`
+	SetTo           bool   `json:"set_to"`
+}
+
+// idleSlotsWindowHandler sets the ignore_idle_slots of a reservation for a
+// window, scheduling a task to put it back, so a critical reservation can
+// stop lending its idle slots at month end. Setting it again during the
+// window keeps the value of before the first change to revert to, and
+// reverts at the later of the two ends.
+func (s *Server) idleSlotsWindowHandler(w http.ResponseWriter, r *http.Request) {
+	var req IdleSlotsWindow
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+	var v validator
+	v.minutes("minutes", &req.Minutes)
+	req.RequestMetadata.validate(&v)
+	if err := v.err(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	want := req.IgnoreIdleSlots == nil || *req.IgnoreIdleSlots
+	name := reservationName(vars["region"], vars["id"])
+	who, caller := req.who(r)
+	ctx := logging.WithFields(r.Context(), "reservation", name)
+
+	unlock, err := s.store.Lock(ctx, "reservation/"+name, purchaseLockTTL)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "waiting for reservation lock: %v", err)
+		logging.Error(ctx, "waiting for reservation lock: %v", err)
+		return
+	}
+	defer unlock()
+
+	var res *reservationpb.Reservation
+	err = retryPolicy.Do(ctx, "GetReservation", func(ctx context.Context) (err error) {
+		res, err = s.reservationsFor(name).GetReservation(ctx, &reservationpb.GetReservationRequest{Name: name})
+		return err
+	})
+	if err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+
+	var pending IdleSlotsRevert
+	prefix := s.revertTaskPrefix("idle", vars["region"], vars["id"])
+	pendingTask, pendingAt, err := s.pendingRevert(ctx, prefix, &pending)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(ctx, "finding revert task: %v", err)
+		return
+	}
+	current := res.IgnoreIdleSlots
+	revertTo, revertAt := current, time.Now().Add(time.Duration(req.Minutes)*time.Minute)
+	if pendingTask != "" {
+		revertTo = pending.IgnoreIdleSlots
+		if pendingAt.After(revertAt) {
+			revertAt = pendingAt
+		}
+	} else if want == current {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "the ignore_idle_slots of %s is %t already", name, current)
+		return
+	}
+
+	if res, err = s.setIgnoreIdleSlots(ctx, name, want); err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+	rev := IdleSlotsRevert{Reservation: name, IgnoreIdleSlots: revertTo, SetTo: want}
+	task, err := s.queue.CreateHTTP(ctx, fmt.Sprintf("%s%d", prefix, revertAt.Unix()), taskURL(r, idleSlotsRevertPath), deleteAudience(r), rev, revertAt)
+	if err != nil {
+		// Never leave the reservation changed without a revert.
+		if _, rerr := s.setIgnoreIdleSlots(ctx, name, current); rerr != nil {
+			logging.Error(ctx, "putting the ignore_idle_slots of %s back to %t: %v", name, current, rerr)
+		}
+		writeError(w, http.StatusInternalServerError, codeInternal, "scheduling revert: %v", err)
+		logging.Error(ctx, "scheduling ignore_idle_slots revert of %s: %v", name, err)
+		return
+	}
+	if pendingTask != "" && pendingTask != task.Name {
+		if err := s.queue.Delete(ctx, pendingTask); err != nil && status.Code(err) != codes.NotFound {
+			logging.Error(ctx, "deleting revert task %s: %v", pendingTask, err)
+		}
+	}
+
+	logging.Info(ctx, "ignore_idle_slots of %s set to %t until %s", name, want, revertAt.Format(time.RFC3339))
+	s.record(ctx, LedgerEntry{Action: actionIdleSlotsSet, Region: vars["region"], Reservation: name, Requester: who, Caller: caller, Reason: req.Reason, Ticket: req.Ticket})
+	writeJSON(w, http.StatusOK, IdleSlotsWindowResponse{Reservation: reservationInfo(res), RevertTo: revertTo, RevertAt: revertAt, RevertTask: task.Name})
+}
+
+// idleSlotsRevertHandler puts the ignore_idle_slots of a reservation back at
+// the end of a window. A value changed since, or a reservation deleted, is
+// left as it is.
+func (s *Server) idleSlotsRevertHandler(w http.ResponseWriter, r *http.Request) {
+	var rev IdleSlotsRevert
+	if err := json.NewDecoder(r.Body).Decode(&rev); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+	ctx := logging.WithFields(r.Context(), "reservation", rev.Reservation)
+
+	unlock, err := s.store.Lock(ctx, "reservation/"+rev.Reservation, purchaseLockTTL)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "waiting for reservation lock: %v", err)
+		logging.Error(ctx, "waiting for reservation lock: %v", err)
+		return
+	}
+	defer unlock()
+
+	var res *reservationpb.Reservation
+	err = retryPolicy.Do(ctx, "GetReservation", func(ctx context.Context) (err error) {
+		res, err = s.reservationsFor(rev.Reservation).GetReservation(ctx, &reservationpb.GetReservationRequest{Name: rev.Reservation})
+		return err
+	})
+	if status.Code(err) == codes.NotFound {
+		writeJSON(w, http.StatusOK, "reservation deleted")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(ctx, "getting reservation: %v", err)
+		return
+	}
+	if res.IgnoreIdleSlots != rev.SetTo {
+		logging.Warning(ctx, "ignore_idle_slots of %s changed since it was set to %t, leaving it", rev.Reservation, rev.SetTo)
+		writeJSON(w, http.StatusOK, "ignore_idle_slots changed since the window started")
+		return
+	}
+
+	if _, err := s.setIgnoreIdleSlots(ctx, rev.Reservation, rev.IgnoreIdleSlots); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(ctx, "reverting ignore_idle_slots: %v", err)
+		return
+	}
+	logging.Info(ctx, "ignore_idle_slots of %s reverted to %t", rev.Reservation, rev.IgnoreIdleSlots)
+	s.record(ctx, LedgerEntry{Action: actionIdleSlotsReverted, Region: capacity.Region(rev.Reservation), Reservation: rev.Reservation, Requester: requesterIdleSlotsWindow})
+	writeJSON(w, http.StatusOK, "ignore_idle_slots reverted")
+}
+
+// setIgnoreIdleSlots sets the ignore_idle_slots of the reservation name.
+func (s *Server) setIgnoreIdleSlots(ctx context.Context, name string, ignore bool) (*reservationpb.Reservation, error) {
+	return s.updateReservation(ctx, &reservationpb.Reservation{Name: name, IgnoreIdleSlots: ignore}, &fieldmaskpb.FieldMask{Paths: []string{"ignore_idle_slots"}})
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// defaultOverdueAfter is how long a commitment may outlive its delete time
+// before the reconciler opens an incident for it.
+const defaultOverdueAfter = time.Hour
+
+// Incident is a commitment that could not be deleted, which costs money until
+// someone deletes it.
+type Incident struct {
+	// Key deduplicates incidents, there is one per commitment.
+	Key        string
+	Commitment string
+	Summary    string
+	Details    map[string]interface{}
+}
+
+// Pager opens and resolves incidents with an on-call tool.
+type Pager interface {
+	Trigger(ctx context.Context, inc Incident) error
+	Resolve(ctx context.Context, key string) error
+}
+
+// incidentKey is the deduplication key of the incident of commitment. It
+// has no slashes so it can be used in URL paths.
+func incidentKey(commitment string) string {
+	return "slot-scheduler:" + strings.ReplaceAll(commitment, "/", ":")
+}
+
+// newPagers builds a PagerDuty pager if PAGERDUTY_ROUTING_KEY is set, and an
+// Opsgenie pager if OPSGENIE_API_KEY is set.
+func newPagers() []Pager {
+	client := &http.Client{Timeout: notifyTimeout}
+	var pagers []Pager
+	if key := getenv("PAGERDUTY_ROUTING_KEY"); key != "" {
+		pagers = append(pagers, &pagerDuty{routingKey: key, client: client})
+	}
+	if key := getenv("OPSGENIE_API_KEY"); key != "" {
+		// EU accounts use https://api.eu.opsgenie.com.
+		apiURL := "https://api.opsgenie.com"
+		if v := getenv("OPSGENIE_API_URL"); v != "" {
+			apiURL = strings.TrimSuffix(v, "/")
+		}
+		pagers = append(pagers, &opsgenie{apiKey: key, apiURL: apiURL, client: client})
+	}
+	return pagers
+}
+
+// currentPagers returns the pagers of the last load or reload.
+func (s *Server) currentPagers() []Pager {
+	s.notifyMu.RLock()
+	defer s.notifyMu.RUnlock()
+	return s.pagers
+}
+
+// parseDeleteAlerting reads DELETE_TASK_MAX_ATTEMPTS, the max attempts of the
+// delete queue, and COMMITMENT_OVERDUE_AFTER.
+func parseDeleteAlerting() error {
+	if v := getenv("DELETE_TASK_MAX_ATTEMPTS"); v != "" {
+		var err error
+		if deleteTaskMaxAttempts, err = strconv.Atoi(v); err != nil || deleteTaskMaxAttempts < 1 {
+			return fmt.Errorf("DELETE_TASK_MAX_ATTEMPTS must be a positive number")
+		}
+	}
+	overdueAfter = defaultOverdueAfter
+	if v := getenv("COMMITMENT_OVERDUE_AFTER"); v != "" {
+		var err error
+		if overdueAfter, err = time.ParseDuration(v); err != nil || overdueAfter < 0 {
+			return fmt.Errorf("cannot parse COMMITMENT_OVERDUE_AFTER: %q", v)
+		}
+	}
+	return nil
+}
+
+// lastDeleteAttempt reports whether r is the last attempt Cloud Tasks makes
+// at a delete task, so a failure leaves the commitment to be paid for.
+func lastDeleteAttempt(r *http.Request) bool {
+	if deleteTaskMaxAttempts == 0 {
+		return false
+	}
+	retries, err := strconv.Atoi(r.Header.Get("X-CloudTasks-TaskRetryCount"))
+	if err != nil {
+		return false
+	}
+	return retries+1 >= deleteTaskMaxAttempts
+}
+
+// openIncident pages about commitment. Paging failures are only logged, the
+// failed deletion is in the ledger either way.
+func (s *Server) openIncident(ctx context.Context, commitment, summary string, details map[string]interface{}) {
+	inc := Incident{Key: incidentKey(commitment), Commitment: commitment, Summary: summary, Details: details}
+	logging.Error(ctx, "opening incident %s: %s", inc.Key, summary)
+	for _, p := range s.currentPagers() {
+		ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		if err := p.Trigger(ctx, inc); err != nil {
+			logging.Error(ctx, "paging %T about %s: %v", p, commitment, err)
+		}
+		cancel()
+	}
+}
+
+// resolveIncident resolves the incident of commitment once it is gone. It is
+// called on every deletion, the on-call tools ignore unknown keys.
+func (s *Server) resolveIncident(ctx context.Context, commitment string) {
+	for _, p := range s.currentPagers() {
+		ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		if err := p.Resolve(ctx, incidentKey(commitment)); err != nil {
+			logging.Warning(ctx, "resolving %T incident of %s: %v", p, commitment, err)
+		}
+		cancel()
+	}
+}
+
+// pagerDuty sends events to the PagerDuty Events API v2.
+type pagerDuty struct {
+	routingKey string
+	client     *http.Client
+}
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+func (p *pagerDuty) Trigger(ctx context.Context, inc Incident) error {
+	return postJSON(ctx, p.client, pagerDutyEventsURL, nil, map[string]interface{}{
+		"routing_key":  p.routingKey,
+		"event_action": "trigger",
+		"dedup_key":    inc.Key,
+		"payload": map[string]interface{}{
+			"summary":        inc.Summary,
+			"source":         inc.Commitment,
+			"severity":       "critical",
+			"component":      "slot-scheduler",
+			"custom_details": inc.Details,
+		},
+	})
+}
+
+func (p *pagerDuty) Resolve(ctx context.Context, key string) error {
+	return postJSON(ctx, p.client, pagerDutyEventsURL, nil, map[string]interface{}{
+		"routing_key":  p.routingKey,
+		"event_action": "resolve",
+		"dedup_key":    key,
+	})
+}
+
+// opsgenie creates and closes Opsgenie alerts, keyed by their alias.
+type opsgenie struct {
+	apiKey string
+	apiURL string
+	client *http.Client
+}
+
+func (o *opsgenie) Trigger(ctx context.Context, inc Incident) error {
+	details := make(map[string]string, len(inc.Details))
+	for k, v := range inc.Details {
+		details[k] = fmt.Sprint(v)
+	}
+	return postJSON(ctx, o.client, o.apiURL+"/v2/alerts", o.header(), map[string]interface{}{
+		"message":     truncate(inc.Summary, 130),
+		"alias":       inc.Key,
+		"description": inc.Summary,
+		"source":      "slot-scheduler",
+		"entity":      inc.Commitment,
+		"details":     details,
+		"priority":    "P1",
+	})
+}
+
+func (o *opsgenie) Resolve(ctx context.Context, key string) error {
+	u := fmt.Sprintf("%s/v2/alerts/%s/close?identifierType=alias", o.apiURL, url.PathEscape(key))
+	return postJSON(ctx, o.client, u, o.header(), map[string]string{"source": "slot-scheduler"})
+}
+
+func (o *opsgenie) header() map[string]string {
+	return map[string]string{"Authorization": "GenieKey " + o.apiKey}
+}
+
+// truncate cuts s to at most n bytes.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
@@ -0,0 +1,339 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+)
+
+// Ledger actions
+const (
+	actionPurchased           = "purchased"
+	actionCapped              = "capped"
+	actionPurchaseFailed      = "purchase_failed"
+	actionDeleteScheduled     = "delete_scheduled"
+	actionScheduleFailed      = "delete_schedule_failed"
+	actionDeleteCancelled     = "delete_cancelled"
+	actionDeleteRescheduled   = "delete_rescheduled"
+	actionDeletePostponed     = "delete_postponed"
+	actionDeleted             = "deleted"
+	actionDeleteFailed        = "delete_failed"
+	actionDeleteMissed        = "delete_missed"
+	actionForgotten           = "forgotten"
+	actionSplit               = "split"
+	actionMerged              = "merged"
+	actionRolledBack          = "rolled_back"
+	actionMergeCreated        = "merge_created"
+	actionBudgetExceeded      = "budget_exceeded"
+	actionBudgetWarning       = "budget_warning"
+	actionBlackedOut          = "blacked_out"
+	actionBlackoutQueued      = "blackout_queued"
+	actionBlackoutOverridden  = "blackout_overridden"
+	actionDesiredStateApplied = "desired_state_applied"
+	actionDesiredStateFailed  = "desired_state_failed"
+	actionInterrupted         = "interrupted"
+	actionFreezeStarted       = "freeze_started"
+	actionFreezeLifted        = "freeze_lifted"
+	actionFrozenOut           = "frozen_out"
+	actionPurged              = "purged"
+	actionAutoscaleBumped     = "autoscale_bumped"
+	actionAutoscaleReverted   = "autoscale_reverted"
+	actionReservationBumped   = "reservation_bumped"
+	actionReservationReverted = "reservation_reverted"
+	actionIdleSlotsSet        = "idle_slots_set"
+	actionIdleSlotsReverted   = "idle_slots_reverted"
+	actionAssignmentMoved     = "assignment_moved"
+	actionAssignmentMovedBack = "assignment_moved_back"
+)
+
+// requesterReconciler is the requester of actions taken by the reconciler.
+const requesterReconciler = "reconciler"
+
+// requesterMerger is the requester of actions taken when merging commitments.
+const requesterMerger = "merger"
+
+// requesterBurst is the requester of actions taken when a burst is torn down.
+const requesterBurst = "burst"
+
+// requesterAutoscaleBump is the requester of the reverts of autoscale bumps.
+const requesterAutoscaleBump = "autoscale_bump"
+
+// requesterIdleSlotsWindow is the requester of the ends of ignore_idle_slots
+// windows.
+const requesterIdleSlotsWindow = "idle_slots_window"
+
+// requesterReservationBump is the requester of the reverts of the bumps of
+// CAPACITY_MODE=reservation.
+const requesterReservationBump = "reservation_bump"
+
+// requesterAssignmentMove is the requester of the ends of assignment moves.
+const requesterAssignmentMove = "assignment_move"
+
+// LedgerEntry is a scaling action taken by the service.
+type LedgerEntry struct {
+	Time       time.Time  `firestore:"time" json:"time"`
+	Action     string     `firestore:"action" json:"action"`
+	Commitment string     `firestore:"commitment,omitempty" json:"commitment,omitempty"`
+	Region     string     `firestore:"region,omitempty" json:"region,omitempty"`
+	Slots      int64      `firestore:"slots,omitempty" json:"slots,omitempty"`
+	Plan       string     `firestore:"plan,omitempty" json:"plan,omitempty"`
+	DeleteAt   *time.Time `firestore:"delete_at,omitempty" json:"delete_at,omitempty"`
+	Requester  string     `firestore:"requester,omitempty" json:"requester,omitempty"`
+	// Caller is who asked for the action, when it was for Requester.
+	Caller string `firestore:"caller,omitempty" json:"caller,omitempty"`
+	Reason string `firestore:"reason,omitempty" json:"reason,omitempty"`
+	// Ticket is the change or incident the action was taken under.
+	Ticket string `firestore:"ticket,omitempty" json:"ticket,omitempty"`
+	Error  string `firestore:"error,omitempty" json:"error,omitempty"`
+	// Group is the group of commitments bought for one request.
+	Group string `firestore:"group,omitempty" json:"group,omitempty"`
+	// Revision is the revision of the desired state applied.
+	Revision string `firestore:"revision,omitempty" json:"revision,omitempty"`
+	// EstimatedCost is the USD cost of a purchase kept until its deletion.
+	EstimatedCost *float64 `firestore:"estimated_cost,omitempty" json:"estimated_cost,omitempty"`
+	// Owned is set on the entries of commitments the service owns, see
+	// owns, Forced on deletions of commitments it doesn't.
+	Owned  bool `firestore:"owned,omitempty" json:"owned,omitempty"`
+	Forced bool `firestore:"forced,omitempty" json:"forced,omitempty"`
+	// Reservation is the reservation of autoscale and reservation bumps, of
+	// ignore_idle_slots windows and the one assignments are moved to.
+	Reservation string `firestore:"reservation,omitempty" json:"reservation,omitempty"`
+	// RequestID is the X-Request-ID of the request the action was taken
+	// for, or of the one that scheduled it.
+	RequestID string `firestore:"request_id,omitempty" json:"request_id,omitempty"`
+}
+
+// record appends e to the ledger. Failing to record never fails the action
+// itself, so errors are only logged.
+func (s *Server) record(ctx context.Context, e LedgerEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Region == "" {
+		e.Region = capacity.Region(e.Commitment)
+	}
+	if e.RequestID == "" {
+		e.RequestID = requestIDOf(ctx)
+	}
+	// The action already happened, record it even if the request is gone.
+	ctx, cancel := context.WithTimeout(detached{ctx}, 10*time.Second)
+	defer cancel()
+	if creationActions[e.Action] {
+		e.Owned = true
+	} else if !e.Owned && e.Commitment != "" {
+		// Deletions forget the record first, and tag their entries.
+		e.Owned, _ = s.recorded(ctx, e.Commitment)
+	}
+	if err := s.store.RecordEvent(ctx, &e); err != nil {
+		logging.Error(ctx, "recording %s of %s in ledger: %v", e.Action, e.Commitment, err)
+	}
+	s.exporter.add(ctx, e)
+	s.events.publish(ctx, e)
+	s.notify(ctx, entryEvent(e))
+}
+
+// detached keeps the values of a context but not its cancellation, for work
+// that must finish after the request that started it.
+type detached struct{ context.Context }
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// requester identifies the caller of r: the one authenticated by authorize,
+// or with IAP_AUDIENCE, the user of a valid IAP signed header. It is empty
+// when the caller was not verified, as headers and unverified tokens can be
+// forged.
+func requester(r *http.Request) string {
+	if p := principalOf(r.Context()); p != nil {
+		return p.Name
+	}
+	if iapAudience != "" && r.Header.Get("X-Goog-IAP-JWT-Assertion") != "" {
+		if user, err := iapUser(r); err == nil {
+			return user
+		}
+	}
+	return ""
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+// defaultHistoryWindow is how far back historyHandler looks by default.
+const defaultHistoryWindow = 7 * 24 * time.Hour
+
+// Page sizes of historyHandler.
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// EventQuery selects a page of ledger entries, newest first.
+type EventQuery struct {
+	// From and To bound the time of the entries, To excluded. Zero leaves
+	// them open.
+	From, To time.Time
+	// Region, Requester, Action, Ticket, Commitment and RequestID match
+	// exactly when set.
+	Region, Requester, Action, Ticket, Commitment, RequestID string
+	// At resumes a previous page: entries from At back, past the first Skip
+	// selected at exactly At.
+	At   time.Time
+	Skip int
+	// Limit is the most entries returned.
+	Limit int
+}
+
+// matches reports whether e is selected by the filters of q.
+func (q *EventQuery) matches(e *LedgerEntry) bool {
+	switch {
+	case !q.From.IsZero() && e.Time.Before(q.From),
+		!q.To.IsZero() && !e.Time.Before(q.To),
+		!q.At.IsZero() && e.Time.After(q.At),
+		q.Region != "" && e.Region != q.Region,
+		q.Requester != "" && e.Requester != q.Requester,
+		q.Action != "" && e.Action != q.Action,
+		q.Ticket != "" && e.Ticket != q.Ticket,
+		q.Commitment != "" && e.Commitment != q.Commitment,
+		q.RequestID != "" && e.RequestID != q.RequestID:
+		return false
+	}
+	return true
+}
+
+// eventPage collects the entries of a query, fed newest first.
+type eventPage struct {
+	q       EventQuery
+	skipped int
+	list    []*LedgerEntry
+}
+
+// add keeps e if it is selected, and reports whether the page is full.
+func (p *eventPage) add(e *LedgerEntry) bool {
+	if !p.q.matches(e) {
+		return false
+	}
+	if e.Time.Equal(p.q.At) && p.skipped < p.q.Skip {
+		p.skipped++
+		return false
+	}
+	p.list = append(p.list, e)
+	return p.q.Limit > 0 && len(p.list) >= p.q.Limit
+}
+
+// HistoryPage is a page of the ledger. NextCursor, when set, fetches the
+// next one.
+type HistoryPage struct {
+	Entries    []*LedgerEntry `json:"entries"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// encodeCursor returns the cursor of the page after entries, read with q.
+func encodeCursor(q EventQuery, entries []*LedgerEntry) string {
+	last := entries[len(entries)-1].Time
+	skip := 0
+	if last.Equal(q.At) {
+		skip = q.Skip
+	}
+	for _, e := range entries {
+		if e.Time.Equal(last) {
+			skip++
+		}
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s|%d", last.Format(time.RFC3339Nano), skip)))
+}
+
+// decodeCursor sets the position of q from cursor.
+func decodeCursor(cursor string, q *EventQuery) error {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return errors.New("invalid cursor")
+	}
+	at, skip, ok := strings.Cut(string(b), "|")
+	if !ok {
+		return errors.New("invalid cursor")
+	}
+	if q.At, err = time.Parse(time.RFC3339Nano, at); err != nil {
+		return errors.New("invalid cursor")
+	}
+	if q.Skip, err = strconv.Atoi(skip); err != nil || q.Skip < 0 {
+		return errors.New("invalid cursor")
+	}
+	return nil
+}
+
+// historyHandler lists the ledger entries newest first, a page of limit
+// (default 100) at a time. They are selected by the region, requester,
+// action, ticket, commitment and request_id query parameters, and by time:
+// from and to, as RFC3339, or the last window (default 7d). The cursor of a
+// page fetches the next one with the same parameters.
+func (s *Server) historyHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	now := time.Now()
+	q := EventQuery{
+		Requester:  params.Get("requester"),
+		Action:     params.Get("action"),
+		Ticket:     params.Get("ticket"),
+		Commitment: params.Get("commitment"),
+		RequestID:  params.Get("request_id"),
+		Limit:      defaultHistoryLimit,
+	}
+
+	var v validator
+	if region := params.Get("region"); region != "" {
+		q.Region = region
+		v.region("region", &q.Region)
+	}
+	if p := params.Get("from"); p != "" {
+		var err error
+		q.From, err = time.Parse(time.RFC3339, p)
+		v.check(err == nil, "from", "must be an RFC3339 timestamp")
+	} else {
+		window := defaultHistoryWindow
+		if p := params.Get("window"); p != "" {
+			var err error
+			window, err = parseWindow(p)
+			v.check(err == nil, "window", "%v", err)
+		}
+		q.From = now.Add(-window)
+	}
+	if p := params.Get("to"); p != "" {
+		var err error
+		q.To, err = time.Parse(time.RFC3339, p)
+		v.check(err == nil, "to", "must be an RFC3339 timestamp")
+	}
+	if p := params.Get("limit"); p != "" {
+		var err error
+		q.Limit, err = strconv.Atoi(p)
+		v.check(err == nil && q.Limit > 0 && q.Limit <= maxHistoryLimit, "limit", "must be between 1 and %d", maxHistoryLimit)
+	}
+	if p := params.Get("cursor"); p != "" {
+		err := decodeCursor(p, &q)
+		v.check(err == nil, "cursor", "%v", err)
+	}
+	if err := v.err(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	entries, err := s.store.QueryEvents(r.Context(), q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "reading ledger: %v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	page := HistoryPage{Entries: entries}
+	if len(entries) == q.Limit {
+		page.NextCursor = encodeCursor(q, entries)
+	}
+	writeJSON(w, http.StatusOK, page)
+}
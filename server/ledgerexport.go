@@ -0,0 +1,305 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"cloud.google.com/go/bigquery/storage/managedwriter/adapt"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+const (
+	// exportBatchSize is how many entries are appended at most at once.
+	exportBatchSize = 500
+	// exportFlushInterval is how long entries wait for a batch at most.
+	exportFlushInterval = 5 * time.Second
+	// exportBuffer is how many entries wait to be exported before new ones
+	// are dropped.
+	exportBuffer = 10000
+)
+
+// ledgerExportSchema is the schema of the table ledger entries are exported
+// to, named as their JSON.
+var ledgerExportSchema = bigquery.Schema{
+	{Name: "time", Type: bigquery.TimestampFieldType, Required: true},
+	{Name: "action", Type: bigquery.StringFieldType, Required: true},
+	{Name: "commitment", Type: bigquery.StringFieldType},
+	{Name: "region", Type: bigquery.StringFieldType},
+	{Name: "slots", Type: bigquery.IntegerFieldType},
+	{Name: "plan", Type: bigquery.StringFieldType},
+	{Name: "delete_at", Type: bigquery.TimestampFieldType},
+	{Name: "requester", Type: bigquery.StringFieldType},
+	{Name: "reason", Type: bigquery.StringFieldType},
+	{Name: "error", Type: bigquery.StringFieldType},
+	{Name: "group", Type: bigquery.StringFieldType},
+	{Name: "revision", Type: bigquery.StringFieldType},
+	{Name: "estimated_cost", Type: bigquery.FloatFieldType},
+	{Name: "caller", Type: bigquery.StringFieldType},
+	{Name: "ticket", Type: bigquery.StringFieldType},
+	{Name: "request_id", Type: bigquery.StringFieldType},
+}
+
+// ledgerExporter streams ledger entries to a BigQuery table with the
+// Storage Write API, in batches. Exporting never holds up recording: entries
+// are dropped, and logged, when the table can't keep up.
+type ledgerExporter struct {
+	table   string
+	client  *managedwriter.Client
+	stream  *managedwriter.ManagedStream
+	message protoreflect.MessageDescriptor
+
+	mu      sync.Mutex
+	closed  bool
+	entries chan LedgerEntry
+	done    chan struct{}
+}
+
+// parseExportTable splits LEDGER_EXPORT_TABLE, as project.dataset.table or
+// dataset.table in the project of the service.
+func parseExportTable(v string) (project, dataset, table string, err error) {
+	parts := strings.Split(v, ".")
+	switch len(parts) {
+	case 2:
+		project, dataset, table = projectID, parts[0], parts[1]
+	case 3:
+		project, dataset, table = parts[0], parts[1], parts[2]
+	default:
+		return "", "", "", fmt.Errorf("LEDGER_EXPORT_TABLE must be dataset.table or project.dataset.table")
+	}
+	for _, p := range []string{project, dataset, table} {
+		if p == "" {
+			return "", "", "", fmt.Errorf("LEDGER_EXPORT_TABLE must be dataset.table or project.dataset.table")
+		}
+	}
+	return project, dataset, table, nil
+}
+
+// newLedgerExporter opens the default stream of the LEDGER_EXPORT_TABLE
+// table, created day partitioned on time if it doesn't exist, and starts
+// exporting to it.
+func newLedgerExporter(ctx context.Context, bq *bigquery.Client) (*ledgerExporter, error) {
+	project, dataset, table, err := parseExportTable(ledgerExportTable)
+	if err != nil {
+		return nil, err
+	}
+	t := bq.DatasetInProject(project, dataset).Table(table)
+	err = t.Create(ctx, &bigquery.TableMetadata{
+		Schema:           ledgerExportSchema,
+		TimePartitioning: &bigquery.TimePartitioning{Type: bigquery.DayPartitioningType, Field: "time"},
+		Description:      "Scaling actions of the slot scheduler",
+	})
+	var apiErr *googleapi.Error
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.Code == 409) {
+		return nil, fmt.Errorf("creating %s: %v", ledgerExportTable, err)
+	}
+	if err != nil {
+		if err := addExportColumns(ctx, t); err != nil {
+			return nil, fmt.Errorf("updating the schema of %s: %v", ledgerExportTable, err)
+		}
+	}
+
+	schema, err := adapt.BQSchemaToStorageTableSchema(ledgerExportSchema)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := adapt.StorageSchemaToProto2Descriptor(schema, "root")
+	if err != nil {
+		return nil, err
+	}
+	message, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("schema of %s is not a message", ledgerExportTable)
+	}
+	normalized, err := adapt.NormalizeDescriptor(message)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := managedwriter.NewClient(ctx, project)
+	if err != nil {
+		return nil, fmt.Errorf("creating storage write client: %v", err)
+	}
+	stream, err := client.NewManagedStream(ctx,
+		managedwriter.WithDestinationTable(managedwriter.TableParentFromParts(project, dataset, table)),
+		managedwriter.WithType(managedwriter.DefaultStream),
+		managedwriter.WithSchemaDescriptor(normalized),
+	)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("opening stream to %s: %v", ledgerExportTable, err)
+	}
+
+	x := &ledgerExporter{
+		table:   ledgerExportTable,
+		client:  client,
+		stream:  stream,
+		message: message,
+		entries: make(chan LedgerEntry, exportBuffer),
+		done:    make(chan struct{}),
+	}
+	go x.run(context.Background())
+	logging.Info(ctx, "exporting the ledger to %s", ledgerExportTable)
+	return x, nil
+}
+
+// add queues e for export. It is a no-op on a nil exporter.
+func (x *ledgerExporter) add(ctx context.Context, e LedgerEntry) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.closed {
+		logging.Warning(ctx, "exporter closed, %s of %s not exported to %s", e.Action, e.Commitment, x.table)
+		return
+	}
+	select {
+	case x.entries <- e:
+	default:
+		logging.Error(ctx, "export buffer full, %s of %s not exported to %s", e.Action, e.Commitment, x.table)
+	}
+}
+
+// run appends the queued entries in batches until the exporter is closed,
+// then the last of them.
+func (x *ledgerExporter) run(ctx context.Context) {
+	defer close(x.done)
+	ticker := time.NewTicker(exportFlushInterval)
+	defer ticker.Stop()
+
+	var batch []LedgerEntry
+	for {
+		select {
+		case e, ok := <-x.entries:
+			if !ok {
+				x.append(ctx, batch)
+				return
+			}
+			if batch = append(batch, e); len(batch) >= exportBatchSize {
+				x.append(ctx, batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			x.append(ctx, batch)
+			batch = nil
+		}
+	}
+}
+
+// append writes batch to the table and waits for it to be acknowledged.
+func (x *ledgerExporter) append(ctx context.Context, batch []LedgerEntry) {
+	if len(batch) == 0 {
+		return
+	}
+	rows := make([][]byte, 0, len(batch))
+	for _, e := range batch {
+		b, err := proto.Marshal(x.row(e))
+		if err != nil {
+			logging.Error(ctx, "encoding %s of %s for %s: %v", e.Action, e.Commitment, x.table, err)
+			continue
+		}
+		rows = append(rows, b)
+	}
+	res, err := x.stream.AppendRows(ctx, rows)
+	if err == nil {
+		_, err = res.GetResult(ctx)
+	}
+	if err != nil {
+		logging.Error(ctx, "exporting %d ledger entries to %s: %v", len(rows), x.table, err)
+	}
+}
+
+// addExportColumns adds the columns of ledgerExportSchema missing from t,
+// created by an earlier version. New columns are always nullable.
+func addExportColumns(ctx context.Context, t *bigquery.Table) error {
+	meta, err := t.Metadata(ctx)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool)
+	for _, f := range meta.Schema {
+		have[f.Name] = true
+	}
+	schema := meta.Schema
+	for _, f := range ledgerExportSchema {
+		if !have[f.Name] {
+			schema = append(schema, f)
+		}
+	}
+	if len(schema) == len(meta.Schema) {
+		return nil
+	}
+	_, err = t.Update(ctx, bigquery.TableMetadataToUpdate{Schema: schema}, meta.ETag)
+	return err
+}
+
+// row converts e to a message of the table schema. Empty fields are left
+// NULL.
+func (x *ledgerExporter) row(e LedgerEntry) *dynamicpb.Message {
+	m := dynamicpb.NewMessage(x.message)
+	fields := x.message.Fields()
+	set := func(name string, v protoreflect.Value) {
+		m.Set(fields.ByName(protoreflect.Name(name)), v)
+	}
+	setString := func(name, v string) {
+		if v != "" {
+			set(name, protoreflect.ValueOfString(v))
+		}
+	}
+
+	// Timestamps are written as microseconds since the epoch.
+	set("time", protoreflect.ValueOfInt64(e.Time.UnixMicro()))
+	setString("action", e.Action)
+	setString("commitment", e.Commitment)
+	setString("region", e.Region)
+	if e.Slots != 0 {
+		set("slots", protoreflect.ValueOfInt64(e.Slots))
+	}
+	setString("plan", e.Plan)
+	if e.DeleteAt != nil {
+		set("delete_at", protoreflect.ValueOfInt64(e.DeleteAt.UnixMicro()))
+	}
+	setString("requester", e.Requester)
+	setString("caller", e.Caller)
+	setString("reason", e.Reason)
+	setString("ticket", e.Ticket)
+	setString("error", e.Error)
+	setString("group", e.Group)
+	setString("revision", e.Revision)
+	setString("request_id", e.RequestID)
+	if e.EstimatedCost != nil {
+		set("estimated_cost", protoreflect.ValueOfFloat64(*e.EstimatedCost))
+	}
+	return m
+}
+
+// Close exports what is queued and closes the stream. It is a no-op on a
+// nil exporter.
+func (x *ledgerExporter) Close() error {
+	if x == nil {
+		return nil
+	}
+	x.mu.Lock()
+	if !x.closed {
+		x.closed = true
+		close(x.entries)
+	}
+	x.mu.Unlock()
+	<-x.done
+	err := x.stream.Close()
+	if cerr := x.client.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+)
+
+// mergeTolerance is how far apart the delete times of commitments merged
+// together may be. The merged commitment is kept until the latest of them.
+const mergeTolerance = 5 * time.Minute
+
+// MergeResult summarises a merge pass.
+type MergeResult struct {
+	Merged []MergedCommitment `json:"merged"`
+	Errors []string           `json:"errors,omitempty"`
+}
+
+// MergedCommitment is a commitment resulting from a merge.
+type MergedCommitment struct {
+	Name      string     `json:"name"`
+	SlotCount int64      `json:"slot_count"`
+	From      []string   `json:"from"`
+	DeleteAt  *time.Time `json:"delete_at,omitempty"`
+	DryRun    bool       `json:"dry_run,omitempty"`
+}
+
+// runMerger merges commitments every interval until ctx is done.
+func (s *Server) runMerger(ctx context.Context, interval time.Duration) {
+	logging.Info(ctx, "merging commitments every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			res, err := s.merge(ctx)
+			if err != nil {
+				logging.Error(ctx, "merging commitments: %v", err)
+				continue
+			}
+			if len(res.Merged) > 0 {
+				logging.Info(ctx, "merged %d groups of commitments", len(res.Merged))
+			}
+		}
+	}
+}
+
+func (s *Server) mergeHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := s.merge(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// merge consolidates the active commitments bought by the service that share
+// a region and plan and are due for deletion within mergeTolerance of each
+// other, or are all kept. Their delete tasks are replaced by one for the
+// merged commitment.
+func (s *Server) merge(ctx context.Context) (*MergeResult, error) {
+	recs, err := s.store.ListCommitments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing recorded commitments: %v", err)
+	}
+
+	// Commitments can only be merged within an admin project and region.
+	byParent := make(map[string][]*CommitmentRecord)
+	for _, rec := range recs {
+		parent := path.Dir(path.Dir(rec.Name))
+		byParent[parent] = append(byParent[parent], rec)
+	}
+
+	res := &MergeResult{Merged: []MergedCommitment{}}
+	for parent, recs := range byParent {
+		region := capacity.Region(recs[0].Name)
+		ctx := logging.WithFields(ctx, "region", region)
+		unlock, err := s.store.Lock(ctx, "scale_to/"+parent, purchaseLockTTL)
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("waiting for scale lock of %s: %v", region, err))
+			continue
+		}
+
+		groups, err := s.mergeGroups(ctx, parent, recs)
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("grouping commitments in %s: %v", region, err))
+		}
+		for _, group := range groups {
+			if dryRun {
+				res.Merged = append(res.Merged, dryMerge(ctx, group))
+				continue
+			}
+			merged, err := s.mergeGroup(ctx, parent, group)
+			if err != nil {
+				res.Errors = append(res.Errors, err.Error())
+				continue
+			}
+			res.Merged = append(res.Merged, *merged)
+		}
+		unlock()
+	}
+	return res, nil
+}
+
+// mergeGroups groups the active commitments of recs that can be merged.
+func (s *Server) mergeGroups(ctx context.Context, parent string, recs []*CommitmentRecord) ([][]*CommitmentRecord, error) {
+	commitments, err := s.capacity.List(ctx, parent)
+	if err != nil {
+		return nil, err
+	}
+	active := make(map[string]bool)
+	for _, c := range commitments {
+		active[c.Name] = c.State == reservationpb.CapacityCommitment_ACTIVE
+	}
+
+	byPlan := make(map[string][]*CommitmentRecord)
+	for _, rec := range recs {
+		if active[rec.Name] {
+			byPlan[rec.Plan] = append(byPlan[rec.Plan], rec)
+		}
+	}
+
+	var groups [][]*CommitmentRecord
+	for _, recs := range byPlan {
+		sort.Slice(recs, func(i, j int) bool { return recs[i].DeleteAt.Before(recs[j].DeleteAt) })
+		var group []*CommitmentRecord
+		for _, rec := range recs {
+			if len(group) > 0 && (rec.DeleteAt.IsZero() != group[0].DeleteAt.IsZero() || rec.DeleteAt.Sub(group[0].DeleteAt) > mergeTolerance) {
+				if len(group) > 1 {
+					groups = append(groups, group)
+				}
+				group = nil
+			}
+			group = append(group, rec)
+		}
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+// dryMerge describes the merge of group without making it.
+func dryMerge(ctx context.Context, group []*CommitmentRecord) MergedCommitment {
+	merged := MergedCommitment{DryRun: true}
+	for _, rec := range group {
+		merged.SlotCount += rec.SlotCount
+		merged.From = append(merged.From, rec.Name)
+	}
+	if last := group[len(group)-1]; !last.DeleteAt.IsZero() {
+		merged.DeleteAt = timePtr(last.DeleteAt)
+	}
+	logging.Info(ctx, "dry run: would merge %v into %d slots", merged.From, merged.SlotCount)
+	return merged
+}
+
+// mergeGroup merges the commitments of group and reschedules the deletion of
+// the result.
+func (s *Server) mergeGroup(ctx context.Context, parent string, group []*CommitmentRecord) (*MergedCommitment, error) {
+	ids := make([]string, 0, len(group))
+	names := make([]string, 0, len(group))
+	for _, rec := range group {
+		ids = append(ids, path.Base(rec.Name))
+		names = append(names, rec.Name)
+	}
+
+	// Merges aren't idempotent, so they aren't retried.
+	commit, err := s.reservationsFor(parent).MergeCapacityCommitments(ctx, &reservationpb.MergeCapacityCommitmentsRequest{
+		Parent:                parent,
+		CapacityCommitmentIds: ids,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("merging %v: %v", names, err)
+	}
+	ctx = logging.WithFields(ctx, "commit", commit.Name, "slots", commit.SlotCount)
+	logging.Info(ctx, "merged %v into %s of %d slots", names, commit.Name, commit.SlotCount)
+
+	// The group is sorted by delete time, the merged commitment is kept for
+	// as long as any of its parts was to be.
+	last := group[len(group)-1]
+	rec := &CommitmentRecord{
+		Name:      commit.Name,
+		Region:    last.Region,
+		SlotCount: commit.SlotCount,
+		Plan:      commit.Plan.String(),
+		DeleteURL: last.DeleteURL,
+		Audience:  last.Audience,
+		CreatedAt: group[0].CreatedAt,
+		DeleteAt:  last.DeleteAt,
+		Requester: last.Requester,
+		Group:     last.Group,
+		RequestID: requestIDOf(ctx),
+	}
+	for _, part := range group {
+		// Parts bought for different requests leave it unattributed.
+		if part.Requester != rec.Requester {
+			rec.Requester = ""
+		}
+		if part.Group != rec.Group {
+			rec.Group = ""
+		}
+		if part.CreatedAt.Before(rec.CreatedAt) {
+			rec.CreatedAt = part.CreatedAt
+		}
+		s.dropDeleteTask(ctx, part.Name)
+		if part.Name != commit.Name {
+			if err := s.store.ForgetCommitment(ctx, part.Name); err != nil {
+				logging.Error(ctx, "forgetting merged commitment %s: %v", part.Name, err)
+			}
+		}
+		s.record(ctx, LedgerEntry{Action: actionMerged, Commitment: part.Name, Slots: part.SlotCount, Requester: requesterMerger, Reason: "merged into " + commit.Name})
+	}
+	s.record(ctx, LedgerEntry{Action: actionMergeCreated, Commitment: commit.Name, Slots: commit.SlotCount, Plan: commit.Plan.String(), Requester: requesterMerger, Reason: fmt.Sprintf("merged from %d commitments", len(group))})
+	if err := s.store.PutCommitment(ctx, rec); err != nil {
+		logging.Error(ctx, "recording merged commitment %s: %v", commit.Name, err)
+	}
+
+	merged := &MergedCommitment{Name: commit.Name, SlotCount: commit.SlotCount, From: names}
+	if rec.DeleteAt.IsZero() {
+		return merged, nil
+	}
+	// The merged commitment may reuse the name of a part whose task was just
+	// deleted, so its task gets a new name. If it can't be created, the
+	// reconciler schedules it from the record.
+	if _, err := s.launchDeleteTask(ctx, s.queue.RescheduledTaskName(commit.Name, rec.DeleteAt), commit.Name, rec.DeleteURL, rec.Audience, rec.DeleteAt); err != nil {
+		s.record(ctx, LedgerEntry{Action: actionScheduleFailed, Commitment: commit.Name, DeleteAt: timePtr(rec.DeleteAt), Requester: requesterMerger, Error: err.Error()})
+		return nil, fmt.Errorf("scheduling deletion of merged commitment %s: %v", commit.Name, err)
+	}
+	s.record(ctx, LedgerEntry{Action: actionDeleteScheduled, Commitment: commit.Name, Slots: commit.SlotCount, DeleteAt: timePtr(rec.DeleteAt), Requester: requesterMerger})
+	merged.DeleteAt = timePtr(rec.DeleteAt)
+	return merged, nil
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go-slot-scheduler/internal/taskspb"
+)
+
+// metricsPath serves gauges for Prometheus and compatible scrapers.
+const metricsPath = "/metrics"
+
+// queueStates are the states of a queue reported by the queue state gauge.
+var queueStates = []string{taskspb.Queue_RUNNING.String(), taskspb.Queue_PAUSED.String(), taskspb.Queue_DISABLED.String()}
+
+// metricsHandler writes the gauges of the instance in the Prometheus text
+// format: the state of each delete queue as last checked, and the
+// operations in flight. Like the probes it needs no role, it tells nothing
+// but states and counts.
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	gauge := func(name, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+
+	queues := s.queues.list()
+	gauge("slot_scheduler_task_queue_state", "State of the delete queue when last checked, 1 for the state it is in.")
+	for _, q := range queues {
+		for _, state := range queueStates {
+			fmt.Fprintf(&b, "slot_scheduler_task_queue_state{queue=%q,state=%q} %d\n", q.Queue, state, boolGauge(q.State == state))
+		}
+	}
+	gauge("slot_scheduler_task_queue_stopped", "1 while the delete queue is PAUSED or DISABLED and purchases are refused.")
+	for _, q := range queues {
+		fmt.Fprintf(&b, "slot_scheduler_task_queue_stopped{queue=%q} %d\n", q.Queue, boolGauge(q.stopped()))
+	}
+	gauge("slot_scheduler_task_queue_checked_timestamp_seconds", "When the state of the delete queue was last checked.")
+	for _, q := range queues {
+		fmt.Fprintf(&b, "slot_scheduler_task_queue_checked_timestamp_seconds{queue=%q} %d\n", q.Queue, q.CheckedAt.Unix())
+	}
+	gauge("slot_scheduler_operations_in_flight", "Purchases, deletions and background requests in flight.")
+	fmt.Fprintf(&b, "slot_scheduler_operations_in_flight %d\n", len(s.ops.running()))
+	gauge("slot_scheduler_draining", "1 once the instance is shutting down.")
+	fmt.Fprintf(&b, "slot_scheduler_draining %d\n", boolGauge(s.ops.isDraining()))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprint(w, b.String())
+}
+
+// boolGauge is 1 for true and 0 for false.
+func boolGauge(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
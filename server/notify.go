@@ -0,0 +1,388 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// notifyTimeout bounds how long a notification may take to be delivered.
+const notifyTimeout = 10 * time.Second
+
+// Event types notifiers are sent. Ledger entries are sent with their action
+// as type, eventReconciled summarises a reconciliation pass that acted,
+// eventDrift a drift detection pass that found some, and eventQueueStopped
+// and eventQueueResumed tell when the delete queue stops or starts
+// dispatching tasks.
+const (
+	eventPurchased       = actionPurchased
+	eventCapped          = actionCapped
+	eventDeleteScheduled = actionDeleteScheduled
+	eventDeleteFailed    = actionDeleteFailed
+	eventReconciled      = "reconciled"
+	eventDrift           = "drift"
+	eventQueueStopped    = "queue_stopped"
+	eventQueueResumed    = "queue_resumed"
+)
+
+// defaultNotifyEvents are the event types operators are told about.
+var defaultNotifyEvents = strings.Join([]string{
+	eventPurchased, eventCapped, actionDeleted, eventDeleteFailed, actionDeleteMissed, actionScheduleFailed,
+	actionRolledBack, actionBudgetExceeded, actionDeletePostponed, eventReconciled,
+	actionDesiredStateApplied, actionDesiredStateFailed, eventDrift,
+	actionFreezeStarted, actionFreezeLifted, actionPurged, eventQueueStopped,
+	eventQueueResumed,
+}, ",")
+
+// Event is a scaling event operators are told about.
+type Event struct {
+	Type    string       `json:"type"`
+	Time    time.Time    `json:"time"`
+	Summary string       `json:"summary"`
+	Entry   *LedgerEntry `json:"entry,omitempty"`
+	// RequestID is the X-Request-ID of the request the event happened in.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Notifier delivers events to operators.
+type Notifier interface {
+	Notify(ctx context.Context, e Event) error
+}
+
+// newNotifier builds the notifiers named in NOTIFIERS, fanning events out to
+// all of them. Without NOTIFIERS, Slack is used if SLACK_WEBHOOK_URL is set.
+func newNotifier(ctx context.Context) (Notifier, error) {
+	names := getenv("NOTIFIERS")
+	slackWebhookURL := getenv("SLACK_WEBHOOK_URL")
+	if names == "" && slackWebhookURL != "" {
+		names = "slack"
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	var fanout multiNotifier
+	for _, name := range strings.Split(names, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "":
+		case "log":
+			fanout = append(fanout, logNotifier{})
+		case "slack":
+			if slackWebhookURL == "" {
+				return nil, fmt.Errorf("slack notifier needs SLACK_WEBHOOK_URL")
+			}
+			fanout = append(fanout, &slackNotifier{webhookURL: slackWebhookURL, client: client})
+		case "chat":
+			url := getenv("GOOGLE_CHAT_WEBHOOK_URL")
+			if url == "" {
+				return nil, fmt.Errorf("chat notifier needs GOOGLE_CHAT_WEBHOOK_URL")
+			}
+			fanout = append(fanout, &chatNotifier{webhookURL: url, client: client})
+		case "pubsub":
+			topic := getenv("NOTIFY_PUBSUB_TOPIC")
+			if topic == "" {
+				return nil, fmt.Errorf("pubsub notifier needs NOTIFY_PUBSUB_TOPIC")
+			}
+			svc, err := pubsub.NewService(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("creating pubsub client: %v", err)
+			}
+			fanout = append(fanout, &pubsubNotifier{topic: topic, service: svc})
+		case "email":
+			n, err := newEmailNotifier(client)
+			if err != nil {
+				return nil, err
+			}
+			fanout = append(fanout, n)
+		default:
+			return nil, fmt.Errorf("unknown notifier %q, want log, slack, chat, pubsub or email", name)
+		}
+	}
+	if len(fanout) == 0 {
+		return nil, nil
+	}
+	return fanout, nil
+}
+
+// parseNotifyEvents parses a comma separated list of event types.
+func parseNotifyEvents(v string) map[string]bool {
+	events := make(map[string]bool)
+	for _, t := range strings.Split(v, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			events[t] = true
+		}
+	}
+	return events
+}
+
+// notify passes e on to the notifier if its type is one operators want to
+// hear about. Failing to notify never fails the action, so errors are only
+// logged.
+func (s *Server) notify(ctx context.Context, e Event) {
+	s.notifyMu.RLock()
+	n := s.notifier
+	s.notifyMu.RUnlock()
+	if n == nil || !live().NotifyEvents[e.Type] {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.RequestID == "" {
+		e.RequestID = requestIDOf(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	if err := n.Notify(ctx, e); err != nil {
+		logging.Error(ctx, "notifying %s: %v", e.Type, err)
+	}
+}
+
+// entryEvent is the event of a ledger entry.
+func entryEvent(e LedgerEntry) Event {
+	return Event{Type: e.Action, Time: e.Time, Summary: e.summary(), Entry: &e, RequestID: e.RequestID}
+}
+
+// summary describes e in a sentence.
+func (e LedgerEntry) summary() string {
+	var b strings.Builder
+	b.WriteString(strings.ReplaceAll(e.Action, "_", " "))
+	if e.Slots > 0 {
+		fmt.Fprintf(&b, ": %d", e.Slots)
+		if e.Plan != "" {
+			fmt.Fprintf(&b, " %s", e.Plan)
+		}
+		b.WriteString(" slots")
+	}
+	if e.Region != "" {
+		fmt.Fprintf(&b, " in %s", e.Region)
+	}
+	if e.Commitment != "" {
+		fmt.Fprintf(&b, " (%s)", e.Commitment)
+	}
+	if e.DeleteAt != nil {
+		fmt.Fprintf(&b, ", deleted at %s", e.DeleteAt.Format(time.RFC3339))
+	}
+	if e.Revision != "" {
+		fmt.Fprintf(&b, ", revision %s", e.Revision)
+	}
+	if e.EstimatedCost != nil {
+		fmt.Fprintf(&b, ", estimated $%.2f", *e.EstimatedCost)
+	}
+	if e.Requester != "" {
+		fmt.Fprintf(&b, ", requested by %s", e.Requester)
+		if e.Caller != "" {
+			fmt.Fprintf(&b, " through %s", e.Caller)
+		}
+	}
+	if e.Reason != "" {
+		fmt.Fprintf(&b, ", reason: %s", e.Reason)
+	}
+	if e.Ticket != "" {
+		fmt.Fprintf(&b, ", ticket: %s", e.Ticket)
+	}
+	if e.RequestID != "" {
+		fmt.Fprintf(&b, ", request: %s", e.RequestID)
+	}
+	if e.Error != "" {
+		fmt.Fprintf(&b, ", error: %s", e.Error)
+	}
+	return b.String()
+}
+
+// severity is how urgently an event needs attention: error, warning or info.
+func (e Event) severity() string {
+	switch e.Type {
+	case actionDeleteFailed, actionDeleteMissed, eventQueueStopped, actionScheduleFailed, actionPurchaseFailed, actionBudgetExceeded, actionDesiredStateFailed, actionInterrupted:
+		return "error"
+	case actionCapped, actionBudgetWarning, actionBlackedOut, actionBlackoutOverridden, actionDeletePostponed:
+		return "warning"
+	}
+	return "info"
+}
+
+// multiNotifier fans events out to every notifier it holds.
+type multiNotifier []Notifier
+
+func (m multiNotifier) Notify(ctx context.Context, e Event) error {
+	var errs []string
+	for _, n := range m {
+		if err := n.Notify(ctx, e); err != nil {
+			errs = append(errs, fmt.Sprintf("%T: %v", n, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// logNotifier writes events to the log.
+type logNotifier struct{}
+
+func (logNotifier) Notify(ctx context.Context, e Event) error {
+	switch e.severity() {
+	case "error":
+		logging.Error(ctx, "event %s: %s", e.Type, e.Summary)
+	case "warning":
+		logging.Warning(ctx, "event %s: %s", e.Type, e.Summary)
+	default:
+		logging.Info(ctx, "event %s: %s", e.Type, e.Summary)
+	}
+	return nil
+}
+
+// slackNotifier posts to a Slack incoming webhook.
+type slackNotifier struct {
+	webhookURL string
+	client     *http.Client
+}
+
+func (n *slackNotifier) Notify(ctx context.Context, e Event) error {
+	icon := map[string]string{"error": ":rotating_light:", "warning": ":warning:", "info": ":information_source:"}[e.severity()]
+	return postJSON(ctx, n.client, n.webhookURL, nil, map[string]string{
+		"text": fmt.Sprintf("%s *slot scheduler* %s", icon, e.Summary),
+	})
+}
+
+// chatNotifier posts to a Google Chat space webhook.
+type chatNotifier struct {
+	webhookURL string
+	client     *http.Client
+}
+
+func (n *chatNotifier) Notify(ctx context.Context, e Event) error {
+	return postJSON(ctx, n.client, n.webhookURL, nil, map[string]string{
+		"text": fmt.Sprintf("*slot scheduler* [%s] %s", e.severity(), e.Summary),
+	})
+}
+
+// pubsubNotifier publishes events as JSON to a Pub/Sub topic, with their type
+// as the type attribute.
+type pubsubNotifier struct {
+	topic   string // projects/{project}/topics/{topic}
+	service *pubsub.Service
+}
+
+func (n *pubsubNotifier) Notify(ctx context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = n.service.Projects.Topics.Publish(n.topic, &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{{
+			Data:       base64.StdEncoding.EncodeToString(data),
+			Attributes: map[string]string{"type": e.Type},
+		}},
+	}).Context(ctx).Do()
+	return err
+}
+
+// emailNotifier mails events through SendGrid, or an SMTP server.
+type emailNotifier struct {
+	from string
+	to   []string
+
+	sendgridKey string
+	client      *http.Client
+
+	smtpAddr string
+	smtpAuth smtp.Auth
+}
+
+// newEmailNotifier reads EMAIL_FROM, EMAIL_TO (comma separated), and either
+// SENDGRID_API_KEY or SMTP_ADDR (host:port) with optional SMTP_USERNAME and
+// SMTP_PASSWORD.
+func newEmailNotifier(client *http.Client) (*emailNotifier, error) {
+	n := &emailNotifier{
+		from:        getenv("EMAIL_FROM"),
+		sendgridKey: getenv("SENDGRID_API_KEY"),
+		client:      client,
+		smtpAddr:    getenv("SMTP_ADDR"),
+	}
+	for _, to := range strings.Split(getenv("EMAIL_TO"), ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			n.to = append(n.to, to)
+		}
+	}
+	if n.from == "" || len(n.to) == 0 {
+		return nil, fmt.Errorf("email notifier needs EMAIL_FROM and EMAIL_TO")
+	}
+	if n.sendgridKey == "" && n.smtpAddr == "" {
+		return nil, fmt.Errorf("email notifier needs SENDGRID_API_KEY or SMTP_ADDR")
+	}
+	if user := getenv("SMTP_USERNAME"); user != "" {
+		host, _, err := net.SplitHostPort(n.smtpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("SMTP_ADDR: %v", err)
+		}
+		n.smtpAuth = smtp.PlainAuth("", user, getenv("SMTP_PASSWORD"), host)
+	}
+	return n, nil
+}
+
+func (n *emailNotifier) Notify(ctx context.Context, e Event) error {
+	subject := fmt.Sprintf("[slot scheduler] %s %s", e.severity(), strings.ReplaceAll(e.Type, "_", " "))
+	if n.sendgridKey != "" {
+		to := make([]map[string]string, 0, len(n.to))
+		for _, addr := range n.to {
+			to = append(to, map[string]string{"email": addr})
+		}
+		return postJSON(ctx, n.client, "https://api.sendgrid.com/v3/mail/send", map[string]string{"Authorization": "Bearer " + n.sendgridKey}, map[string]interface{}{
+			"personalizations": []interface{}{map[string]interface{}{"to": to}},
+			"from":             map[string]string{"email": n.from},
+			"subject":          subject,
+			"content":          []interface{}{map[string]string{"type": "text/plain", "value": e.Summary}},
+		})
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		n.from, strings.Join(n.to, ", "), subject, e.Summary)
+	// net/smtp takes no context, so the send is given up on, not cancelled.
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(n.smtpAddr, n.smtpAuth, n.from, n.to, []byte(msg)) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// postJSON POSTs v as JSON to url with header and fails on any status but
+// 2xx.
+func postJSON(ctx context.Context, client *http.Client, url string, header map[string]string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"go-slot-scheduler/internal/openapi"
+	"go-slot-scheduler/scheduler"
+)
+
+// apiDoc documents a route in the OpenAPI document.
+type apiDoc struct {
+	id      string
+	summary string
+	tag     string
+	// role is the least role callers need, roleNone for the routes that
+	// authenticate their callers their own way.
+	role  role
+	query []apiParam
+	// body and data are values of the types of the request body and of the
+	// data of the response, nil when there is none.
+	body interface{}
+	data interface{}
+	// cloudEvent is set on the routes also taking a CloudEvent, whose data
+	// is the body in binary mode.
+	cloudEvent bool
+	// status is that of success, 200 when 0.
+	status int
+	// oneOf are the types the data may have instead of data.
+	oneOf []interface{}
+	// contentType is that of the response when it isn't the JSON envelope
+	// of writeJSON. Its data is then sent bare.
+	contentType string
+}
+
+// apiParam is a query parameter.
+type apiParam struct {
+	name, typ, description string
+}
+
+// Tags of the operations of the OpenAPI document.
+const (
+	tagCapacity     = "capacity"
+	tagSchedules    = "schedules"
+	tagReservations = "reservations"
+	tagReports      = "reports"
+	tagAdmin        = "admin"
+	tagCallbacks    = "callbacks"
+	tagHealth       = "health"
+	tagUI           = "ui"
+)
+
+var (
+	regionParam  = apiParam{"region", "string", "region or multi-region, default every configured region"}
+	projectParam = apiParam{"project", "string", "admin project, default GOOGLE_CLOUD_PROJECT"}
+	asyncParam   = apiParam{"async", "boolean", "run in the background, answering 202 with an operation to poll, as Prefer: respond-async does"}
+)
+
+// apiDocs documents the routes of the API by method and path template. The
+// unversioned aliases of the /v1 routes are documented from their successor,
+// unless their body differs.
+var apiDocs = map[string]apiDoc{
+	"GET " + v1Prefix + capacityPath: {id: "getCapacitySummary", summary: "Sum up the slots held and the headroom left in each region", tag: tagCapacity, role: roleReader,
+		query: []apiParam{{"fresh", "boolean", "list the commitments again rather than use the summary of the last 10 seconds"}}, data: CapacitySummary{}},
+	"POST " + v1Prefix + capacityPath: {id: "addCapacity", summary: "Buy slots, deleted again after minutes or at until", tag: tagCapacity, role: roleOperator,
+		query: []apiParam{asyncParam}, body: Payload{}, cloudEvent: true, data: AddCapacityResponse{}},
+	"PUT " + v1Prefix + capacityPath: {id: "scaleTo", summary: "Buy or release slots to hold a total in a region", tag: tagCapacity, role: roleOperator,
+		query: []apiParam{asyncParam}, body: ScaleTo{}, data: ScaleToResponse{}},
+	"POST " + v1Prefix + capacityBatchPath: {id: "addCapacityBatch", summary: "Buy slots in several regions at once", tag: tagCapacity, role: roleOperator,
+		query: []apiParam{asyncParam}, body: CapacityBatch{}, data: CapacityBatchResponse{}},
+	"GET " + v1Prefix + commitmentsPath: {id: "listCommitments", summary: "List commitments and their pending deletions", tag: tagCapacity, role: roleReader,
+		query: []apiParam{regionParam, projectParam, {"state", "string", "state of the commitments, ACTIVE by default, PENDING, FAILED or all"}}, data: []CommitmentInfo{}},
+	"POST " + v1Prefix + commitmentPath + "/extend": {id: "extendCommitment", summary: "Push back the deletion of a commitment", tag: tagCapacity, role: roleOperator,
+		body: ExtendRequest{}, data: CommitmentInfo{}},
+	"DELETE " + v1Prefix + commitmentPath: {id: "releaseCommitment", summary: "Delete a commitment now, or only slots split off it", tag: tagCapacity, role: roleOperator,
+		query: []apiParam{{"slots", "integer", "slots to split off and delete, a multiple of 100, the whole commitment when 0, which needs the admin role"}, {"force", "boolean", "delete a commitment the service did not buy, which needs the admin role"}, {"dry_run", "boolean", "only report what would be deleted"}},
+		oneOf: []interface{}{"", ReleasedSlots{}, DryRunDelete{}}},
+	"DELETE " + v1Prefix + commitmentPath + "/deletion": {id: "cancelCommitmentDelete", summary: "Cancel the deletion of a commitment, keeping its slots", tag: tagCapacity, role: roleAdmin,
+		data: CommitmentInfo{}},
+	"GET " + v1Prefix + freezePath: {id: "getFreeze", summary: "Get the freeze of purchases in force", tag: tagAdmin, role: roleReader,
+		data: Freeze{}},
+	"DELETE " + v1Prefix + freezePath: {id: "liftFreeze", summary: "Lift the freeze of purchases", tag: tagAdmin, role: roleAdmin,
+		data: Freeze{}},
+	"POST " + v1Prefix + purgePath: {id: "purge", summary: "Delete every FLEX commitment bought by the service now, in a region or everywhere", tag: tagCapacity, role: roleAdmin,
+		body: Purge{}, data: PurgeResult{}},
+	"POST " + v1Prefix + mergeCommitmentsPath: {id: "mergeCommitments", summary: "Merge the commitments of each region that can be", tag: tagCapacity, role: roleOperator,
+		data: MergeResult{}},
+	"POST " + v1Prefix + burstsPath: {id: "createBurst", summary: "Buy slots and assign them to projects until a teardown", tag: tagCapacity, role: roleOperator,
+		query: []apiParam{asyncParam}, body: BurstRequest{}, data: BurstResponse{}},
+	"GET " + v1Prefix + operationsPath + "/{id}": {id: "getOperation", summary: "Get the progress of a request run in the background by the caller, and its result once done", tag: tagCapacity, role: roleReader,
+		data: AsyncOperation{}},
+	"POST " + v1Prefix + reconcilePath: {id: "reconcile", summary: "Delete or reschedule recorded commitments without a delete task", tag: tagCapacity, role: roleOperator,
+		data: ReconcileResult{}},
+	"POST " + v1Prefix + watchdogPath: {id: "watchDeletes", summary: "Delete commitments still ACTIVE past their delete time and its grace", tag: tagCapacity, role: roleOperator,
+		data: WatchdogResult{}},
+	"GET " + v1Prefix + groupsPath + "/{id}": {id: "getGroup", summary: "Get the commitments of a chunked or ramped down purchase", tag: tagCapacity, role: roleReader,
+		data: GroupStatus{}},
+	"DELETE " + v1Prefix + groupsPath + "/{id}": {id: "releaseGroup", summary: "Release the commitments of a group now", tag: tagCapacity, role: roleAdmin,
+		data: GroupRelease{}},
+
+	"GET " + v1Prefix + schedulesPath: {id: "listSchedules", summary: "List schedules", tag: tagSchedules, role: roleReader,
+		data: []*scheduler.Schedule{}},
+	"POST " + v1Prefix + schedulesPath: {id: "createSchedule", summary: "Create a schedule", tag: tagSchedules, role: roleOperator,
+		body: scheduler.Schedule{}, data: scheduler.Schedule{}, status: http.StatusCreated},
+	"POST " + v1Prefix + schedulesPath + "/run": {id: "runSchedules", summary: "Run the schedules that are due", tag: tagSchedules, role: roleOperator,
+		data: ScheduleRunResult{}},
+	"GET " + v1Prefix + schedulesPath + "/{id}": {id: "getSchedule", summary: "Get a schedule", tag: tagSchedules, role: roleReader,
+		data: scheduler.Schedule{}},
+	"PUT " + v1Prefix + schedulesPath + "/{id}": {id: "updateSchedule", summary: "Replace a schedule", tag: tagSchedules, role: roleOperator,
+		body: scheduler.Schedule{}, data: scheduler.Schedule{}},
+	"DELETE " + v1Prefix + schedulesPath + "/{id}": {id: "deleteSchedule", summary: "Delete a schedule", tag: tagSchedules, role: roleAdmin,
+		data: ""},
+	"POST " + v1Prefix + schedulesPath + "/{id}/run": {id: "runSchedule", summary: "Run a schedule now", tag: tagSchedules, role: roleOperator,
+		data: ScheduleRunResult{}},
+	"GET " + v1Prefix + profilesPath: {id: "listProfiles", summary: "List capacity profiles", tag: tagSchedules, role: roleReader,
+		data: []*scheduler.Profile{}},
+	"POST " + v1Prefix + profilesPath: {id: "createProfile", summary: "Create a capacity profile", tag: tagSchedules, role: roleOperator,
+		body: scheduler.Profile{}, data: scheduler.Profile{}, status: http.StatusCreated},
+	"POST " + v1Prefix + profilesPath + "/run": {id: "runProfiles", summary: "Bring every region to the slots of its profile", tag: tagSchedules, role: roleOperator,
+		data: ProfileRunResult{}},
+	"GET " + v1Prefix + profilesPath + "/{id}": {id: "getProfile", summary: "Get a capacity profile", tag: tagSchedules, role: roleReader,
+		data: scheduler.Profile{}},
+	"PUT " + v1Prefix + profilesPath + "/{id}": {id: "updateProfile", summary: "Replace a capacity profile", tag: tagSchedules, role: roleOperator,
+		body: scheduler.Profile{}, data: scheduler.Profile{}},
+	"DELETE " + v1Prefix + profilesPath + "/{id}": {id: "deleteProfile", summary: "Delete a capacity profile", tag: tagSchedules, role: roleAdmin,
+		data: ""},
+	"POST " + v1Prefix + applyPath: {id: "apply", summary: "Apply a desired state of profiles", tag: tagSchedules, role: roleOperator,
+		body: DesiredState{}, data: ApplyPlan{}},
+	"GET " + v1Prefix + driftPath: {id: "detectDrift", summary: "Compare the commitments held with the profiles", tag: tagSchedules, role: roleReader,
+		query: []apiParam{{"remediate", "boolean", "correct the drift too"}}, data: DriftReport{}},
+
+	"GET " + v1Prefix + reservationsPath: {id: "listReservations", summary: "List reservations and their assignments", tag: tagReservations, role: roleReader,
+		query: []apiParam{regionParam}, data: []ReservationInfo{}},
+	"POST " + v1Prefix + reservationsPath: {id: "createReservation", summary: "Create a reservation", tag: tagReservations, role: roleOperator,
+		body: ReservationRequest{}, data: ReservationInfo{}, status: http.StatusCreated},
+	"GET " + v1Prefix + reservationsPath + "/{region}/{id}": {id: "getReservation", summary: "Get a reservation", tag: tagReservations, role: roleReader,
+		data: ReservationInfo{}},
+	"PATCH " + v1Prefix + reservationsPath + "/{region}/{id}": {id: "updateReservation", summary: "Change the slots, idle slot use, edition or autoscale max of a reservation", tag: tagReservations, role: roleOperator,
+		body: ReservationRequest{}, data: ReservationInfo{}},
+	"POST " + v1Prefix + reservationsPath + "/{region}/{id}/autoscale": {id: "bumpAutoscale", summary: "Raise the autoscale max of an edition reservation for minutes", tag: tagReservations, role: roleOperator,
+		body: AutoscaleBump{}, data: AutoscaleBumpResponse{}},
+	"POST " + v1Prefix + reservationsPath + "/{region}/{id}/ignore_idle_slots": {id: "setIgnoreIdleSlots", summary: "Set whether a reservation ignores idle slots for minutes", tag: tagReservations, role: roleOperator,
+		body: IdleSlotsWindow{}, data: IdleSlotsWindowResponse{}},
+	"DELETE " + v1Prefix + reservationsPath + "/{region}/{id}": {id: "deleteReservation", summary: "Delete a reservation", tag: tagReservations, role: roleAdmin,
+		data: ""},
+	"POST " + v1Prefix + assignmentsPath: {id: "createAssignment", summary: "Assign a project, folder or organization to a reservation", tag: tagReservations, role: roleOperator,
+		body: AssignmentRequest{}, data: AssignmentInfo{}, status: http.StatusCreated},
+	"POST " + v1Prefix + assignmentsPath + "/move": {id: "moveAssignment", summary: "Move an assignment to another reservation for minutes", tag: tagReservations, role: roleOperator,
+		body: AssignmentMove{}, data: AssignmentMoveResponse{}},
+	"GET " + v1Prefix + assignmentsPath + "/resolve": {id: "resolveAssignment", summary: "Find the reservations an assignee runs in", tag: tagReservations, role: roleReader,
+		query: []apiParam{{"assignee", "string", "projects/{project}, folders/{folder} or organizations/{organization}"}, regionParam}, data: []AssignmentInfo{}},
+	"DELETE " + v1Prefix + assignmentsPath + "/{region}/{reservation}/{id}": {id: "deleteAssignment", summary: "Delete an assignment", tag: tagReservations, role: roleAdmin,
+		data: ""},
+
+	"GET " + v1Prefix + costPath: {id: "getCost", summary: "Report the cost of the capacity bought", tag: tagReports, role: roleReader,
+		query: []apiParam{{"window", "string", "duration to report back from now, such as 720h, default 30 days"}}, data: CostReport{}},
+	"GET " + v1Prefix + recommendationsPath: {id: "getRecommendations", summary: "Recommend a baseline and profile from slot usage", tag: tagReports, role: roleReader,
+		query: []apiParam{{"region", "string", "region or multi-region"}, {"days", "integer", "days of usage to look at"}, {"timezone", "string", "IANA time zone of the profile"}}, data: Recommendation{}},
+	"POST " + v1Prefix + simulatePath: {id: "simulate", summary: "Replay slot usage against an autoscaling policy", tag: tagReports, role: roleReader,
+		body: SimulationRequest{}, data: SimulationReport{}},
+	"GET " + v1Prefix + regionsPath: {id: "listRegions", summary: "List the regions capacity can be bought in, or check one", tag: tagReports, role: roleReader,
+		query: []apiParam{{"region", "string", "region to check instead"}}, oneOf: []interface{}{[]RegionInfo{}, RegionCheck{}}},
+	"GET " + v1Prefix + historyPath: {id: "listHistory", summary: "List the entries of the ledger, newest first", tag: tagReports, role: roleReader,
+		query: []apiParam{
+			regionParam,
+			{"requester", "string", "who the capacity was for"},
+			{"action", "string", "action of the entries, such as purchased"},
+			{"ticket", "string", "ticket the capacity was bought under"},
+			{"commitment", "string", "resource name of the commitment of the entries"},
+			{"request_id", "string", "X-Request-ID of the request the entries were recorded for"},
+			{"from", "string", "RFC3339 time of the oldest entry"},
+			{"to", "string", "RFC3339 time of the newest entry"},
+			{"window", "string", "duration back from to, such as 24h, instead of from"},
+			{"limit", "integer", "most entries of a page"},
+			{"cursor", "string", "next_cursor of the previous page"},
+		},
+		data: HistoryPage{}},
+	"GET " + v1Prefix + eventsPath: {id: "streamEvents", summary: "Stream the entries of the ledger as server-sent events", tag: tagReports, role: roleReader,
+		query:       []apiParam{{"action", "string", "comma separated actions, or all"}, regionParam},
+		contentType: "text/event-stream", data: LedgerEntry{}},
+
+	"GET " + v1Prefix + preflightPath: {id: "preflight", summary: "Check the queue and permissions the service needs", tag: tagAdmin, role: roleAdmin,
+		data: PreflightReport{}},
+	"POST " + v1Prefix + reloadPath: {id: "reloadConfig", summary: "Read the config file and environment again", tag: tagAdmin, role: roleAdmin,
+		data: ReloadResult{}},
+	"GET " + v1Prefix + configPath: {id: "getConfig", summary: "Get the effective configuration, secrets redacted", tag: tagAdmin, role: roleOperator,
+		data: EffectiveConfig{}},
+
+	"POST " + extendCapacityPath: {id: "extendCapacity", summary: "Push back the deletion of a commitment", tag: tagCapacity, role: roleOperator,
+		body: Extend{}, data: CommitmentInfo{}},
+	"POST " + cancelDeletePath: {id: "cancelDelete", summary: "Cancel the deletion of a commitment, keeping its slots", tag: tagCapacity, role: roleAdmin,
+		body: Commit{}, data: CommitmentInfo{}},
+	"POST " + v1Prefix + deleteCommitmentPath: {id: "deleteCommitment", summary: "Delete a commitment, called by delete tasks with their OIDC token", tag: tagCallbacks,
+		body: Commit{}, data: ""},
+	"POST " + burstPath + "/teardown": {id: "teardownBurst", summary: "Tear a burst down, called by its task with its OIDC token", tag: tagCallbacks,
+		body: BurstTeardown{}, data: ""},
+	"POST " + autoscaleRevertPath: {id: "revertAutoscale", summary: "Revert an autoscale bump, called by its task with its OIDC token", tag: tagCallbacks,
+		body: AutoscaleRevert{}, data: ""},
+	"POST " + bumpRevertPath: {id: "revertBump", summary: "Take the slots of a reservation bump back out, called by its task with its OIDC token", tag: tagCallbacks,
+		body: ReservationBump{}, data: ""},
+	"POST " + idleSlotsRevertPath: {id: "revertIgnoreIdleSlots", summary: "End an ignore_idle_slots window, called by its task with its OIDC token", tag: tagCallbacks,
+		body: IdleSlotsRevert{}, data: ""},
+	"POST " + assignmentMoveBackPath: {id: "moveAssignmentBack", summary: "Move an assignment back at the end of its window, called by its task with its OIDC token", tag: tagCallbacks,
+		body: AssignmentMoveBack{}, data: ""},
+	"POST " + scaleOnAlertPath: {id: "scaleOnAlert", summary: "Buy slots for a Cloud Monitoring alert, authenticated by its token", tag: tagCallbacks,
+		query: []apiParam{{"token", "string", "ALERT_TOKEN"}}, body: AlertNotification{}},
+	"POST " + pubsubPushPath: {id: "pubsubPush", summary: "Buy slots for a Pub/Sub push message", tag: tagCallbacks,
+		query: []apiParam{{"token", "string", "PUBSUB_TOKEN, without OIDC push auth"}}, body: PushEnvelope{}, data: AddCapacityResponse{}},
+	"POST " + cloudEventsPath + "/{action}": {id: "cloudEvent", summary: "Buy the slots of an action of CLOUDEVENT_ACTIONS for an Eventarc event", tag: tagCallbacks,
+		cloudEvent: true, data: AddCapacityResponse{}},
+	"POST " + billingPushPath: {id: "budgetPush", summary: "Freeze purchases and release slots for a Cloud Billing budget notification", tag: tagCallbacks,
+		query: []apiParam{{"token", "string", "PUBSUB_TOKEN, without OIDC push auth"}}, body: PushEnvelope{}, data: BudgetStopResult{}},
+	"POST " + taskPushPath: {id: "taskPush", summary: "Run a task pushed by the Pub/Sub delete scheduler", tag: tagCallbacks,
+		body: PushEnvelope{}, status: http.StatusNoContent},
+	"POST " + slackCommandPath: {id: "slackCommand", summary: "Answer a Slack slash command, authenticated by its signature", tag: tagCallbacks,
+		contentType: "application/json"},
+
+	"GET /healthz": {id: "healthz", summary: "Liveness probe", tag: tagHealth,
+		contentType: "application/json", data: map[string]string{}},
+	"GET /readyz": {id: "readyz", summary: "Readiness probe", tag: tagHealth,
+		contentType: "application/json", data: Readiness{}},
+	"GET " + metricsPath: {id: "metrics", summary: "Gauges of the delete queue and the operations in flight, in the Prometheus text format", tag: tagHealth,
+		contentType: "text/plain"},
+	"GET " + openAPIPath: {id: "getOpenAPI", summary: "This document", tag: tagHealth,
+		contentType: "application/json"},
+
+	"GET " + uiPath: {id: "ui", summary: "Dashboard", tag: tagUI, role: roleReader,
+		contentType: "text/html"},
+	"POST " + uiPath + addCapacityPath: {id: "uiAddCapacity", summary: "Buy slots from the dashboard", tag: tagUI, role: roleOperator,
+		body: Payload{}, data: AddCapacityResponse{}},
+	"POST " + uiPath + extendCapacityPath: {id: "uiExtendCapacity", summary: "Push back a deletion from the dashboard", tag: tagUI, role: roleOperator,
+		body: Extend{}, data: CommitmentInfo{}},
+	"POST " + uiPath + cancelDeletePath: {id: "uiCancelDelete", summary: "Cancel a deletion from the dashboard", tag: tagUI, role: roleAdmin,
+		body: Commit{}, data: CommitmentInfo{}},
+}
+
+// renamedRoutes are the unversioned routes whose successor under /v1 has
+// another path, by method and path template.
+var renamedRoutes = map[string]string{
+	"POST " + addCapacityPath:    "POST " + v1Prefix + capacityPath,
+	"POST " + scaleToPath:        "PUT " + v1Prefix + capacityPath,
+	"POST " + mergePath:          "POST " + v1Prefix + mergeCommitmentsPath,
+	"POST " + extendCapacityPath: "POST " + v1Prefix + commitmentPath + "/extend",
+	"POST " + cancelDeletePath:   "DELETE " + v1Prefix + commitmentPath + "/deletion",
+	"POST " + burstPath:          "POST " + v1Prefix + burstsPath,
+	"POST " + deleteCapacityPath: "POST " + v1Prefix + deleteCommitmentPath,
+}
+
+var pathParamRE = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// OpenAPI returns the OpenAPI document of the API.
+func OpenAPI() *openapi.Document {
+	return newOpenAPI(new(Server).router())
+}
+
+// newOpenAPI documents the routes of r, with apiDocs.
+func newOpenAPI(r *mux.Router) *openapi.Document {
+	doc := &openapi.Document{
+		OpenAPI: openapi.Version,
+		Info: openapi.Info{
+			Title:       "Slot scheduler",
+			Description: "Buys BigQuery slot capacity on demand and deletes it again when it is no longer needed.",
+			Version:     apiVersion,
+		},
+		Paths: make(map[string]openapi.PathItem),
+		Components: openapi.Components{
+			Schemas: make(map[string]*openapi.Schema),
+			SecuritySchemes: map[string]*openapi.SecurityScheme{
+				"idToken": {Type: "http", Scheme: "bearer", BearerFormat: "JWT", Description: "Google-signed ID token minted for the URL of the service"},
+				"apiKey":  {Type: "apiKey", In: "header", Name: "X-API-Key", Description: "key of API_KEYS_JSON"},
+			},
+		},
+		Security: []openapi.SecurityRequirement{{"idToken": {}}, {"apiKey": {}}},
+	}
+	schemas := openapi.NewSchemas(doc.Components.Schemas)
+	errorSchema := &openapi.Schema{
+		Type:       "object",
+		Properties: openapi.Properties{{Name: "error", Schema: schemas.For(APIError{})}},
+		Required:   []string{"error"},
+	}
+
+	r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			op := newOperation(method, path, schemas, errorSchema)
+			template := pathParamRE.ReplaceAllString(path, "{$1}")
+			if doc.Paths[template] == nil {
+				doc.Paths[template] = make(openapi.PathItem)
+			}
+			doc.Paths[template][strings.ToLower(method)] = op
+		}
+		return nil
+	})
+	return doc
+}
+
+// newOperation documents the route of method and path, from its apiDoc or
+// else from that of its successor under /v1.
+func newOperation(method, path string, schemas *openapi.Schemas, errorSchema *openapi.Schema) *openapi.Operation {
+	key := method + " " + path
+	successor := renamedRoutes[key]
+	if _, ok := apiDocs[method+" "+v1Prefix+path]; ok && successor == "" {
+		successor = method + " " + v1Prefix + path
+	}
+	d, ok := apiDocs[key]
+	if !ok {
+		d = apiDocs[successor]
+	}
+
+	op := &openapi.Operation{
+		OperationID: d.id,
+		Summary:     d.summary,
+		Responses:   make(map[string]*openapi.Response),
+	}
+	if d.tag != "" {
+		op.Tags = []string{d.tag}
+	}
+	if successor != "" {
+		op.Deprecated = true
+		op.Description = "Deprecated, use " + successor + "."
+		if !ok && d.id != "" {
+			op.OperationID = d.id + "Unversioned"
+		}
+	}
+	if d.role > roleNone {
+		op.Role = d.role.String()
+	} else {
+		op.Security = &[]openapi.SecurityRequirement{}
+	}
+	for _, m := range pathParamRE.FindAllStringSubmatch(path, -1) {
+		op.Parameters = append(op.Parameters, &openapi.Parameter{Name: m[1], In: "path", Required: true, Schema: &openapi.Schema{Type: "string"}})
+	}
+	if strings.HasPrefix(path, v1Prefix+commitmentsPath+"/{region}") {
+		op.Parameters = append(op.Parameters, &openapi.Parameter{Name: projectParam.name, In: "query", Description: projectParam.description, Schema: &openapi.Schema{Type: projectParam.typ}})
+	}
+	for _, q := range d.query {
+		op.Parameters = append(op.Parameters, &openapi.Parameter{Name: q.name, In: "query", Description: q.description, Schema: &openapi.Schema{Type: q.typ}})
+	}
+	if d.body != nil || d.cloudEvent {
+		op.RequestBody = &openapi.RequestBody{Required: true, Content: make(map[string]*openapi.MediaType)}
+		if d.body != nil {
+			op.RequestBody.Content["application/json"] = &openapi.MediaType{Schema: schemas.For(d.body)}
+		}
+		if d.cloudEvent {
+			op.RequestBody.Content[cloudEventsJSON] = &openapi.MediaType{Schema: schemas.For(CloudEvent{})}
+		}
+	}
+
+	status := d.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	data := schemas.For(d.data)
+	for _, v := range d.oneOf {
+		if data == nil {
+			data = &openapi.Schema{}
+		}
+		data.OneOf = append(data.OneOf, schemas.For(v))
+	}
+	success := &openapi.Response{Description: http.StatusText(status)}
+	switch {
+	case d.contentType != "":
+		success.Content = map[string]*openapi.MediaType{d.contentType: {Schema: data}}
+	case data != nil:
+		success.Content = map[string]*openapi.MediaType{"application/json": {Schema: &openapi.Schema{
+			Type:       "object",
+			Properties: openapi.Properties{{Name: "data", Schema: data}},
+			Required:   []string{"data"},
+		}}}
+	}
+	op.Responses[strconv.Itoa(status)] = success
+	op.Responses["default"] = &openapi.Response{
+		Description: "Error",
+		Content:     map[string]*openapi.MediaType{"application/json": {Schema: errorSchema}},
+	}
+	return op
+}
+
+var openAPIDoc struct {
+	once sync.Once
+	json []byte
+	err  error
+}
+
+// openAPIHandler serves the OpenAPI document of the API.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	openAPIDoc.once.Do(func() {
+		openAPIDoc.json, openAPIDoc.err = json.Marshal(OpenAPI())
+	})
+	if openAPIDoc.err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", openAPIDoc.err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDoc.json)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"fmt"
+)
+
+// creationActions are the ledger actions creating a commitment the service
+// owns, recorded under its name.
+var creationActions = map[string]bool{
+	actionPurchased:    true,
+	actionMergeCreated: true,
+}
+
+// owns reports whether the service created the commitment name: it is
+// recorded, or the ledger has its purchase or merge. Commitments bought by
+// hand, such as annual ones, are only deleted when forced.
+func (s *Server) owns(ctx context.Context, name string) (bool, error) {
+	if ok, err := s.recorded(ctx, name); ok || err != nil {
+		return ok, err
+	}
+	entries, err := s.store.QueryEvents(ctx, EventQuery{Commitment: name})
+	if err != nil {
+		return false, fmt.Errorf("reading ledger: %v", err)
+	}
+	for _, e := range entries {
+		if creationActions[e.Action] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// recorded reports whether the commitment name is in the state store.
+func (s *Server) recorded(ctx context.Context, name string) (bool, error) {
+	rec, err := s.commitmentRecord(ctx, name)
+	return rec != nil, err
+}
+
+// commitmentRecord returns the record of the commitment name, nil if it is
+// not recorded.
+func (s *Server) commitmentRecord(ctx context.Context, name string) (*CommitmentRecord, error) {
+	recs, err := s.store.ListCommitments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing recorded commitments: %v", err)
+	}
+	for _, rec := range recs {
+		if rec.Name == name {
+			return rec, nil
+		}
+	}
+	return nil, nil
+}
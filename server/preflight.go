@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+	iampb "google.golang.org/genproto/googleapis/iam/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/internal/taskspb"
+)
+
+// preflightTimeout bounds the preflight checks.
+const preflightTimeout = 30 * time.Second
+
+// Outcomes of a preflight check. Only failed checks fail the preflight,
+// warnings are what couldn't be verified.
+const (
+	preflightOK      = "ok"
+	preflightWarning = "warning"
+	preflightFailed  = "failed"
+	preflightSkipped = "skipped"
+)
+
+// Modes of PREFLIGHT at startup.
+const (
+	preflightFail = "fail"
+	preflightWarn = "warn"
+	preflightOff  = "off"
+)
+
+// reservationPermissions are the permissions of roles/bigquery.resourceAdmin
+// the service buys, splits, merges and deletes commitments with.
+var reservationPermissions = []string{
+	"bigquery.capacityCommitments.create",
+	"bigquery.capacityCommitments.delete",
+	"bigquery.capacityCommitments.list",
+	"bigquery.capacityCommitments.update",
+}
+
+// taskPermissions are the permissions of roles/cloudtasks.enqueuer the
+// service schedules deletions with, and those it cancels and lists them
+// with, which only some endpoints need.
+var (
+	taskPermissions         = []string{"cloudtasks.tasks.create"}
+	optionalTaskPermissions = []string{"cloudtasks.tasks.delete", "cloudtasks.tasks.get", "cloudtasks.tasks.list"}
+)
+
+// PreflightCheck is the outcome of one preflight check, with what to do
+// about it when it isn't ok.
+type PreflightCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// PreflightReport lists the preflight checks. OK is false if any failed.
+type PreflightReport struct {
+	OK     bool              `json:"ok"`
+	Checks []*PreflightCheck `json:"checks"`
+}
+
+// Preflight checks the service can do its job: the Cloud Tasks queue exists
+// and is RUNNING, commitments can be listed, and the service account holds
+// the permissions of roles/bigquery.resourceAdmin on the project and
+// roles/cloudtasks.enqueuer on the queue.
+func (s *Server) Preflight(ctx context.Context) *PreflightReport {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	report := &PreflightReport{OK: true}
+	for _, check := range []struct {
+		name string
+		run  func(context.Context) (string, string)
+	}{
+		{"task_queue", s.preflightQueue},
+		{"list_commitments", s.preflightListCommitments},
+		{"reservation_permissions", s.preflightReservationPermissions},
+		{"task_permissions", s.preflightTaskPermissions},
+	} {
+		st, msg := check.run(ctx)
+		report.Checks = append(report.Checks, &PreflightCheck{Name: check.name, Status: st, Message: msg})
+		if st == preflightFailed {
+			report.OK = false
+		}
+	}
+	return report
+}
+
+// StartupPreflight runs the preflight as PREFLIGHT says: with fail
+// (default) an error lists the failed checks, with warn they are only
+// logged, and off skips it.
+func (s *Server) StartupPreflight(ctx context.Context) error {
+	if preflightMode == preflightOff {
+		return nil
+	}
+	report := s.Preflight(ctx)
+	var failed []string
+	for _, c := range report.Checks {
+		switch c.Status {
+		case preflightFailed:
+			logging.Error(ctx, "preflight %s failed: %s", c.Name, c.Message)
+			failed = append(failed, fmt.Sprintf("%s: %s", c.Name, c.Message))
+		case preflightWarning:
+			logging.Warning(ctx, "preflight %s: %s", c.Name, c.Message)
+		default:
+			logging.Info(ctx, "preflight %s %s", c.Name, c.Status)
+		}
+	}
+	if len(failed) > 0 && preflightMode == preflightFail {
+		return fmt.Errorf("preflight failed, set PREFLIGHT=warn to start anyway:\n%s", strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// preflightHandler runs the preflight on demand, answering a 503 if it
+// fails.
+func (s *Server) preflightHandler(w http.ResponseWriter, r *http.Request) {
+	report := s.Preflight(r.Context())
+	code := http.StatusOK
+	if !report.OK {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, report)
+}
+
+// preflightQueue gets the queues delete tasks are created in.
+func (s *Server) preflightQueue(ctx context.Context) (string, string) {
+	if s.tasks == nil {
+		return preflightSkipped, noQueue()
+	}
+	for _, name := range queueNames() {
+		location, id := queueParts(name)
+		q, err := s.tasks.GetQueue(ctx, &taskspb.GetQueueRequest{Name: name})
+		switch status.Code(err) {
+		case codes.OK:
+		case codes.NotFound:
+			return preflightFailed, fmt.Sprintf("queue %s does not exist, create it with `gcloud tasks queues create %s --location=%s`, set CREATE_QUEUE=true to create it on startup, or set QUEUE_ID and QUEUE_LOCATION", name, id, location)
+		case codes.PermissionDenied:
+			// roles/cloudtasks.enqueuer can't get queues.
+			return preflightWarning, fmt.Sprintf("can't check queue %s exists without cloudtasks.queues.get (roles/cloudtasks.viewer): %v", name, err)
+		default:
+			return preflightFailed, fmt.Sprintf("getting queue %s: %v", name, err)
+		}
+		if q.State != taskspb.Queue_RUNNING {
+			return preflightFailed, fmt.Sprintf("queue %s is %s, delete tasks won't run until it is resumed with `gcloud tasks queues resume %s --location=%s`", name, q.State, id, location)
+		}
+	}
+	return preflightOK, ""
+}
+
+// preflightListCommitments lists the commitments of every region.
+func (s *Server) preflightListCommitments(ctx context.Context) (string, string) {
+	for _, region := range regions {
+		_, err := s.capacity.List(ctx, capacity.Parent(projectID, region))
+		switch status.Code(err) {
+		case codes.OK:
+			continue
+		case codes.PermissionDenied:
+			return preflightFailed, fmt.Sprintf("listing commitments in %s: %v; grant the service account roles/bigquery.resourceAdmin on %s", region, err, projectID)
+		default:
+			return preflightFailed, fmt.Sprintf("listing commitments in %s: %v; check the BigQuery Reservation API is enabled in %s", region, err, projectID)
+		}
+	}
+	return preflightOK, ""
+}
+
+// preflightReservationPermissions tests the reservation permissions on the
+// project.
+func (s *Server) preflightReservationPermissions(ctx context.Context) (string, string) {
+	if s.reservations == nil {
+		return preflightSkipped, "FAKE_BACKENDS"
+	}
+	svc, err := cloudresourcemanager.NewService(ctx)
+	if err != nil {
+		return preflightWarning, fmt.Sprintf("can't test permissions: %v", err)
+	}
+	resp, err := svc.Projects.TestIamPermissions(projectID, &cloudresourcemanager.TestIamPermissionsRequest{Permissions: reservationPermissions}).Context(ctx).Do()
+	if err != nil {
+		return preflightWarning, fmt.Sprintf("can't test permissions on %s, is the Cloud Resource Manager API enabled? %v", projectID, err)
+	}
+	if missing := missingPermissions(reservationPermissions, resp.Permissions); len(missing) > 0 {
+		return preflightFailed, fmt.Sprintf("the service account lacks %s on %s; grant it roles/bigquery.resourceAdmin", strings.Join(missing, ", "), projectID)
+	}
+	return preflightOK, ""
+}
+
+// preflightTaskPermissions tests the task permissions on the queues.
+func (s *Server) preflightTaskPermissions(ctx context.Context) (string, string) {
+	if s.tasks == nil {
+		return preflightSkipped, noQueue()
+	}
+	for _, name := range queueNames() {
+		if result, detail := s.preflightQueuePermissions(ctx, name); result != preflightOK {
+			return result, detail
+		}
+	}
+	return preflightOK, ""
+}
+
+// preflightQueuePermissions tests the task permissions on the queue name.
+func (s *Server) preflightQueuePermissions(ctx context.Context, name string) (string, string) {
+	resp, err := s.tasks.TestIamPermissions(ctx, &iampb.TestIamPermissionsRequest{
+		Resource:    name,
+		Permissions: append(append([]string{}, taskPermissions...), optionalTaskPermissions...),
+	})
+	if status.Code(err) == codes.NotFound {
+		return preflightSkipped, fmt.Sprintf("queue %s does not exist", name)
+	}
+	if err != nil {
+		return preflightWarning, fmt.Sprintf("can't test permissions on %s: %v", name, err)
+	}
+	if missing := missingPermissions(taskPermissions, resp.Permissions); len(missing) > 0 {
+		return preflightFailed, fmt.Sprintf("the service account lacks %s on %s; grant it roles/cloudtasks.enqueuer", strings.Join(missing, ", "), name)
+	}
+	if missing := missingPermissions(optionalTaskPermissions, resp.Permissions); len(missing) > 0 {
+		return preflightWarning, fmt.Sprintf("the service account lacks %s on %s, so deletions can't be cancelled, extended or listed; grant it roles/cloudtasks.taskDeleter and roles/cloudtasks.viewer, or roles/cloudtasks.admin", strings.Join(missing, ", "), name)
+	}
+	return preflightOK, ""
+}
+
+// noQueue says why there is no Cloud Tasks queue to check.
+func noQueue() string {
+	if fakeBackends {
+		return "FAKE_BACKENDS"
+	}
+	return "DELETE_SCHEDULER=" + deleteScheduler
+}
+
+// missingPermissions returns the permissions of want not in have, sorted.
+func missingPermissions(want, have []string) []string {
+	held := make(map[string]bool, len(have))
+	for _, p := range have {
+		held[p] = true
+	}
+	var missing []string
+	for _, p := range want {
+		if !held[p] {
+			missing = append(missing, p)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// parsePreflightMode reads PREFLIGHT.
+func parsePreflightMode(v string) (string, error) {
+	switch v {
+	case "":
+		return preflightFail, nil
+	case preflightFail, preflightWarn, preflightOff:
+		return v, nil
+	}
+	return "", errors.New("PREFLIGHT must be fail, warn or off")
+}
@@ -0,0 +1,372 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/scheduler"
+)
+
+// profileRenewBefore is how long before its deletion a commitment of a
+// profile still at its level is kept longer, rather than bought again.
+const profileRenewBefore = 10 * time.Minute
+
+var errProfileNotFound = errors.New("profile not found")
+
+// validateProfile checks p and fills in its defaults.
+func validateProfile(p *scheduler.Profile) error {
+	var v validator
+	v.region("region", &p.Region)
+	v.check(p.DefaultSlots >= 0 && p.DefaultSlots%slotIncrement == 0, "default_slots", "must be a multiple of %d, zero or more", slotIncrement)
+	for i, w := range p.Windows {
+		v.check(w.Slots >= 0 && w.Slots%slotIncrement == 0, fmt.Sprintf("windows[%d].slots", i), "must be a multiple of %d, zero or more", slotIncrement)
+	}
+	_, err := p.Location()
+	v.check(err == nil, "timezone", "%v", err)
+	err = p.Validate()
+	v.check(err == nil, "profile", "%v", err)
+	return v.err()
+}
+
+func (s *Server) listProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := s.store.ListProfiles(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	now := time.Now()
+	for _, p := range list {
+		p.SetTarget(now)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) getProfileHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := s.store.GetProfile(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeProfileError(w, r, err)
+		return
+	}
+	p.SetTarget(time.Now())
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *Server) createProfileHandler(w http.ResponseWriter, r *http.Request) {
+	var p scheduler.Profile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validateProfile(&p); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		return
+	}
+	now := time.Now()
+	p.ID = "prof-" + id
+	p.DeleteURL = deleteURL(r)
+	p.Audience = deleteAudience(r)
+	p.CreatedAt, p.UpdatedAt = now, now
+	if err := s.store.PutProfile(r.Context(), &p); err != nil {
+		writeProfileError(w, r, err)
+		return
+	}
+	logging.Info(r.Context(), "profile %s created", p.ID)
+
+	p.SetTarget(now)
+	writeJSON(w, http.StatusCreated, p)
+}
+
+func (s *Server) updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	old, err := s.store.GetProfile(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeProfileError(w, r, err)
+		return
+	}
+
+	var p scheduler.Profile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validateProfile(&p); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	now := time.Now()
+	p.ID, p.CreatedAt = old.ID, old.CreatedAt
+	p.DeleteURL = deleteURL(r)
+	p.Audience = deleteAudience(r)
+	p.UpdatedAt = now
+	if err := s.store.PutProfile(r.Context(), &p); err != nil {
+		writeProfileError(w, r, err)
+		return
+	}
+	logging.Info(r.Context(), "profile %s updated", p.ID)
+
+	p.SetTarget(now)
+	writeJSON(w, http.StatusOK, p)
+}
+
+// deleteProfileHandler removes a profile. The commitments bought for it are
+// left to their delete tasks, which are due when its level was to change.
+func (s *Server) deleteProfileHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := s.store.GetProfile(r.Context(), id); err != nil {
+		writeProfileError(w, r, err)
+		return
+	}
+	if err := s.store.DeleteProfile(r.Context(), id); err != nil {
+		writeProfileError(w, r, err)
+		return
+	}
+	logging.Info(r.Context(), "profile %s deleted", id)
+	writeJSON(w, http.StatusOK, "profile deleted")
+}
+
+func writeProfileError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errProfileNotFound) {
+		writeError(w, http.StatusNotFound, codeNotFound, "%v", err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+	logging.Error(r.Context(), "%v", err)
+}
+
+// ProfileRun is what a pass did to bring a profile to its level.
+type ProfileRun struct {
+	ID          string               `json:"id"`
+	TargetSlots int64                `json:"target_slots"`
+	HeldSlots   int64                `json:"held_slots"`
+	Purchased   *AddCapacityResponse `json:"purchased,omitempty"`
+	Extended    []string             `json:"extended,omitempty"`
+	Released    []ReleasedSlots      `json:"released,omitempty"`
+}
+
+// ProfileRunResult summarises a pass over the profiles.
+type ProfileRunResult struct {
+	Runs   []*ProfileRun `json:"runs"`
+	Errors []string      `json:"errors,omitempty"`
+}
+
+// runProfiler brings the profiles to their level every interval until ctx
+// is done.
+func (s *Server) runProfiler(ctx context.Context, interval time.Duration) {
+	logging.Info(ctx, "checking profiles every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			res, err := s.runProfiles(ctx)
+			if err != nil {
+				logging.Error(ctx, "running profiles: %v", err)
+				continue
+			}
+			for _, e := range res.Errors {
+				logging.Error(ctx, "%s", e)
+			}
+		}
+	}
+}
+
+func (s *Server) runProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := s.runProfiles(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// runProfiles brings every profile that isn't paused to its level.
+func (s *Server) runProfiles(ctx context.Context) (*ProfileRunResult, error) {
+	list, err := s.store.ListProfiles(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing profiles: %v", err)
+	}
+
+	res := &ProfileRunResult{Runs: []*ProfileRun{}}
+	now := time.Now()
+	for _, p := range list {
+		if p.Paused {
+			continue
+		}
+		ctx := logging.WithFields(ctx, "profile", p.ID, "region", p.Region)
+		run, err := s.applyProfile(ctx, p.ID, now)
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("running %s: %v", p.ID, err))
+		}
+		if run != nil {
+			res.Runs = append(res.Runs, run)
+		}
+	}
+	return res, nil
+}
+
+// applyProfile brings the capacity bought for profile id to its level at now.
+func (s *Server) applyProfile(ctx context.Context, id string, now time.Time) (*ProfileRun, error) {
+	unlock, err := s.store.Lock(ctx, "profile/"+id, scheduleLockTTL)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Read again under the lock, it may have been changed or deleted.
+	p, err := s.store.GetProfile(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if p.Paused {
+		return nil, nil
+	}
+	target, until, err := p.Target(now)
+	if err != nil {
+		return nil, err
+	}
+	return s.levelProfile(ctx, p, target, until, now)
+}
+
+// levelProfile brings the capacity bought for p to target slots, which hold
+// until until, or indefinitely if it is zero. Missing slots are bought until
+// then, commitments due for deletion before are kept longer, and excess whole
+// FLEX commitments are released, newest first. Capacity bought by other
+// means is never touched.
+func (s *Server) levelProfile(ctx context.Context, p *scheduler.Profile, target int64, until, now time.Time) (*ProfileRun, error) {
+	// Capacity is kept until the level changes, at most MAX_MINUTES.
+	end := now.Add(time.Duration(live().MaxMinutes) * time.Minute)
+	if !until.IsZero() && until.Before(end) {
+		end = until
+	}
+	if earliest := now.Add(time.Duration(defaultMinute) * time.Minute); end.Before(earliest) {
+		end = earliest
+	}
+
+	held, err := s.profileCommitments(ctx, p, now)
+	if err != nil {
+		return nil, err
+	}
+	run := &ProfileRun{ID: p.ID, TargetSlots: target}
+	for _, rec := range held {
+		run.HeldSlots += rec.SlotCount
+	}
+	requester := "profile/" + p.ID
+
+	// Keep what the level still needs past its deletion, oldest first.
+	var kept int64
+	for i := len(held) - 1; i >= 0; i-- {
+		rec := held[i]
+		if kept+rec.SlotCount > target {
+			break
+		}
+		kept += rec.SlotCount
+		if rec.DeleteAt.IsZero() || !rec.DeleteAt.Before(end) || rec.DeleteAt.Sub(now) > profileRenewBefore {
+			continue
+		}
+		if p.DryRun {
+			logging.Info(ctx, "dry run: would keep %s until %s", rec.Name, end.Format(time.RFC3339))
+			continue
+		}
+		task, err := s.extendDelete(ctx, rec.Name, end.Sub(rec.DeleteAt))
+		if err != nil {
+			logging.Warning(ctx, "keeping %s for profile %s: %v", rec.Name, p.ID, err)
+			continue
+		}
+		s.record(ctx, LedgerEntry{Action: actionDeleteRescheduled, Commitment: rec.Name, DeleteAt: timePtr(task.ScheduleTime.AsTime()), Requester: requester, Reason: p.Reason})
+		run.Extended = append(run.Extended, rec.Name)
+	}
+
+	switch {
+	case run.HeldSlots < target:
+		// Round up, falling short of the level is worse than overshooting it.
+		delta := (target - run.HeldSlots + slotIncrement - 1) / slotIncrement * slotIncrement
+		logging.Info(ctx, "profile %s holds %d slots, buying %d until %s to reach %d", p.ID, run.HeldSlots, delta, end.Format(time.RFC3339), target)
+		purchased, err := s.purchase(ctx, purchaseRequest{
+			Region:    p.Region,
+			Slots:     delta,
+			Plan:      reservationpb.CapacityCommitment_FLEX,
+			DeleteAt:  end,
+			DeleteURL: p.DeleteURL,
+			Audience:  p.Audience,
+			Requester: requester,
+			Reason:    p.Reason,
+			DryRun:    p.DryRun,
+		})
+		if errors.Is(err, capacity.ErrMaxSlots) {
+			logging.Warning(ctx, "profile %s: %v", p.ID, err)
+			return run, nil
+		}
+		if err != nil {
+			return run, err
+		}
+		run.Purchased = purchased
+
+	case run.HeldSlots-target >= slotIncrement:
+		excess := run.HeldSlots - target
+		logging.Info(ctx, "profile %s holds %d slots, releasing up to %d to reach %d", p.ID, run.HeldSlots, excess, target)
+		for _, rec := range held {
+			if rec.SlotCount > excess || rec.Plan != reservationpb.CapacityCommitment_FLEX.String() || now.Sub(rec.CreatedAt) < capacity.FlexMinDuration {
+				continue
+			}
+			if p.DryRun {
+				logging.Info(ctx, "dry run: would release %s of %d slots", rec.Name, rec.SlotCount)
+				run.Released = append(run.Released, ReleasedSlots{Commitment: rec.Name, Slots: rec.SlotCount})
+				excess -= rec.SlotCount
+				continue
+			}
+			rel, err := s.releaseSlots(ctx, rec, rec.SlotCount, requester, true)
+			if err != nil {
+				return run, err
+			}
+			run.Released = append(run.Released, *rel)
+			excess -= rel.Slots
+		}
+	}
+	return run, nil
+}
+
+// profileCommitments returns the commitments bought for p that are not yet
+// due for deletion, newest first.
+func (s *Server) profileCommitments(ctx context.Context, p *scheduler.Profile, now time.Time) ([]*CommitmentRecord, error) {
+	recs, err := s.store.ListCommitments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing recorded commitments: %v", err)
+	}
+	var held []*CommitmentRecord
+	for _, rec := range recs {
+		if rec.Requester != "profile/"+p.ID || rec.Region != p.Region || resourceProject(rec.Name) != projectID {
+			continue
+		}
+		if !rec.DeleteAt.IsZero() && !rec.DeleteAt.After(now) {
+			continue
+		}
+		held = append(held, rec)
+	}
+	sort.Slice(held, func(i, j int) bool { return held[i].CreatedAt.After(held[j].CreatedAt) })
+	return held, nil
+}
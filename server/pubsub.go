@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// PushEnvelope is the body of a Pub/Sub push request, see
+// https://cloud.google.com/pubsub/docs/push#receive_push.
+type PushEnvelope struct {
+	Message struct {
+		Data        []byte            `json:"data"` // base64 in JSON
+		Attributes  map[string]string `json:"attributes"`
+		MessageID   string            `json:"messageId"`
+		PublishTime string            `json:"publishTime"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// pubsubPushHandler adds capacity for a Payload published to Pub/Sub and
+// pushed by a subscription. Redeliveries of a message are deduplicated on
+// its message ID, unless the payload has its own request_id.
+func (s *Server) pubsubPushHandler(w http.ResponseWriter, r *http.Request) {
+	if err := verifyPushRequest(r, pubsubPushPath); err != nil {
+		logging.Warning(r.Context(), "rejected %s request: %v", r.URL.Path, err)
+		writeError(w, http.StatusUnauthorized, codeUnauthenticated, "unauthorized")
+		return
+	}
+
+	var env PushEnvelope
+	if err := json.NewDecoder(r.Body).Decode(&env); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	var p Payload
+	if err := json.Unmarshal(env.Message.Data, &p); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "decoding message %s: %v", env.Message.MessageID, err)
+		return
+	}
+	if p.RequestID == "" && env.Message.MessageID != "" {
+		p.RequestID = "pubsub/" + env.Message.MessageID
+	}
+
+	r = r.WithContext(logging.WithFields(r.Context(), "pubsub_message", env.Message.MessageID, "subscription", env.Subscription))
+	s.addCapacityFromPayload(w, r, p)
+}
+
+// pushVerified reports whether push requests can be verified, with
+// PUBSUB_SERVICE_ACCOUNT or PUBSUB_VERIFICATION_TOKEN.
+func pushVerified() bool {
+	return pubsubServiceAcct != "" || pubsubVerificationToken != ""
+}
+
+// verifyPushRequest checks the OIDC token Pub/Sub attaches to authenticated
+// push requests to path and, if PUBSUB_VERIFICATION_TOKEN is set, the token
+// query parameter of the push endpoint. Without either every request is
+// refused, the push routes buy and delete capacity.
+func verifyPushRequest(r *http.Request, path string) error {
+	if !pushVerified() {
+		return errors.New("neither PUBSUB_SERVICE_ACCOUNT nor PUBSUB_VERIFICATION_TOKEN is set")
+	}
+	if pubsubVerificationToken != "" {
+		token := r.URL.Query().Get("token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(pubsubVerificationToken)) != 1 {
+			return fmt.Errorf("invalid verification token")
+		}
+	}
+	if pubsubServiceAcct == "" {
+		return nil
+	}
+	return verifyOIDCToken(r, pushAudience(r, path), pubsubServiceAcct)
+}
+
+// pushAudience is the audience of the OIDC token of pushes to path:
+// PUBSUB_AUDIENCE, or else the URL tasks reach path on, as subscriptions are
+// pointed at it.
+func pushAudience(r *http.Request, path string) string {
+	if pubsubAudience != "" {
+		return pubsubAudience
+	}
+	return taskURL(r, path)
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPushAudience(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"self url", map[string]string{"SELF_URL": "https://slots.example.com/"}, "https://slots.example.com" + pubsubPushPath},
+		{"pubsub audience", map[string]string{"SELF_URL": "https://slots.example.com", "PUBSUB_AUDIENCE": "https://push.example.com"}, "https://push.example.com"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			loadTestConfig(t, tc.env)
+			// The Host of a request is up to its sender.
+			r := httptest.NewRequest(http.MethodPost, "https://attacker.example.com"+pubsubPushPath, nil)
+			if got := pushAudience(r, pubsubPushPath); got != tc.want {
+				t.Errorf("pushAudience = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,718 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/internal/taskspb"
+	"go-slot-scheduler/internal/tracing"
+)
+
+const (
+	// purchaseLockWait bounds how long a purchase waits for another to finish.
+	purchaseLockWait = 30 * time.Second
+	// purchaseLockTTL frees the purchase lock of an instance that died holding
+	// it. It must outlast a purchase, retries included.
+	purchaseLockTTL = 2 * time.Minute
+)
+
+// rollbackTimeout bounds how long a purchase whose delete task couldn't be
+// created waits to delete the commitment again.
+const rollbackTimeout = capacity.FlexMinDuration + 30*time.Second
+
+// settleTimeout bounds recording a commitment bought and scheduling its
+// deletion, once they no longer wait on the request that bought it.
+const settleTimeout = time.Minute
+
+// activeTimeout bounds how long a purchase with wait_for_active waits for
+// its commitment to leave PENDING, reading it every activePollInterval.
+const (
+	activeTimeout      = 3 * time.Minute
+	activePollInterval = 5 * time.Second
+)
+
+// rollbackError is returned when a commitment was bought but its delete task
+// couldn't be created. It tells whether the purchase was rolled back, or, if
+// not, whether the reconciler will schedule the deletion.
+type rollbackError struct {
+	Commitment  string
+	RolledBack  bool
+	Recorded    bool
+	Err         error
+	RollbackErr error
+}
+
+func (e *rollbackError) Error() string {
+	switch {
+	case e.RolledBack:
+		return fmt.Sprintf("scheduling deletion of %s: %v; commitment deleted again", e.Commitment, e.Err)
+	case e.Recorded:
+		return fmt.Sprintf("scheduling deletion of %s: %v; rollback failed (%v), the reconciler will schedule its deletion", e.Commitment, e.Err, e.RollbackErr)
+	default:
+		return fmt.Sprintf("scheduling deletion of %s: %v; rollback failed (%v) and the commitment is not recorded, delete it by hand", e.Commitment, e.Err, e.RollbackErr)
+	}
+}
+
+func (e *rollbackError) Unwrap() error { return e.Err }
+
+// HTTP request payload for adding capacity
+type Payload struct {
+	Minutes   int64  `json:"minutes"`
+	Until     string `json:"until,omitempty"` // RFC3339, alternative to minutes
+	Region    string `json:"region"`
+	Project   string `json:"project,omitempty"` // admin project, default GOOGLE_CLOUD_PROJECT
+	ExtraSlot int64  `json:"extra_slot"`
+	Plan      string `json:"plan,omitempty"` // FLEX, MONTHLY or ANNUAL
+	RequestID string `json:"request_id,omitempty"`
+	DryRun    bool   `json:"dry_run,omitempty"`
+	RequestMetadata
+	// Override buys even during a blackout, for BLACKOUT_ADMINS only.
+	Override bool `json:"override,omitempty"`
+	// RampDown releases the slots in steps instead of all at once, in
+	// place of minutes or until.
+	RampDown []RampStep `json:"ramp_down,omitempty"`
+	// ChunkSlots buys the slots as commitments of at most that many slots,
+	// which can be released one at a time.
+	ChunkSlots int64 `json:"chunk_slots,omitempty"`
+	// WaitForActive waits for the commitment to be ACTIVE before returning,
+	// and starts the minutes from then.
+	WaitForActive bool `json:"wait_for_active,omitempty"`
+	// Fallback is what a FLEX purchase the region has no capacity for does,
+	// none, shrink or split, buying no less than FallbackMinSlots. They
+	// default to STOCKOUT_FALLBACK and STOCKOUT_MIN_SLOTS.
+	Fallback         string `json:"fallback,omitempty"`
+	FallbackMinSlots int64  `json:"fallback_min_slots,omitempty"`
+}
+
+// RequestMetadata says who capacity is bought for, why, and under which
+// ticket, for the ledger. REQUIRED_METADATA makes fields of it mandatory.
+type RequestMetadata struct {
+	// Requester is who the capacity is for, when the caller buys it on
+	// someone else's behalf. The caller is recorded as requester otherwise.
+	Requester string `json:"requester,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	// Ticket is the change or incident the capacity is bought under.
+	Ticket string `json:"ticket,omitempty"`
+}
+
+// validate checks the fields REQUIRED_METADATA asks for are given.
+func (m *RequestMetadata) validate(v *validator) {
+	v.check(!requiredMetadata["requester"] || m.Requester != "", "requester", "required")
+	v.check(!requiredMetadata["reason"] || m.Reason != "", "reason", "required")
+	v.check(!requiredMetadata["ticket"] || m.Ticket != "", "ticket", "required")
+}
+
+// who returns who m buys for, its Requester or else the caller of r, and
+// the caller when that is someone else.
+func (m *RequestMetadata) who(r *http.Request) (who, caller string) {
+	caller = requester(r)
+	if m.Requester == "" || m.Requester == caller {
+		return caller, ""
+	}
+	return m.Requester, caller
+}
+
+// validate checks every field of p, filling in defaults, and returns the plan
+// to buy and when to delete it, either Minutes from now or at the absolute
+// Until time. The deletion time is zero for plans that can't be deleted
+// early.
+func (p *Payload) validate(now time.Time) (reservationpb.CapacityCommitment_CommitmentPlan, time.Time, error) {
+	var v validator
+	v.region("region", &p.Region)
+	if p.Project == "" {
+		p.Project = projectID
+	}
+	v.check(validAdminProject(p.Project), "project", "%q is not an admin project of the service", p.Project)
+	v.slots("extra_slot", p.ExtraSlot)
+	v.chunkSlots(p)
+	p.RequestMetadata.validate(&v)
+
+	plan := defaultPlan
+	if capacityMode == capacityModeReservation {
+		// Nothing is bought, the slots go when the bump is reverted.
+		plan = reservationpb.CapacityCommitment_FLEX
+		v.check(p.Plan == "" || strings.EqualFold(p.Plan, plan.String()), "plan", "only FLEX with CAPACITY_MODE=reservation, which buys no commitment")
+		v.check(len(p.RampDown) == 0, "ramp_down", "not supported with CAPACITY_MODE=reservation")
+		v.check(p.ChunkSlots == 0, "chunk_slots", "not supported with CAPACITY_MODE=reservation")
+	} else if p.Plan != "" {
+		var err error
+		if plan, err = capacity.ParsePlan(p.Plan); err != nil {
+			v.check(false, "plan", "%v", err)
+		}
+	}
+	v.fallback(p, plan)
+	// Only FLEX commitments can be deleted before their commitment period ends.
+	if plan != reservationpb.CapacityCommitment_FLEX {
+		v.check(p.Minutes == 0 && p.Until == "", "minutes", "%s commitments can not be deleted early, omit minutes and until", plan)
+		v.check(len(p.RampDown) == 0, "ramp_down", "%s commitments can not be deleted early", plan)
+		return plan, time.Time{}, v.err()
+	}
+	if len(p.RampDown) > 0 {
+		v.check(p.Minutes == 0 && p.Until == "", "ramp_down", "provide either ramp_down, minutes or until")
+		v.rampDown(p)
+		last := p.RampDown[len(p.RampDown)-1]
+		return plan, now.Add(time.Duration(last.Minutes) * time.Minute), v.err()
+	}
+
+	if p.Until == "" {
+		v.minutes("minutes", &p.Minutes)
+		return plan, now.Add(time.Duration(p.Minutes) * time.Minute), v.err()
+	}
+	v.check(p.Minutes == 0, "minutes", "provide either minutes or until, not both")
+	until, err := time.Parse(time.RFC3339, p.Until)
+	if !v.check(err == nil, "until", "must be an RFC3339 timestamp") {
+		return plan, time.Time{}, v.err()
+	}
+	v.check(until.After(now), "until", "%s is not in the future", p.Until)
+	l := live()
+	latest := now.Add(time.Duration(l.MaxMinutes) * time.Minute)
+	if l.ClampMinutes && until.After(latest) {
+		until = latest
+	}
+	v.check(!until.After(latest), "until", "%s is more than %d minutes away", p.Until, l.MaxMinutes)
+	return plan, until, v.err()
+}
+
+func (s *Server) addCapacityHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := decodePayload(w, r)
+	if !ok {
+		return
+	}
+	s.addCapacityFromPayload(w, r, p)
+}
+
+// addCapacityFromPayload validates p and buys the capacity it asks for, or
+// bumps the reservation with CAPACITY_MODE=reservation.
+func (s *Server) addCapacityFromPayload(w http.ResponseWriter, r *http.Request, p Payload) {
+	now := time.Now()
+	plan, deleteAt, err := p.validate(now)
+	if err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	r = r.WithContext(logging.WithFields(r.Context(), "region", p.Region, "slots_requested", p.ExtraSlot))
+	logging.Info(r.Context(), "request to add capacity: %+v", p)
+
+	if p.Override && !isBlackoutAdmin(r) {
+		writeError(w, http.StatusForbidden, codeForbidden, "only BLACKOUT_ADMINS authenticated with AUTH_ROLES_JSON or API_KEYS_JSON can override blackouts")
+		return
+	}
+
+	// A dry run buys nothing, so there is nothing to replay. The key is
+	// claimed before the request may be queued, so a retry isn't queued
+	// again.
+	finish := func(*AddCapacityResponse) {}
+	if !p.DryRun && !dryRun {
+		var ok bool
+		if finish, ok = s.claimIdempotencyKey(w, r, &p); !ok {
+			return
+		}
+	}
+	var result *AddCapacityResponse
+	defer func() { finish(result) }()
+
+	if b, until := activeBlackout(p.Region, now); b != nil && !p.Override && !p.DryRun && !dryRun {
+		if queued, ok := s.queueAddCapacity(w, r, p, b, until); ok {
+			if queued != nil {
+				result = &AddCapacityResponse{Queued: queued}
+			}
+			return
+		}
+	}
+
+	req := purchaseRequest{
+		Project:   p.Project,
+		Region:    p.Region,
+		Slots:     p.ExtraSlot,
+		Plan:      plan,
+		DeleteURL: deleteURL(r),
+		Audience:  deleteAudience(r),
+		Reason:    p.Reason,
+		Ticket:    p.Ticket,
+		DryRun:    p.DryRun,
+		Override:  p.Override,
+		DeleteAt:  deleteAt,
+	}
+	req.Requester, req.Caller = p.who(r)
+	req.WaitForActive, req.DeleteAtFixed = p.WaitForActive, p.Until != ""
+	stages := []groupStage{{Slots: p.ExtraSlot, DeleteAt: deleteAt}}
+	if len(p.RampDown) > 0 {
+		stages = p.rampStages(now)
+	}
+	stages = chunk(stages, p.ChunkSlots)
+	var resp *AddCapacityResponse
+	if capacityMode == capacityModeReservation {
+		if s.reservations == nil {
+			writeError(w, http.StatusNotImplemented, codeNotImplemented, "CAPACITY_MODE=%s is not available with FAKE_BACKENDS", capacityModeReservation)
+			return
+		}
+		resp, err = s.bumpReservation(r.Context(), req, taskURL(r, bumpRevertPath))
+		if code := status.Code(err); code == codes.NotFound || code == codes.FailedPrecondition || code == codes.InvalidArgument {
+			writeReservationError(w, r, err)
+			return
+		}
+	} else if len(stages) > 1 {
+		resp, err = s.purchaseGroup(r.Context(), req, stages)
+	} else {
+		resp, err = s.purchaseFallback(r.Context(), req, p.Fallback, p.FallbackMinSlots)
+	}
+	if err != nil {
+		writePurchaseError(w, err)
+		var overBudget *budgetExceededError
+		var capped *capacity.CapReachedError
+		var blacked *blackoutError
+		if errors.As(err, &overBudget) || errors.As(err, &capped) || errors.As(err, &blacked) {
+			logging.Warning(r.Context(), "%v", err)
+		} else {
+			logging.Error(r.Context(), "%v", err)
+		}
+		return
+	}
+
+	result = resp
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// purchaseRequest is a validated request for capacity.
+type purchaseRequest struct {
+	// Project is the admin project, empty for GOOGLE_CLOUD_PROJECT.
+	Project string
+	Region  string
+	Slots   int64
+	Plan    reservationpb.CapacityCommitment_CommitmentPlan
+	// DeleteAt is when to delete the commitment, zero keeps it.
+	DeleteAt  time.Time
+	DeleteURL string
+	Audience  string
+	// Requester is who the capacity is for, Caller who asked for it when
+	// that is someone else.
+	Requester string
+	Caller    string
+	Reason    string
+	Ticket    string
+	// DryRun only works out what would be bought, as does DRY_RUN.
+	DryRun bool
+	// Override buys even during a blackout.
+	Override bool
+	// Group is the group of commitments bought for one request, if it was
+	// split.
+	Group string
+	// WaitForActive waits for the commitment to leave PENDING before
+	// scheduling its deletion, pushing DeleteAt back by the wait unless
+	// DeleteAtFixed, an absolute time was asked for.
+	WaitForActive bool
+	DeleteAtFixed bool
+}
+
+// purchase buys the capacity of req, up to the cap of its region, records it and schedules
+// its deletion. It returns capacity.ErrMaxSlots when the cap is already reached.
+func (s *Server) purchase(ctx context.Context, req purchaseRequest) (*AddCapacityResponse, error) {
+	if req.Project == "" {
+		req.Project = projectID
+	}
+	if err := s.checkBlackout(ctx, req); err != nil {
+		return nil, err
+	}
+	if err := s.checkBudgets(ctx, req); err != nil {
+		return nil, err
+	}
+	if err := s.checkFreeze(ctx, req); err != nil {
+		return nil, err
+	}
+	if err := s.checkQueueRunning(ctx, req); err != nil {
+		return nil, err
+	}
+	if req.DryRun || dryRun {
+		return s.dryPurchase(ctx, req)
+	}
+	op, done, err := s.ops.begin("purchase", LedgerEntry{Region: req.Region, Slots: req.Slots, Plan: req.Plan.String(), Requester: req.Requester, Caller: req.Caller, Reason: req.Reason, Ticket: req.Ticket, Group: req.Group}, false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	commit, err := s.capacity.Buy(ctx, capacity.Parent(req.Project, req.Region), req.Plan, req.Slots, maxSlotsFor(req.Project, req.Region))
+	var uncertain *capacity.UncertainError
+	if errors.As(err, &uncertain) {
+		commit, err = s.boughtAnyway(ctx, uncertain)
+	}
+	if err != nil {
+		if errors.Is(err, capacity.ErrMaxSlots) {
+			s.record(ctx, LedgerEntry{Action: actionCapped, Region: req.Region, Slots: req.Slots, Plan: req.Plan.String(), Requester: req.Requester, Caller: req.Caller, Reason: req.Reason, Ticket: req.Ticket})
+			return nil, err
+		}
+
+		s.record(ctx, LedgerEntry{Action: actionPurchaseFailed, Region: req.Region, Slots: req.Slots, Plan: req.Plan.String(), Requester: req.Requester, Caller: req.Caller, Reason: req.Reason, Ticket: req.Ticket, Error: err.Error()})
+		return nil, err
+	}
+	ctx = logging.WithFields(ctx, "commit", commit.Name, "slots", commit.SlotCount)
+	reportProgress(ctx, "bought commitment %s of %d slots in %s", commit.Name, commit.SlotCount, req.Region)
+	if req.WaitForActive && commit.State != reservationpb.CapacityCommitment_ACTIVE {
+		if commit, err = s.waitActive(ctx, commit, &req); err != nil {
+			return nil, err
+		}
+	}
+	// The commitment is recorded and its deletion scheduled even if the
+	// request times out meanwhile, it would bill with neither.
+	ctx, cancel := context.WithTimeout(detached{ctx}, settleTimeout)
+	defer cancel()
+	op.update(func(e *LedgerEntry) { e.Commitment, e.Slots = commit.Name, commit.SlotCount })
+	purchased := LedgerEntry{Action: actionPurchased, Commitment: commit.Name, Slots: commit.SlotCount, Plan: commit.Plan.String(), Requester: req.Requester, Caller: req.Caller, Reason: req.Reason, Ticket: req.Ticket, Group: req.Group}
+	if !req.DeleteAt.IsZero() {
+		purchased.EstimatedCost = estimateCost(req.Region, commit.Plan.String(), commit.SlotCount, time.Until(req.DeleteAt))
+	}
+	s.record(ctx, purchased)
+
+	resp := &AddCapacityResponse{
+		CommitName:     commit.Name,
+		SlotsRequested: req.Slots,
+		SlotsPurchased: commit.SlotCount,
+		Plan:           commit.Plan.String(),
+		State:          commit.State.String(),
+	}
+
+	rec := &CommitmentRecord{
+		Name:      commit.Name,
+		Region:    req.Region,
+		SlotCount: commit.SlotCount,
+		Plan:      commit.Plan.String(),
+		DeleteURL: req.DeleteURL,
+		Audience:  req.Audience,
+		CreatedAt: time.Now(),
+		DeleteAt:  req.DeleteAt,
+		Requester: req.Requester,
+		Group:     req.Group,
+		RequestID: requestIDOf(ctx),
+	}
+	// Record the commitment before scheduling its deletion, so the reconciler
+	// finds it if the delete task can't be created.
+	putErr := s.store.PutCommitment(ctx, rec)
+	if putErr != nil {
+		logging.Error(ctx, "recording commitment %s: %v", commit.Name, putErr)
+	}
+
+	if req.DeleteAt.IsZero() {
+		logging.Info(ctx, "purchased %s commitment %s, not scheduling deletion", req.Plan, commit.Name)
+		return resp, nil
+	}
+
+	logging.Info(ctx, "purchased commitmment, launching delete task for commit ID: %s", commit.Name)
+	task, err := s.launchDeleteTask(ctx, s.queue.DeleteTaskName(commit.Name), commit.Name, rec.DeleteURL, rec.Audience, req.DeleteAt)
+	if err != nil {
+		s.record(ctx, LedgerEntry{Action: actionScheduleFailed, Commitment: commit.Name, DeleteAt: timePtr(req.DeleteAt), Requester: req.Requester, Caller: req.Caller, Reason: req.Reason, Ticket: req.Ticket, Error: err.Error()})
+		return nil, s.rollback(ctx, commit.Name, commit.SlotCount, putErr == nil, req, err)
+	}
+	scheduled := task.ScheduleTime.AsTime()
+	reportProgress(ctx, "deletion of %s scheduled at %s", commit.Name, scheduled.Format(time.RFC3339))
+	resp.DeleteAt = &scheduled
+	resp.EstimatedCost = estimateCost(req.Region, resp.Plan, resp.SlotsPurchased, time.Until(scheduled))
+	s.record(ctx, LedgerEntry{Action: actionDeleteScheduled, Commitment: commit.Name, DeleteAt: &scheduled, Requester: req.Requester, Caller: req.Caller, Reason: req.Reason, Ticket: req.Ticket, Group: req.Group})
+	return resp, nil
+}
+
+// waitActive waits up to activeTimeout for commit to be ACTIVE, so the
+// slots are usable for all of the time paid for, and pushes the DeleteAt of
+// req back by the wait. A commitment still pending then is kept, and its
+// deletion scheduled, all the same. A commitment that FAILED holds no slots
+// and is returned as a *capacity.FailedError.
+func (s *Server) waitActive(ctx context.Context, commit *reservationpb.CapacityCommitment, req *purchaseRequest) (*reservationpb.CapacityCommitment, error) {
+	started := time.Now()
+	reportProgress(ctx, "waiting for %s to be ACTIVE", commit.Name)
+	active, err := s.capacity.WaitActive(ctx, commit.Name, activeTimeout, activePollInterval)
+	var failed *capacity.FailedError
+	switch {
+	case errors.As(err, &failed):
+		s.record(ctx, LedgerEntry{Action: actionPurchaseFailed, Commitment: commit.Name, Region: req.Region, Slots: commit.SlotCount, Plan: commit.Plan.String(), Requester: req.Requester, Caller: req.Caller, Reason: req.Reason, Ticket: req.Ticket, Error: err.Error()})
+		return nil, err
+	case err != nil:
+		logging.Warning(ctx, "commitment %s not active after %s, scheduling its deletion anyway: %v", commit.Name, time.Since(started).Round(time.Second), err)
+		reportProgress(ctx, "%s not ACTIVE after %s", commit.Name, time.Since(started).Round(time.Second))
+	default:
+		logging.Info(ctx, "commitment %s active after %s", commit.Name, time.Since(started).Round(time.Second))
+		reportProgress(ctx, "%s ACTIVE after %s", commit.Name, time.Since(started).Round(time.Second))
+		commit = active
+	}
+	if !req.DeleteAtFixed && !req.DeleteAt.IsZero() {
+		req.DeleteAt = req.DeleteAt.Add(time.Since(started))
+	}
+	return commit, nil
+}
+
+// boughtAnyway returns the commitment of a purchase whose request timed out
+// with its create in flight, if it was bought all the same, for the purchase
+// to record it and schedule its deletion.
+func (s *Server) boughtAnyway(ctx context.Context, uncertain *capacity.UncertainError) (*reservationpb.CapacityCommitment, error) {
+	ctx, cancel := context.WithTimeout(detached{ctx}, settleTimeout)
+	defer cancel()
+	commit, err := s.capacity.Get(ctx, uncertain.Name)
+	if status.Code(err) == codes.NotFound {
+		return nil, fmt.Errorf("creating capacity commitment: %v", uncertain.Err)
+	}
+	if err != nil {
+		logging.Error(ctx, "%v, and getting it failed: %v", uncertain, err)
+		return nil, fmt.Errorf("%w, and getting it failed: %v", uncertain, err)
+	}
+	logging.Warning(ctx, "commitment %s was bought though its request timed out", commit.Name)
+	return commit, nil
+}
+
+// rollback deletes a commitment whose delete task couldn't be created, so it
+// doesn't bill for longer than asked. A FLEX commitment is only deleted once
+// it is a minute old, and if that takes longer than rollbackTimeout it is
+// left to the reconciler, provided it was recorded.
+func (s *Server) rollback(ctx context.Context, commitName string, slots int64, recorded bool, req purchaseRequest, taskErr error) error {
+	// The purchase is undone even if the request that made it is gone.
+	ctx, cancel := context.WithTimeout(detached{ctx}, rollbackTimeout)
+	defer cancel()
+
+	err := s.deleteCapacity(ctx, commitName)
+	if err == nil {
+		logging.Warning(ctx, "delete task of %s could not be created, commitment rolled back", commitName)
+		s.record(ctx, LedgerEntry{Action: actionRolledBack, Commitment: commitName, Slots: slots, Requester: req.Requester, Caller: req.Caller, Reason: req.Reason, Ticket: req.Ticket, Error: taskErr.Error()})
+		return &rollbackError{Commitment: commitName, RolledBack: true, Err: taskErr}
+	}
+
+	logging.Error(ctx, "rolling back commitment %s: %v", commitName, err)
+	s.record(ctx, LedgerEntry{Action: actionDeleteFailed, Commitment: commitName, Requester: req.Requester, Caller: req.Caller, Reason: req.Reason, Ticket: req.Ticket, Error: err.Error()})
+	if !recorded {
+		logging.Error(ctx, "commitment %s has no delete task and is not recorded, delete it by hand", commitName)
+	}
+	return &rollbackError{Commitment: commitName, Recorded: recorded, Err: taskErr, RollbackErr: err}
+}
+
+// AddCapacityResponse describes the commitment purchased by addCapacityHandler
+// and when its delete task will fire.
+type AddCapacityResponse struct {
+	CommitName     string     `json:"commit_name"`
+	SlotsRequested int64      `json:"slots_requested"`
+	SlotsPurchased int64      `json:"slots_purchased"`
+	Plan           string     `json:"plan"`
+	State          string     `json:"state"`
+	DeleteAt       *time.Time `json:"delete_at,omitempty"`
+	DryRun         bool       `json:"dry_run,omitempty"`
+	// EstimatedCost is the USD cost of keeping the slots until DeleteAt.
+	EstimatedCost *float64 `json:"estimated_cost,omitempty"`
+	// Group and Stages are the commitments of a ramp down or chunked
+	// request, the first of which is CommitName. DeleteAt is when the last
+	// one goes.
+	Group  string                 `json:"group,omitempty"`
+	Stages []*AddCapacityResponse `json:"stages,omitempty"`
+	// Reservation is the reservation bumped instead with
+	// CAPACITY_MODE=reservation, and RevertTask the task taking the slots
+	// back out at DeleteAt.
+	Reservation string `json:"reservation,omitempty"`
+	RevertTask  string `json:"revert_task,omitempty"`
+	// Fallback is the stockout fallback SlotsPurchased were bought with,
+	// when the region had no capacity for SlotsRequested.
+	Fallback string `json:"fallback,omitempty"`
+	// Queued is the request held until a blackout ends instead, answered
+	// again to retries with the same idempotency key.
+	Queued *QueuedRequest `json:"-"`
+}
+
+// writeJSON writes v wrapped in the {"data": ...} envelope.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"data": v}); err != nil {
+		logging.Error(context.Background(), "writing response: %v", err)
+	}
+}
+
+// Commit request for deleteCapacity
+type Commit struct {
+	CommitID string `json:"commit_id"`
+	// Slots, if set, only deletes that many slots split off the commitment.
+	Slots int64 `json:"slots,omitempty"`
+	// DryRun only reports what would be deleted, as does DRY_RUN.
+	DryRun bool `json:"dry_run,omitempty"`
+	// Force deletes a commitment the service did not buy, such as an
+	// annual commitment bought by hand. Only admins set it, with the force
+	// query parameter of deleteCommitmentHandler.
+	Force bool `json:"-"`
+	// RequestID is the X-Request-ID of the purchase that scheduled the
+	// deletion, the deletion is logged and recorded under it.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (s *Server) launchDeleteTask(ctx context.Context, taskName, commitName, deleteURL, audience string, deleteAt time.Time) (task *taskspb.Task, err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "launchDeleteTask", trace.WithAttributes(attribute.String("commit", commitName)))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	resp, err := s.queue.CreateHTTP(ctx, taskName, deleteURL, audience, Commit{CommitID: commitName, RequestID: requestIDOf(ctx)}, deleteAt)
+	if status.Code(err) == codes.AlreadyExists {
+		// Task names derive from the commitment, so scheduling its deletion
+		// twice finds the first task. Cloud Tasks also refuses the names of
+		// tasks that ran lately, which are not found.
+		if task, gerr := s.queue.Get(ctx, taskName); gerr == nil {
+			logging.Info(ctx, "deletion of %s already scheduled by %s", commitName, task.Name)
+			return task, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logging.Info(ctx, "delete commitment task created %s", resp.Name)
+	s.recordTaskQueue(ctx, commitName, resp)
+	return resp, nil
+}
+
+func (s *Server) deleteCapacityHandler(w http.ResponseWriter, r *http.Request) {
+	var c Commit
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	if c.CommitID == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "required CommitID not provided")
+		return
+	}
+	s.deleteCommitment(w, r, c)
+}
+
+// deleteCommitment deletes the commitment of c, or only c.Slots split off it.
+func (s *Server) deleteCommitment(w http.ResponseWriter, r *http.Request, c Commit) {
+	r = r.WithContext(logging.WithFields(withRequest(r.Context(), c.RequestID), "commit", c.CommitID, "region", capacity.Region(c.CommitID)))
+	if c.Slots < 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "slots can not be negative")
+		return
+	}
+	owned, err := s.owns(r.Context(), c.CommitID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "checking owner of %s: %v", c.CommitID, err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	if !owned {
+		if !c.Force {
+			writeError(w, http.StatusForbidden, codeNotOwned, "%s was not bought by the service, an admin can delete it anyway with force", c.CommitID)
+			return
+		}
+		who := requester(r)
+		if who == "" {
+			// Forced deletions are recorded with who forced them.
+			writeError(w, http.StatusForbidden, codeForbidden, "forcing the deletion of %s needs a verified caller", c.CommitID)
+			return
+		}
+		logging.Warning(r.Context(), "%s forcing the deletion of %s, not bought by the service", who, c.CommitID)
+	}
+	if c.DryRun || dryRun {
+		s.dryDelete(w, r, c)
+		return
+	}
+	if s.postponeDelete(w, r, c) {
+		return
+	}
+	if c.Slots > 0 && s.deleteSlots(w, r, c) {
+		return
+	}
+
+	err = s.deleteCapacity(r.Context(), c.CommitID)
+	var tooSoon *capacity.DeleteTooSoonError
+	if errors.As(err, &tooSoon) {
+		// Cloud Tasks retries on 503, tell it when it's worth it.
+		retryAfter := int64(math.Ceil(time.Until(tooSoon.RetryAt).Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		logging.Warning(r.Context(), "%v", err)
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		writeError(w, http.StatusServiceUnavailable, codeDeleteTooSoon, "%v", err)
+		return
+	}
+	gone := status.Code(err) == codes.NotFound
+	if status.Code(err) == codes.FailedPrecondition {
+		// Refused for some other reason than the minimum duration: only
+		// forget the commitment if it is no longer billed.
+		gone = s.commitmentLapsed(r.Context(), c.CommitID)
+	}
+	if gone {
+		// The commitment was removed by hand, or has expired. Retrying can
+		// never succeed, so let the task complete instead of failing until
+		// the queue gives up.
+		logging.Warning(r.Context(), "commitment %s can not be deleted, completing task: %v", c.CommitID, err)
+		if err := s.store.ForgetCommitment(r.Context(), c.CommitID); err != nil {
+			logging.Error(r.Context(), "forgetting commitment %s: %v", c.CommitID, err)
+		}
+		s.record(r.Context(), LedgerEntry{Action: actionForgotten, Commitment: c.CommitID, Requester: requester(r), Error: err.Error(), Owned: owned})
+		s.resolveIncident(r.Context(), c.CommitID)
+		writeJSON(w, http.StatusOK, "commitment already deleted or expired")
+		return
+	}
+	if err != nil {
+		s.record(r.Context(), LedgerEntry{Action: actionDeleteFailed, Commitment: c.CommitID, Requester: requester(r), Error: err.Error(), Owned: owned, Forced: !owned})
+		if lastDeleteAttempt(r) {
+			s.openIncident(r.Context(), c.CommitID, fmt.Sprintf("delete task of %s ran out of retries, the commitment is still billed", c.CommitID), map[string]interface{}{
+				"commitment": c.CommitID,
+				"task":       r.Header.Get("X-CloudTasks-TaskName"),
+				"attempts":   deleteTaskMaxAttempts,
+				"error":      err.Error(),
+			})
+		}
+		code := http.StatusInternalServerError
+		if status.Code(err) == codes.FailedPrecondition {
+			// Cloud Tasks retries on 503, the commitment may be deletable
+			// later.
+			code = http.StatusServiceUnavailable
+		}
+		writeError(w, code, codeInternal, "%v", err)
+
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	s.record(r.Context(), LedgerEntry{Action: actionDeleted, Commitment: c.CommitID, Requester: requester(r), Owned: owned, Forced: !owned})
+	s.resolveIncident(r.Context(), c.CommitID)
+
+	writeJSON(w, http.StatusOK, "request processed")
+}
+
+// commitmentLapsed reports whether commitName, which could not be deleted,
+// is no longer billed: it was removed, failed, or reached the end of a plan
+// that doesn't renew. It is false when that can't be told.
+func (s *Server) commitmentLapsed(ctx context.Context, commitName string) bool {
+	c, err := s.capacity.Get(ctx, commitName)
+	if status.Code(err) == codes.NotFound {
+		return true
+	}
+	if err != nil {
+		logging.Error(ctx, "getting commitment %s after its deletion was refused: %v", commitName, err)
+		return false
+	}
+	if c.State == reservationpb.CapacityCommitment_FAILED {
+		return true
+	}
+	renews := c.RenewalPlan != reservationpb.CapacityCommitment_COMMITMENT_PLAN_UNSPECIFIED
+	return c.Plan != reservationpb.CapacityCommitment_FLEX && !renews && c.CommitmentEndTime != nil && time.Now().After(c.CommitmentEndTime.AsTime())
+}
+
+// deleteCapacity deletes commitName and forgets its record.
+func (s *Server) deleteCapacity(ctx context.Context, commitName string) error {
+	_, done, _ := s.ops.begin("deletion", LedgerEntry{Commitment: commitName, Region: capacity.Region(commitName)}, true)
+	defer done()
+	if err := s.capacity.Delete(ctx, commitName); err != nil {
+		return err
+	}
+
+	logging.Info(ctx, "capacity commitment %s deleted", commitName)
+	if err := s.store.ForgetCommitment(ctx, commitName); err != nil {
+		logging.Error(ctx, "forgetting commitment %s: %v", commitName, err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/taskspb"
+	"go-slot-scheduler/tasks"
+)
+
+// testClock is the time of a capacity.Fake, moved on by hand.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// failingTasks is a tasks.Fake whose tasks cannot be created. Creating one
+// first moves clock past the minimum duration of FLEX commitments, so the
+// commitment bought can be rolled back at once.
+type failingTasks struct {
+	*tasks.Fake
+	clock *testClock
+}
+
+func (f failingTasks) CreateTask(ctx context.Context, req *taskspb.CreateTaskRequest) (*taskspb.Task, error) {
+	f.clock.advance(capacity.FlexMinDuration)
+	return nil, status.Error(codes.PermissionDenied, "queue is not writable")
+}
+
+// loadTestConfig loads the configuration of a service of test-project over
+// the fake backends, capped at 1000 slots, with the settings of env on top.
+func loadTestConfig(t *testing.T, env map[string]string) {
+	t.Helper()
+	for name, v := range map[string]string{"FAKE_BACKENDS": "true", "FAKE_LATENCY": "0", "GOOGLE_CLOUD_PROJECT": "test-project", "MAX_SLOTS": "1000"} {
+		t.Setenv(name, v)
+	}
+	for name, v := range env {
+		t.Setenv(name, v)
+	}
+	if err := LoadConfig(nil); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+}
+
+// newTestServer returns a Server over in-memory fakes, configured by
+// loadTestConfig with env.
+func newTestServer(t *testing.T, tc tasks.Client, clock *testClock, env map[string]string) (*Server, *capacity.Fake) {
+	t.Helper()
+	loadTestConfig(t, env)
+
+	fc := capacity.NewFake()
+	fc.Now = clock.Now
+	s := &Server{
+		store:      newMemStore(),
+		autoscaler: autoscaler{lastAction: make(map[string]time.Time)},
+	}
+	s.useBackends(func(string) capacity.Client { return fc }, tc)
+	return s, fc
+}
+
+func TestPurchaseRollsBackWhenDeleteTaskFails(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Now()}
+	s, fc := newTestServer(t, failingTasks{Fake: tasks.NewFake(), clock: clock}, clock, nil)
+
+	_, err := s.purchase(ctx, purchaseRequest{
+		Region:    "US",
+		Slots:     100,
+		Plan:      reservationpb.CapacityCommitment_FLEX,
+		DeleteAt:  time.Now().Add(time.Hour),
+		DeleteURL: "https://example.com/delete",
+		Requester: "alice@example.com",
+	})
+	var rb *rollbackError
+	if !errors.As(err, &rb) {
+		t.Fatalf("purchase error = %v, want a *rollbackError", err)
+	}
+	if !rb.RolledBack {
+		t.Errorf("rollback of %s failed: %v", rb.Commitment, rb.RollbackErr)
+	}
+
+	if _, err := fc.GetCapacityCommitment(ctx, &reservationpb.GetCapacityCommitmentRequest{Name: rb.Commitment}); status.Code(err) != codes.NotFound {
+		t.Errorf("commitment %s after rollback: err = %v, want NotFound", rb.Commitment, err)
+	}
+	if recorded, err := s.recorded(ctx, rb.Commitment); err != nil || recorded {
+		t.Errorf("commitment %s still recorded after rollback: %v, %v", rb.Commitment, recorded, err)
+	}
+
+	entries, err := s.store.QueryEvents(ctx, EventQuery{Commitment: rb.Commitment, Action: actionRolledBack})
+	if err != nil {
+		t.Fatalf("QueryEvents: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d %s entries for %s, want 1", len(entries), actionRolledBack, rb.Commitment)
+	}
+	if e := entries[0]; e.Slots != 100 || e.Requester != "alice@example.com" || e.Error == "" {
+		t.Errorf("%s entry = %+v, want 100 slots for alice@example.com with the task error", actionRolledBack, e)
+	}
+}
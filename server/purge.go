@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// Purge asks for every FLEX commitment bought by the service in Region, or
+// in every region when empty, to be deleted now.
+type Purge struct {
+	Region string `json:"region,omitempty"`
+	RequestMetadata
+}
+
+// PurgeResult is what a purge deleted.
+type PurgeResult struct {
+	Released      []ReleasedSlots `json:"released"`
+	SlotsReleased int64           `json:"slots_released"`
+	Errors        []string        `json:"errors,omitempty"`
+}
+
+// purgeHandler deletes every FLEX commitment the service bought, in the
+// region of the body or everywhere, cancelling their delete tasks. It is
+// the panic button for when costs run away: commitments still in the FLEX
+// minimum of a minute are waited for rather than skipped, and one failing
+// doesn't stop the others.
+func (s *Server) purgeHandler(w http.ResponseWriter, r *http.Request) {
+	var req Purge
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	var v validator
+	if req.Region != "" {
+		v.region("region", &req.Region)
+	}
+	req.RequestMetadata.validate(&v)
+	if err := v.err(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	who, caller := req.who(r)
+	// Deleting goes on if the caller gives up waiting.
+	ctx := logging.WithFields(detached{r.Context()}, "region", req.Region)
+
+	recs, err := s.store.ListCommitments(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "listing recorded commitments: %v", err)
+		logging.Error(ctx, "listing recorded commitments: %v", err)
+		return
+	}
+	// Oldest first, they are past the FLEX minimum.
+	sort.Slice(recs, func(i, j int) bool { return recs[i].CreatedAt.Before(recs[j].CreatedAt) })
+
+	res := PurgeResult{Released: []ReleasedSlots{}}
+	for _, rec := range recs {
+		if rec.Plan != reservationpb.CapacityCommitment_FLEX.String() || req.Region != "" && rec.Region != req.Region {
+			continue
+		}
+		rel, err := s.releaseSlots(ctx, rec, rec.SlotCount, who, true)
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("releasing %s: %v", rec.Name, err))
+			logging.Error(ctx, "purging %s: %v", rec.Name, err)
+			continue
+		}
+		res.Released = append(res.Released, *rel)
+		res.SlotsReleased += rel.Slots
+	}
+
+	logging.Warning(ctx, "%s purged %d commitments, %d slots", who, len(res.Released), res.SlotsReleased)
+	if !dryRun {
+		s.record(ctx, LedgerEntry{Action: actionPurged, Region: req.Region, Slots: res.SlotsReleased, Requester: who, Caller: caller, Reason: req.Reason, Ticket: req.Ticket})
+	}
+	code := http.StatusOK
+	if len(res.Errors) > 0 {
+		code = http.StatusInternalServerError
+	}
+	writeJSON(w, code, res)
+}
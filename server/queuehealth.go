@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/internal/taskspb"
+)
+
+// queueCheckTimeout bounds a check of the delete queue.
+const queueCheckTimeout = 10 * time.Second
+
+// QueueStatus is the state of a Cloud Tasks queue when it was last checked,
+// and since when it is in it.
+type QueueStatus struct {
+	Queue     string    `json:"queue"`
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// stopped reports whether the queue doesn't dispatch its tasks.
+func (q QueueStatus) stopped() bool {
+	return q.State == taskspb.Queue_PAUSED.String() || q.State == taskspb.Queue_DISABLED.String()
+}
+
+// queueHealth holds the last known state of the delete queues. The zero
+// value is ready to use.
+type queueHealth struct {
+	mu     sync.Mutex
+	queues map[string]QueueStatus
+}
+
+// observe records the state of queue, returning the state it was in before,
+// "" when unknown.
+func (h *queueHealth) observe(queue, state string) (previous string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.queues == nil {
+		h.queues = make(map[string]QueueStatus)
+	}
+	now := time.Now()
+	st, ok := h.queues[queue]
+	if !ok || st.State != state {
+		previous = st.State
+		st = QueueStatus{Queue: queue, State: state, Since: now}
+	} else {
+		previous = state
+	}
+	st.CheckedAt = now
+	h.queues[queue] = st
+	return previous
+}
+
+// get returns the last known state of queue, if it was checked.
+func (h *queueHealth) get(queue string) (QueueStatus, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, ok := h.queues[queue]
+	return st, ok
+}
+
+// list returns the last known state of every queue checked, by name.
+func (h *queueHealth) list() []QueueStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]QueueStatus, 0, len(h.queues))
+	for _, st := range h.queues {
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Queue < list[j].Queue })
+	return list
+}
+
+// queueRunning reports whether queue dispatches its tasks as far as is
+// known, tasks are created in the queues that do first.
+func (s *Server) queueRunning(queue string) bool {
+	st, ok := s.queues.get(queue)
+	return !ok || !st.stopped()
+}
+
+// queuePausedError refuses a purchase whose deletion wouldn't fire.
+type queuePausedError struct {
+	Status QueueStatus
+}
+
+func (e *queuePausedError) Error() string {
+	return fmt.Sprintf("delete queue %s is %s since %s, its deletion would not fire", e.Status.Queue, e.Status.State, e.Status.Since.Format(time.RFC3339))
+}
+
+// runQueueMonitor checks the delete queues every interval until ctx is done.
+func (s *Server) runQueueMonitor(ctx context.Context, interval time.Duration) {
+	logging.Info(ctx, "checking the delete queues every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.checkQueueState(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkQueueState gets the state of the delete queues. A queue that can't be
+// got keeps its last known state.
+func (s *Server) checkQueueState(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, queueCheckTimeout)
+	defer cancel()
+	for _, name := range queueNames() {
+		q, err := s.tasks.GetQueue(ctx, &taskspb.GetQueueRequest{Name: name})
+		if err != nil {
+			logging.Warning(ctx, "checking delete queue %s: %v", name, err)
+			continue
+		}
+		s.observeQueue(ctx, name, q.State)
+	}
+}
+
+// observeQueue records the state of queue, alerting and paging when it
+// stops dispatching tasks and resolving the incident once it runs again.
+func (s *Server) observeQueue(ctx context.Context, queue string, state taskspb.Queue_State) {
+	previous := s.queues.observe(queue, state.String())
+	if previous == state.String() {
+		return
+	}
+	st, _ := s.queues.get(queue)
+	switch {
+	case st.stopped():
+		summary := fmt.Sprintf("delete queue %s is %s: deletions won't fire, purchases are refused until it is resumed", queue, state)
+		logging.Error(ctx, "%s", summary)
+		s.notify(ctx, Event{Type: eventQueueStopped, Summary: summary})
+		s.openIncident(ctx, queue, summary, map[string]interface{}{"queue": queue, "state": state.String()})
+	case state == taskspb.Queue_RUNNING:
+		// Resolved even if it was never seen stopped, another instance
+		// may have paged.
+		s.resolveIncident(ctx, queue)
+		if previous != "" {
+			logging.Info(ctx, "delete queue %s is %s again", queue, state)
+			s.notify(ctx, Event{Type: eventQueueResumed, Summary: fmt.Sprintf("delete queue %s is %s again, purchases resume", queue, state)})
+		}
+	}
+}
+
+// checkQueueRunning refuses purchases scheduling their deletion while every
+// delete queue was last seen PAUSED or DISABLED. With QUEUES, their deletion
+// fails over to a queue still running.
+func (s *Server) checkQueueRunning(ctx context.Context, req purchaseRequest) error {
+	if req.DeleteAt.IsZero() {
+		return nil
+	}
+	for _, name := range queueNames() {
+		if s.queueRunning(name) {
+			return nil
+		}
+	}
+	st, _ := s.queues.get(queueName())
+	err := &queuePausedError{Status: st}
+	logging.Warning(ctx, "refusing purchase: %v", err)
+	return err
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// RampStep releases Percent of the slots of a request Minutes after it is
+// bought.
+type RampStep struct {
+	Minutes int64 `json:"minutes"`
+	Percent int64 `json:"percent"`
+}
+
+// rampDown checks the ramp down steps of p: later and later, within
+// MAX_MINUTES, and adding up to 100 percent.
+func (v *validator) rampDown(p *Payload) {
+	var total, last int64
+	maxMinutes := live().MaxMinutes
+	for i, step := range p.RampDown {
+		field := fmt.Sprintf("ramp_down[%d]", i)
+		v.check(step.Minutes > last, field+".minutes", "must be positive and after the previous step")
+		v.check(step.Minutes <= maxMinutes, field+".minutes", "can not be more than %d", maxMinutes)
+		v.check(step.Percent > 0, field+".percent", "must be positive")
+		total += step.Percent
+		last = step.Minutes
+	}
+	v.check(total == 100, "ramp_down", "percents add up to %d, not 100", total)
+	for i, stage := range p.rampStages(time.Now()) {
+		v.check(stage.Slots >= slotIncrement, fmt.Sprintf("ramp_down[%d].percent", i), "releases %d slots, less than %d", stage.Slots, slotIncrement)
+	}
+}
+
+// rampStages splits the slots of p into a commitment per ramp down step,
+// rounded to the nearest slotIncrement. The last step gets what is left.
+func (p *Payload) rampStages(now time.Time) []groupStage {
+	stages := make([]groupStage, 0, len(p.RampDown))
+	left := p.ExtraSlot
+	for i, step := range p.RampDown {
+		slots := left
+		if i < len(p.RampDown)-1 {
+			slots = (p.ExtraSlot*step.Percent/100 + slotIncrement/2) / slotIncrement * slotIncrement
+		}
+		left -= slots
+		stages = append(stages, groupStage{Slots: slots, DeleteAt: now.Add(time.Duration(step.Minutes) * time.Minute)})
+	}
+	return stages
+}
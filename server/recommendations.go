@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/scheduler"
+)
+
+const (
+	// defaultRecommendationDays is how many days of usage are analysed by
+	// default, maxRecommendationDays at most.
+	defaultRecommendationDays = 14
+	maxRecommendationDays     = 90
+)
+
+// Recommendation suggests the capacity of a region from its usage: a
+// baseline commitment held all the time and weekly schedules of FLEX slots
+// on top of it, with what they would have cost over the days analysed.
+type Recommendation struct {
+	Region   string `json:"region"`
+	Timezone string `json:"timezone"`
+	Days     int    `json:"days"`
+	// Hours of usage analysed, and the average and peak slots used in them.
+	Hours        int     `json:"hours"`
+	AverageSlots float64 `json:"average_slots"`
+	PeakSlots    float64 `json:"peak_slots"`
+	// BaselineSlots is the size of the commitment worth holding all the
+	// time at COMMIT_SLOT_HOUR_PRICE rather than buying as FLEX.
+	BaselineSlots int64 `json:"baseline_slots"`
+	// Schedules add FLEX slots when usage is above the baseline, ready to
+	// be created with POST /schedules.
+	Schedules []*scheduler.Schedule `json:"schedules"`
+	// CurrentCost is the spend on FLEX capacity bought by the service over
+	// the days, from the ledger. EstimatedCost is what the baseline and the
+	// schedules would have cost.
+	CurrentCost      float64 `json:"current_cost"`
+	EstimatedCost    float64 `json:"estimated_cost"`
+	EstimatedSavings float64 `json:"estimated_savings"`
+	Currency         string  `json:"currency"`
+}
+
+// hourlyUsage is the slots used by the jobs of a region in an hour.
+type hourlyUsage struct {
+	Hour time.Time `bigquery:"hour"`
+	Used float64   `bigquery:"used_slots"`
+}
+
+// recommendationsHandler recommends the capacity of the region query
+// parameter from the usage of its last days (default 14), with schedules in
+// timezone (default UTC).
+func (s *Server) recommendationsHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	var v validator
+	region := params.Get("region")
+	v.region("region", &region)
+	days := defaultRecommendationDays
+	if p := params.Get("days"); p != "" {
+		var err error
+		days, err = strconv.Atoi(p)
+		v.check(err == nil && days > 0 && days <= maxRecommendationDays, "days", "must be between 1 and %d", maxRecommendationDays)
+	}
+	tz := params.Get("timezone")
+	if tz == "" {
+		tz = "UTC"
+	}
+	loc, err := time.LoadLocation(tz)
+	v.check(err == nil, "timezone", "unknown time zone %q", tz)
+	if err := v.err(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	ctx := logging.WithFields(r.Context(), "region", region)
+	to := time.Now().Truncate(time.Hour)
+	from := to.Add(-time.Duration(days) * 24 * time.Hour)
+	usage, err := s.hourlyUsage(ctx, autoscale.View, region, from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "reading slot usage: %v", err)
+		logging.Error(ctx, "reading slot usage of %s: %v", region, err)
+		return
+	}
+	entries, err := s.store.ListEvents(ctx, from.Add(-time.Duration(live().MaxMinutes)*time.Minute))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "reading ledger: %v", err)
+		logging.Error(ctx, "%v", err)
+		return
+	}
+
+	rec := recommend(region, loc, days, from, usage)
+	if rc, ok := costReport(entries, from, to, false).ByRegion[region]; ok {
+		rec.CurrentCost = rc.EstimatedCost
+	}
+	rec.EstimatedSavings = roundCents(rec.CurrentCost - rec.EstimatedCost)
+	writeJSON(w, http.StatusOK, rec)
+}
+
+// hourlyUsage returns the slots used in region each hour from from to to,
+// zero in hours without jobs.
+func (s *Server) hourlyUsage(ctx context.Context, view, region string, from, to time.Time) ([]float64, error) {
+	q := s.bigquery.Query(fmt.Sprintf(`
+SELECT
+  TIMESTAMP_TRUNC(period_start, HOUR) AS hour,
+  SUM(period_slot_ms) / (1000 * 3600) AS used_slots
+FROM `+"`region-%s`.INFORMATION_SCHEMA.%s"+`
+WHERE period_start >= @from AND period_start < @to
+  AND (statement_type IS NULL OR statement_type != 'SCRIPT')
+GROUP BY hour`, strings.ToLower(region), view))
+	q.Location = region
+	q.Parameters = []bigquery.QueryParameter{{Name: "from", Value: from}, {Name: "to", Value: to}}
+
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hours := make([]float64, int(to.Sub(from)/time.Hour))
+	for {
+		var u hourlyUsage
+		err := it.Next(&u)
+		if err == iterator.Done {
+			return hours, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i := int(u.Hour.Sub(from) / time.Hour); i >= 0 && i < len(hours) {
+			hours[i] = u.Used
+		}
+	}
+}
+
+// recommend sizes the baseline and the schedules of region from the slots
+// used in each hour of the last days, the first starting at from.
+//
+// A baseline slot pays off when it would be used for a larger share of the
+// hours than the ratio of the commitment and FLEX prices, so the baseline
+// is the usage exceeded for that share of the hours. Above it, each hour of
+// the week gets the average excess of that hour over the weeks, rounded to
+// 100 slots, and consecutive hours of a day are joined into a window at
+// their highest level. Days with the same windows share a schedule.
+func recommend(region string, loc *time.Location, days int, from time.Time, hours []float64) *Recommendation {
+	rec := &Recommendation{Region: region, Timezone: loc.String(), Days: days, Hours: len(hours), Schedules: []*scheduler.Schedule{}, Currency: "USD"}
+	if len(hours) == 0 {
+		return rec
+	}
+	flexPrice, _ := slotHourPrice(region, reservationpb.CapacityCommitment_FLEX.String())
+	for _, used := range hours {
+		rec.AverageSlots += used / float64(len(hours))
+		rec.PeakSlots = math.Max(rec.PeakSlots, used)
+	}
+	rec.AverageSlots = math.Round(rec.AverageSlots)
+	rec.PeakSlots = math.Round(rec.PeakSlots)
+
+	if flexPrice > 0 {
+		sorted := append([]float64(nil), hours...)
+		sort.Sort(sort.Reverse(sort.Float64Slice(sorted)))
+		share := math.Min(commitSlotHourPrice/flexPrice, 1)
+		if i := int(math.Ceil(share*float64(len(sorted)))) - 1; i >= 0 && i < len(sorted) {
+			rec.BaselineSlots = int64(sorted[i]) / slotIncrement * slotIncrement
+		}
+	}
+
+	// Average excess of each hour of the week, Sunday midnight first.
+	var excess, seen [7 * 24]float64
+	for i, used := range hours {
+		t := from.Add(time.Duration(i) * time.Hour).In(loc)
+		h := int(t.Weekday())*24 + t.Hour()
+		excess[h] += math.Max(used-float64(rec.BaselineSlots), 0)
+		seen[h]++
+	}
+	var level [7 * 24]int64
+	for h := range level {
+		if seen[h] > 0 {
+			level[h] = int64(math.Round(excess[h]/seen[h]/slotIncrement)) * slotIncrement
+		}
+	}
+
+	// Windows of each day, as start hour, end hour and slots.
+	type window struct {
+		start, end int
+		slots      int64
+	}
+	maxHours := int(live().MaxMinutes / 60)
+	byWindows := make(map[string][]string)
+	var keys []string
+	windows := make(map[string][]window)
+	for day := 0; day < 7; day++ {
+		var list []window
+		for hour := 0; hour < 24; hour++ {
+			l := level[day*24+hour]
+			if l == 0 {
+				continue
+			}
+			if n := len(list); n > 0 && list[n-1].end == hour && hour-list[n-1].start < maxHours {
+				list[n-1].end = hour + 1
+				if l > list[n-1].slots {
+					list[n-1].slots = l
+				}
+				continue
+			}
+			list = append(list, window{start: hour, end: hour + 1, slots: l})
+		}
+		if len(list) == 0 {
+			continue
+		}
+		key := fmt.Sprint(list)
+		if _, ok := byWindows[key]; !ok {
+			keys = append(keys, key)
+			windows[key] = list
+		}
+		byWindows[key] = append(byWindows[key], strings.ToUpper(time.Weekday(day).String()[:3]))
+	}
+
+	var flexSlotHours float64
+	for _, key := range keys {
+		for _, win := range windows[key] {
+			rec.Schedules = append(rec.Schedules, &scheduler.Schedule{
+				Name:     fmt.Sprintf("recommended-%d", len(rec.Schedules)+1),
+				Region:   region,
+				Timezone: loc.String(),
+				Weekly: &scheduler.WeeklyWindow{
+					Days:  byWindows[key],
+					Start: fmt.Sprintf("%02d:00", win.start),
+					End:   fmt.Sprintf("%02d:00", win.end%24),
+				},
+				Slots:  win.slots,
+				Reason: fmt.Sprintf("recommended from %d days of usage", days),
+			})
+			flexSlotHours += float64(win.slots*int64(win.end-win.start)*int64(len(byWindows[key]))) * float64(len(hours)) / (7 * 24)
+		}
+	}
+	rec.EstimatedCost = roundCents(float64(rec.BaselineSlots)*float64(len(hours))*commitSlotHourPrice + flexSlotHours*flexPrice)
+	return rec
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// reconcileGrace leaves recently bought commitments alone, since the request
+// that bought them may still be creating their delete task.
+const reconcileGrace = 5 * time.Minute
+
+// ReconcileResult summarises a reconciliation pass.
+type ReconcileResult struct {
+	Checked     int      `json:"checked"`
+	Deleted     []string `json:"deleted"`
+	Rescheduled []string `json:"rescheduled"`
+	Forgotten   []string `json:"forgotten"`
+	// Expired are the FLEX commitments deleted for being kept longer than
+	// MAX_MINUTES.
+	Expired []string `json:"expired"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// runReconciler reconciles every interval until ctx is done.
+func (s *Server) runReconciler(ctx context.Context, interval time.Duration) {
+	logging.Info(ctx, "reconciling commitments every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			res, err := s.reconcile(ctx)
+			if err != nil {
+				logging.Error(ctx, "reconciling commitments: %v", err)
+				continue
+			}
+			logging.Info(ctx, "reconciled %d commitments: deleted %v, rescheduled %v, forgotten %v, expired %v", res.Checked, res.Deleted, res.Rescheduled, res.Forgotten, res.Expired)
+		}
+	}
+}
+
+func (s *Server) reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := s.reconcile(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// reconcile makes sure every commitment the service bought either has a
+// pending delete task or is deleted once it is past its delete time, which
+// covers commitments orphaned by a crash between the purchase and the task
+// creation, or by a task that was removed from the queue. FLEX commitments
+// kept longer than MAX_MINUTES are deleted whatever their task, as a last
+// resort against runaway costs.
+func (s *Server) reconcile(ctx context.Context) (*ReconcileResult, error) {
+	recs, err := s.store.ListCommitments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing recorded commitments: %v", err)
+	}
+	pending, err := s.pendingDeletes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing delete tasks: %v", err)
+	}
+
+	res := &ReconcileResult{Deleted: []string{}, Rescheduled: []string{}, Forgotten: []string{}, Expired: []string{}}
+	now := time.Now()
+	// Delete tasks fire at MAX_MINUTES at the latest, leave them the grace
+	// to do so.
+	maxAge := time.Duration(live().MaxMinutes)*time.Minute + reconcileGrace
+	for _, rec := range recs {
+		if rec.Plan == reservationpb.CapacityCommitment_FLEX.String() && now.Sub(rec.CreatedAt) > maxAge {
+			res.Checked++
+			s.expire(logging.WithFields(ctx, "commit", rec.Name, "region", rec.Region, "slots", rec.SlotCount), rec, res)
+			continue
+		}
+		if rec.DeleteAt.IsZero() || now.Sub(rec.CreatedAt) < reconcileGrace {
+			continue
+		}
+		res.Checked++
+		// Its deletion is traced under the purchase.
+		ctx := logging.WithFields(withRequest(ctx, rec.RequestID), "commit", rec.Name, "region", rec.Region, "slots", rec.SlotCount)
+
+		// A commitment with a delete task is checked again once it is
+		// overdue, in case the task keeps failing.
+		overdue := now.After(rec.DeleteAt.Add(overdueAfter))
+		_, hasTask := pending[rec.Name]
+		if hasTask && !overdue {
+			continue
+		}
+
+		_, err := s.capacity.Get(ctx, rec.Name)
+		if status.Code(err) == codes.NotFound {
+			if err := s.store.ForgetCommitment(ctx, rec.Name); err != nil {
+				res.Errors = append(res.Errors, fmt.Sprintf("forgetting %s: %v", rec.Name, err))
+				continue
+			}
+			res.Forgotten = append(res.Forgotten, rec.Name)
+			s.record(ctx, LedgerEntry{Action: actionForgotten, Commitment: rec.Name, Requester: requesterReconciler, Owned: true})
+			s.resolveIncident(ctx, rec.Name)
+			continue
+		}
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("getting %s: %v", rec.Name, err))
+			continue
+		}
+
+		if hasTask {
+			s.openIncident(ctx, rec.Name, fmt.Sprintf("%s is alive %s past its delete time, its delete task keeps failing", rec.Name, now.Sub(rec.DeleteAt).Round(time.Minute)), overdueDetails(rec))
+			continue
+		}
+
+		if !now.Before(rec.DeleteAt) {
+			logging.Info(ctx, "orphaned commitment %s was due for deletion at %s, deleting", rec.Name, rec.DeleteAt)
+			if err := s.deleteCapacity(ctx, rec.Name); err != nil {
+				s.record(ctx, LedgerEntry{Action: actionDeleteFailed, Commitment: rec.Name, Slots: rec.SlotCount, Requester: requesterReconciler, Error: err.Error(), Owned: true})
+				res.Errors = append(res.Errors, fmt.Sprintf("deleting %s: %v", rec.Name, err))
+				if overdue {
+					details := overdueDetails(rec)
+					details["error"] = err.Error()
+					s.openIncident(ctx, rec.Name, fmt.Sprintf("%s is alive %s past its delete time and can not be deleted", rec.Name, now.Sub(rec.DeleteAt).Round(time.Minute)), details)
+				}
+				continue
+			}
+			res.Deleted = append(res.Deleted, rec.Name)
+			s.record(ctx, LedgerEntry{Action: actionDeleted, Commitment: rec.Name, Slots: rec.SlotCount, Requester: requesterReconciler, Owned: true})
+			s.resolveIncident(ctx, rec.Name)
+			continue
+		}
+
+		logging.Info(ctx, "orphaned commitment %s has no delete task, scheduling deletion at %s", rec.Name, rec.DeleteAt)
+		_, err = s.launchDeleteTask(ctx, s.queue.RescheduledTaskName(rec.Name, rec.DeleteAt), rec.Name, rec.DeleteURL, rec.Audience, rec.DeleteAt)
+		if err != nil && status.Code(err) != codes.AlreadyExists {
+			res.Errors = append(res.Errors, fmt.Sprintf("scheduling deletion of %s: %v", rec.Name, err))
+			continue
+		}
+		res.Rescheduled = append(res.Rescheduled, rec.Name)
+		s.record(ctx, LedgerEntry{Action: actionDeleteScheduled, Commitment: rec.Name, Slots: rec.SlotCount, DeleteAt: timePtr(rec.DeleteAt), Requester: requesterReconciler})
+	}
+
+	if len(res.Deleted)+len(res.Rescheduled)+len(res.Forgotten)+len(res.Expired)+len(res.Errors) > 0 {
+		s.notify(ctx, Event{
+			Type:    eventReconciled,
+			Summary: fmt.Sprintf("reconciled %d commitments: deleted %v, rescheduled %v, forgotten %v, expired %v, errors %v", res.Checked, res.Deleted, res.Rescheduled, res.Forgotten, res.Expired, res.Errors),
+		})
+	}
+	return res, nil
+}
+
+// expire deletes the commitment of rec, kept longer than MAX_MINUTES, and
+// its delete task if it still has one. Failing to is paged: the commitment
+// is billed until someone deletes it.
+func (s *Server) expire(ctx context.Context, rec *CommitmentRecord, res *ReconcileResult) {
+	age := time.Since(rec.CreatedAt).Round(time.Minute)
+	logging.Warning(ctx, "%s was bought %s ago, more than MAX_MINUTES, deleting", rec.Name, age)
+	err := s.deleteCapacity(ctx, rec.Name)
+	if status.Code(err) == codes.NotFound {
+		if err := s.store.ForgetCommitment(ctx, rec.Name); err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("forgetting %s: %v", rec.Name, err))
+			return
+		}
+		res.Forgotten = append(res.Forgotten, rec.Name)
+		s.record(ctx, LedgerEntry{Action: actionForgotten, Commitment: rec.Name, Requester: requesterReconciler, Owned: true})
+		s.resolveIncident(ctx, rec.Name)
+		return
+	}
+	reason := fmt.Sprintf("kept %s, more than MAX_MINUTES", age)
+	if err != nil {
+		s.record(ctx, LedgerEntry{Action: actionDeleteFailed, Commitment: rec.Name, Slots: rec.SlotCount, Requester: requesterReconciler, Reason: reason, Error: err.Error(), Owned: true})
+		res.Errors = append(res.Errors, fmt.Sprintf("deleting expired %s: %v", rec.Name, err))
+		details := overdueDetails(rec)
+		details["error"] = err.Error()
+		s.openIncident(ctx, rec.Name, fmt.Sprintf("%s was bought %s ago, more than MAX_MINUTES, and can not be deleted", rec.Name, age), details)
+		return
+	}
+	res.Expired = append(res.Expired, rec.Name)
+	s.record(ctx, LedgerEntry{Action: actionDeleted, Commitment: rec.Name, Slots: rec.SlotCount, Requester: requesterReconciler, Reason: reason, Owned: true})
+	s.dropDeleteTask(ctx, rec.Name)
+	s.resolveIncident(ctx, rec.Name)
+}
+
+// overdueDetails describes an overdue commitment to whoever is paged.
+func overdueDetails(rec *CommitmentRecord) map[string]interface{} {
+	return map[string]interface{}{
+		"commitment": rec.Name,
+		"region":     rec.Region,
+		"slots":      rec.SlotCount,
+		"delete_at":  rec.DeleteAt.Format(time.RFC3339),
+	}
+}
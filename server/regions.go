@@ -0,0 +1,171 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Kinds of BigQuery locations.
+const (
+	regionMulti  = "multi-region"
+	regionSingle = "region"
+	regionOmni   = "omni"
+)
+
+// RegionInfo is a BigQuery location capacity can be bought in.
+type RegionInfo struct {
+	Location string `json:"location"`
+	Kind     string `json:"kind"`
+	// Cloud is where an omni location runs, aws or azure.
+	Cloud string `json:"cloud,omitempty"`
+}
+
+// regionCatalog lists the BigQuery reservation locations.
+var regionCatalog = func() []RegionInfo {
+	var catalog []RegionInfo
+	for _, l := range []string{"US", "EU"} {
+		catalog = append(catalog, RegionInfo{Location: l, Kind: regionMulti})
+	}
+	for _, l := range []string{
+		"us-central1", "us-east1", "us-east4", "us-east5", "us-south1", "us-west1", "us-west2", "us-west3", "us-west4",
+		"northamerica-northeast1", "northamerica-northeast2", "northamerica-south1", "southamerica-east1", "southamerica-west1",
+		"europe-central2", "europe-north1", "europe-north2", "europe-southwest1", "europe-west1", "europe-west2", "europe-west3",
+		"europe-west4", "europe-west6", "europe-west8", "europe-west9", "europe-west10", "europe-west12",
+		"me-central1", "me-central2", "me-west1", "africa-south1",
+		"asia-east1", "asia-east2", "asia-northeast1", "asia-northeast2", "asia-northeast3", "asia-south1", "asia-south2",
+		"asia-southeast1", "asia-southeast2", "australia-southeast1", "australia-southeast2",
+	} {
+		catalog = append(catalog, RegionInfo{Location: l, Kind: regionSingle})
+	}
+	for _, l := range []string{"aws-us-east-1", "aws-us-west-2", "aws-eu-west-1", "aws-ap-northeast-2", "aws-ap-southeast-2"} {
+		catalog = append(catalog, RegionInfo{Location: l, Kind: regionOmni, Cloud: "aws"})
+	}
+	catalog = append(catalog, RegionInfo{Location: "azure-eastus2", Kind: regionOmni, Cloud: "azure"})
+	return catalog
+}()
+
+var (
+	// allowedRegions are the locations requests may name, in catalog order.
+	allowedRegions []RegionInfo
+	// knownRegions maps the lower case name of allowedRegions to their
+	// location.
+	knownRegions map[string]string
+)
+
+// parseRegions reads ALLOWED_REGIONS, a comma separated list narrowing the
+// catalog. Locations missing from the catalog are allowed as plain regions,
+// so new BigQuery regions don't need a release.
+func parseRegions() {
+	allowedRegions = regionCatalog
+	if v := getenv("ALLOWED_REGIONS"); v != "" {
+		byName := make(map[string]RegionInfo, len(regionCatalog))
+		for _, info := range regionCatalog {
+			byName[strings.ToLower(info.Location)] = info
+		}
+		allowedRegions = nil
+		for _, l := range strings.Split(v, ",") {
+			if l = strings.TrimSpace(l); l == "" {
+				continue
+			}
+			info, ok := byName[strings.ToLower(l)]
+			if !ok {
+				info = RegionInfo{Location: l, Kind: regionSingle}
+			}
+			allowedRegions = append(allowedRegions, info)
+		}
+	}
+	knownRegions = make(map[string]string, len(allowedRegions))
+	for _, info := range allowedRegions {
+		knownRegions[strings.ToLower(info.Location)] = info.Location
+	}
+}
+
+// maxSuggestionDistance is how many edits away a location may be to be
+// suggested for a typo.
+const maxSuggestionDistance = 3
+
+// suggestRegions returns the allowed locations region was most likely meant
+// to be: those it is a prefix of, such as us-central for us-central1, or
+// else the closest by edit distance.
+func suggestRegions(region string) []string {
+	region = strings.ToLower(region)
+	if region == "" {
+		return nil
+	}
+	var prefixed []string
+	for _, info := range allowedRegions {
+		if strings.HasPrefix(strings.ToLower(info.Location), region) {
+			prefixed = append(prefixed, info.Location)
+		}
+	}
+	if len(prefixed) > 0 && len(prefixed) <= 3 {
+		return prefixed
+	}
+
+	best := maxSuggestionDistance + 1
+	var closest []string
+	for _, info := range allowedRegions {
+		switch d := editDistance(region, strings.ToLower(info.Location)); {
+		case d < best:
+			best, closest = d, []string{info.Location}
+		case d == best:
+			closest = append(closest, info.Location)
+		}
+	}
+	sort.Strings(closest)
+	if len(closest) > 3 {
+		closest = closest[:3]
+	}
+	return closest
+}
+
+// editDistance is the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// RegionCheck is the result of validating a region name.
+type RegionCheck struct {
+	Region      string   `json:"region"`
+	Valid       bool     `json:"valid"`
+	Location    string   `json:"location,omitempty"` // canonical name
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+// regionsHandler lists the locations capacity can be bought in, or with the
+// region query parameter, checks a name and suggests what it may have meant.
+func (s *Server) regionsHandler(w http.ResponseWriter, r *http.Request) {
+	region, ok := r.URL.Query()["region"]
+	if !ok {
+		writeJSON(w, http.StatusOK, allowedRegions)
+		return
+	}
+	check := &RegionCheck{Region: region[0]}
+	if check.Location, check.Valid = knownRegions[strings.ToLower(region[0])]; !check.Valid {
+		check.Suggestions = suggestRegions(region[0])
+	}
+	writeJSON(w, http.StatusOK, check)
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/config"
+	"go-slot-scheduler/internal/logging"
+)
+
+// liveConfig are the settings a reload applies without a restart: the caps,
+// the budgets and blackouts purchases are held to, how often schedules run
+// and the events notified. They are swapped whole, never changed in place.
+type liveConfig struct {
+	MaxSlots       int64
+	RegionMaxSlots map[string]int64
+	MaxMinutes     int64
+	// ClampMinutes shortens requests for more than MaxMinutes instead of
+	// rejecting them.
+	ClampMinutes     bool
+	CapFilter        capacity.Filter
+	Budgets          []budget
+	Blackouts        []*blackout
+	BlackoutAdmins   map[string]bool
+	ScheduleInterval time.Duration
+	NotifyEvents     map[string]bool
+}
+
+var liveSettings atomic.Pointer[liveConfig]
+
+// live returns the settings of the last load or reload.
+func live() *liveConfig {
+	return liveSettings.Load()
+}
+
+// reloadedSettings are the settings a reload applies, those of liveConfig
+// and of the notifiers and pagers. Others take a restart.
+var reloadedSettings = map[string]bool{
+	"MAX_SLOTS": true, "MAX_SLOTS_JSON": true, "MAX_MINUTES": true, "MAX_MINUTES_POLICY": true,
+	"CAP_PLANS": true, "CAP_STATES": true, "CAP_OWNED_ONLY": true,
+	"BUDGETS_JSON": true, "BLACKOUTS_JSON": true, "BLACKOUT_ADMINS": true,
+	"SCHEDULE_INTERVAL": true,
+	"NOTIFY_EVENTS":     true, "NOTIFIERS": true, "SLACK_WEBHOOK_URL": true,
+	"GOOGLE_CHAT_WEBHOOK_URL": true, "NOTIFY_PUBSUB_TOPIC": true,
+	"EMAIL_FROM": true, "EMAIL_TO": true, "SENDGRID_API_KEY": true,
+	"SMTP_ADDR": true, "SMTP_USERNAME": true, "SMTP_PASSWORD": true,
+	"PAGERDUTY_ROUTING_KEY": true, "OPSGENIE_API_KEY": true, "OPSGENIE_API_URL": true,
+}
+
+// ReloadResult lists the settings a reload changed, by name: those applied,
+// and those that only take effect on a restart.
+type ReloadResult struct {
+	Path            string   `json:"path,omitempty"`
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// Reload reads the config file and environment again, keeping the flags,
+// and applies the caps, budgets, blackouts, schedule interval and notifiers
+// they set. Nothing is applied if any of them is invalid. Requests in flight
+// carry on with the settings they read.
+func (s *Server) Reload(ctx context.Context) (*ReloadResult, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	prev := settings.Load()
+	next, err := prev.Reload()
+	if err != nil {
+		return nil, err
+	}
+	// The parsers read the settings through getenv, which nothing else
+	// calls once the service runs.
+	settings.Store(next)
+	l, n, pagers, err := parseReloaded(ctx)
+	if err != nil {
+		settings.Store(prev)
+		return nil, err
+	}
+
+	liveSettings.Store(l)
+	s.notifyMu.Lock()
+	s.notifier, s.pagers = n, pagers
+	s.notifyMu.Unlock()
+
+	res := &ReloadResult{Path: next.Path, Applied: []string{}, RestartRequired: []string{}}
+	for _, name := range config.Changed(prev, next) {
+		if reloadedSettings[name] {
+			res.Applied = append(res.Applied, name)
+		} else {
+			res.RestartRequired = append(res.RestartRequired, name)
+		}
+	}
+	logging.Info(ctx, "reloaded config, applied %v", res.Applied)
+	if len(res.RestartRequired) > 0 {
+		logging.Warning(ctx, "config changes of %s take a restart", strings.Join(res.RestartRequired, ", "))
+	}
+	return res, nil
+}
+
+// parseReloaded parses the settings a reload applies, and checks them
+// against those it doesn't.
+func parseReloaded(ctx context.Context) (*liveConfig, Notifier, []Pager, error) {
+	l, err := parseLiveConfig()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if autoscale.MaxHold > time.Duration(l.MaxMinutes)*time.Minute {
+		return nil, nil, nil, fmt.Errorf("AUTOSCALE_MAX_HOLD is longer than MAX_MINUTES")
+	}
+	for policy, a := range alertActions {
+		if a.Minutes > l.MaxMinutes {
+			return nil, nil, nil, fmt.Errorf("ALERT_ACTIONS: minutes of %q are more than MAX_MINUTES", policy)
+		}
+	}
+	for name, a := range cloudEventActions {
+		if a.Minutes > l.MaxMinutes {
+			return nil, nil, nil, fmt.Errorf("CLOUDEVENT_ACTIONS: minutes of %q are more than MAX_MINUTES", name)
+		}
+	}
+	n, err := newNotifier(ctx)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("creating notifier: %v", err)
+	}
+	return l, n, newPagers(), nil
+}
+
+// reloadHandler reloads the config, answering what changed.
+func (s *Server) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := s.Reload(r.Context())
+	if err != nil {
+		logging.Error(r.Context(), "reloading config: %v", err)
+		writeError(w, http.StatusUnprocessableEntity, codeInvalidConfig, "reloading config: %v, nothing was applied", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// requestIDHeader carries the ID tracing a request through the log, the
+// ledger, notifications and the tasks it schedules.
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID matches the request IDs accepted from callers, others are
+// replaced so they can't break log queries or task bodies.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:/-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// withRequestID gives each request an ID: the X-Request-ID it came with, or
+// a new one. It is sent back in the response header, and logging.Middleware
+// attaches it to the log entries of the request.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			var err error
+			if id, err = randomHex(16); err != nil {
+				writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+				return
+			}
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestIDOf returns the request ID ctx carries, "" if none.
+func requestIDOf(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequest continues the request id in ctx, such as the purchase that
+// scheduled a task in the task's handler. An empty id leaves ctx as is.
+func withRequest(ctx context.Context, id string) context.Context {
+	if id == "" || !validRequestID.MatchString(id) {
+		return ctx
+	}
+	return logging.WithFields(context.WithValue(ctx, requestIDKey{}, id), "request_id", id)
+}
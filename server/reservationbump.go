@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+)
+
+// CAPACITY_MODE values: adding capacity buys commitments, or bumps the
+// reservation BUMP_RESERVATION for the orgs on editions without any.
+const (
+	capacityModeCommitments = "commitments"
+	capacityModeReservation = "reservation"
+)
+
+// BUMP_TARGET values, what a bump raises by the slots asked for.
+const (
+	bumpTargetBaseline  = "baseline"
+	bumpTargetAutoscale = "autoscale"
+	bumpTargetBoth      = "both"
+)
+
+// bumpRevertPath is called by the task taking the slots of a bump back out.
+const bumpRevertPath = reservationsPath + "/bump/revert"
+
+// ReservationBump is the body of a revert task, the slots a bump added to
+// the baseline and autoscale max of Reservation. Key makes sure they are
+// taken out once.
+type ReservationBump struct {
+	Reservation string `json:"reservation"`
+	Baseline    int64  `json:"baseline,omitempty"`
+	Autoscale   int64  `json:"autoscale,omitempty"`
+	Key         string `json:"key"`
+}
+
+// bumpSlots returns the slots added to the baseline and to the autoscale
+// max for slots asked for, per BUMP_TARGET.
+func bumpSlots(slots int64) (baseline, autoscale int64) {
+	switch bumpTarget {
+	case bumpTargetAutoscale:
+		return 0, slots
+	case bumpTargetBoth:
+		return slots, slots
+	}
+	return slots, 0
+}
+
+// bumpReservation adds the slots of req to the reservation BUMP_RESERVATION
+// of its region instead of buying them, and schedules a task calling
+// revertURL to take them out again at req.DeleteAt. The reservation must
+// exist, and have an edition to bump its autoscale max. Each bump is undone
+// on its own, so overlapping bumps add up like commitments would.
+func (s *Server) bumpReservation(ctx context.Context, req purchaseRequest, revertURL string) (*AddCapacityResponse, error) {
+	if req.Project == "" {
+		req.Project = projectID
+	}
+	if err := s.checkBlackout(ctx, req); err != nil {
+		return nil, err
+	}
+	if err := s.checkFreeze(ctx, req); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("projects/%s/locations/%s/reservations/%s", req.Project, req.Region, bumpReservationID)
+	ctx = logging.WithFields(ctx, "reservation", name)
+	baseline, autoscale := bumpSlots(req.Slots)
+	resp := &AddCapacityResponse{
+		SlotsRequested: req.Slots,
+		SlotsPurchased: req.Slots,
+		DeleteAt:       &req.DeleteAt,
+		Reservation:    name,
+	}
+
+	unlock, err := s.store.Lock(ctx, "reservation/"+name, purchaseLockTTL)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for reservation lock: %v", err)
+	}
+	defer unlock()
+
+	var res *reservationpb.Reservation
+	err = retryPolicy.Do(ctx, "GetReservation", func(ctx context.Context) (err error) {
+		res, err = s.reservationsFor(name).GetReservation(ctx, &reservationpb.GetReservationRequest{Name: name})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	edition, as := editionFields(res)
+	if autoscale > 0 && edition == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "reservation %s has no edition, its autoscale max can't be bumped", name)
+	}
+	if req.DryRun || dryRun {
+		logging.Info(ctx, "dry run: would add %d slots to the baseline and %d to the autoscale max of %s until %s", baseline, autoscale, name, req.DeleteAt.Format(time.RFC3339))
+		resp.DryRun = true
+		return resp, nil
+	}
+
+	if _, err := s.addReservationSlots(ctx, res, as, baseline, autoscale); err != nil {
+		return nil, err
+	}
+	bump := ReservationBump{Reservation: name, Baseline: baseline, Autoscale: autoscale, Key: newBumpKey()}
+	taskName := s.queue.TaskName("bump-" + bump.Key)
+	task, err := s.queue.CreateHTTP(ctx, taskName, revertURL, req.Audience, bump, req.DeleteAt)
+	if err != nil {
+		// Never leave the slots added without a revert.
+		if _, rerr := s.addReservationSlots(ctx, res, as, 0, 0); rerr != nil {
+			logging.Error(ctx, "taking the bump of %s back out: %v", name, rerr)
+		}
+		return nil, fmt.Errorf("scheduling revert of %s: %v", name, err)
+	}
+	resp.RevertTask = task.Name
+
+	logging.Info(ctx, "added %d slots to the baseline and %d to the autoscale max of %s until %s", baseline, autoscale, name, req.DeleteAt.Format(time.RFC3339))
+	s.record(ctx, LedgerEntry{Action: actionReservationBumped, Region: req.Region, Reservation: name, Slots: req.Slots, DeleteAt: &req.DeleteAt, Requester: req.Requester, Caller: req.Caller, Reason: req.Reason, Ticket: req.Ticket})
+	return resp, nil
+}
+
+// addReservationSlots sets the baseline and autoscale max of res, as read
+// with as, to theirs plus baseline and autoscale.
+func (s *Server) addReservationSlots(ctx context.Context, res *reservationpb.Reservation, as *AutoscaleInfo, baseline, autoscale int64) (*reservationpb.Reservation, error) {
+	update := &reservationpb.Reservation{Name: res.Name, SlotCapacity: res.SlotCapacity + baseline}
+	mask := &fieldmaskpb.FieldMask{Paths: []string{"slot_capacity"}}
+	if as != nil || autoscale > 0 {
+		max := autoscale
+		if as != nil {
+			max += as.MaxSlots
+		}
+		setEditionFields(update, "", &max)
+		mask.Paths = append(mask.Paths, "autoscale.max_slots")
+	}
+	return s.updateReservation(ctx, update, mask)
+}
+
+// newBumpKey returns a key unique to a bump.
+func newBumpKey() string {
+	return hashKey(fmt.Sprintf("%d", time.Now().UnixNano()))[:20]
+}
+
+// bumpRevertHandler takes the slots of a bump back out of its reservation,
+// once even if the task is retried, never going under zero. A reservation
+// deleted since is left alone.
+func (s *Server) bumpRevertHandler(w http.ResponseWriter, r *http.Request) {
+	var b ReservationBump
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+	ctx := logging.WithFields(r.Context(), "reservation", b.Reservation)
+
+	if err := s.revertBump(ctx, b); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(ctx, "reverting bump: %v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, "bump reverted")
+}
+
+func (s *Server) revertBump(ctx context.Context, b ReservationBump) error {
+	unlock, err := s.store.Lock(ctx, "reservation/"+b.Reservation, purchaseLockTTL)
+	if err != nil {
+		return fmt.Errorf("waiting for reservation lock: %v", err)
+	}
+	defer unlock()
+
+	var res *reservationpb.Reservation
+	err = retryPolicy.Do(ctx, "GetReservation", func(ctx context.Context) (err error) {
+		res, err = s.reservationsFor(b.Reservation).GetReservation(ctx, &reservationpb.GetReservationRequest{Name: b.Reservation})
+		return err
+	})
+	if status.Code(err) == codes.NotFound {
+		logging.Warning(ctx, "reservation %s was deleted before its bump was reverted", b.Reservation)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	key := "bump/" + b.Key
+	_, fresh, err := s.store.ReserveIdempotencyKey(ctx, key, "", idempotencyTTL)
+	if err != nil || !fresh {
+		return err
+	}
+	_, as := editionFields(res)
+	baseline, autoscale := b.Baseline, b.Autoscale
+	if baseline > res.SlotCapacity {
+		baseline = res.SlotCapacity
+	}
+	if as == nil {
+		autoscale = 0
+	} else if autoscale > as.MaxSlots {
+		autoscale = as.MaxSlots
+	}
+	if _, err := s.addReservationSlots(ctx, res, as, -baseline, -autoscale); err != nil {
+		if err := s.store.ReleaseIdempotencyKey(ctx, key); err != nil {
+			logging.Error(ctx, "releasing key of bump revert: %v", err)
+		}
+		return err
+	}
+	logging.Info(ctx, "took %d slots out of the baseline and %d out of the autoscale max of %s", baseline, autoscale, b.Reservation)
+	s.record(ctx, LedgerEntry{Action: actionReservationReverted, Region: capacity.Region(b.Reservation), Reservation: b.Reservation, Slots: baseline + autoscale, Requester: requesterReservationBump})
+	return nil
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/api/iterator"
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+)
+
+// ReservationInfo is a reservation as reported by the reservation endpoints.
+type ReservationInfo struct {
+	Name            string           `json:"name"`
+	Region          string           `json:"region"`
+	SlotCapacity    int64            `json:"slot_capacity"`
+	IgnoreIdleSlots bool             `json:"ignore_idle_slots"`
+	Assignments     []AssignmentInfo `json:"assignments"`
+	// Edition is STANDARD, ENTERPRISE or ENTERPRISE_PLUS, empty for the
+	// reservations of the flat-rate model.
+	Edition   string         `json:"edition,omitempty"`
+	Autoscale *AutoscaleInfo `json:"autoscale,omitempty"`
+}
+
+// AssignmentInfo is an assignment of a project, folder or organization to a
+// reservation.
+type AssignmentInfo struct {
+	Name        string `json:"name"`
+	Reservation string `json:"reservation"`
+	Assignee    string `json:"assignee"`
+	JobType     string `json:"job_type"`
+	State       string `json:"state"`
+}
+
+// ReservationRequest creates a reservation, or with PATCH changes the fields
+// that are set. With an Edition, SlotCapacity is the baseline and
+// AutoscaleMaxSlots the slots added on top as queries need them.
+type ReservationRequest struct {
+	Region            string `json:"region"`
+	ID                string `json:"id"`
+	SlotCapacity      *int64 `json:"slot_capacity"`
+	IgnoreIdleSlots   *bool  `json:"ignore_idle_slots"`
+	Edition           string `json:"edition,omitempty"`
+	AutoscaleMaxSlots *int64 `json:"autoscale_max_slots,omitempty"`
+}
+
+func reservationInfo(r *reservationpb.Reservation) ReservationInfo {
+	info := ReservationInfo{
+		Name:            r.Name,
+		Region:          capacity.Region(r.Name),
+		SlotCapacity:    r.SlotCapacity,
+		IgnoreIdleSlots: r.IgnoreIdleSlots,
+		Assignments:     []AssignmentInfo{},
+	}
+	info.Edition, info.Autoscale = editionFields(r)
+	return info
+}
+
+func assignmentInfo(reservation string, a *reservationpb.Assignment) AssignmentInfo {
+	return AssignmentInfo{
+		Name:        a.Name,
+		Reservation: reservation,
+		Assignee:    a.Assignee,
+		JobType:     a.JobType.String(),
+		State:       a.State.String(),
+	}
+}
+
+// reservationName is the resource name of reservation id in region.
+func reservationName(region, id string) string {
+	return fmt.Sprintf("projects/%s/locations/%s/reservations/%s", projectID, region, id)
+}
+
+// listReservationsHandler lists the reservations of the region query
+// parameter, or of every configured region, with their assignments.
+func (s *Server) listReservationsHandler(w http.ResponseWriter, r *http.Request) {
+	listRegions := regions
+	if region := r.URL.Query().Get("region"); region != "" {
+		var v validator
+		v.region("region", &region)
+		if err := v.err(); err != nil {
+			writeValidationError(w, err)
+			return
+		}
+		listRegions = []string{region}
+	}
+
+	list := []ReservationInfo{}
+	for _, region := range listRegions {
+		parent := fmt.Sprintf("projects/%s/locations/%s", projectID, region)
+		reservations, err := s.listReservations(r.Context(), parent)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternal, "listing reservations in %s: %v", region, err)
+			logging.Error(r.Context(), "%v", err)
+			return
+		}
+		for _, res := range reservations {
+			info := reservationInfo(res)
+			if info.Assignments, err = s.listAssignments(r.Context(), res.Name); err != nil {
+				writeError(w, http.StatusInternalServerError, codeInternal, "listing assignments of %s: %v", res.Name, err)
+				logging.Error(r.Context(), "%v", err)
+				return
+			}
+			list = append(list, info)
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) getReservationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var res *reservationpb.Reservation
+	err := retryPolicy.Do(r.Context(), "GetReservation", func(ctx context.Context) (err error) {
+		res, err = s.reservations.GetReservation(ctx, &reservationpb.GetReservationRequest{Name: reservationName(vars["region"], vars["id"])})
+		return err
+	})
+	if err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+
+	info := reservationInfo(res)
+	if info.Assignments, err = s.listAssignments(r.Context(), res.Name); err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (s *Server) createReservationHandler(w http.ResponseWriter, r *http.Request) {
+	var req ReservationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	var v validator
+	v.region("region", &req.Region)
+	v.check(req.ID != "", "id", "required")
+	req.validateEditionFields(&v)
+	v.check(req.AutoscaleMaxSlots == nil || req.Edition != "", "autoscale_max_slots", "needs an edition")
+	if err := v.err(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	res := &reservationpb.Reservation{}
+	if req.SlotCapacity != nil {
+		res.SlotCapacity = *req.SlotCapacity
+	}
+	if req.IgnoreIdleSlots != nil {
+		res.IgnoreIdleSlots = *req.IgnoreIdleSlots
+	}
+	setEditionFields(res, req.Edition, req.AutoscaleMaxSlots)
+
+	// A reservation ID can only be taken once, so creation isn't retried.
+	res, err := s.reservations.CreateReservation(r.Context(), &reservationpb.CreateReservationRequest{
+		Parent:        fmt.Sprintf("projects/%s/locations/%s", projectID, req.Region),
+		ReservationId: req.ID,
+		Reservation:   res,
+	})
+	if err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+	logging.Info(r.Context(), "reservation %s created with %d slots", res.Name, res.SlotCapacity)
+	writeJSON(w, http.StatusCreated, reservationInfo(res))
+}
+
+func (s *Server) updateReservationHandler(w http.ResponseWriter, r *http.Request) {
+	var req ReservationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	var v validator
+	req.validateEditionFields(&v)
+	if err := v.err(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	vars := mux.Vars(r)
+	res := &reservationpb.Reservation{Name: reservationName(vars["region"], vars["id"])}
+	mask := &fieldmaskpb.FieldMask{}
+	if req.SlotCapacity != nil {
+		res.SlotCapacity = *req.SlotCapacity
+		mask.Paths = append(mask.Paths, "slot_capacity")
+	}
+	if req.IgnoreIdleSlots != nil {
+		res.IgnoreIdleSlots = *req.IgnoreIdleSlots
+		mask.Paths = append(mask.Paths, "ignore_idle_slots")
+	}
+	setEditionFields(res, req.Edition, req.AutoscaleMaxSlots)
+	if req.Edition != "" {
+		mask.Paths = append(mask.Paths, "edition")
+	}
+	if req.AutoscaleMaxSlots != nil {
+		mask.Paths = append(mask.Paths, "autoscale.max_slots")
+	}
+	if len(mask.Paths) == 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "provide slot_capacity, ignore_idle_slots, edition or autoscale_max_slots")
+		return
+	}
+
+	res, err := s.updateReservation(r.Context(), res, mask)
+	if err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+	logging.Info(r.Context(), "reservation %s updated: %v", res.Name, mask.Paths)
+	writeJSON(w, http.StatusOK, reservationInfo(res))
+}
+
+func (s *Server) deleteReservationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := reservationName(vars["region"], vars["id"])
+	err := retryPolicy.Do(r.Context(), "DeleteReservation", func(ctx context.Context) error {
+		return s.reservationsFor(name).DeleteReservation(ctx, &reservationpb.DeleteReservationRequest{Name: name})
+	})
+	if err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+	logging.Info(r.Context(), "reservation %s deleted", name)
+	writeJSON(w, http.StatusOK, "reservation deleted")
+}
+
+// writeReservationError maps reservation API errors the caller can act on to
+// their HTTP status.
+func writeReservationError(w http.ResponseWriter, r *http.Request, err error) {
+	switch status.Code(err) {
+	case codes.NotFound:
+		writeError(w, http.StatusNotFound, codeNotFound, "%v", err)
+	case codes.AlreadyExists:
+		writeError(w, http.StatusConflict, codeAlreadyExists, "%v", err)
+	case codes.InvalidArgument, codes.FailedPrecondition:
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+	default:
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+	}
+}
+
+func (s *Server) updateReservation(ctx context.Context, res *reservationpb.Reservation, mask *fieldmaskpb.FieldMask) (updated *reservationpb.Reservation, err error) {
+	err = retryPolicy.Do(ctx, "UpdateReservation", func(ctx context.Context) error {
+		updated, err = s.reservationsFor(res.Name).UpdateReservation(ctx, &reservationpb.UpdateReservationRequest{Reservation: res, UpdateMask: mask})
+		return err
+	})
+	return updated, err
+}
+
+func (s *Server) listReservations(ctx context.Context, parent string) (list []*reservationpb.Reservation, err error) {
+	err = retryPolicy.Do(ctx, "ListReservations", func(ctx context.Context) error {
+		list = nil
+		it := s.reservationsFor(parent).ListReservations(ctx, &reservationpb.ListReservationsRequest{Parent: parent})
+		for {
+			res, err := it.Next()
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			list = append(list, res)
+		}
+	})
+	return list, err
+}
+
+func (s *Server) listAssignments(ctx context.Context, reservation string) (list []AssignmentInfo, err error) {
+	err = retryPolicy.Do(ctx, "ListAssignments", func(ctx context.Context) error {
+		list = []AssignmentInfo{}
+		it := s.reservationsFor(reservation).ListAssignments(ctx, &reservationpb.ListAssignmentsRequest{Parent: reservation})
+		for {
+			a, err := it.Next()
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			list = append(list, assignmentInfo(reservation, a))
+		}
+	})
+	return list, err
+}
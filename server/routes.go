@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/internal/tracing"
+)
+
+// Handler routes the API. Every request is traced and its log entries carry
+// its request and trace IDs.
+func (s *Server) Handler() http.Handler {
+	return tracing.Handler(s.router())
+}
+
+// router routes the requests of the API to the handlers of s.
+func (s *Server) router() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(withRequestID, logging.Middleware, accessLog, limitResponses, recoverPanics, s.audit, withAPIVersion, withTimeout)
+
+	// Callers need a role with AUTH_ROLES_JSON or API_KEYS_JSON: readers
+	// list and report, operators buy and change, admins delete and cancel.
+	read := func(h http.HandlerFunc) http.HandlerFunc { return authorize(roleReader, h) }
+	operate := func(h http.HandlerFunc) http.HandlerFunc { return authorize(roleOperator, h) }
+	admin := func(h http.HandlerFunc) http.HandlerFunc { return authorize(roleAdmin, h) }
+
+	// The API is served under /v1. Its unversioned routes are kept as
+	// deprecated aliases, those renamed under /v1 are registered apart.
+	v1 := r.PathPrefix(v1Prefix).Subrouter()
+	api := func(path string, h http.HandlerFunc, method string) {
+		v1.HandleFunc(path, h).Methods(method)
+		r.HandleFunc(path, deprecated("", h)).Methods(method)
+	}
+	v1.HandleFunc(capacityPath, read(s.capacitySummaryHandler)).Methods("GET")
+	v1.HandleFunc(capacityPath, operate(s.async(s.addCapacityHandler))).Methods("POST")
+	v1.HandleFunc(capacityPath, operate(s.needsReservationAPI(s.async(s.scaleToHandler)))).Methods("PUT")
+	v1.HandleFunc(capacityBatchPath, operate(s.async(s.addCapacityBatchHandler))).Methods("POST")
+	v1.HandleFunc(mergeCommitmentsPath, operate(s.needsReservationAPI(s.mergeHandler))).Methods("POST")
+	v1.HandleFunc(commitmentPath+"/extend", operate(s.extendCommitmentHandler)).Methods("POST")
+	v1.HandleFunc(commitmentPath, operate(s.deleteCommitmentHandler)).Methods("DELETE")
+	v1.HandleFunc(commitmentPath+"/deletion", admin(s.cancelCommitmentDeleteHandler)).Methods("DELETE")
+	v1.HandleFunc(burstsPath, operate(s.needsReservationAPI(s.async(s.burstHandler)))).Methods("POST")
+	v1.HandleFunc(operationsPath+"/{id}", read(s.getOperationHandler)).Methods("GET")
+	v1.HandleFunc(freezePath, read(s.getFreezeHandler)).Methods("GET")
+	v1.HandleFunc(freezePath, admin(s.liftFreezeHandler)).Methods("DELETE")
+	v1.HandleFunc(purgePath, admin(s.purgeHandler)).Methods("POST")
+	r.HandleFunc(addCapacityPath, deprecated(v1Prefix+capacityPath, operate(s.async(s.addCapacityHandler)))).Methods("POST")
+	r.HandleFunc(scaleToPath, deprecated(v1Prefix+capacityPath, operate(s.needsReservationAPI(s.async(s.scaleToHandler))))).Methods("POST")
+	r.HandleFunc(mergePath, deprecated(v1Prefix+mergeCommitmentsPath, operate(s.needsReservationAPI(s.mergeHandler)))).Methods("POST")
+	r.HandleFunc(extendCapacityPath, deprecated(v1Prefix+commitmentsPath, operate(s.extendCapacityHandler))).Methods("POST")
+	r.HandleFunc(cancelDeletePath, deprecated(v1Prefix+commitmentsPath, admin(s.cancelDeleteHandler))).Methods("POST")
+	r.HandleFunc(burstPath, deprecated(v1Prefix+burstsPath, operate(s.needsReservationAPI(s.async(s.burstHandler))))).Methods("POST")
+
+	api(commitmentsPath, read(s.listCommitmentsHandler), "GET")
+	api(reconcilePath, operate(s.reconcileHandler), "POST")
+	api(watchdogPath, operate(s.watchdogHandler), "POST")
+	api(schedulesPath, read(s.listSchedulesHandler), "GET")
+	api(schedulesPath, operate(s.createScheduleHandler), "POST")
+	api(schedulesPath+"/run", operate(s.runSchedulesHandler), "POST")
+	api(schedulesPath+"/{id}", read(s.getScheduleHandler), "GET")
+	api(schedulesPath+"/{id}", operate(s.updateScheduleHandler), "PUT")
+	api(schedulesPath+"/{id}", admin(s.deleteScheduleHandler), "DELETE")
+	api(schedulesPath+"/{id}/run", operate(s.runScheduleHandler), "POST")
+	api(profilesPath, read(s.listProfilesHandler), "GET")
+	api(profilesPath, operate(s.createProfileHandler), "POST")
+	api(profilesPath+"/run", operate(s.runProfilesHandler), "POST")
+	api(profilesPath+"/{id}", read(s.getProfileHandler), "GET")
+	api(profilesPath+"/{id}", operate(s.updateProfileHandler), "PUT")
+	api(profilesPath+"/{id}", admin(s.deleteProfileHandler), "DELETE")
+	api(applyPath, operate(s.applyHandler), "POST")
+	api(driftPath, read(s.driftHandler), "GET")
+	api(groupsPath+"/{id}", read(s.getGroupHandler), "GET")
+	api(groupsPath+"/{id}", admin(s.releaseGroupHandler), "DELETE")
+	api(reservationsPath, read(s.needsReservationAPI(s.listReservationsHandler)), "GET")
+	api(reservationsPath, operate(s.needsReservationAPI(s.createReservationHandler)), "POST")
+	api(reservationsPath+"/{region}/{id}", read(s.needsReservationAPI(s.getReservationHandler)), "GET")
+	api(reservationsPath+"/{region}/{id}", operate(s.needsReservationAPI(s.updateReservationHandler)), "PATCH")
+	api(reservationsPath+"/{region}/{id}", admin(s.needsReservationAPI(s.deleteReservationHandler)), "DELETE")
+	api(reservationsPath+"/{region}/{id}/autoscale", operate(s.needsReservationAPI(s.bumpAutoscaleHandler)), "POST")
+	api(reservationsPath+"/{region}/{id}/ignore_idle_slots", operate(s.needsReservationAPI(s.idleSlotsWindowHandler)), "POST")
+	api(assignmentsPath, operate(s.needsReservationAPI(s.createAssignmentHandler)), "POST")
+	api(assignmentsPath+"/move", operate(s.needsReservationAPI(s.moveAssignmentHandler)), "POST")
+	api(assignmentsPath+"/resolve", read(s.needsReservationAPI(s.resolveAssignmentHandler)), "GET")
+	api(assignmentsPath+"/{region}/{reservation}/{id}", admin(s.needsReservationAPI(s.deleteAssignmentHandler)), "DELETE")
+	api(costPath, read(s.costHandler), "GET")
+	api(recommendationsPath, read(s.needsReservationAPI(s.recommendationsHandler)), "GET")
+	api(simulatePath, read(s.needsReservationAPI(s.simulateHandler)), "POST")
+	api(regionsPath, read(s.regionsHandler), "GET")
+	api(historyPath, read(s.historyHandler), "GET")
+	api(eventsPath, read(s.eventsHandler), "GET")
+	api(preflightPath, admin(s.preflightHandler), "GET")
+	api(reloadPath, admin(s.reloadHandler), "POST")
+	api(configPath, operate(s.configHandler), "GET")
+	r.HandleFunc(uiPath, read(s.uiHandler)).Methods("GET")
+	r.HandleFunc(uiPath+addCapacityPath, operate(uiAction(s.addCapacityHandler))).Methods("POST")
+	r.HandleFunc(uiPath+extendCapacityPath, operate(uiAction(s.extendCapacityHandler))).Methods("POST")
+	r.HandleFunc(uiPath+cancelDeletePath, admin(uiAction(s.cancelDeleteHandler))).Methods("POST")
+
+	// Called by Cloud Tasks, Pub/Sub, alerting, Eventarc and Slack, which
+	// prove who they are their own way. Webhooks are only served once there
+	// is a way to verify their callers, and refuse them all otherwise.
+	v1.Handle(deleteCommitmentPath, requireTasksOIDC(http.HandlerFunc(s.deleteCapacityHandler))).Methods("POST")
+	r.Handle(deleteCapacityPath, requireTasksOIDC(deprecated(v1Prefix+deleteCommitmentPath, s.deleteCapacityHandler))).Methods("POST")
+	r.Handle(burstPath+"/teardown", requireTasksOIDC(http.HandlerFunc(s.burstTeardownHandler))).Methods("POST")
+	r.Handle(autoscaleRevertPath, requireTasksOIDC(http.HandlerFunc(s.autoscaleRevertHandler))).Methods("POST")
+	r.Handle(bumpRevertPath, requireTasksOIDC(http.HandlerFunc(s.bumpRevertHandler))).Methods("POST")
+	r.Handle(idleSlotsRevertPath, requireTasksOIDC(http.HandlerFunc(s.idleSlotsRevertHandler))).Methods("POST")
+	r.Handle(assignmentMoveBackPath, requireTasksOIDC(http.HandlerFunc(s.assignmentMoveBackHandler))).Methods("POST")
+	if alertToken != "" {
+		r.HandleFunc(scaleOnAlertPath, s.scaleOnAlertHandler).Methods("POST")
+	}
+	if pushVerified() {
+		r.HandleFunc(pubsubPushPath, s.pubsubPushHandler).Methods("POST")
+		r.HandleFunc(billingPushPath, s.budgetPushHandler).Methods("POST")
+		r.HandleFunc(taskPushPath, s.taskPushHandler).Methods("POST")
+	}
+	if eventarcServiceAcct != "" {
+		r.HandleFunc(cloudEventsPath+"/{action}", s.cloudEventHandler).Methods("POST")
+	}
+	if slackSigningSecret != "" {
+		r.HandleFunc(slackCommandPath, s.slackCommandHandler).Methods("POST")
+	}
+	r.HandleFunc("/healthz", s.healthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", s.readyzHandler).Methods("GET")
+	r.HandleFunc(metricsPath, s.metricsHandler).Methods("GET")
+	r.HandleFunc(openAPIPath, openAPIHandler).Methods("GET")
+
+	return r
+}
+
+// Start runs the background loops turned on by the configuration until ctx
+// is done.
+func (s *Server) Start(ctx context.Context) {
+	if s.timer != nil {
+		// Deletions pending when the last process stopped
+		if n, err := s.timer.Load(ctx); err != nil {
+			logging.Error(ctx, "reloading pending tasks: %v", err)
+		} else {
+			logging.Info(ctx, "reloaded %d pending tasks", n)
+		}
+	}
+	if reconcileInterval > 0 {
+		go s.runReconciler(ctx, reconcileInterval)
+	}
+	if watchdogInterval > 0 {
+		go s.runWatchdog(ctx, watchdogInterval)
+	}
+	if queueCheckInterval > 0 && s.tasks != nil {
+		go s.runQueueMonitor(ctx, queueCheckInterval)
+	}
+	go s.runScheduler(ctx)
+	if profileInterval > 0 {
+		go s.runProfiler(ctx, profileInterval)
+	}
+	if desiredStateURL != "" {
+		go s.runGitOps(ctx, desiredStateInterval)
+	}
+	if driftInterval > 0 {
+		go s.runDriftDetector(ctx, driftInterval)
+	}
+	if s.fakeTasks != nil {
+		go s.fakeTasks.Run(ctx, http.DefaultClient, fakeDispatchInterval)
+		// Merging and autoscaling need the reservation and BigQuery APIs.
+		return
+	}
+	if mergeInterval > 0 {
+		go s.runMerger(ctx, mergeInterval)
+	}
+	if autoscale.Interval > 0 {
+		go s.runAutoscaler(ctx, autoscale)
+	}
+}
+
+// Addr is the address to listen on, from PORT.
+func Addr() string {
+	return ":" + port
+}
+
+// ShutdownTimeout is how long the server drains on SIGTERM, from
+// SHUTDOWN_TIMEOUT.
+func ShutdownTimeout() time.Duration {
+	return shutdownTimeout
+}
+
+// InitTracing exports a TRACE_SAMPLE_RATIO share of traces to Cloud Trace.
+// The returned func flushes pending spans.
+func InitTracing(ctx context.Context) (func(context.Context) error, error) {
+	if traceSampleRatio == 0 {
+		return func(context.Context) error { return nil }, nil
+	}
+	return tracing.Init(ctx, projectID, traceSampleRatio)
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+)
+
+// slotIncrement is the granularity of FLEX commitments, which are bought and
+// split in multiples of 100 slots.
+const slotIncrement = 100
+
+// ScaleTo asks for the committed slots of a region to be brought to
+// TargetSlots. Minutes is how long added capacity is kept.
+type ScaleTo struct {
+	Project     string `json:"project,omitempty"` // admin project, default GOOGLE_CLOUD_PROJECT
+	Region      string `json:"region"`
+	TargetSlots int64  `json:"target_slots"`
+	Minutes     int64  `json:"minutes"`
+	RequestMetadata
+}
+
+// ScaleToResponse describes what scaleToHandler did to reach the target.
+// The slots counted are those of ACTIVE commitments, of which
+// SlotsUnreleasable were not bought by the service as FLEX and can't be
+// released by it.
+type ScaleToResponse struct {
+	Project           string               `json:"project"`
+	Region            string               `json:"region"`
+	TargetSlots       int64                `json:"target_slots"`
+	SlotsBefore       int64                `json:"slots_before"`
+	SlotsAfter        int64                `json:"slots_after"`
+	SlotsUnreleasable int64                `json:"slots_unreleasable"`
+	Purchased         *AddCapacityResponse `json:"purchased,omitempty"`
+	Released          []ReleasedSlots      `json:"released"`
+	TargetReached     bool                 `json:"target_reached"`
+}
+
+// ReleasedSlots is capacity removed from a commitment, either all of it or a
+// piece split off it.
+type ReleasedSlots struct {
+	Commitment string `json:"commitment"`
+	Slots      int64  `json:"slots"`
+	Split      bool   `json:"split"`
+}
+
+func (s *Server) scaleToHandler(w http.ResponseWriter, r *http.Request) {
+	var req ScaleTo
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	var v validator
+	v.region("region", &req.Region)
+	if req.Project == "" {
+		req.Project = projectID
+	}
+	v.check(validAdminProject(req.Project), "project", "%q is not an admin project of the service", req.Project)
+	v.check(req.TargetSlots >= 0 && req.TargetSlots%slotIncrement == 0, "target_slots", "must be a multiple of %d, zero or more", slotIncrement)
+	v.minutes("minutes", &req.Minutes)
+	req.RequestMetadata.validate(&v)
+	if err := v.err(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	r = r.WithContext(logging.WithFields(r.Context(), "project", req.Project, "region", req.Region, "target_slots", req.TargetSlots))
+
+	who, caller := req.who(r)
+	resp, err := s.scaleTo(r.Context(), req, purchaseRequest{
+		Project:   req.Project,
+		DeleteURL: deleteURL(r),
+		Audience:  deleteAudience(r),
+		Requester: who,
+		Caller:    caller,
+		Reason:    req.Reason,
+		Ticket:    req.Ticket,
+	})
+	if err != nil {
+		writePurchaseError(w, err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// scaleTo buys the missing slots when the ACTIVE commitments of the region
+// are below the target, or releases FLEX commitments bought by the service,
+// newest first, when they are above. Capacity the service didn't buy is never
+// released, so the target may not be reached. base supplies the delete
+// callback and requester of a purchase.
+func (s *Server) scaleTo(ctx context.Context, req ScaleTo, base purchaseRequest) (*ScaleToResponse, error) {
+	if req.Project == "" {
+		req.Project = projectID
+	}
+	parent := capacity.Parent(req.Project, req.Region)
+	unlock, err := s.store.Lock(ctx, "scale_to/"+parent, purchaseLockTTL)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for scale lock: %v", err)
+	}
+	defer unlock()
+
+	commitments, err := s.capacity.List(ctx, parent)
+	if err != nil {
+		return nil, fmt.Errorf("listing commitments: %v", err)
+	}
+	recs, err := s.store.ListCommitments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing recorded commitments: %v", err)
+	}
+	owned := make(map[string]bool, len(recs))
+	for _, rec := range recs {
+		owned[rec.Name] = true
+	}
+	var committed, unreleasable int64
+	for _, c := range commitments {
+		if c.State != reservationpb.CapacityCommitment_ACTIVE {
+			continue
+		}
+		committed += c.SlotCount
+		if !owned[c.Name] || c.Plan != reservationpb.CapacityCommitment_FLEX {
+			unreleasable += c.SlotCount
+		}
+	}
+
+	resp := &ScaleToResponse{Project: req.Project, Region: req.Region, TargetSlots: req.TargetSlots, SlotsBefore: committed, SlotsAfter: committed, SlotsUnreleasable: unreleasable, Released: []ReleasedSlots{}}
+	switch {
+	case req.TargetSlots > committed:
+		// Round up, falling short of the target is worse than overshooting it.
+		delta := (req.TargetSlots - committed + slotIncrement - 1) / slotIncrement * slotIncrement
+		base.Project = req.Project
+		base.Region = req.Region
+		base.Slots = delta
+		base.Plan = reservationpb.CapacityCommitment_FLEX
+		base.DeleteAt = time.Now().Add(time.Duration(req.Minutes) * time.Minute)
+		logging.Info(ctx, "%s has %d slots, buying %d to reach %d", req.Region, committed, delta, req.TargetSlots)
+		purchased, err := s.purchase(ctx, base)
+		if errors.Is(err, capacity.ErrMaxSlots) {
+			logging.Warning(ctx, "%v", err)
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		resp.Purchased = purchased
+		resp.SlotsAfter += purchased.SlotsPurchased
+
+	case req.TargetSlots < committed:
+		// Round down, never release more than asked, nor capacity the
+		// service can't release.
+		excess := min(committed-req.TargetSlots, committed-unreleasable) / slotIncrement * slotIncrement
+		if excess == 0 {
+			logging.Info(ctx, "%s has %d slots, %d of which can't be released, above %d", req.Region, committed, unreleasable, req.TargetSlots)
+			break
+		}
+		logging.Info(ctx, "%s has %d slots, releasing %d to reach %d", req.Region, committed, excess, req.TargetSlots)
+		released, err := s.releaseOwned(ctx, req.Project, req.Region, excess, base.Requester)
+		resp.Released = released
+		for _, rel := range released {
+			resp.SlotsAfter -= rel.Slots
+		}
+		if err != nil {
+			return resp, err
+		}
+	}
+
+	resp.TargetReached = resp.SlotsAfter >= req.TargetSlots && resp.SlotsAfter-req.TargetSlots < slotIncrement
+	return resp, nil
+}
+
+// releaseOwned releases up to slots of the FLEX commitments bought by the
+// service in region of project, newest first, splitting a commitment when
+// only part of it is to go.
+func (s *Server) releaseOwned(ctx context.Context, project, region string, slots int64, requester string) ([]ReleasedSlots, error) {
+	recs, err := s.store.ListCommitments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing recorded commitments: %v", err)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].CreatedAt.After(recs[j].CreatedAt) })
+
+	released := []ReleasedSlots{}
+	for _, rec := range recs {
+		if slots < slotIncrement {
+			break
+		}
+		if rec.Region != region || resourceProject(rec.Name) != project || rec.Plan != reservationpb.CapacityCommitment_FLEX.String() {
+			continue
+		}
+		if time.Since(rec.CreatedAt) < capacity.FlexMinDuration {
+			continue
+		}
+		if rec.SlotCount > slots && rec.SlotCount-slots < slotIncrement {
+			continue
+		}
+
+		rel, err := s.releaseSlots(ctx, rec, min(slots, rec.SlotCount), requester, true)
+		if err != nil {
+			return released, err
+		}
+		released = append(released, *rel)
+		slots -= rel.Slots
+	}
+	return released, nil
+}
+
+// releaseSlots deletes slots of the commitment of rec: the whole commitment,
+// or a piece split off it which keeps the rest and its scheduled deletion.
+// The record of the commitment is only updated if it is owned, that is
+// bought by the service.
+func (s *Server) releaseSlots(ctx context.Context, rec *CommitmentRecord, slots int64, requester string, owned bool) (*ReleasedSlots, error) {
+	ctx = logging.WithFields(ctx, "commit", rec.Name, "slots", rec.SlotCount)
+	if dryRun {
+		rel := &ReleasedSlots{Commitment: rec.Name, Slots: min(slots, rec.SlotCount), Split: slots < rec.SlotCount}
+		logging.Info(ctx, "dry run: would release %d slots of %s", rel.Slots, rec.Name)
+		return rel, nil
+	}
+	if slots >= rec.SlotCount {
+		if err := s.deleteCapacity(ctx, rec.Name); err != nil {
+			s.record(ctx, LedgerEntry{Action: actionDeleteFailed, Commitment: rec.Name, Slots: rec.SlotCount, Requester: requester, Error: err.Error(), Owned: owned})
+			return nil, err
+		}
+		s.record(ctx, LedgerEntry{Action: actionDeleted, Commitment: rec.Name, Slots: rec.SlotCount, Requester: requester, Owned: owned})
+		s.dropDeleteTask(ctx, rec.Name)
+		return &ReleasedSlots{Commitment: rec.Name, Slots: rec.SlotCount}, nil
+	}
+
+	// Splits aren't idempotent, so they aren't retried.
+	split, err := s.reservationsFor(rec.Name).SplitCapacityCommitment(ctx, &reservationpb.SplitCapacityCommitmentRequest{
+		Name:      rec.Name,
+		SlotCount: rec.SlotCount - slots,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("splitting %d slots off %s: %v", slots, rec.Name, err)
+	}
+	piece := split.Second
+	logging.Info(ctx, "split %s into %d slots and %s of %d slots", rec.Name, split.First.SlotCount, piece.Name, piece.SlotCount)
+	s.record(ctx, LedgerEntry{Action: actionSplit, Commitment: rec.Name, Slots: piece.SlotCount, Requester: requester, Reason: "split off " + piece.Name, Owned: owned})
+
+	if owned {
+		kept := *rec
+		kept.SlotCount = split.First.SlotCount
+		if err := s.store.PutCommitment(ctx, &kept); err != nil {
+			logging.Error(ctx, "recording split of %s: %v", rec.Name, err)
+		}
+	}
+
+	if err := s.deleteCapacity(ctx, piece.Name); err != nil {
+		// Keep track of the piece, so the reconciler deletes it with the
+		// rest of the commitment.
+		if owned {
+			orphan := *rec
+			orphan.Name, orphan.SlotCount = piece.Name, piece.SlotCount
+			if perr := s.store.PutCommitment(ctx, &orphan); perr != nil {
+				logging.Error(ctx, "recording split off commitment %s: %v", piece.Name, perr)
+			}
+		}
+		s.record(ctx, LedgerEntry{Action: actionDeleteFailed, Commitment: piece.Name, Slots: piece.SlotCount, Requester: requester, Error: err.Error(), Owned: owned})
+		return nil, err
+	}
+	s.record(ctx, LedgerEntry{Action: actionDeleted, Commitment: piece.Name, Slots: piece.SlotCount, Requester: requester, Owned: owned})
+	return &ReleasedSlots{Commitment: rec.Name, Slots: piece.SlotCount, Split: true}, nil
+}
+
+// deleteSlots splits c.Slots off the commitment c.CommitID and deletes them.
+// It reports false, having written nothing, when the whole commitment is to
+// be deleted instead, which only admins may do.
+func (s *Server) deleteSlots(w http.ResponseWriter, r *http.Request, c Commit) bool {
+	if c.Slots%slotIncrement != 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "slots must be a multiple of %d", slotIncrement)
+		return true
+	}
+
+	commit, err := s.capacity.Get(r.Context(), c.CommitID)
+	if status.Code(err) == codes.NotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, "commitment %s not found", c.CommitID)
+		return true
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "getting %s: %v", c.CommitID, err)
+		logging.Error(r.Context(), "%v", err)
+		return true
+	}
+	if c.Slots >= commit.SlotCount {
+		if !hasRole(r, roleAdmin) {
+			writeError(w, http.StatusForbidden, codeForbidden, "%s has %d slots, deleting all of them needs the admin role", c.CommitID, commit.SlotCount)
+			return true
+		}
+		return false
+	}
+	if s.reservationsFor(c.CommitID) == nil {
+		writeError(w, http.StatusNotImplemented, codeNotImplemented, "splitting %s is not available with FAKE_BACKENDS", c.CommitID)
+		return true
+	}
+	if commit.Plan != reservationpb.CapacityCommitment_FLEX {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "only FLEX commitments can be partially deleted, %s is %s", c.CommitID, commit.Plan)
+		return true
+	}
+	if commit.SlotCount-c.Slots < slotIncrement {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%s has %d slots, at least %d must remain", c.CommitID, commit.SlotCount, slotIncrement)
+		return true
+	}
+
+	recs, err := s.store.ListCommitments(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "listing recorded commitments: %v", err)
+		logging.Error(r.Context(), "%v", err)
+		return true
+	}
+	rec, owned := &CommitmentRecord{
+		Name:      commit.Name,
+		Region:    capacity.Region(commit.Name),
+		SlotCount: commit.SlotCount,
+		Plan:      commit.Plan.String(),
+	}, false
+	for _, known := range recs {
+		if known.Name == commit.Name {
+			rec, owned = known, true
+			rec.SlotCount = commit.SlotCount
+			break
+		}
+	}
+
+	rel, err := s.releaseSlots(r.Context(), rec, c.Slots, requester(r), owned)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return true
+	}
+	writeJSON(w, http.StatusOK, rel)
+	return true
+}
+
+// dropDeleteTask removes the pending delete task of a commitment deleted by
+// other means, if it has one.
+func (s *Server) dropDeleteTask(ctx context.Context, commitName string) {
+	task, err := s.findDeleteTask(ctx, commitName)
+	if err != nil {
+		return
+	}
+	if err := s.queue.Delete(ctx, task.Name); err != nil {
+		logging.Warning(ctx, "removing delete task %s: %v", task.Name, err)
+	}
+}
+
+func min(x, y int64) int64 {
+	if x < y {
+		return x
+	}
+	return y
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/api/cloudscheduler/v1"
+	"google.golang.org/api/googleapi"
+
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/scheduler"
+)
+
+// scheduleJobEarly is how early a Cloud Scheduler job may fire and still run
+// its schedule.
+const scheduleJobEarly = 30 * time.Second
+
+// parseSchedulerJobs reads SCHEDULER_JOBS, and where the jobs are created and
+// whose OIDC token they call with.
+func parseSchedulerJobs() error {
+	var err error
+	if v := getenv("SCHEDULER_JOBS"); v != "" {
+		if schedulerJobs, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("cannot parse SCHEDULER_JOBS: %v", err)
+		}
+	}
+	if !schedulerJobs {
+		return nil
+	}
+	// Default to the region of the Cloud Tasks queue
+	if schedulerJobsLocation = getenv("SCHEDULER_JOBS_LOCATION"); schedulerJobsLocation == "" && deleteScheduler == schedulerCloudTasks {
+		schedulerJobsLocation = queueLocation
+	} else if schedulerJobsLocation == "" {
+		return errors.New("SCHEDULER_JOBS needs SCHEDULER_JOBS_LOCATION")
+	}
+	if schedulerJobsServiceAcct = getenv("SCHEDULER_JOBS_SERVICE_ACCOUNT"); schedulerJobsServiceAcct == "" {
+		schedulerJobsServiceAcct = defaultServiceAcct
+	}
+	return nil
+}
+
+// scheduleJobName is the full resource name of the Cloud Scheduler job of
+// the schedule id.
+func scheduleJobName(id string) string {
+	return fmt.Sprintf("projects/%s/locations/%s/jobs/slot-scheduler-%s", projectID, schedulerJobsLocation, id)
+}
+
+// putScheduleJob creates or updates the Cloud Scheduler job running sc, which
+// calls schedulesPath/{id}/run on the service r was sent to, and pauses or
+// resumes it with sc. It records the job in sc.
+func (s *Server) putScheduleJob(ctx context.Context, r *http.Request, sc *scheduler.Schedule) error {
+	if s.jobs == nil {
+		return nil
+	}
+	expr, err := sc.Expression()
+	if err != nil {
+		return err
+	}
+	tz := sc.Timezone
+	if tz == "" {
+		tz = "UTC"
+	}
+	url := taskURL(r, schedulesPath+"/"+sc.ID+"/run")
+	name := scheduleJobName(sc.ID)
+	job := &cloudscheduler.Job{
+		Name:        name,
+		Description: strings.TrimSpace("Runs slot-scheduler schedule " + sc.ID + " " + sc.Name),
+		Schedule:    expr,
+		TimeZone:    tz,
+		HttpTarget: &cloudscheduler.HttpTarget{
+			Uri:        url,
+			HttpMethod: "POST",
+			OidcToken: &cloudscheduler.OidcToken{
+				ServiceAccountEmail: schedulerJobsServiceAcct,
+				Audience:            url,
+			},
+		},
+	}
+
+	jobs := s.jobs.Projects.Locations.Jobs
+	got, err := jobs.Patch(name, job).UpdateMask("description,schedule,timeZone,httpTarget").Context(ctx).Do()
+	if isNotFound(err) {
+		parent := fmt.Sprintf("projects/%s/locations/%s", projectID, schedulerJobsLocation)
+		got, err = jobs.Create(parent, job).Context(ctx).Do()
+	}
+	if err != nil {
+		return fmt.Errorf("putting Cloud Scheduler job %s: %v", name, err)
+	}
+	switch {
+	case sc.Paused && got.State == "ENABLED":
+		_, err = jobs.Pause(name, &cloudscheduler.PauseJobRequest{}).Context(ctx).Do()
+	case !sc.Paused && got.State == "PAUSED":
+		_, err = jobs.Resume(name, &cloudscheduler.ResumeJobRequest{}).Context(ctx).Do()
+	}
+	if err != nil {
+		return fmt.Errorf("pausing or resuming Cloud Scheduler job %s: %v", name, err)
+	}
+	sc.Job = name
+	logging.Info(ctx, "Cloud Scheduler job %s runs schedule %s on %q %s", name, sc.ID, expr, tz)
+	return nil
+}
+
+// deleteScheduleJob deletes the Cloud Scheduler job of sc, if it has one.
+func (s *Server) deleteScheduleJob(ctx context.Context, sc *scheduler.Schedule) error {
+	if s.jobs == nil || sc.Job == "" {
+		return nil
+	}
+	_, err := s.jobs.Projects.Locations.Jobs.Delete(sc.Job).Context(ctx).Do()
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("deleting Cloud Scheduler job %s: %v", sc.Job, err)
+	}
+	logging.Info(ctx, "Cloud Scheduler job %s deleted", sc.Job)
+	return nil
+}
+
+// isNotFound reports whether err is a 404 of a REST API.
+func isNotFound(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusNotFound
+}
+
+// runScheduleHandler runs one schedule if it is due, as its Cloud Scheduler
+// job does when it fires.
+func (s *Server) runScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := s.store.GetSchedule(r.Context(), id); err != nil {
+		writeScheduleError(w, r, err)
+		return
+	}
+
+	ctx := logging.WithFields(r.Context(), "schedule", id)
+	res := &ScheduleRunResult{Ran: []string{}, Skipped: []string{}}
+	ran, err := s.runSchedule(ctx, id, time.Now().Add(scheduleJobEarly))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "running %s: %v", id, err)
+		logging.Error(ctx, "running schedule %s: %v", id, err)
+		return
+	}
+	if ran {
+		res.Ran = append(res.Ran, id)
+	} else {
+		res.Skipped = append(res.Skipped, id)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/scheduler"
+)
+
+const (
+	// scheduleMissedGrace is how late a schedule may still run, for instance
+	// after the service was scaled to zero. Older runs are skipped.
+	scheduleMissedGrace = 10 * time.Minute
+	// scheduleLockTTL frees the lock of an instance that died running a
+	// schedule.
+	scheduleLockTTL = 2 * time.Minute
+	// schedulePausedTick is how often a paused scheduler looks for a
+	// reloaded SCHEDULE_INTERVAL.
+	schedulePausedTick = time.Minute
+)
+
+var errScheduleNotFound = errors.New("schedule not found")
+
+// validateSchedule checks sc and fills in its defaults.
+func validateSchedule(sc *scheduler.Schedule) error {
+	var v validator
+	v.region("region", &sc.Region)
+	v.check(sc.Project == "" || validAdminProject(sc.Project), "project", "%q is not an admin project of the service", sc.Project)
+	v.slots("slots", sc.Slots)
+	_, err := sc.Location()
+	v.check(err == nil, "timezone", "%v", err)
+	_, _, err = sc.Spec(time.Duration(live().MaxMinutes) * time.Minute)
+	v.check(err == nil, "schedule", "%v", err)
+	return v.err()
+}
+
+func (s *Server) listSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := s.store.ListSchedules(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	now := time.Now()
+	for _, sc := range list {
+		sc.SetNextRun(now)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) getScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	sc, err := s.store.GetSchedule(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeScheduleError(w, r, err)
+		return
+	}
+	sc.SetNextRun(time.Now())
+	writeJSON(w, http.StatusOK, sc)
+}
+
+func (s *Server) createScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	var sc scheduler.Schedule
+	if err := json.NewDecoder(r.Body).Decode(&sc); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validateSchedule(&sc); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		return
+	}
+	now := time.Now()
+	sc.ID = "sched-" + id
+	sc.DeleteURL = deleteURL(r)
+	sc.Audience = deleteAudience(r)
+	sc.CreatedAt, sc.UpdatedAt, sc.LastRun = now, now, time.Time{}
+	if err := s.putScheduleJob(r.Context(), r, &sc); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	if err := s.store.PutSchedule(r.Context(), &sc); err != nil {
+		if derr := s.deleteScheduleJob(r.Context(), &sc); derr != nil {
+			logging.Error(r.Context(), "%v", derr)
+		}
+		writeScheduleError(w, r, err)
+		return
+	}
+	logging.Info(r.Context(), "schedule %s created", sc.ID)
+
+	sc.SetNextRun(now)
+	writeJSON(w, http.StatusCreated, sc)
+}
+
+func (s *Server) updateScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	old, err := s.store.GetSchedule(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeScheduleError(w, r, err)
+		return
+	}
+
+	var sc scheduler.Schedule
+	if err := json.NewDecoder(r.Body).Decode(&sc); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validateSchedule(&sc); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	now := time.Now()
+	sc.ID, sc.CreatedAt, sc.LastRun = old.ID, old.CreatedAt, old.LastRun
+	sc.DeleteURL = deleteURL(r)
+	sc.Audience = deleteAudience(r)
+	sc.UpdatedAt = now
+	if err := s.putScheduleJob(r.Context(), r, &sc); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	if err := s.store.PutSchedule(r.Context(), &sc); err != nil {
+		writeScheduleError(w, r, err)
+		return
+	}
+	logging.Info(r.Context(), "schedule %s updated", sc.ID)
+
+	sc.SetNextRun(now)
+	writeJSON(w, http.StatusOK, sc)
+}
+
+func (s *Server) deleteScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	sc, err := s.store.GetSchedule(r.Context(), id)
+	if err != nil {
+		writeScheduleError(w, r, err)
+		return
+	}
+	if err := s.deleteScheduleJob(r.Context(), sc); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	if err := s.store.DeleteSchedule(r.Context(), id); err != nil {
+		writeScheduleError(w, r, err)
+		return
+	}
+	logging.Info(r.Context(), "schedule %s deleted", id)
+	writeJSON(w, http.StatusOK, "schedule deleted")
+}
+
+func writeScheduleError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errScheduleNotFound) {
+		writeError(w, http.StatusNotFound, codeNotFound, "%v", err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+	logging.Error(r.Context(), "%v", err)
+}
+
+// ScheduleRunResult summarises a pass over the schedules.
+type ScheduleRunResult struct {
+	Ran     []string `json:"ran"`
+	Skipped []string `json:"skipped"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// runScheduler runs the due schedules every SCHEDULE_INTERVAL until ctx is
+// done. With 0 it only waits for a reload to set one.
+func (s *Server) runScheduler(ctx context.Context) {
+	interval := live().ScheduleInterval
+	if interval > 0 {
+		logging.Info(ctx, "checking schedules every %s", interval)
+	}
+	ticker := time.NewTicker(schedulerTick(interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// SCHEDULE_INTERVAL may have been reloaded.
+			if next := live().ScheduleInterval; next != interval {
+				interval = next
+				ticker.Reset(schedulerTick(interval))
+				logging.Info(ctx, "checking schedules every %s", interval)
+			}
+			if interval == 0 {
+				continue
+			}
+			res, err := s.runSchedules(ctx)
+			if err != nil {
+				logging.Error(ctx, "running schedules: %v", err)
+				continue
+			}
+			if len(res.Ran) > 0 || len(res.Skipped) > 0 {
+				logging.Info(ctx, "ran schedules %v, skipped %v", res.Ran, res.Skipped)
+			}
+		}
+	}
+}
+
+// schedulerTick is the tick of the scheduler with interval.
+func schedulerTick(interval time.Duration) time.Duration {
+	if interval == 0 {
+		return schedulePausedTick
+	}
+	return interval
+}
+
+func (s *Server) runSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := s.runSchedules(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// runSchedules buys the capacity of every schedule that is due. Each run is
+// claimed under a lock and recorded in the schedule, so instances checking at
+// the same time run it once.
+func (s *Server) runSchedules(ctx context.Context) (*ScheduleRunResult, error) {
+	list, err := s.store.ListSchedules(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing schedules: %v", err)
+	}
+
+	res := &ScheduleRunResult{Ran: []string{}, Skipped: []string{}}
+	now := time.Now()
+	for _, sc := range list {
+		if _, ok := sc.Due(now); !ok {
+			continue
+		}
+		ctx := logging.WithFields(ctx, "schedule", sc.ID, "region", sc.Region)
+		ran, err := s.runSchedule(ctx, sc.ID, now)
+		switch {
+		case err != nil:
+			res.Errors = append(res.Errors, fmt.Sprintf("running %s: %v", sc.ID, err))
+		case ran:
+			res.Ran = append(res.Ran, sc.ID)
+		default:
+			res.Skipped = append(res.Skipped, sc.ID)
+		}
+	}
+	return res, nil
+}
+
+// runSchedule buys the capacity of schedule id if it is still due. It reports
+// whether it ran, as opposed to being claimed elsewhere or missed by more
+// than scheduleMissedGrace.
+func (s *Server) runSchedule(ctx context.Context, id string, now time.Time) (bool, error) {
+	unlock, err := s.store.Lock(ctx, "schedule/"+id, scheduleLockTTL)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	// Read again under the lock, another instance may have run it.
+	sc, err := s.store.GetSchedule(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	due, ok := sc.Due(now)
+	if !ok {
+		return false, nil
+	}
+	_, window, err := sc.Spec(time.Duration(live().MaxMinutes) * time.Minute)
+	if err != nil {
+		return false, err
+	}
+
+	// Claim the run before buying, so a failure can't lead to buying twice.
+	sc.LastRun = due
+	if err := s.store.PutSchedule(ctx, sc); err != nil {
+		return false, fmt.Errorf("recording run: %v", err)
+	}
+	if now.Sub(due) > scheduleMissedGrace {
+		logging.Warning(ctx, "schedule %s missed its run at %s", sc.ID, due.Format(time.RFC3339))
+		return false, nil
+	}
+
+	// The window is kept from when the run was due, not from when it ran.
+	deleteAt := due.Add(window)
+	if earliest := now.Add(time.Duration(defaultMinute) * time.Minute); deleteAt.Before(earliest) {
+		deleteAt = earliest
+	}
+	logging.Info(ctx, "schedule %s due at %s, adding %d slots until %s", sc.ID, due.Format(time.RFC3339), sc.Slots, deleteAt.Format(time.RFC3339))
+	_, err = s.purchase(ctx, purchaseRequest{
+		Project:   sc.Project,
+		Region:    sc.Region,
+		Slots:     sc.Slots,
+		Plan:      reservationpb.CapacityCommitment_FLEX,
+		DeleteAt:  deleteAt,
+		DeleteURL: sc.DeleteURL,
+		Audience:  sc.Audience,
+		Requester: "schedule/" + sc.ID,
+		Reason:    sc.Reason,
+		DryRun:    sc.DryRun,
+	})
+	if errors.Is(err, capacity.ErrMaxSlots) {
+		logging.Warning(ctx, "schedule %s: %v", sc.ID, err)
+		return true, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	reservation "cloud.google.com/go/bigquery/reservation/apiv1"
+	"google.golang.org/api/cloudscheduler/v1"
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/taskspb"
+	"go-slot-scheduler/internal/tracing"
+	"go-slot-scheduler/tasks"
+)
+
+// CapacityClient buys, lists and deletes commitments. *capacity.Manager
+// implements it, over the reservation API or a capacity.Fake.
+type CapacityClient interface {
+	List(ctx context.Context, parent string) ([]*reservationpb.CapacityCommitment, error)
+	Get(ctx context.Context, name string) (*reservationpb.CapacityCommitment, error)
+	Available(ctx context.Context, parent string, extraSlots, maxSlots int64) (int64, int64, error)
+	Buy(ctx context.Context, parent string, plan reservationpb.CapacityCommitment_CommitmentPlan, extraSlot, maxSlots int64) (*reservationpb.CapacityCommitment, error)
+	WaitActive(ctx context.Context, name string, timeout, interval time.Duration) (*reservationpb.CapacityCommitment, error)
+	Delete(ctx context.Context, commitName string) error
+	EarliestDelete(ctx context.Context, commitName string) (time.Time, bool)
+}
+
+// TaskScheduler schedules the delete tasks and other callbacks of the
+// service. *tasks.Queue implements it, over Cloud Tasks or a tasks.Fake.
+type TaskScheduler interface {
+	TaskName(id string) string
+	DeleteTaskName(commitName string) string
+	RescheduledTaskName(commitName string, deleteAt time.Time) string
+	Create(ctx context.Context, task *taskspb.Task) (*taskspb.Task, error)
+	CreateHTTP(ctx context.Context, taskName, url, audience string, body interface{}, scheduleAt time.Time) (*taskspb.Task, error)
+	Get(ctx context.Context, name string) (*taskspb.Task, error)
+	Delete(ctx context.Context, name string) error
+	List(ctx context.Context) ([]*taskspb.Task, error)
+}
+
+var (
+	_ CapacityClient = (*capacity.Manager)(nil)
+	_ TaskScheduler  = (*tasks.Queue)(nil)
+	_ TaskScheduler  = (*tasks.Queues)(nil)
+)
+
+// Server holds the GCP clients shared by all handlers. The clients are safe
+// for concurrent use and are created once at startup.
+type Server struct {
+	reservations *reservation.Client
+	// projectReservations are the clients of admin projects with their own
+	// credentials, by project ID.
+	projectReservations map[string]*reservation.Client
+	// tasks is the Cloud Tasks client, nil with another DELETE_SCHEDULER.
+	tasks      *taskspb.Client
+	queue      TaskScheduler
+	capacity   CapacityClient
+	bigquery   *bigquery.Client
+	store      stateStore
+	autoscaler autoscaler
+	// notifier and pagers are replaced by Reload, under notifyMu.
+	notifyMu sync.RWMutex
+	notifier Notifier
+	pagers   []Pager
+	// fakeTasks sends the tasks of the queue with FAKE_BACKENDS.
+	fakeTasks *tasks.Fake
+	// timer runs the tasks with DELETE_SCHEDULER=timer.
+	timer *tasks.Timer
+	// pushTasks holds the tasks pushed back by Pub/Sub with
+	// DELETE_SCHEDULER=pubsub.
+	pushTasks *pubsubTasks
+	// jobs manages the Cloud Scheduler jobs of schedules with
+	// SCHEDULER_JOBS.
+	jobs *cloudscheduler.Service
+	// exporter streams the ledger to LEDGER_EXPORT_TABLE, if set.
+	exporter *ledgerExporter
+	// events fans recorded entries out to the /events streams.
+	events eventHub
+	// ops are the purchases and deletions in flight, waited for by Drain.
+	ops operations
+	// auditSink publishes the mutating requests to AUDIT_TOPIC, if set.
+	auditSink *auditSink
+	// reloadMu serializes reloads.
+	reloadMu sync.Mutex
+	// summaries caches the capacity summary briefly.
+	summaries summaryCache
+	// queues are the states of the delete queue last seen.
+	queues queueHealth
+}
+
+// New creates the clients of the service and of its DELETE_SCHEDULER, or
+// fakes of the reservation and Cloud Tasks APIs with FAKE_BACKENDS.
+func New(ctx context.Context) (*Server, error) {
+	if fakeBackends {
+		return newFake(ctx)
+	}
+
+	rc, err := reservation.NewClient(ctx, tracing.GRPCOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("creating reservation client: %v", err)
+	}
+
+	bq, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("creating bigquery client: %v", err)
+	}
+
+	pc, err := newProjectClients(ctx)
+	if err != nil {
+		rc.Close()
+		bq.Close()
+		return nil, err
+	}
+
+	var store stateStore = newMemStore()
+	if stateStoreKind == "firestore" {
+		if store, err = newFirestoreStore(ctx, firestoreProject); err != nil {
+			rc.Close()
+			bq.Close()
+			closeClients(pc)
+			return nil, fmt.Errorf("creating firestore client: %v", err)
+		}
+	}
+
+	n, err := newNotifier(ctx)
+	if err != nil {
+		rc.Close()
+		bq.Close()
+		closeClients(pc)
+		store.Close()
+		return nil, fmt.Errorf("creating notifier: %v", err)
+	}
+
+	s := &Server{
+		reservations:        rc,
+		projectReservations: pc,
+		bigquery:            bq,
+		store:               store,
+		autoscaler:          autoscaler{lastAction: make(map[string]time.Time)},
+		notifier:            n,
+		pagers:              newPagers(),
+	}
+	tc, err := s.newTaskClient(ctx)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if schedulerJobs {
+		if s.jobs, err = cloudscheduler.NewService(ctx); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("creating cloud scheduler client: %v", err)
+		}
+	}
+	if ledgerExportTable != "" {
+		if s.exporter, err = newLedgerExporter(ctx, bq); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("exporting the ledger: %v", err)
+		}
+	}
+	if s.auditSink, err = newAuditSink(ctx); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("auditing to %s: %v", auditTopic, err)
+	}
+	s.useBackends(func(name string) capacity.Client { return capacity.NewClient(s.reservationsFor(name)) }, tc)
+	if err := s.createQueues(ctx); err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.applyDeleteTaskRetry(ctx)
+	return s, nil
+}
+
+// useBackends has the handlers buy and delete commitments with the client
+// for each resource name, and schedule tasks with tc.
+func (s *Server) useBackends(client func(name string) capacity.Client, tc tasks.Client) {
+	var queues []*tasks.Queue
+	for _, name := range queueNames() {
+		queues = append(queues, &tasks.Queue{
+			Client:           tc,
+			Name:             name,
+			ServiceAccount:   taskServiceAcct,
+			Retry:            retryPolicy,
+			DispatchDeadline: deleteTaskDispatchDeadline,
+		})
+	}
+	if len(queues) == 1 {
+		s.queue = queues[0]
+	} else {
+		s.queue = &tasks.Queues{Queues: queues, Healthy: s.queueRunning}
+	}
+	s.capacity = &capacity.Manager{
+		Client: client,
+		Retry:  retryPolicy,
+		Filter: func() capacity.Filter { return live().CapFilter },
+		Owned:  s.ownedCommitments,
+		Lock: func(ctx context.Context, name string) (func(), error) {
+			ctx, cancel := context.WithTimeout(ctx, purchaseLockWait)
+			defer cancel()
+			return s.store.Lock(ctx, name, purchaseLockTTL)
+		},
+		Totals:    s.store,
+		TotalsTTL: capCacheTTL,
+	}
+}
+
+// ownedCommitments returns the names of the commitments bought by the
+// service.
+func (s *Server) ownedCommitments(ctx context.Context) (map[string]bool, error) {
+	recs, err := s.store.ListCommitments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	owned := make(map[string]bool, len(recs))
+	for _, rec := range recs {
+		owned[rec.Name] = true
+	}
+	return owned, nil
+}
+
+// Close releases the underlying gRPC connections, and stops the timers of
+// DELETE_SCHEDULER=timer.
+func (s *Server) Close() error {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	var firstErr error
+	// The exporter first, it flushes entries recorded up to now.
+	if err := s.exporter.Close(); err != nil {
+		firstErr = err
+	}
+	s.auditSink.Close()
+	closers := []interface{ Close() error }{s.store}
+	if s.reservations != nil {
+		closers = append(closers, s.reservations, s.bigquery)
+	}
+	if s.tasks != nil {
+		closers = append(closers, s.tasks)
+	}
+	for _, c := range s.projectReservations {
+		closers = append(closers, c)
+	}
+	for _, c := range closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// healthy reports an error if either client connection has shut down or is
+// failing to connect.
+func (s *Server) healthy() error {
+	if s.reservations == nil {
+		// FAKE_BACKENDS
+		return nil
+	}
+	conns := map[string]*grpc.ClientConn{
+		"reservation": s.reservations.Connection(),
+	}
+	if s.tasks != nil {
+		conns["cloudtasks"] = s.tasks.Connection()
+	}
+	for name, conn := range conns {
+		switch state := conn.GetState(); state {
+		case connectivity.Shutdown, connectivity.TransientFailure:
+			return fmt.Errorf("%s client connection is %s", name, state)
+		}
+	}
+	return nil
+}
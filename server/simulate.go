@@ -0,0 +1,370 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+)
+
+const (
+	// defaultSimulationWindow is how much history is replayed by default,
+	// maxSimulationWindow at most.
+	defaultSimulationWindow = 7 * 24 * time.Hour
+	maxSimulationWindow     = 30 * 24 * time.Hour
+	// defaultSimulationInterval is the tick of a policy without an
+	// AUTOSCALE_INTERVAL.
+	defaultSimulationInterval = time.Minute
+)
+
+// timelineViews are the INFORMATION_SCHEMA views a simulation can read.
+var timelineViews = map[string]bool{
+	"JOBS_TIMELINE":                 true,
+	"JOBS_TIMELINE_BY_PROJECT":      true,
+	"JOBS_TIMELINE_BY_USER":         true,
+	"JOBS_TIMELINE_BY_FOLDER":       true,
+	"JOBS_TIMELINE_BY_ORGANIZATION": true,
+}
+
+// SimulationPolicy is the autoscaling policy replayed, in the units of the
+// AUTOSCALE_* environment. Fields left out are those of the service.
+type SimulationPolicy struct {
+	Interval        string  `json:"interval"`
+	Lookback        string  `json:"lookback"`
+	View            string  `json:"view"`
+	UpUtilization   float64 `json:"up_utilization"`
+	UpPending       float64 `json:"up_pending"`
+	DownUtilization float64 `json:"down_utilization"`
+	Step            int64   `json:"step"`
+	Cooldown        string  `json:"cooldown"`
+	MaxHold         string  `json:"max_hold"`
+}
+
+// SimulationRequest replays the usage of Region over the last Window against
+// a policy.
+type SimulationRequest struct {
+	Region string `json:"region"`
+	// Window is a Go duration or a number of days, default 7d.
+	Window string `json:"window"`
+	// CommittedSlots is the capacity held besides what the autoscaler buys,
+	// default the slots of the commitments of the region that aren't FLEX.
+	CommittedSlots *int64           `json:"committed_slots,omitempty"`
+	Policy         SimulationPolicy `json:"policy"`
+}
+
+// SimulationReport is what the autoscaler would have done over the window.
+type SimulationReport struct {
+	Region         string           `json:"region"`
+	From           time.Time        `json:"from"`
+	To             time.Time        `json:"to"`
+	CommittedSlots int64            `json:"committed_slots"`
+	Policy         SimulationPolicy `json:"policy"`
+	Purchases      int              `json:"purchases"`
+	Releases       int              `json:"releases"`
+	// Expired counts the commitments deleted at AUTOSCALE_MAX_HOLD.
+	Expired int `json:"expired"`
+	// CappedPurchases counts the scale ups MAX_SLOTS held back.
+	CappedPurchases int     `json:"capped_purchases"`
+	PeakSlots       int64   `json:"peak_slots"`
+	SlotHours       float64 `json:"slot_hours"`
+	EstimatedCost   float64 `json:"estimated_cost"`
+	Currency        string  `json:"currency"`
+	// QueuedSlotHours is the work that waited for slots in the window,
+	// AvoidedSlotHours the share of it the bought slots could have run.
+	QueuedSlotHours  float64             `json:"queued_slot_hours"`
+	AvoidedSlotHours float64             `json:"avoided_slot_hours"`
+	Actions          []*SimulationAction `json:"actions"`
+}
+
+// SimulationAction is one purchase or release of the simulation.
+type SimulationAction struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"` // purchase, release or expire
+	Slots       int64     `json:"slots"`
+	Held        int64     `json:"held"` // bought slots held after it
+	Used        float64   `json:"used_slots"`
+	Pending     float64   `json:"pending_slots"`
+	Utilization float64   `json:"utilization"`
+}
+
+// minuteUsage is the slots used and pending in a region in a minute.
+type minuteUsage struct {
+	Minute  time.Time `bigquery:"minute"`
+	Used    float64   `bigquery:"used_slots"`
+	Pending float64   `bigquery:"pending_units"`
+}
+
+// simulationPolicy is the policy of the service in the units of a request.
+func simulationPolicy(p autoscalePolicy) SimulationPolicy {
+	interval := p.Interval
+	if interval <= 0 {
+		interval = defaultSimulationInterval
+	}
+	return SimulationPolicy{
+		Interval:        interval.String(),
+		Lookback:        p.Lookback.String(),
+		View:            p.View,
+		UpUtilization:   p.UpUtilization,
+		UpPending:       p.UpPending,
+		DownUtilization: p.DownUtilization,
+		Step:            p.Step,
+		Cooldown:        p.Cooldown.String(),
+		MaxHold:         p.MaxHold.String(),
+	}
+}
+
+// policy checks sp and converts it, adding its errors to v.
+func (sp *SimulationPolicy) policy(v *validator) autoscalePolicy {
+	p := autoscalePolicy{
+		View:            strings.ToUpper(sp.View),
+		UpUtilization:   sp.UpUtilization,
+		UpPending:       sp.UpPending,
+		DownUtilization: sp.DownUtilization,
+		Step:            sp.Step,
+	}
+	durations := []struct {
+		field string
+		value string
+		d     *time.Duration
+	}{
+		{"policy.interval", sp.Interval, &p.Interval},
+		{"policy.lookback", sp.Lookback, &p.Lookback},
+		{"policy.cooldown", sp.Cooldown, &p.Cooldown},
+		{"policy.max_hold", sp.MaxHold, &p.MaxHold},
+	}
+	for _, d := range durations {
+		var err error
+		*d.d, err = time.ParseDuration(d.value)
+		v.check(err == nil && *d.d >= 0, d.field, "must be a duration such as 10m")
+	}
+	v.check(p.Interval >= time.Minute && p.Interval%time.Minute == 0, "policy.interval", "must be whole minutes")
+	v.check(p.Lookback >= time.Minute, "policy.lookback", "must be at least 1m")
+	v.check(p.MaxHold <= time.Duration(live().MaxMinutes)*time.Minute, "policy.max_hold", "is longer than MAX_MINUTES")
+	v.check(timelineViews[p.View], "policy.view", "unknown view %q, want a JOBS_TIMELINE view", sp.View)
+	v.check(p.DownUtilization < p.UpUtilization, "policy.down_utilization", "must be below up_utilization")
+	v.check(p.Step >= 100, "policy.step", "must be at least 100 slots")
+	return p
+}
+
+// simulateHandler replays the slot usage of a region against an autoscaling
+// policy, by default the one of the service, without buying anything.
+func (s *Server) simulateHandler(w http.ResponseWriter, r *http.Request) {
+	req := SimulationRequest{Policy: simulationPolicy(autoscale)}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	var v validator
+	v.region("region", &req.Region)
+	window := defaultSimulationWindow
+	if req.Window != "" {
+		var err error
+		window, err = parseWindow(req.Window)
+		v.check(err == nil, "window", "%v", err)
+		v.check(window <= maxSimulationWindow, "window", "can not be more than 30d")
+	}
+	if req.CommittedSlots != nil {
+		v.check(*req.CommittedSlots >= 0, "committed_slots", "can not be negative")
+	}
+	p := req.Policy.policy(&v)
+	if err := v.err(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	ctx := logging.WithFields(r.Context(), "region", req.Region)
+	if req.CommittedSlots == nil {
+		committed, err := s.baseCommitment(ctx, req.Region)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternal, "listing commitments: %v", err)
+			logging.Error(ctx, "listing commitments in %s: %v", req.Region, err)
+			return
+		}
+		req.CommittedSlots = &committed
+	}
+	to := time.Now().Truncate(time.Minute)
+	from := to.Add(-window)
+	usage, err := s.minuteUsage(ctx, p.View, req.Region, from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "reading slot usage: %v", err)
+		logging.Error(ctx, "reading slot usage of %s: %v", req.Region, err)
+		return
+	}
+
+	report := simulate(p, req.Region, *req.CommittedSlots, maxSlotsFor(projectID, req.Region), from, usage)
+	report.Policy = req.Policy
+	report.Policy.View = p.View
+	writeJSON(w, http.StatusOK, report)
+}
+
+// baseCommitment is the slots committed in region other than FLEX, the
+// capacity the autoscaler scales on top of.
+func (s *Server) baseCommitment(ctx context.Context, region string) (int64, error) {
+	list, err := s.capacity.List(ctx, capacity.Parent(projectID, region))
+	if err != nil {
+		return 0, err
+	}
+	var slots int64
+	for _, c := range list {
+		if c.Plan != reservationpb.CapacityCommitment_FLEX {
+			slots += c.SlotCount
+		}
+	}
+	return slots, nil
+}
+
+// minuteUsage returns the slots used and pending in region each minute from
+// from to to, as two series, zero in minutes without jobs.
+func (s *Server) minuteUsage(ctx context.Context, view, region string, from, to time.Time) ([][2]float64, error) {
+	q := s.bigquery.Query(fmt.Sprintf(`
+SELECT
+  TIMESTAMP_TRUNC(period_start, MINUTE) AS minute,
+  SUM(period_slot_ms) / (1000 * 60) AS used_slots,
+  SUM(period_estimated_runnable_units) / 60 AS pending_units
+FROM `+"`region-%s`.INFORMATION_SCHEMA.%s"+`
+WHERE period_start >= @from AND period_start < @to
+  AND (statement_type IS NULL OR statement_type != 'SCRIPT')
+GROUP BY minute`, strings.ToLower(region), view))
+	q.Location = region
+	q.Parameters = []bigquery.QueryParameter{{Name: "from", Value: from}, {Name: "to", Value: to}}
+
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	minutes := make([][2]float64, int(to.Sub(from)/time.Minute))
+	for {
+		var u minuteUsage
+		err := it.Next(&u)
+		if err == iterator.Done {
+			return minutes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i := int(u.Minute.Sub(from) / time.Minute); i >= 0 && i < len(minutes) {
+			minutes[i] = [2]float64{u.Used, u.Pending}
+		}
+	}
+}
+
+// simulate runs the policy p over the slots used and pending each minute
+// from from, in region with committed slots held besides those it buys and
+// a cap of maxSlots. Usage is taken as it was: the jobs are not sped up by
+// the slots bought, so the queueing avoided is the pending work the bought
+// slots could have run in each minute.
+func simulate(p autoscalePolicy, region string, committed, maxSlots int64, from time.Time, usage [][2]float64) *SimulationReport {
+	report := &SimulationReport{
+		Region:         region,
+		From:           from,
+		To:             from.Add(time.Duration(len(usage)) * time.Minute),
+		CommittedSlots: committed,
+		Currency:       "USD",
+		Actions:        []*SimulationAction{},
+	}
+	type bought struct {
+		at, deleteAt time.Time
+		slots        int64
+	}
+	var (
+		held       []bought
+		heldSlots  int64
+		lastAction time.Time
+	)
+	act := func(t time.Time, action string, slots int64, used, pending, utilization float64) {
+		report.Actions = append(report.Actions, &SimulationAction{
+			Time:        t,
+			Action:      action,
+			Slots:       slots,
+			Held:        heldSlots,
+			Used:        roundCents(used),
+			Pending:     roundCents(pending),
+			Utilization: roundCents(utilization),
+		})
+	}
+
+	lookback := int(p.Lookback / time.Minute)
+	interval := int(p.Interval / time.Minute)
+	for i, u := range usage {
+		t := from.Add(time.Duration(i) * time.Minute)
+
+		// Deletions at AUTOSCALE_MAX_HOLD of what the autoscaler didn't
+		// release in time.
+		kept := held[:0]
+		for _, b := range held {
+			if !t.Before(b.deleteAt) {
+				heldSlots -= b.slots
+				report.Expired++
+				act(t, "expire", b.slots, u[0], u[1], 0)
+				continue
+			}
+			kept = append(kept, b)
+		}
+		held = kept
+
+		if i >= lookback && i%interval == 0 && t.Sub(lastAction) >= p.Cooldown {
+			var used, pending float64
+			for _, m := range usage[i-lookback : i] {
+				used += m[0] / float64(lookback)
+				pending += m[1] / float64(lookback)
+			}
+			total := committed + heldSlots
+			decision, utilization := p.decide(used, pending, total)
+			switch decision {
+			case scaleUp:
+				if total+p.Step > maxSlots {
+					report.CappedPurchases++
+					break
+				}
+				held = append(held, bought{at: t, deleteAt: t.Add(p.MaxHold), slots: p.Step})
+				heldSlots += p.Step
+				report.Purchases++
+				lastAction = t
+				act(t, "purchase", p.Step, used, pending, utilization)
+			case scaleDown:
+				for j, b := range held {
+					if t.Sub(b.at) < capacity.FlexMinDuration || !p.canRelease(used, total, b.slots) {
+						continue
+					}
+					held = append(held[:j], held[j+1:]...)
+					heldSlots -= b.slots
+					report.Releases++
+					lastAction = t
+					act(t, "release", b.slots, used, pending, utilization)
+					break
+				}
+			}
+		}
+
+		if heldSlots > report.PeakSlots {
+			report.PeakSlots = heldSlots
+		}
+		report.SlotHours += float64(heldSlots) / 60
+		report.QueuedSlotHours += u[1] / 60
+		if pending := u[1]; pending > 0 {
+			avoided := float64(heldSlots)
+			if pending < avoided {
+				avoided = pending
+			}
+			report.AvoidedSlotHours += avoided / 60
+		}
+	}
+
+	price, _ := slotHourPrice(region, reservationpb.CapacityCommitment_FLEX.String())
+	report.EstimatedCost = roundCents(report.SlotHours * price)
+	report.SlotHours = roundCents(report.SlotHours)
+	report.QueuedSlotHours = roundCents(report.QueuedSlotHours)
+	report.AvoidedSlotHours = roundCents(report.AvoidedSlotHours)
+	return report
+}
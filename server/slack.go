@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+const (
+	// slackMaxSkew is how old a signed Slack request can be, against replays.
+	slackMaxSkew = 5 * time.Minute
+	// slackMaxBody bounds the slash command payload read.
+	slackMaxBody = 64 << 10
+	// slackResponseTimeout bounds the work done after the acknowledgement,
+	// within the 30 minutes Slack takes delayed responses for.
+	slackResponseTimeout = 2 * time.Minute
+)
+
+// slackUsage is the help of the slash command.
+const slackUsage = "Usage:\n" +
+	"• `add <slots> <minutes or duration> [region] [ticket=<id>] [reason]`, e.g. `add 500 60m EU ticket=OPS-42 month end close`\n" +
+	"• `status [region]`"
+
+// slackMessage is a slash command response.
+type slackMessage struct {
+	ResponseType string `json:"response_type"` // ephemeral or in_channel
+	Text         string `json:"text"`
+}
+
+// verifySlackSignature checks the request was signed with
+// SLACK_SIGNING_SECRET in the last slackMaxSkew.
+func verifySlackSignature(r *http.Request, body []byte, now time.Time) error {
+	ts := r.Header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing request timestamp")
+	}
+	if skew := now.Sub(time.Unix(sec, 0)); skew > slackMaxSkew || skew < -slackMaxSkew {
+		return fmt.Errorf("request timestamp is %s off", skew.Round(time.Second))
+	}
+	mac := hmac.New(sha256.New, []byte(slackSigningSecret))
+	fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(want), []byte(r.Header.Get("X-Slack-Signature"))) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+// slackCommandHandler runs a Slack slash command. It answers within Slack's
+// 3 seconds with an acknowledgement and posts the outcome to the
+// response_url of the command once it is done.
+func (s *Server) slackCommandHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, slackMaxBody))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+	if err := verifySlackSignature(r, body, time.Now()); err != nil {
+		logging.Warning(r.Context(), "rejected %s request: %v", r.URL.Path, err)
+		writeError(w, http.StatusUnauthorized, codeUnauthenticated, "unauthorized")
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	if slackTeamID != "" && form.Get("team_id") != slackTeamID {
+		writeError(w, http.StatusForbidden, codeForbidden, "workspace %s is not allowed", form.Get("team_id"))
+		return
+	}
+
+	user := form.Get("user_id")
+	who := "slack/" + user
+	if name := form.Get("user_name"); name != "" {
+		who = "slack/" + name
+	}
+	ctx := logging.WithFields(r.Context(), "slack_user", user)
+	args := strings.Fields(form.Get("text"))
+	logging.Info(ctx, "slack command %s %s from %s", form.Get("command"), form.Get("text"), who)
+
+	var (
+		ack string
+		run func(ctx context.Context) slackMessage
+	)
+	switch {
+	case len(args) == 0 || args[0] == "help":
+		writeSlack(w, slackMessage{ResponseType: "ephemeral", Text: slackUsage})
+		return
+
+	case args[0] == "status":
+		var region string
+		if len(args) > 1 {
+			region = args[1]
+		}
+		list := regions
+		if region != "" {
+			var v validator
+			v.region("region", &region)
+			if err := v.err(); err != nil {
+				writeSlack(w, slackMessage{ResponseType: "ephemeral", Text: fieldErrors(err)})
+				return
+			}
+			list = []string{region}
+		}
+		ack = "Looking up capacity..."
+		run = func(ctx context.Context) slackMessage { return s.slackStatus(ctx, list) }
+
+	case args[0] == "add":
+		if !slackOperators[user] {
+			writeSlack(w, slackMessage{ResponseType: "ephemeral", Text: "Only SLACK_OPERATORS can buy slots."})
+			return
+		}
+		p, err := parseSlackAdd(args[1:])
+		var (
+			plan     reservationpb.CapacityCommitment_CommitmentPlan
+			deleteAt time.Time
+		)
+		if err == nil {
+			plan, deleteAt, err = p.validate(time.Now())
+		}
+		if err != nil {
+			writeSlack(w, slackMessage{ResponseType: "ephemeral", Text: fieldErrors(err) + "\n" + slackUsage})
+			return
+		}
+		req := purchaseRequest{
+			Project:   p.Project,
+			Region:    p.Region,
+			Slots:     p.ExtraSlot,
+			Plan:      plan,
+			DeleteAt:  deleteAt,
+			DeleteURL: deleteURL(r),
+			Audience:  deleteAudience(r),
+			Requester: who,
+			Reason:    p.Reason,
+			Ticket:    p.Ticket,
+		}
+		ack = fmt.Sprintf("Buying %d slots in %s for %d minutes...", p.ExtraSlot, p.Region, p.Minutes)
+		run = func(ctx context.Context) slackMessage { return s.slackAdd(ctx, req, user) }
+
+	default:
+		writeSlack(w, slackMessage{ResponseType: "ephemeral", Text: fmt.Sprintf("Unknown command %q.\n%s", args[0], slackUsage)})
+		return
+	}
+
+	responseURL := form.Get("response_url")
+	go func() {
+		ctx, cancel := context.WithTimeout(detached{ctx}, slackResponseTimeout)
+		defer cancel()
+		msg := run(ctx)
+		client := &http.Client{Timeout: notifyTimeout}
+		if err := postJSON(ctx, client, responseURL, nil, msg); err != nil {
+			logging.Error(ctx, "posting slack response: %v", err)
+		}
+	}()
+	writeSlack(w, slackMessage{ResponseType: "ephemeral", Text: ack})
+}
+
+// parseSlackAdd reads `<slots> <minutes or duration> [region] [ticket=<id>]
+// [reason]`.
+func parseSlackAdd(args []string) (*Payload, error) {
+	if len(args) < 2 {
+		return nil, errors.New("give the slots and for how long")
+	}
+	slots, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a number of slots", args[0])
+	}
+	minutes, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		d, derr := time.ParseDuration(args[1])
+		if derr != nil || d%time.Minute != 0 {
+			return nil, fmt.Errorf("%q is not a number of minutes or a duration such as 90m", args[1])
+		}
+		minutes = int64(d / time.Minute)
+	}
+	// Slots bought from Slack are always released again.
+	p := &Payload{ExtraSlot: slots, Minutes: minutes, Plan: reservationpb.CapacityCommitment_FLEX.String()}
+	if len(args) > 2 {
+		p.Region = args[2]
+	}
+	if len(args) > 3 {
+		rest := args[3:]
+		if strings.HasPrefix(rest[0], "ticket=") {
+			p.Ticket = strings.TrimPrefix(rest[0], "ticket=")
+			rest = rest[1:]
+		}
+		p.Reason = strings.Join(rest, " ")
+	}
+	return p, nil
+}
+
+// slackAdd buys the capacity of req for user and describes the outcome.
+func (s *Server) slackAdd(ctx context.Context, req purchaseRequest, user string) slackMessage {
+	resp, err := s.purchase(ctx, req)
+	if err != nil {
+		logging.Warning(ctx, "slack purchase for %s: %v", req.Requester, err)
+		return slackMessage{ResponseType: "ephemeral", Text: fmt.Sprintf(":x: Could not buy %d slots in %s: %v", req.Slots, req.Region, err)}
+	}
+	text := fmt.Sprintf(":white_check_mark: <@%s> bought %d slots in %s", user, resp.SlotsPurchased, req.Region)
+	if resp.DeleteAt != nil {
+		text += fmt.Sprintf(", released at %s", resp.DeleteAt.UTC().Format("15:04 MST"))
+	}
+	if resp.EstimatedCost != nil {
+		text += fmt.Sprintf(" (about $%.2f)", *resp.EstimatedCost)
+	}
+	if resp.DryRun {
+		text += ", dry run"
+	}
+	return slackMessage{ResponseType: "in_channel", Text: text + "\n`" + resp.CommitName + "`"}
+}
+
+// slackStatus describes the capacity held in each of list.
+func (s *Server) slackStatus(ctx context.Context, list []string) slackMessage {
+	statuses, pending, errs := s.regionStatuses(ctx, list)
+	var b strings.Builder
+	for _, rs := range statuses {
+		if rs.Error != "" {
+			fmt.Fprintf(&b, "*%s*: %s\n", rs.Name, rs.Error)
+			continue
+		}
+		fmt.Fprintf(&b, "*%s*: %d of %d slots held, %d headroom\n", rs.Name, rs.Held, rs.MaxSlots, rs.Headroom)
+	}
+	for _, c := range pending {
+		fmt.Fprintf(&b, "• %d slots in %s released in %s\n", c.SlotCount, c.Region, time.Until(*c.DeleteAt).Round(time.Minute))
+	}
+	for _, e := range errs {
+		fmt.Fprintf(&b, ":warning: %s\n", e)
+	}
+	return slackMessage{ResponseType: "ephemeral", Text: b.String()}
+}
+
+// fieldErrors describes err in one line per field.
+func fieldErrors(err error) string {
+	var verr *validationError
+	if !errors.As(err, &verr) {
+		return err.Error()
+	}
+	lines := make([]string, 0, len(verr.Fields))
+	for _, f := range verr.Fields {
+		lines = append(lines, fmt.Sprintf("%s %s", f.Field, f.Message))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// writeSlack answers a slash command with msg.
+func writeSlack(w http.ResponseWriter, msg slackMessage) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		logging.Error(context.Background(), "writing slack response: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+)
+
+// STOCKOUT_FALLBACK values, what a FLEX purchase the region has no capacity
+// for does: fail, buy one smaller commitment, or buy the slots as smaller
+// commitments.
+const (
+	fallbackNone   = "none"
+	fallbackShrink = "shrink"
+	fallbackSplit  = "split"
+)
+
+// fallback checks the stockout fallback of p, filling in STOCKOUT_FALLBACK
+// and STOCKOUT_MIN_SLOTS. Only single FLEX purchases fall back, asking for
+// a fallback for others is refused.
+func (v *validator) fallback(p *Payload, plan reservationpb.CapacityCommitment_CommitmentPlan) {
+	if p.FallbackMinSlots == 0 {
+		p.FallbackMinSlots = stockoutMinSlots
+	}
+	v.check(p.FallbackMinSlots > 0 && p.FallbackMinSlots%slotIncrement == 0, "fallback_min_slots", "must be a positive multiple of %d", slotIncrement)
+	if p.Fallback == "" {
+		p.Fallback = stockoutFallback
+		return
+	}
+	switch p.Fallback {
+	case fallbackNone:
+	case fallbackShrink, fallbackSplit:
+		v.check(plan == reservationpb.CapacityCommitment_FLEX, "fallback", "only FLEX purchases fall back")
+		v.check(len(p.RampDown) == 0 && p.ChunkSlots == 0, "fallback", "not supported with ramp_down or chunk_slots")
+		v.check(capacityMode != capacityModeReservation, "fallback", "not supported with CAPACITY_MODE=reservation")
+	default:
+		v.check(false, "fallback", "must be %s, %s or %s", fallbackNone, fallbackShrink, fallbackSplit)
+	}
+}
+
+// purchaseFallback buys req, and if the region has no capacity for it
+// falls back per strategy to sizes halving from req.Slots, in multiples of
+// 100, down to minSlots. shrink buys one commitment of the largest size the
+// region has, split buys as many commitments of it as make up req.Slots,
+// halving again on the next stockout. The response tells the slots bought
+// of those asked for and the fallback taken. When no size is available the
+// first stockout is returned.
+func (s *Server) purchaseFallback(ctx context.Context, req purchaseRequest, strategy string, minSlots int64) (*AddCapacityResponse, error) {
+	resp, err := s.purchase(ctx, req)
+	if strategy == fallbackNone || req.Plan != reservationpb.CapacityCommitment_FLEX || !errors.Is(err, capacity.ErrStockout) {
+		return resp, err
+	}
+	stockout := err
+	logging.Warning(ctx, "%v, falling back to %s down to %d slots", err, strategy, minSlots)
+	reportProgress(ctx, "no capacity for %d slots, falling back to %s", req.Slots, strategy)
+
+	if strategy == fallbackSplit {
+		id, err := randomHex(8)
+		if err != nil {
+			return nil, err
+		}
+		req.Group = "grp-" + id
+		ctx = logging.WithFields(ctx, "group", req.Group)
+	}
+	resp = &AddCapacityResponse{Group: req.Group, SlotsRequested: req.Slots, Plan: req.Plan.String(), Fallback: strategy}
+	size := req.Slots
+	for left := req.Slots; left > 0; {
+		if errors.Is(err, capacity.ErrStockout) {
+			if size = size / 2 / slotIncrement * slotIncrement; size < minSlots {
+				break
+			}
+		}
+		part := req
+		part.Slots = min(size, left)
+		var bought *AddCapacityResponse
+		bought, err = s.purchase(ctx, part)
+		if errors.Is(err, capacity.ErrStockout) {
+			logging.Warning(ctx, "%v", err)
+			continue
+		}
+		if errors.Is(err, capacity.ErrMaxSlots) && resp.SlotsPurchased > 0 {
+			logging.Warning(ctx, "%d of %d slots bought before the cap: %v", resp.SlotsPurchased, req.Slots, err)
+			break
+		}
+		if err != nil {
+			if resp.SlotsPurchased > 0 {
+				logging.Error(ctx, "fallback failed, %d slots bought before it are kept until their deletion", resp.SlotsPurchased)
+			}
+			return nil, err
+		}
+		if strategy == fallbackShrink {
+			bought.SlotsRequested, bought.Fallback = req.Slots, strategy
+			logging.Warning(ctx, "bought %d of %d slots after a stockout", bought.SlotsPurchased, req.Slots)
+			return bought, nil
+		}
+		resp.addStage(bought)
+		left -= bought.SlotsPurchased
+	}
+	if resp.SlotsPurchased == 0 {
+		return nil, stockout
+	}
+	if resp.SlotsPurchased < req.Slots {
+		logging.Warning(ctx, "bought %d of %d slots after a stockout", resp.SlotsPurchased, req.Slots)
+	}
+	return resp, nil
+}
@@ -0,0 +1,603 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go-slot-scheduler/scheduler"
+)
+
+const (
+	// idempotencyTTL is how long a completed request can be replayed.
+	idempotencyTTL = 24 * time.Hour
+	// memLedgerSize bounds the ledger kept by memStore.
+	memLedgerSize = 10000
+	// lockRetryInterval is how often a held lock is tried again.
+	lockRetryInterval = 250 * time.Millisecond
+)
+
+// stateStore persists state that must be shared between instances and survive
+// restarts.
+type stateStore interface {
+	// ReserveIdempotencyKey claims key for a new request for lease, after
+	// which a request that never completed can be taken over. If the key is
+	// held it returns the existing record and false instead.
+	ReserveIdempotencyKey(ctx context.Context, key, requestHash string, lease time.Duration) (*IdempotencyRecord, bool, error)
+	// CompleteIdempotencyKey stores the result to replay for key, for
+	// idempotencyTTL.
+	CompleteIdempotencyKey(ctx context.Context, key string, resp *AddCapacityResponse) error
+	// ReleaseIdempotencyKey forgets key, so a failed request can be retried.
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+
+	// PutCommitment records a commitment bought by the service.
+	PutCommitment(ctx context.Context, rec *CommitmentRecord) error
+	// SetCommitmentDeleteAt changes when a recorded commitment is due for
+	// deletion. A zero time means it is kept until deleted by other means.
+	SetCommitmentDeleteAt(ctx context.Context, name string, deleteAt time.Time) error
+	// SetCommitmentQueue records the queue holding the delete task of a
+	// recorded commitment.
+	SetCommitmentQueue(ctx context.Context, name, queue string) error
+	// ListCommitments returns every recorded commitment.
+	ListCommitments(ctx context.Context) ([]*CommitmentRecord, error)
+	// ForgetCommitment removes the record of a deleted commitment.
+	ForgetCommitment(ctx context.Context, name string) error
+
+	// RecordEvent appends an entry to the ledger of scaling actions.
+	RecordEvent(ctx context.Context, e *LedgerEntry) error
+	// ListEvents returns the ledger entries from since on, oldest first.
+	ListEvents(ctx context.Context, since time.Time) ([]*LedgerEntry, error)
+	// QueryEvents returns a page of the ledger entries selected by q, newest
+	// first.
+	QueryEvents(ctx context.Context, q EventQuery) ([]*LedgerEntry, error)
+
+	// PutSchedule creates or replaces a schedule.
+	PutSchedule(ctx context.Context, sc *scheduler.Schedule) error
+	// GetSchedule returns the schedule id, or errScheduleNotFound.
+	GetSchedule(ctx context.Context, id string) (*scheduler.Schedule, error)
+	// ListSchedules returns every schedule.
+	ListSchedules(ctx context.Context) ([]*scheduler.Schedule, error)
+	// DeleteSchedule removes the schedule id.
+	DeleteSchedule(ctx context.Context, id string) error
+
+	// PutProfile creates or replaces a capacity profile.
+	PutProfile(ctx context.Context, p *scheduler.Profile) error
+	// GetProfile returns the profile id, or errProfileNotFound.
+	GetProfile(ctx context.Context, id string) (*scheduler.Profile, error)
+	// ListProfiles returns every profile.
+	ListProfiles(ctx context.Context) ([]*scheduler.Profile, error)
+	// DeleteProfile removes the profile id.
+	DeleteProfile(ctx context.Context, id string) error
+
+	// PutTask records a pending task, or returns errTaskExists if a task of
+	// the same name is pending.
+	PutTask(ctx context.Context, rec *TaskRecord) error
+	// GetTask returns the pending task name, or errTaskNotFound.
+	GetTask(ctx context.Context, name string) (*TaskRecord, error)
+	// ListTasks returns every pending task.
+	ListTasks(ctx context.Context) ([]*TaskRecord, error)
+	// DeleteTask removes the pending task name, or returns errTaskNotFound.
+	DeleteTask(ctx context.Context, name string) error
+
+	// CreateFreeze freezes purchases with f, or returns false if they are
+	// frozen already.
+	CreateFreeze(ctx context.Context, f *Freeze) (bool, error)
+	// GetFreeze returns the freeze in force, nil if there is none.
+	GetFreeze(ctx context.Context) (*Freeze, error)
+	// LiftFreeze lifts the freeze in force, keeping a record of who lifted
+	// it and when, and returns it, nil if there was none.
+	LiftFreeze(ctx context.Context, by string, at time.Time) (*Freeze, error)
+	// FreezeLifted reports whether a freeze for budget in the billing
+	// interval starting at interval was lifted.
+	FreezeLifted(ctx context.Context, budget, interval string) (bool, error)
+
+	// GetTotal, PutTotal and DropTotal keep the slots counted toward the cap
+	// of a parent, with CAP_CACHE_TTL, see capacity.TotalsStore.
+	GetTotal(ctx context.Context, parent string) (total int64, listedAt time.Time, ok bool, err error)
+	PutTotal(ctx context.Context, parent string, total int64, listedAt time.Time) error
+	DropTotal(ctx context.Context, parent string) error
+
+	// PutOperation creates or replaces an operation run in the background.
+	PutOperation(ctx context.Context, op *AsyncOperation) error
+	// GetOperation returns the operation id, or errOperationNotFound once it
+	// expired.
+	GetOperation(ctx context.Context, id string) (*AsyncOperation, error)
+
+	// Lock blocks until it holds the lock called name, or ctx is done. The
+	// lock is released by calling unlock, or after ttl in case the holder
+	// died.
+	Lock(ctx context.Context, name string, ttl time.Duration) (unlock func(), err error)
+
+	Close() error
+}
+
+// IdempotencyRecord is the stored outcome of a request made with an
+// Idempotency-Key. Response is nil while the request is still in flight, and
+// ExpireAt then the end of its lease.
+type IdempotencyRecord struct {
+	Key         string               `firestore:"key"`
+	RequestHash string               `firestore:"request_hash"`
+	Response    *AddCapacityResponse `firestore:"response"`
+	CreatedAt   time.Time            `firestore:"created_at"`
+	ExpireAt    time.Time            `firestore:"expire_at"`
+}
+
+// CommitmentRecord is a commitment bought by the service, with what the
+// reconciler needs to delete it or schedule its deletion again.
+type CommitmentRecord struct {
+	Name      string    `firestore:"name"`
+	Region    string    `firestore:"region"`
+	SlotCount int64     `firestore:"slot_count"`
+	Plan      string    `firestore:"plan"`
+	DeleteURL string    `firestore:"delete_url"`
+	Audience  string    `firestore:"audience"`
+	CreatedAt time.Time `firestore:"created_at"`
+	DeleteAt  time.Time `firestore:"delete_at"`
+	// Requester is who the commitment was bought for, such as
+	// profile/{id}.
+	Requester string `firestore:"requester"`
+	// Group is the group of commitments bought for the same request, if it
+	// was split.
+	Group string `firestore:"group"`
+	// PostponedFrom is when the deletion was first due, if it was postponed
+	// since.
+	PostponedFrom time.Time `firestore:"postponed_from"`
+	// Queue is the queue holding its delete task, when failing over between
+	// QUEUES.
+	Queue string `firestore:"queue"`
+	// RequestID is the X-Request-ID of the purchase, its deletion is
+	// scheduled again under it.
+	RequestID string `firestore:"request_id"`
+}
+
+// TaskRecord is a pending task of a delete scheduler keeping its tasks in
+// the state store. Task is the taskspb.Task encoded as JSON, or in the
+// binary v2beta3 encoding of the records kept before Format.
+type TaskRecord struct {
+	Name         string    `firestore:"name"`
+	ScheduleTime time.Time `firestore:"schedule_time"`
+	Task         []byte    `firestore:"task"`
+	Format       string    `firestore:"format"`
+}
+
+// taskFormatJSON is the Format of the tasks encoded as JSON, which decode
+// with either version of the Cloud Tasks API.
+const taskFormatJSON = "json"
+
+var (
+	errTaskExists   = errors.New("task already exists")
+	errTaskNotFound = errors.New("task not found")
+)
+
+// hashKey turns an arbitrary client supplied key into a fixed length ID.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating random id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// memStore is a stateStore local to the process, for single instance
+// deployments and development.
+type memStore struct {
+	mu          sync.Mutex
+	keys        map[string]*IdempotencyRecord
+	commitments map[string]*CommitmentRecord
+	ledger      []*LedgerEntry
+	schedules   map[string]*scheduler.Schedule
+	profiles    map[string]*scheduler.Profile
+	tasks       map[string]*TaskRecord
+	freeze      *Freeze
+	lifted      map[string]*Freeze
+	totals      map[string]slotTotal
+	operations  map[string]*AsyncOperation
+	locks       map[string]chan struct{}
+}
+
+// slotTotal is the slots counted toward the cap of Parent when its
+// commitments were listed at ListedAt.
+type slotTotal struct {
+	Parent   string    `firestore:"parent"`
+	Total    int64     `firestore:"total"`
+	ListedAt time.Time `firestore:"listed_at"`
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		keys:        make(map[string]*IdempotencyRecord),
+		commitments: make(map[string]*CommitmentRecord),
+		schedules:   make(map[string]*scheduler.Schedule),
+		profiles:    make(map[string]*scheduler.Profile),
+		tasks:       make(map[string]*TaskRecord),
+		totals:      make(map[string]slotTotal),
+		operations:  make(map[string]*AsyncOperation),
+		lifted:      make(map[string]*Freeze),
+		locks:       make(map[string]chan struct{}),
+	}
+}
+
+func (m *memStore) ReserveIdempotencyKey(ctx context.Context, key, requestHash string, lease time.Duration) (*IdempotencyRecord, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for k, rec := range m.keys {
+		if !now.Before(rec.ExpireAt) {
+			delete(m.keys, k)
+		}
+	}
+	if rec, ok := m.keys[key]; ok {
+		return rec, false, nil
+	}
+	m.keys[key] = &IdempotencyRecord{Key: key, RequestHash: requestHash, CreatedAt: now, ExpireAt: now.Add(lease)}
+	return m.keys[key], true, nil
+}
+
+func (m *memStore) CompleteIdempotencyKey(ctx context.Context, key string, resp *AddCapacityResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if rec, ok := m.keys[key]; ok {
+		rec.Response = resp
+		rec.ExpireAt = time.Now().Add(idempotencyTTL)
+	}
+	return nil
+}
+
+func (m *memStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.keys, key)
+	return nil
+}
+
+func (m *memStore) PutCommitment(ctx context.Context, rec *CommitmentRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := *rec
+	m.commitments[rec.Name] = &c
+	return nil
+}
+
+func (m *memStore) SetCommitmentDeleteAt(ctx context.Context, name string, deleteAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if rec, ok := m.commitments[name]; ok {
+		rec.DeleteAt = deleteAt
+	}
+	return nil
+}
+
+func (m *memStore) SetCommitmentQueue(ctx context.Context, name, queue string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if rec, ok := m.commitments[name]; ok {
+		rec.Queue = queue
+	}
+	return nil
+}
+
+func (m *memStore) ListCommitments(ctx context.Context) ([]*CommitmentRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := make([]*CommitmentRecord, 0, len(m.commitments))
+	for _, rec := range m.commitments {
+		c := *rec
+		list = append(list, &c)
+	}
+	return list, nil
+}
+
+func (m *memStore) ForgetCommitment(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.commitments, name)
+	return nil
+}
+
+func (m *memStore) RecordEvent(ctx context.Context, e *LedgerEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := *e
+	m.ledger = append(m.ledger, &entry)
+	if len(m.ledger) > memLedgerSize {
+		m.ledger = m.ledger[len(m.ledger)-memLedgerSize:]
+	}
+	return nil
+}
+
+func (m *memStore) QueryEvents(ctx context.Context, q EventQuery) ([]*LedgerEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	page := eventPage{q: q, list: []*LedgerEntry{}}
+	for i := len(m.ledger) - 1; i >= 0; i-- {
+		entry := *m.ledger[i]
+		if page.add(&entry) {
+			break
+		}
+	}
+	return page.list, nil
+}
+
+func (m *memStore) ListEvents(ctx context.Context, since time.Time) ([]*LedgerEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var list []*LedgerEntry
+	for _, e := range m.ledger {
+		if !e.Time.Before(since) {
+			entry := *e
+			list = append(list, &entry)
+		}
+	}
+	return list, nil
+}
+
+func (m *memStore) PutSchedule(ctx context.Context, sc *scheduler.Schedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := *sc
+	m.schedules[sc.ID] = &c
+	return nil
+}
+
+func (m *memStore) GetSchedule(ctx context.Context, id string) (*scheduler.Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sc, ok := m.schedules[id]
+	if !ok {
+		return nil, errScheduleNotFound
+	}
+	c := *sc
+	return &c, nil
+}
+
+func (m *memStore) ListSchedules(ctx context.Context) ([]*scheduler.Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := make([]*scheduler.Schedule, 0, len(m.schedules))
+	for _, sc := range m.schedules {
+		c := *sc
+		list = append(list, &c)
+	}
+	return list, nil
+}
+
+func (m *memStore) DeleteSchedule(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.schedules, id)
+	return nil
+}
+
+func (m *memStore) PutProfile(ctx context.Context, p *scheduler.Profile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := *p
+	m.profiles[p.ID] = &c
+	return nil
+}
+
+func (m *memStore) GetProfile(ctx context.Context, id string) (*scheduler.Profile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.profiles[id]
+	if !ok {
+		return nil, errProfileNotFound
+	}
+	c := *p
+	return &c, nil
+}
+
+func (m *memStore) ListProfiles(ctx context.Context) ([]*scheduler.Profile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := make([]*scheduler.Profile, 0, len(m.profiles))
+	for _, p := range m.profiles {
+		c := *p
+		list = append(list, &c)
+	}
+	return list, nil
+}
+
+func (m *memStore) DeleteProfile(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.profiles, id)
+	return nil
+}
+
+func (m *memStore) PutTask(ctx context.Context, rec *TaskRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tasks[rec.Name]; ok {
+		return errTaskExists
+	}
+	c := *rec
+	m.tasks[rec.Name] = &c
+	return nil
+}
+
+func (m *memStore) GetTask(ctx context.Context, name string) (*TaskRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec, ok := m.tasks[name]
+	if !ok {
+		return nil, errTaskNotFound
+	}
+	c := *rec
+	return &c, nil
+}
+
+func (m *memStore) ListTasks(ctx context.Context) ([]*TaskRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := make([]*TaskRecord, 0, len(m.tasks))
+	for _, rec := range m.tasks {
+		c := *rec
+		list = append(list, &c)
+	}
+	return list, nil
+}
+
+func (m *memStore) DeleteTask(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tasks[name]; !ok {
+		return errTaskNotFound
+	}
+	delete(m.tasks, name)
+	return nil
+}
+
+func (m *memStore) CreateFreeze(ctx context.Context, f *Freeze) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.freeze != nil {
+		return false, nil
+	}
+	c := *f
+	m.freeze = &c
+	return true, nil
+}
+
+func (m *memStore) GetFreeze(ctx context.Context) (*Freeze, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.freeze == nil {
+		return nil, nil
+	}
+	c := *m.freeze
+	return &c, nil
+}
+
+func (m *memStore) LiftFreeze(ctx context.Context, by string, at time.Time) (*Freeze, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.freeze == nil {
+		return nil, nil
+	}
+	f := m.freeze
+	f.LiftedBy, f.LiftedAt = by, &at
+	m.lifted[f.liftKey()] = f
+	m.freeze = nil
+	c := *f
+	return &c, nil
+}
+
+func (m *memStore) FreezeLifted(ctx context.Context, budget, interval string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.lifted[(&Freeze{Budget: budget, Interval: interval}).liftKey()]
+	return ok, nil
+}
+
+func (m *memStore) GetTotal(ctx context.Context, parent string) (int64, time.Time, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.totals[parent]
+	return t.Total, t.ListedAt, ok, nil
+}
+
+func (m *memStore) PutTotal(ctx context.Context, parent string, total int64, listedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.totals[parent] = slotTotal{Parent: parent, Total: total, ListedAt: listedAt}
+	return nil
+}
+
+func (m *memStore) DropTotal(ctx context.Context, parent string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.totals, parent)
+	return nil
+}
+
+func (m *memStore) PutOperation(ctx context.Context, op *AsyncOperation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.operations[op.ID]; !ok {
+		now := time.Now()
+		for id, old := range m.operations {
+			if now.After(old.ExpireAt) {
+				delete(m.operations, id)
+			}
+		}
+	}
+	c := *op
+	c.Progress = append([]string(nil), op.Progress...)
+	m.operations[op.ID] = &c
+	return nil
+}
+
+func (m *memStore) GetOperation(ctx context.Context, id string) (*AsyncOperation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	op, ok := m.operations[id]
+	if !ok || time.Now().After(op.ExpireAt) {
+		return nil, errOperationNotFound
+	}
+	c := *op
+	return &c, nil
+}
+
+// Lock ignores ttl, a process local lock can't outlive its holder.
+func (m *memStore) Lock(ctx context.Context, name string, ttl time.Duration) (func(), error) {
+	m.mu.Lock()
+	lock, ok := m.locks[name]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		m.locks[name] = lock
+	}
+	m.mu.Unlock()
+
+	select {
+	case lock <- struct{}{}:
+		return func() { <-lock }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (m *memStore) Close() error { return nil }
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+)
+
+const (
+	// regionListParallelism bounds how many regions are listed at once.
+	regionListParallelism = 8
+	// regionListTimeout bounds the listing of one region, so a slow one
+	// doesn't hold up the others.
+	regionListTimeout = 5 * time.Second
+	// summaryCacheTTL is how long a capacity summary is served again.
+	summaryCacheTTL = 10 * time.Second
+)
+
+// CapacitySummary is the capacity held in each of REGIONS against its cap.
+type CapacitySummary struct {
+	Regions []RegionCapacity `json:"regions"`
+	Held    int64            `json:"held"`
+	// AsOf is when the commitments were listed, at most 10 seconds ago.
+	AsOf time.Time `json:"as_of"`
+}
+
+// RegionCapacity is the capacity held in a region, or why it couldn't be
+// listed.
+type RegionCapacity struct {
+	Region      string `json:"region"`
+	MaxSlots    int64  `json:"max_slots"`
+	Held        int64  `json:"held"`
+	Headroom    int64  `json:"headroom"`
+	Commitments int    `json:"commitments"`
+	Error       string `json:"error,omitempty"`
+}
+
+// summaryCache holds the last capacity summary for summaryCacheTTL.
+type summaryCache struct {
+	mu      sync.Mutex
+	summary *CapacitySummary
+}
+
+// capacitySummaryHandler sums up the commitments held in each of REGIONS
+// against its cap. The summary is cached briefly, ?fresh=true lists again.
+func (s *Server) capacitySummaryHandler(w http.ResponseWriter, r *http.Request) {
+	fresh, _ := strconv.ParseBool(r.URL.Query().Get("fresh"))
+	writeJSON(w, http.StatusOK, s.capacitySummary(r.Context(), fresh))
+}
+
+// capacitySummary returns the cached summary, or lists the regions again
+// when it is older than summaryCacheTTL or fresh is set. Concurrent calls
+// wait for the one listing. Summaries with regions that failed are not
+// cached.
+func (s *Server) capacitySummary(ctx context.Context, fresh bool) *CapacitySummary {
+	s.summaries.mu.Lock()
+	defer s.summaries.mu.Unlock()
+	if c := s.summaries.summary; c != nil && !fresh && time.Since(c.AsOf) < summaryCacheTTL {
+		return c
+	}
+
+	summary := &CapacitySummary{Regions: make([]RegionCapacity, len(regions)), AsOf: time.Now()}
+	lists, errs := s.listRegions(ctx, regions)
+	failed := false
+	for i, region := range regions {
+		rc := RegionCapacity{Region: region, MaxSlots: maxSlotsFor(projectID, region)}
+		if errs[i] != nil {
+			rc.Error, failed = errs[i].Error(), true
+			logging.Error(ctx, "listing commitments in %s: %v", region, errs[i])
+		}
+		for _, c := range lists[i] {
+			rc.Held += c.SlotCount
+		}
+		rc.Commitments = len(lists[i])
+		if rc.Headroom = rc.MaxSlots - rc.Held; rc.Headroom < 0 {
+			rc.Headroom = 0
+		}
+		summary.Regions[i] = rc
+		summary.Held += rc.Held
+	}
+	if !failed {
+		s.summaries.summary = summary
+	}
+	return summary
+}
+
+// listRegions lists the commitments of each of list in the service's
+// project, regionListParallelism at a time, each within regionListTimeout.
+// The commitments and error of each region are at its index.
+func (s *Server) listRegions(ctx context.Context, list []string) ([][]*reservationpb.CapacityCommitment, []error) {
+	commitments := make([][]*reservationpb.CapacityCommitment, len(list))
+	errs := make([]error, len(list))
+	sem := make(chan struct{}, regionListParallelism)
+	var wg sync.WaitGroup
+	for i, region := range list {
+		wg.Add(1)
+		go func(i int, region string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			ctx, cancel := context.WithTimeout(ctx, regionListTimeout)
+			defer cancel()
+			commitments[i], errs[i] = s.capacity.List(ctx, capacity.Parent(projectID, region))
+		}(i, region)
+	}
+	wg.Wait()
+	return commitments, errs
+}
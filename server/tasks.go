@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/internal/taskspb"
+	"go-slot-scheduler/tasks"
+)
+
+var errNoDeleteTask = errors.New("no pending delete task for commitment")
+
+// findDeleteTask returns the pending delete task of commitName, or
+// errNoDeleteTask if there is none. The task is looked up by its deterministic
+// name first, then by the name it was rescheduled under, from the delete time
+// recorded, and only then among the queued tasks, for tasks of commitments
+// not recorded.
+func (s *Server) findDeleteTask(ctx context.Context, commitName string) (*taskspb.Task, error) {
+	var rec *CommitmentRecord
+	if _, ok := s.queue.(*tasks.Queues); ok {
+		// Looked up in the queue it failed over to first.
+		rec, _ = s.commitmentRecord(ctx, commitName)
+	}
+	task, err := s.queue.Get(ctx, inRecordedQueue(s.queue.DeleteTaskName(commitName), rec))
+	if status.Code(err) != codes.NotFound {
+		return task, err
+	}
+	if rec == nil {
+		rec, _ = s.commitmentRecord(ctx, commitName)
+	}
+	if rec != nil && !rec.DeleteAt.IsZero() {
+		task, err := s.queue.Get(ctx, inRecordedQueue(s.queue.RescheduledTaskName(commitName, rec.DeleteAt), rec))
+		if status.Code(err) != codes.NotFound {
+			return task, err
+		}
+	}
+
+	pending, err := s.pendingDeletes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if task, ok := pending[commitName]; ok {
+		return task, nil
+	}
+	return nil, errNoDeleteTask
+}
+
+// inRecordedQueue moves the task name to the queue recorded for rec, if any.
+func inRecordedQueue(name string, rec *CommitmentRecord) string {
+	if rec == nil || rec.Queue == "" {
+		return name
+	}
+	return tasks.InQueue(name, rec.Queue)
+}
+
+// recordTaskQueue records the queue holding task, the delete task of
+// commitName, when failing over between QUEUES.
+func (s *Server) recordTaskQueue(ctx context.Context, commitName string, task *taskspb.Task) {
+	if _, ok := s.queue.(*tasks.Queues); !ok {
+		return
+	}
+	queue := tasks.QueueOf(task.Name)
+	if queue != queueName() {
+		logging.Warning(ctx, "delete task of %s failed over to %s", commitName, queue)
+	}
+	if err := s.store.SetCommitmentQueue(ctx, commitName, queue); err != nil {
+		logging.Error(ctx, "recording queue of %s: %v", commitName, err)
+	}
+}
+
+// cancelDeleteHandler removes the pending delete task of a commitment, keeping
+// the commitment until it is deleted by other means.
+func (s *Server) cancelDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	var c Commit
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	if c.CommitID == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "required CommitID not provided")
+		return
+	}
+	s.cancelDeleteOf(w, r, c.CommitID)
+}
+
+// cancelDeleteOf cancels the pending deletion of the commitment named
+// commitName, answering the commitment.
+func (s *Server) cancelDeleteOf(w http.ResponseWriter, r *http.Request, commitName string) {
+	r = r.WithContext(logging.WithFields(r.Context(), "commit", commitName, "region", capacity.Region(commitName)))
+	commit, err := s.cancelDelete(r.Context(), commitName)
+	if err != nil {
+		if errors.Is(err, errNoDeleteTask) {
+			writeError(w, http.StatusNotFound, codeDeleteTaskNotFound, "%v", err)
+			return
+		}
+
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+
+	s.record(r.Context(), LedgerEntry{Action: actionDeleteCancelled, Commitment: commitName, Slots: commit.SlotCount, Requester: requester(r)})
+	writeJSON(w, http.StatusOK, commitmentInfo(commit, nil))
+}
+
+func (s *Server) cancelDelete(ctx context.Context, commitName string) (*reservationpb.CapacityCommitment, error) {
+	task, err := s.findDeleteTask(ctx, commitName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.queue.Delete(ctx, task.Name); err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, errNoDeleteTask
+		}
+		return nil, fmt.Errorf("deleting task %s: %v", task.Name, err)
+	}
+	logging.Info(ctx, "delete task %s cancelled for commitment %s", task.Name, commitName)
+	if err := s.store.SetCommitmentDeleteAt(ctx, commitName, time.Time{}); err != nil {
+		logging.Error(ctx, "recording cancelled delete of %s: %v", commitName, err)
+	}
+
+	commit, err := s.capacity.Get(ctx, commitName)
+	if err != nil {
+		return nil, fmt.Errorf("getting commitment: %v", err)
+	}
+	return commit, nil
+}
+
+// Extend request for extendCapacityHandler
+type Extend struct {
+	CommitID string `json:"commit_id"`
+	Minutes  int64  `json:"minutes"`
+}
+
+// extendCapacityHandler pushes back the pending deletion of a commitment by
+// the requested number of minutes.
+func (s *Server) extendCapacityHandler(w http.ResponseWriter, r *http.Request) {
+	var e Extend
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+
+	if e.CommitID == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "required CommitID not provided")
+		return
+	}
+	s.extend(w, r, e)
+}
+
+// extend pushes back the pending deletion of e.CommitID, answering the
+// commitment with its new deletion time.
+func (s *Server) extend(w http.ResponseWriter, r *http.Request, e Extend) {
+	if e.Minutes <= 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "minutes must be greater than zero")
+		return
+	}
+
+	r = r.WithContext(logging.WithFields(r.Context(), "commit", e.CommitID, "region", capacity.Region(e.CommitID)))
+	task, err := s.extendDelete(r.Context(), e.CommitID, time.Duration(e.Minutes)*time.Minute)
+	if err != nil {
+		if errors.Is(err, errNoDeleteTask) {
+			writeError(w, http.StatusNotFound, codeDeleteTaskNotFound, "%v", err)
+			return
+		}
+		var verr *validationError
+		if errors.As(err, &verr) {
+			writeValidationError(w, err)
+			return
+		}
+
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+
+	s.record(r.Context(), LedgerEntry{Action: actionDeleteRescheduled, Commitment: e.CommitID, DeleteAt: timePtr(task.ScheduleTime.AsTime()), Requester: requester(r)})
+
+	commit, err := s.capacity.Get(r.Context(), e.CommitID)
+	if status.Code(err) == codes.NotFound {
+		writeError(w, http.StatusNotFound, codeCommitNotFound, "commitment %s not found", e.CommitID)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "getting commitment: %v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, commitmentInfo(commit, task))
+}
+
+// extendDelete moves the pending delete task of commitName back by d. The new
+// task is created before the old one is removed, so a failure part way never
+// leaves the commitment without a scheduled deletion. Moving it past
+// MAX_MINUTES, which the reconciler would undo, is a *validationError.
+func (s *Server) extendDelete(ctx context.Context, commitName string, d time.Duration) (*taskspb.Task, error) {
+	old, err := s.findDeleteTask(ctx, commitName)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteAt := old.ScheduleTime.AsTime().Add(d)
+	rec, err := s.commitmentRecord(ctx, commitName)
+	if err != nil {
+		return nil, err
+	}
+	if rec != nil {
+		var v validator
+		v.deleteAt("minutes", rec, deleteAt)
+		if err := v.err(); err != nil {
+			return nil, err
+		}
+	}
+	t := &taskspb.Task{
+		Name:         s.queue.RescheduledTaskName(commitName, deleteAt),
+		ScheduleTime: timestamppb.New(deleteAt),
+	}
+	taskspb.SetHTTPRequest(t, old.GetHttpRequest())
+	task, err := s.queue.Create(ctx, t)
+	if err != nil {
+		return nil, fmt.Errorf("creating rescheduled task: %v", err)
+	}
+
+	if err := s.queue.Delete(ctx, old.Name); err != nil && status.Code(err) != codes.NotFound {
+		if derr := s.queue.Delete(ctx, task.Name); derr != nil {
+			logging.Error(ctx, "removing rescheduled task %s: %v", task.Name, derr)
+		}
+		return nil, fmt.Errorf("deleting task %s: %v", old.Name, err)
+	}
+
+	logging.Info(ctx, "delete task for commitment %s moved from %s to %s", commitName, old.Name, task.Name)
+	s.recordTaskQueue(ctx, commitName, task)
+	if err := s.store.SetCommitmentDeleteAt(ctx, commitName, deleteAt); err != nil {
+		logging.Error(ctx, "recording new delete time of %s: %v", commitName, err)
+	}
+	return task, nil
+}
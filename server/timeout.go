@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// untimedRoutes stream for as long as the client listens, they are only
+// bounded when ENDPOINT_TIMEOUTS_JSON says so.
+var untimedRoutes = map[string]bool{
+	"GET " + v1Prefix + eventsPath: true,
+}
+
+// parseEndpointTimeouts reads ENDPOINT_TIMEOUTS_JSON, the timeouts of the
+// routes that don't use REQUEST_TIMEOUT by method and path template under
+// /v1, e.g. {"POST /v1/capacity":"3m","GET /v1/history":"10s"}. 0 lets a
+// route run unbounded.
+func parseEndpointTimeouts(v string) (map[string]time.Duration, error) {
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(v), &raw); err != nil {
+		return nil, fmt.Errorf("cannot parse ENDPOINT_TIMEOUTS_JSON: %v", err)
+	}
+	timeouts := make(map[string]time.Duration, len(raw))
+	for route, d := range raw {
+		if _, ok := apiDocs[route]; !ok {
+			return nil, fmt.Errorf("ENDPOINT_TIMEOUTS_JSON: %q is not a route, want the method and path as in the OpenAPI document, e.g. \"POST %s%s\"", route, v1Prefix, capacityPath)
+		}
+		timeout, err := time.ParseDuration(d)
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("ENDPOINT_TIMEOUTS_JSON: timeout of %s must be a duration, 0 for none", route)
+		}
+		timeouts[route] = timeout
+	}
+	return timeouts, nil
+}
+
+// WriteTimeout is how long the server gets to write a response: longer than
+// the longest request timeout, so requests answer their own 504 first, and
+// at least the minute requests always had.
+func WriteTimeout() time.Duration {
+	longest := requestTimeout
+	for _, d := range endpointTimeouts {
+		if d > longest {
+			longest = d
+		}
+	}
+	if longest+5*time.Second > time.Minute {
+		return longest + 5*time.Second
+	}
+	return time.Minute
+}
+
+// routeKey returns the method and path template under /v1 of the route r
+// matched, renamed routes by their successor.
+func routeKey(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	key := r.Method + " " + tmpl
+	if successor, ok := renamedRoutes[key]; ok {
+		return successor
+	}
+	if !strings.HasPrefix(tmpl, v1Prefix) {
+		return r.Method + " " + v1Prefix + tmpl
+	}
+	return key
+}
+
+// timeoutFor returns how long the route key gets to answer, 0 for no bound.
+func timeoutFor(key string) time.Duration {
+	if d, ok := endpointTimeouts[key]; ok {
+		return d
+	}
+	if untimedRoutes[key] {
+		return 0
+	}
+	return requestTimeout
+}
+
+// withTimeout bounds each request by the timeout of its route, through the
+// deadline of its context, which the calls to Google Cloud it makes carry. A
+// request that fails past its deadline, or answers nothing, answers a 504
+// DEADLINE_EXCEEDED with the message and details of the error it failed with.
+// Work that must finish once started, such as recording a purchase and
+// scheduling its deletion or rolling it back, detaches from the deadline.
+// Requests run in the background are bounded by the operation instead.
+func withTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := routeKey(r)
+		timeout := timeoutFor(key)
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		tw := &timeoutWriter{ResponseWriter: w, ctx: ctx}
+		next.ServeHTTP(tw, r.WithContext(ctx))
+		tw.finish(fmt.Sprintf("%s did not complete within %s", key, timeout))
+	})
+}
+
+// timeoutWriter holds back the server error a request answers past its
+// deadline, for withTimeout to answer a 504 in its place.
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx   context.Context
+	wrote bool
+	// held is the body of the error held back.
+	held *bytes.Buffer
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	if code >= 500 && w.ctx.Err() == context.DeadlineExceeded {
+		w.held = new(bytes.Buffer)
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush lets streamed responses through.
+func (w *timeoutWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && w.held == nil {
+		f.Flush()
+	}
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.held != nil {
+		return w.held.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// finish answers the 504 of a request past its deadline that failed or
+// answered nothing. It is only retryable if the error held back was, a
+// purchase may have gone through.
+func (w *timeoutWriter) finish(message string) {
+	if w.held == nil && (w.wrote || w.ctx.Err() != context.DeadlineExceeded) {
+		return
+	}
+	e := &APIError{Code: codeDeadlineExceeded, Message: message}
+	var body struct {
+		Error *APIError `json:"error"`
+	}
+	if w.held != nil && json.Unmarshal(w.held.Bytes(), &body) == nil && body.Error != nil {
+		e.Message += ": " + body.Error.Message
+		e.Details, e.Retryable = body.Error.Details, body.Error.Retryable
+	}
+	writeAPIError(w.ResponseWriter, http.StatusGatewayTimeout, e)
+}
+
+// endpointTimeoutSettings lists REQUEST_TIMEOUT as "default" and the
+// timeouts of ENDPOINT_TIMEOUTS_JSON, for the effective config.
+func endpointTimeoutSettings() map[string]string {
+	m := map[string]string{"default": requestTimeout.String()}
+	for route, d := range endpointTimeouts {
+		m[route] = d.String()
+	}
+	return m
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"sort"
+	"time"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+const (
+	// uiHistorySize is how many ledger entries the dashboard shows.
+	uiHistorySize = 25
+	// uiHistoryWindow is how far back the dashboard looks for them.
+	uiHistoryWindow = 7 * 24 * time.Hour
+)
+
+//go:embed ui/dashboard.html
+var uiFiles embed.FS
+
+// dashboard is the page served at /ui.
+var dashboard = template.Must(template.New("dashboard.html").Funcs(template.FuncMap{
+	"time": func(v interface{}) string {
+		var t time.Time
+		switch v := v.(type) {
+		case time.Time:
+			t = v
+		case *time.Time:
+			if v != nil {
+				t = *v
+			}
+		}
+		if t.IsZero() {
+			return "-"
+		}
+		return t.UTC().Format("2006-01-02 15:04:05 UTC")
+	},
+	"rfc3339": func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	},
+	"percent": func(n, of int64) int64 {
+		if of <= 0 {
+			return 0
+		}
+		return n * 100 / of
+	},
+}).ParseFS(uiFiles, "ui/dashboard.html"))
+
+// regionStatus is the capacity held in a region against its cap.
+type regionStatus struct {
+	Name        string
+	MaxSlots    int64
+	Held        int64
+	Headroom    int64
+	Commitments []CommitmentInfo
+	Error       string
+}
+
+// uiPage is the data of the dashboard.
+type uiPage struct {
+	Project string
+	User    string
+	// Operator shows the add, extend and cancel buttons.
+	Operator bool
+	// Required are the REQUIRED_METADATA fields of the add form.
+	Required map[string]bool
+	DryRun   bool
+	Regions  []*regionStatus
+	Pending  []CommitmentInfo
+	History  []*LedgerEntry
+	Errors   []string
+	Now      time.Time
+}
+
+// uiUser identifies the user of the dashboard: the email of the IAP signed
+// header when IAP_AUDIENCE is set. Without it users can't be verified, and
+// are anonymous.
+func uiUser(r *http.Request) (string, error) {
+	if iapAudience == "" {
+		return "", nil
+	}
+	return iapUser(r)
+}
+
+// uiOperator reports whether user, verified by uiUser, may change capacity
+// from the dashboard: anyone with FAKE_BACKENDS, otherwise the UI_OPERATORS.
+func uiOperator(user string) bool {
+	return fakeBackends || user != "" && uiOperators[user]
+}
+
+// uiHandler renders the dashboard: the commitments of every region against
+// its cap, the deletions pending and the latest ledger entries.
+func (s *Server) uiHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		user     string
+		operator bool
+		err      error
+	)
+	if authEnabled() {
+		// Authenticated by authorize, the buttons follow the role.
+		if p := principalOf(r.Context()); p != nil {
+			user = p.Name
+		}
+		operator = hasRole(r, roleOperator)
+	} else if user, err = uiUser(r); err != nil {
+		logging.Warning(r.Context(), "rejected %s request: %v", r.URL.Path, err)
+		writeError(w, http.StatusUnauthorized, codeUnauthenticated, "unauthorized")
+		return
+	} else {
+		operator = uiOperator(user)
+	}
+
+	ctx := r.Context()
+	page := &uiPage{Project: projectID, User: user, Operator: operator, Required: requiredMetadata, DryRun: dryRun, Now: time.Now()}
+	page.Regions, page.Pending, page.Errors = s.regionStatuses(ctx, regions)
+	page.History, err = s.store.QueryEvents(ctx, EventQuery{From: page.Now.Add(-uiHistoryWindow), Limit: uiHistorySize})
+	if err != nil {
+		page.Errors = append(page.Errors, fmt.Sprintf("reading ledger: %v", err))
+		logging.Error(ctx, "reading ledger: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := dashboard.Execute(w, page); err != nil {
+		logging.Error(ctx, "rendering dashboard: %v", err)
+	}
+}
+
+// regionStatuses lists the commitments held in each of list, concurrently,
+// and those of them with a pending deletion, soonest first. Regions that
+// can't be listed carry the error, tasks that can't be listed are reported
+// in errs.
+func (s *Server) regionStatuses(ctx context.Context, list []string) (statuses []*regionStatus, pending []CommitmentInfo, errs []string) {
+	tasks, err := s.pendingDeletes(ctx)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("listing delete tasks: %v", err))
+		logging.Error(ctx, "listing delete tasks: %v", err)
+	}
+	lists, listErrs := s.listRegions(ctx, list)
+	for i, region := range list {
+		rs := &regionStatus{Name: region, MaxSlots: maxSlotsFor(projectID, region), Commitments: []CommitmentInfo{}}
+		statuses = append(statuses, rs)
+		if err := listErrs[i]; err != nil {
+			rs.Error = err.Error()
+			logging.Error(ctx, "listing commitments in %s: %v", region, err)
+			continue
+		}
+		for _, c := range lists[i] {
+			info := commitmentInfo(c, tasks[c.Name])
+			rs.Commitments = append(rs.Commitments, info)
+			rs.Held += c.SlotCount
+			if info.PendingDelete {
+				pending = append(pending, info)
+			}
+		}
+		if rs.Headroom = rs.MaxSlots - rs.Held; rs.Headroom < 0 {
+			rs.Headroom = 0
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].DeleteAt.Before(*pending[j].DeleteAt) })
+	return statuses, pending, errs
+}
+
+// uiAction lets the UI_OPERATORS verified by uiUser through to next, the
+// API handler of a dashboard button, or with auth on, the callers authorize
+// let through. Only JSON bodies are taken, which browsers don't send across
+// sites without CORS.
+func uiAction(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled() {
+			user, err := uiUser(r)
+			if err != nil {
+				logging.Warning(r.Context(), "rejected %s request: %v", r.URL.Path, err)
+				writeError(w, http.StatusUnauthorized, codeUnauthenticated, "unauthorized")
+				return
+			}
+			if !uiOperator(user) {
+				writeError(w, http.StatusForbidden, codeForbidden, "only UI_OPERATORS can change capacity from the dashboard")
+				return
+			}
+		}
+		if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+			writeError(w, http.StatusUnsupportedMediaType, codeInvalidRequest, "Content-Type must be application/json")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"go-slot-scheduler/capacity"
+)
+
+// The API is served under v1Prefix, and every response says which version
+// it is in apiVersionHeader. The unversioned routes it replaced still answer
+// the same, as deprecated aliases.
+const (
+	apiVersion       = "v1"
+	apiVersionHeader = "X-API-Version"
+	v1Prefix         = "/" + apiVersion
+)
+
+// Routes under v1Prefix named differently from the routes they replace.
+const (
+	// capacityPath buys slots with POST and scales to a total with PUT.
+	capacityPath = "/capacity"
+	// deleteCommitmentPath is called by delete tasks.
+	deleteCommitmentPath = commitmentsPath + "/delete"
+	mergeCommitmentsPath = commitmentsPath + "/merge"
+	commitmentPath       = commitmentsPath + "/{region}/{id}"
+	burstsPath           = "/bursts"
+)
+
+// withAPIVersion sets the API version header of every response.
+func withAPIVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(apiVersionHeader, apiVersion)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deprecated serves h on an unversioned route, telling clients to move to
+// successor, or to the same path under v1Prefix when successor is empty.
+func deprecated(successor string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next := successor
+		if next == "" {
+			next = v1Prefix + r.URL.Path
+		}
+		w.Header().Set("Deprecation", "true")
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", next))
+		h(w, r)
+	}
+}
+
+// commitmentFromPath returns the name of the commitment of the region and id
+// path variables, in the admin project of the project query parameter or the
+// service's. It answers a 400 and returns "" if they are invalid.
+func commitmentFromPath(w http.ResponseWriter, r *http.Request) string {
+	project := projectID
+	if v := r.URL.Query().Get("project"); v != "" {
+		if !validAdminProject(v) {
+			writeError(w, http.StatusBadRequest, codeInvalidProject, "project %q is not an admin project of the service", v)
+			return ""
+		}
+		project = v
+	}
+	vars := mux.Vars(r)
+	region := vars["region"]
+	var v validator
+	v.region("region", &region)
+	if err := v.err(); err != nil {
+		writeValidationError(w, err)
+		return ""
+	}
+	return capacity.Parent(project, region) + "/capacityCommitments/" + vars["id"]
+}
+
+// ExtendRequest is the body of an extension of a commitment under /v1.
+type ExtendRequest struct {
+	Minutes int64 `json:"minutes"`
+}
+
+// extendCommitmentHandler pushes back the pending deletion of the commitment
+// of the path by the minutes of the body.
+func (s *Server) extendCommitmentHandler(w http.ResponseWriter, r *http.Request) {
+	name := commitmentFromPath(w, r)
+	if name == "" {
+		return
+	}
+	var req ExtendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	defer r.Body.Close()
+	s.extend(w, r, Extend{CommitID: name, Minutes: req.Minutes})
+}
+
+// cancelCommitmentDeleteHandler cancels the pending deletion of the
+// commitment of the path.
+func (s *Server) cancelCommitmentDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	name := commitmentFromPath(w, r)
+	if name == "" {
+		return
+	}
+	s.cancelDeleteOf(w, r, name)
+}
+
+// deleteCommitmentHandler deletes the commitment of the path now, or only
+// the slots of the query split off it. Operators may split slots off, only
+// admins delete whole commitments, or force the deletion of commitments the
+// service did not buy.
+func (s *Server) deleteCommitmentHandler(w http.ResponseWriter, r *http.Request) {
+	name := commitmentFromPath(w, r)
+	if name == "" {
+		return
+	}
+	q := r.URL.Query()
+	c := Commit{CommitID: name, DryRun: q.Get("dry_run") == "true", Force: q.Get("force") == "true"}
+	if v := q.Get("slots"); v != "" {
+		slots, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || slots <= 0 {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "slots must be a positive number, not %q", v)
+			return
+		}
+		c.Slots = slots
+	}
+	if c.Slots == 0 && !hasRole(r, roleAdmin) {
+		writeError(w, http.StatusForbidden, codeForbidden, "deleting a whole commitment needs the admin role, give slots to split some off")
+		return
+	}
+	if c.Force && !hasRole(r, roleAdmin) {
+		writeError(w, http.StatusForbidden, codeForbidden, "forcing a deletion needs the admin role")
+		return
+	}
+	s.deleteCommitment(w, r, c)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"go-slot-scheduler/capacity"
+	"go-slot-scheduler/tasks"
+)
+
+// testKeys are the API keys of a caller of each role.
+var testKeys = map[role]string{
+	roleReader:   "reader-key-0123456789",
+	roleOperator: "operator-key-0123456789",
+	roleAdmin:    "admin-key-0123456789",
+}
+
+// newAuthServer returns a test Server whose callers need the roles of
+// testKeys.
+func newAuthServer(t *testing.T) (*Server, *capacity.Fake) {
+	t.Helper()
+	keys := make(map[string]*apiKey)
+	for r, key := range testKeys {
+		keys[r.String()] = &apiKey{Key: key, Role: r.String()}
+	}
+	keysJSON, err := json.Marshal(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestServer(t, tasks.NewFake(), &testClock{now: time.Now()}, map[string]string{"API_KEYS_JSON": string(keysJSON)})
+}
+
+// addOwned adds a FLEX commitment of slots in US, bought by the service and
+// past its minimum duration, and returns its name.
+func addOwned(t *testing.T, s *Server, fc *capacity.Fake, id string, slots int64) string {
+	t.Helper()
+	name := capacity.Parent(projectID, "US") + "/capacityCommitments/" + id
+	fc.Add(&reservationpb.CapacityCommitment{
+		Name:                name,
+		SlotCount:           slots,
+		Plan:                reservationpb.CapacityCommitment_FLEX,
+		State:               reservationpb.CapacityCommitment_ACTIVE,
+		CommitmentStartTime: timestamppb.New(time.Now().Add(-time.Hour)),
+		CommitmentEndTime:   timestamppb.New(time.Now().Add(-time.Hour).Add(capacity.FlexMinDuration)),
+	})
+	if err := s.store.PutCommitment(context.Background(), &CommitmentRecord{Name: name, Region: "US", SlotCount: slots, Plan: "FLEX", CreatedAt: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatalf("PutCommitment: %v", err)
+	}
+	return name
+}
+
+// deleteAs sends DELETE /v1/commitments/US/{id}?query as a caller of role.
+func deleteAs(s *Server, r role, id, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodDelete, v1Prefix+commitmentsPath+"/US/"+id+"?"+query, nil)
+	req.Header.Set("X-API-Key", testKeys[r])
+	w := httptest.NewRecorder()
+	s.router().ServeHTTP(w, req)
+	return w
+}
+
+// exists reports whether the fake still holds the commitment name.
+func exists(t *testing.T, fc *capacity.Fake, name string) bool {
+	t.Helper()
+	_, err := fc.GetCapacityCommitment(context.Background(), &reservationpb.GetCapacityCommitmentRequest{Name: name})
+	if err != nil && status.Code(err) != codes.NotFound {
+		t.Fatalf("getting %s: %v", name, err)
+	}
+	return err == nil
+}
+
+func TestDeleteCommitmentAllSlotsNeedsAdmin(t *testing.T) {
+	s, fc := newAuthServer(t)
+	name := addOwned(t, s, fc, "c1", 200)
+
+	w := deleteAs(s, roleOperator, "c1", "slots=200")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("operator deleting all 200 slots = %d %s, want %d", w.Code, w.Body, http.StatusForbidden)
+	}
+	if !exists(t, fc, name) {
+		t.Errorf("%s was deleted by an operator", name)
+	}
+}
+
+func TestDeleteCommitmentRoles(t *testing.T) {
+	const size = 200
+	// Splits take the reservation API, which the fakes lack: a 501 tells the
+	// caller got past the role checks.
+	for _, tc := range []struct {
+		caller  role
+		slots   string
+		want    int
+		deleted bool
+	}{
+		{roleReader, "", http.StatusForbidden, false},
+		{roleReader, "100", http.StatusForbidden, false},
+		{roleReader, "200", http.StatusForbidden, false},
+		{roleReader, "300", http.StatusForbidden, false},
+		{roleOperator, "", http.StatusForbidden, false},
+		{roleOperator, "100", http.StatusNotImplemented, false},
+		{roleOperator, "200", http.StatusForbidden, false},
+		{roleOperator, "300", http.StatusForbidden, false},
+		{roleAdmin, "", http.StatusOK, true},
+		{roleAdmin, "100", http.StatusNotImplemented, false},
+		{roleAdmin, "200", http.StatusOK, true},
+		{roleAdmin, "300", http.StatusOK, true},
+	} {
+		query := "slots=" + tc.slots
+		if tc.slots == "" {
+			query = ""
+		}
+		t.Run(tc.caller.String()+"/"+query, func(t *testing.T) {
+			s, fc := newAuthServer(t)
+			name := addOwned(t, s, fc, "c1", size)
+
+			w := deleteAs(s, tc.caller, "c1", query)
+			if w.Code != tc.want {
+				t.Errorf("%s deleting slots=%q of %d = %d %s, want %d", tc.caller, tc.slots, size, w.Code, w.Body, tc.want)
+			}
+			if deleted := !exists(t, fc, name); deleted != tc.deleted {
+				t.Errorf("%s deleting slots=%q of %d: deleted = %v, want %v", tc.caller, tc.slots, size, deleted, tc.deleted)
+			}
+		})
+	}
+}
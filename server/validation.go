@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+)
+
+// FieldError is what is wrong with one field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError holds every field error of a request.
+type validationError struct {
+	Fields []FieldError
+}
+
+func (e *validationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		msgs = append(msgs, f.Field+": "+f.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// validator collects field errors, so a request is rejected with all of them
+// at once.
+type validator struct {
+	fields []FieldError
+}
+
+// check adds a field error unless ok.
+func (v *validator) check(ok bool, field, format string, args ...interface{}) bool {
+	if !ok {
+		v.fields = append(v.fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	return ok
+}
+
+// err returns the collected field errors, or nil.
+func (v *validator) err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+	return &validationError{Fields: v.fields}
+}
+
+// region checks *region is known and replaces it with its canonical name,
+// defaultRegion if empty.
+func (v *validator) region(field string, region *string) {
+	if *region == "" {
+		*region = defaultRegion
+		return
+	}
+	name, ok := knownRegions[strings.ToLower(*region)]
+	if ok {
+		*region = name
+		return
+	}
+	if suggestions := suggestRegions(*region); len(suggestions) > 0 {
+		v.check(false, field, "unknown region %q, did you mean %s?", *region, strings.Join(suggestions, " or "))
+	} else {
+		v.check(false, field, "unknown region %q, see %s", *region, regionsPath)
+	}
+}
+
+// minutes checks *minutes is within MAX_MINUTES, defaulting it if unset.
+// With MAX_MINUTES_POLICY=clamp it is shortened to MAX_MINUTES instead.
+func (v *validator) minutes(field string, minutes *int64) {
+	if *minutes == 0 {
+		*minutes = defaultMinute
+		return
+	}
+	v.check(*minutes > 0, field, "must be positive")
+	l := live()
+	if l.ClampMinutes && *minutes > l.MaxMinutes {
+		*minutes = l.MaxMinutes
+	}
+	v.check(*minutes <= l.MaxMinutes, field, "can not be more than %d", l.MaxMinutes)
+}
+
+// maxDeleteAt is the latest the commitment of rec can be deleted at: the
+// reconciler expires FLEX commitments kept longer than MAX_MINUTES. It is
+// zero for the other plans.
+func maxDeleteAt(rec *CommitmentRecord) time.Time {
+	if rec.Plan != reservationpb.CapacityCommitment_FLEX.String() {
+		return time.Time{}
+	}
+	return rec.CreatedAt.Add(time.Duration(live().MaxMinutes) * time.Minute)
+}
+
+// deleteAt checks the commitment of rec can be kept until deleteAt, within
+// MAX_MINUTES of its purchase.
+func (v *validator) deleteAt(field string, rec *CommitmentRecord, deleteAt time.Time) {
+	if last := maxDeleteAt(rec); !last.IsZero() {
+		v.check(!deleteAt.After(last), field, "would keep %s until %s, past MAX_MINUTES (%d) since it was bought at %s: it can be kept until %s at the latest",
+			rec.Name, deleteAt.Format(time.RFC3339), live().MaxMinutes, rec.CreatedAt.Format(time.RFC3339), last.Format(time.RFC3339))
+	}
+}
+
+// slots checks slots is a positive multiple of slotIncrement.
+func (v *validator) slots(field string, slots int64) {
+	if v.check(slots != 0, field, "required") {
+		v.check(slots > 0 && slots%slotIncrement == 0, field, "must be a positive multiple of %d", slotIncrement)
+	}
+}
+
+// writeValidationError writes the field errors of err, INVALID_REGION if
+// the region is all that is wrong.
+func writeValidationError(w http.ResponseWriter, err error) {
+	verr, ok := err.(*validationError)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "%v", err)
+		return
+	}
+	code := codeInvalidRegion
+	for _, f := range verr.Fields {
+		if f.Field != "region" {
+			code = codeInvalidRequest
+		}
+	}
+	writeAPIError(w, http.StatusBadRequest, &APIError{
+		Code:    code,
+		Message: verr.Error(),
+		Details: map[string]interface{}{"fields": verr.Fields},
+	})
+}
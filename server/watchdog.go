@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	reservationpb "google.golang.org/genproto/googleapis/cloud/bigquery/reservation/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go-slot-scheduler/internal/logging"
+)
+
+// watchdogPath runs the delete watchdog once.
+const watchdogPath = "/watchdog"
+
+// requesterWatchdog is the requester of the deletions of the delete
+// watchdog.
+const requesterWatchdog = "delete_watchdog"
+
+// WatchdogResult summarises a pass of the delete watchdog: the commitments
+// found ACTIVE past their delete time, those it deleted and those found gone.
+type WatchdogResult struct {
+	Checked   int      `json:"checked"`
+	Missed    []string `json:"missed"`
+	Deleted   []string `json:"deleted"`
+	Forgotten []string `json:"forgotten"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+// runWatchdog watches for missed deletions every interval until ctx is done.
+func (s *Server) runWatchdog(ctx context.Context, interval time.Duration) {
+	logging.Info(ctx, "watching for missed deletions every %s, %s after they were due", interval, watchdogGrace)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			res, err := s.watchDeletes(ctx)
+			if err != nil {
+				logging.Error(ctx, "watching for missed deletions: %v", err)
+				continue
+			}
+			if len(res.Missed) > 0 {
+				logging.Warning(ctx, "%d deletions missed: deleted %v, errors %v", len(res.Missed), res.Deleted, res.Errors)
+			}
+		}
+	}
+}
+
+func (s *Server) watchdogHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := s.watchDeletes(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		logging.Error(r.Context(), "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// watchDeletes deletes the commitments the service bought that are still
+// ACTIVE DELETE_WATCHDOG_GRACE after their delete time, whatever their delete
+// task, which may sit in a paused queue or have been purged. Each is recorded
+// as delete_missed, which alerts, and one that can't be deleted is paged.
+// Those found gone are forgotten.
+func (s *Server) watchDeletes(ctx context.Context) (*WatchdogResult, error) {
+	recs, err := s.store.ListCommitments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing recorded commitments: %v", err)
+	}
+	res := &WatchdogResult{Missed: []string{}, Deleted: []string{}, Forgotten: []string{}}
+	now := time.Now()
+	for _, rec := range recs {
+		if rec.DeleteAt.IsZero() || !now.After(rec.DeleteAt.Add(watchdogGrace)) {
+			continue
+		}
+		res.Checked++
+		ctx := logging.WithFields(withRequest(ctx, rec.RequestID), "commit", rec.Name, "region", rec.Region, "slots", rec.SlotCount)
+
+		c, err := s.capacity.Get(ctx, rec.Name)
+		if status.Code(err) == codes.NotFound {
+			s.forgetMissed(ctx, rec, res)
+			continue
+		}
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("getting %s: %v", rec.Name, err))
+			continue
+		}
+		if c.State != reservationpb.CapacityCommitment_ACTIVE {
+			continue
+		}
+
+		late := now.Sub(rec.DeleteAt).Round(time.Minute)
+		res.Missed = append(res.Missed, rec.Name)
+		logging.Warning(ctx, "%s is still ACTIVE %s past its delete time, deleting", rec.Name, late)
+		reason := fmt.Sprintf("still ACTIVE %s past its delete time", late)
+		s.record(ctx, LedgerEntry{Action: actionDeleteMissed, Commitment: rec.Name, Slots: rec.SlotCount, DeleteAt: timePtr(rec.DeleteAt), Requester: requesterWatchdog, Reason: reason, Owned: true})
+
+		err = s.deleteCapacity(ctx, rec.Name)
+		if status.Code(err) == codes.NotFound {
+			// Its delete task fired in the meantime.
+			s.forgetMissed(ctx, rec, res)
+			continue
+		}
+		if err != nil {
+			s.record(ctx, LedgerEntry{Action: actionDeleteFailed, Commitment: rec.Name, Slots: rec.SlotCount, Requester: requesterWatchdog, Reason: reason, Error: err.Error(), Owned: true})
+			res.Errors = append(res.Errors, fmt.Sprintf("deleting %s: %v", rec.Name, err))
+			details := overdueDetails(rec)
+			details["error"] = err.Error()
+			s.openIncident(ctx, rec.Name, fmt.Sprintf("%s is ACTIVE %s past its delete time and can not be deleted", rec.Name, late), details)
+			continue
+		}
+		res.Deleted = append(res.Deleted, rec.Name)
+		s.record(ctx, LedgerEntry{Action: actionDeleted, Commitment: rec.Name, Slots: rec.SlotCount, Requester: requesterWatchdog, Reason: reason, Owned: true})
+		// Its task would only find it gone.
+		s.dropDeleteTask(ctx, rec.Name)
+		s.resolveIncident(ctx, rec.Name)
+	}
+	return res, nil
+}
+
+// forgetMissed forgets the record of a commitment found deleted.
+func (s *Server) forgetMissed(ctx context.Context, rec *CommitmentRecord, res *WatchdogResult) {
+	if err := s.store.ForgetCommitment(ctx, rec.Name); err != nil {
+		res.Errors = append(res.Errors, fmt.Sprintf("forgetting %s: %v", rec.Name, err))
+		return
+	}
+	res.Forgotten = append(res.Forgotten, rec.Name)
+	s.record(ctx, LedgerEntry{Action: actionForgotten, Commitment: rec.Name, Requester: requesterWatchdog, Owned: true})
+	s.resolveIncident(ctx, rec.Name)
+}
@@ -0,0 +1,217 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"go-slot-scheduler/internal/fault"
+	"go-slot-scheduler/internal/taskspb"
+)
+
+// Fake is an in-memory Client. Tasks are only stored until Dispatch or Run
+// sends them.
+type Fake struct {
+	// Latency is about how long every call takes.
+	Latency time.Duration
+	// ErrorRate is the share of calls failing with UNAVAILABLE, between 0
+	// and 1.
+	ErrorRate float64
+	// MaxAttempts is how many times a task is dispatched before it is
+	// dropped, 0 retries forever.
+	MaxAttempts int
+	// MinBackoff and MaxBackoff bound the wait between attempts, 1s and
+	// an hour when zero.
+	MinBackoff, MaxBackoff time.Duration
+
+	mu    sync.Mutex
+	tasks map[string]*taskspb.Task
+}
+
+// NewFake returns a Fake holding no tasks.
+func NewFake() *Fake {
+	return &Fake{tasks: make(map[string]*taskspb.Task)}
+}
+
+var _ Client = (*Fake)(nil)
+
+// inject delays and fails calls as configured.
+func (f *Fake) inject(ctx context.Context, op string) error {
+	return fault.Injector{Latency: f.Latency, ErrorRate: f.ErrorRate}.Inject(ctx, op)
+}
+
+func (f *Fake) CreateTask(ctx context.Context, req *taskspb.CreateTaskRequest) (*taskspb.Task, error) {
+	if err := f.inject(ctx, "CreateTask"); err != nil {
+		return nil, err
+	}
+	if req.Parent == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "parent is required")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := proto.Clone(req.Task).(*taskspb.Task)
+	if t.Name == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, status.Errorf(codes.Internal, "generating task id: %v", err)
+		}
+		t.Name = req.Parent + "/tasks/" + hex.EncodeToString(b)
+	} else if !strings.HasPrefix(t.Name, req.Parent+"/tasks/") {
+		return nil, status.Errorf(codes.InvalidArgument, "task %s is not in queue %s", t.Name, req.Parent)
+	}
+	if _, ok := f.tasks[t.Name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "task %s already exists", t.Name)
+	}
+	if t.ScheduleTime == nil {
+		t.ScheduleTime = timestamppb.New(time.Now())
+	}
+	t.CreateTime = timestamppb.New(time.Now())
+	f.tasks[t.Name] = t
+	return proto.Clone(t).(*taskspb.Task), nil
+}
+
+func (f *Fake) GetTask(ctx context.Context, req *taskspb.GetTaskRequest) (*taskspb.Task, error) {
+	if err := f.inject(ctx, "GetTask"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, ok := f.tasks[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "task %s not found", req.Name)
+	}
+	return proto.Clone(t).(*taskspb.Task), nil
+}
+
+func (f *Fake) DeleteTask(ctx context.Context, req *taskspb.DeleteTaskRequest) error {
+	if err := f.inject(ctx, "DeleteTask"); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.tasks[req.Name]; !ok {
+		return status.Errorf(codes.NotFound, "task %s not found", req.Name)
+	}
+	delete(f.tasks, req.Name)
+	return nil
+}
+
+// ListTasks returns the tasks of the queue in the order they are scheduled.
+func (f *Fake) ListTasks(ctx context.Context, req *taskspb.ListTasksRequest) ([]*taskspb.Task, error) {
+	if err := f.inject(ctx, "ListTasks"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return listQueue(f.tasks, req.Parent), nil
+}
+
+// Run dispatches the due tasks every interval until ctx is done.
+func (f *Fake) Run(ctx context.Context, client *http.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			f.Dispatch(ctx, client)
+		}
+	}
+}
+
+// Dispatch sends the HTTP request of every task scheduled by now, with the
+// headers Cloud Tasks adds, but no OIDC token. Tasks answered with a 2xx
+// status are removed, the others are retried with exponential backoff, or
+// after their Retry-After, until MaxAttempts.
+func (f *Fake) Dispatch(ctx context.Context, client *http.Client) {
+	now := time.Now()
+	f.mu.Lock()
+	var due []*taskspb.Task
+	for _, t := range f.tasks {
+		if !t.ScheduleTime.AsTime().After(now) {
+			due = append(due, proto.Clone(t).(*taskspb.Task))
+		}
+	}
+	f.mu.Unlock()
+
+	for _, t := range due {
+		retryAfter, err := dispatch(ctx, client, t)
+
+		f.mu.Lock()
+		if _, ok := f.tasks[t.Name]; !ok {
+			// Deleted while it ran.
+			f.mu.Unlock()
+			continue
+		}
+		t.DispatchCount++
+		if err == nil || f.MaxAttempts > 0 && int(t.DispatchCount) >= f.MaxAttempts {
+			delete(f.tasks, t.Name)
+			f.mu.Unlock()
+			continue
+		}
+		if retryAfter <= 0 {
+			retryAfter = retryDelay(t.DispatchCount, f.MinBackoff, f.MaxBackoff)
+		}
+		t.ScheduleTime = timestamppb.New(time.Now().Add(retryAfter))
+		f.tasks[t.Name] = t
+		f.mu.Unlock()
+	}
+}
+
+// dispatch sends the HTTP request of t. It returns when to retry if the
+// response says so.
+func dispatch(ctx context.Context, client *http.Client, t *taskspb.Task) (time.Duration, error) {
+	h := t.GetHttpRequest()
+	if h == nil {
+		return 0, nil
+	}
+	if t.DispatchDeadline != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.DispatchDeadline.AsDuration())
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, h.HttpMethod.String(), h.Url, bytes.NewReader(h.Body))
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+	parts := strings.Split(t.Name, "/")
+	req.Header.Set("X-CloudTasks-TaskName", parts[len(parts)-1])
+	if len(parts) >= 6 {
+		req.Header.Set("X-CloudTasks-QueueName", parts[5])
+	}
+	req.Header.Set("X-CloudTasks-TaskRetryCount", strconv.Itoa(int(t.DispatchCount)))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 == 2 {
+		return 0, nil
+	}
+	var retryAfter time.Duration
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		retryAfter = time.Duration(secs) * time.Second
+	}
+	return retryAfter, fmt.Errorf("%s %s: %s", req.Method, h.Url, resp.Status)
+}
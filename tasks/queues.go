@@ -0,0 +1,190 @@
+package tasks
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"go-slot-scheduler/internal/taskspb"
+)
+
+// failoverCooldown is how long a queue that failed to create a task is
+// tried after the others.
+const failoverCooldown = time.Minute
+
+// Queues spreads tasks over several queues, possibly in different
+// locations, so deletions are still scheduled when one is paused or
+// unavailable. Tasks are created in the healthiest queue, failing over to
+// the next when creation fails, and found in whichever queue holds them.
+type Queues struct {
+	// Queues are in order of preference. Tasks are named in the first, and
+	// moved to the queue they are created in.
+	Queues []*Queue
+	// Healthy, if set, reports whether the queue called name dispatches its
+	// tasks. Unhealthy queues are tried last.
+	Healthy func(name string) bool
+
+	mu     sync.Mutex
+	failed map[string]time.Time
+}
+
+// InQueue moves the task name to queue, keeping its ID. Names not of a
+// task are returned as they are.
+func InQueue(name, queue string) string {
+	i := strings.Index(name, "/tasks/")
+	if i < 0 {
+		return name
+	}
+	return queue + name[i:]
+}
+
+// QueueOf returns the queue of the task name, "" if it names no task.
+func QueueOf(name string) string {
+	i := strings.Index(name, "/tasks/")
+	if i < 0 {
+		return ""
+	}
+	return name[:i]
+}
+
+func (qs *Queues) TaskName(id string) string {
+	return qs.Queues[0].TaskName(id)
+}
+
+func (qs *Queues) DeleteTaskName(commitName string) string {
+	return qs.Queues[0].DeleteTaskName(commitName)
+}
+
+func (qs *Queues) RescheduledTaskName(commitName string, deleteAt time.Time) string {
+	return qs.Queues[0].RescheduledTaskName(commitName, deleteAt)
+}
+
+// Create creates t in the healthiest queue, failing over to the next ones.
+func (qs *Queues) Create(ctx context.Context, t *taskspb.Task) (*taskspb.Task, error) {
+	return qs.create(ctx, func(q *Queue) (*taskspb.Task, error) {
+		c := proto.Clone(t).(*taskspb.Task)
+		c.Name = InQueue(t.Name, q.Name)
+		return c, nil
+	})
+}
+
+// CreateHTTP creates an HTTP task as Queue.CreateHTTP does, in the
+// healthiest queue, failing over to the next ones.
+func (qs *Queues) CreateHTTP(ctx context.Context, taskName, url, audience string, body interface{}, scheduleAt time.Time) (*taskspb.Task, error) {
+	return qs.create(ctx, func(q *Queue) (*taskspb.Task, error) {
+		return q.httpTask(InQueue(taskName, q.Name), url, audience, body, scheduleAt)
+	})
+}
+
+// create creates the task made for each queue in turn until one takes it.
+// ALREADY_EXISTS and INVALID_ARGUMENT don't fail over, the next queue would
+// answer the same.
+func (qs *Queues) create(ctx context.Context, task func(q *Queue) (*taskspb.Task, error)) (created *taskspb.Task, err error) {
+	for _, q := range qs.order() {
+		t, terr := task(q)
+		if terr != nil {
+			return nil, terr
+		}
+		created, err = q.Create(ctx, t)
+		switch status.Code(err) {
+		case codes.OK:
+			qs.setFailed(q, false)
+			return created, nil
+		case codes.AlreadyExists, codes.InvalidArgument:
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		qs.setFailed(q, true)
+	}
+	return nil, err
+}
+
+// order returns the queues to create tasks in: the healthy ones in order of
+// preference, then those that failed to lately, then the unhealthy ones.
+func (qs *Queues) order() []*Queue {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	var healthy, failing, unhealthy []*Queue
+	for _, q := range qs.Queues {
+		switch {
+		case qs.Healthy != nil && !qs.Healthy(q.Name):
+			unhealthy = append(unhealthy, q)
+		case time.Since(qs.failed[q.Name]) < failoverCooldown:
+			failing = append(failing, q)
+		default:
+			healthy = append(healthy, q)
+		}
+	}
+	return append(append(healthy, failing...), unhealthy...)
+}
+
+// setFailed records whether q failed to create a task.
+func (qs *Queues) setFailed(q *Queue, failed bool) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if !failed {
+		delete(qs.failed, q.Name)
+		return
+	}
+	if qs.failed == nil {
+		qs.failed = make(map[string]time.Time)
+	}
+	qs.failed[q.Name] = time.Now()
+}
+
+// holding returns the queue of the task name first, then the others.
+func (qs *Queues) holding(name string) []*Queue {
+	owner := QueueOf(name)
+	list := make([]*Queue, 0, len(qs.Queues))
+	for _, q := range qs.Queues {
+		if q.Name == owner {
+			list = append([]*Queue{q}, list...)
+		} else {
+			list = append(list, q)
+		}
+	}
+	return list
+}
+
+// Get returns the task name from its queue, or from another holding a task
+// of its ID, such as one created there on failover.
+func (qs *Queues) Get(ctx context.Context, name string) (task *taskspb.Task, err error) {
+	for _, q := range qs.holding(name) {
+		if task, err = q.Get(ctx, InQueue(name, q.Name)); status.Code(err) != codes.NotFound {
+			return task, err
+		}
+	}
+	return nil, err
+}
+
+// Delete deletes the task name from its queue, or from another holding a
+// task of its ID.
+func (qs *Queues) Delete(ctx context.Context, name string) (err error) {
+	for _, q := range qs.holding(name) {
+		if err = q.Delete(ctx, InQueue(name, q.Name)); status.Code(err) != codes.NotFound {
+			return err
+		}
+	}
+	return err
+}
+
+// List returns the tasks waiting in every queue. It fails if any queue
+// can't be listed, so missing tasks are never taken for gone.
+func (qs *Queues) List(ctx context.Context) ([]*taskspb.Task, error) {
+	var all []*taskspb.Task
+	for _, q := range qs.Queues {
+		list, err := q.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, list...)
+	}
+	return all, nil
+}
@@ -0,0 +1,359 @@
+// Package tasks schedules HTTP callbacks, such as the deletion of a
+// commitment, on a Cloud Tasks queue.
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"go-slot-scheduler/internal/taskspb"
+	"go-slot-scheduler/retry"
+)
+
+// Client is the part of the Cloud Tasks API the Queue calls. NewClient adapts
+// *taskspb.Client to it, and Fake implements it in memory.
+type Client interface {
+	CreateTask(ctx context.Context, req *taskspb.CreateTaskRequest) (*taskspb.Task, error)
+	GetTask(ctx context.Context, req *taskspb.GetTaskRequest) (*taskspb.Task, error)
+	DeleteTask(ctx context.Context, req *taskspb.DeleteTaskRequest) error
+	// ListTasks returns every page of tasks.
+	ListTasks(ctx context.Context, req *taskspb.ListTasksRequest) ([]*taskspb.Task, error)
+}
+
+// NewClient returns a Client calling Cloud Tasks with c.
+func NewClient(c *taskspb.Client) Client {
+	return grpcClient{c}
+}
+
+type grpcClient struct {
+	*taskspb.Client
+}
+
+func (c grpcClient) CreateTask(ctx context.Context, req *taskspb.CreateTaskRequest) (*taskspb.Task, error) {
+	return c.Client.CreateTask(ctx, req)
+}
+
+func (c grpcClient) GetTask(ctx context.Context, req *taskspb.GetTaskRequest) (*taskspb.Task, error) {
+	return c.Client.GetTask(ctx, req)
+}
+
+func (c grpcClient) DeleteTask(ctx context.Context, req *taskspb.DeleteTaskRequest) error {
+	return c.Client.DeleteTask(ctx, req)
+}
+
+func (c grpcClient) UpdateQueue(ctx context.Context, req *taskspb.UpdateQueueRequest) (*taskspb.Queue, error) {
+	return c.Client.UpdateQueue(ctx, req)
+}
+
+func (c grpcClient) GetQueue(ctx context.Context, req *taskspb.GetQueueRequest) (*taskspb.Queue, error) {
+	return c.Client.GetQueue(ctx, req)
+}
+
+func (c grpcClient) CreateQueue(ctx context.Context, req *taskspb.CreateQueueRequest) (*taskspb.Queue, error) {
+	return c.Client.CreateQueue(ctx, req)
+}
+
+func (c grpcClient) ListTasks(ctx context.Context, req *taskspb.ListTasksRequest) ([]*taskspb.Task, error) {
+	var list []*taskspb.Task
+	it := c.Client.ListTasks(ctx, req)
+	for {
+		task, err := it.Next()
+		if err == iterator.Done {
+			return list, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, task)
+	}
+}
+
+// Queue creates and removes the tasks of one queue.
+type Queue struct {
+	Client Client
+	// Name is the full resource name of the queue,
+	// projects/{project}/locations/{location}/queues/{queue}.
+	Name string
+	// ServiceAccount signs the OIDC token HTTP tasks call back with.
+	ServiceAccount string
+	// Retry is the policy calls are retried with. The zero value tries once.
+	Retry retry.Policy
+	// DispatchDeadline is how long the HTTP tasks created wait for their
+	// response, the 10 minutes of Cloud Tasks when zero.
+	DispatchDeadline time.Duration
+}
+
+// QueueUpdater is implemented by the Clients whose queue keeps a retry
+// config, as Cloud Tasks does.
+type QueueUpdater interface {
+	UpdateQueue(ctx context.Context, req *taskspb.UpdateQueueRequest) (*taskspb.Queue, error)
+}
+
+// QueueCreator is implemented by the Clients that can create their queue, as
+// Cloud Tasks can.
+type QueueCreator interface {
+	GetQueue(ctx context.Context, req *taskspb.GetQueueRequest) (*taskspb.Queue, error)
+	CreateQueue(ctx context.Context, req *taskspb.CreateQueueRequest) (*taskspb.Queue, error)
+}
+
+// DefaultRetry is the retry config CreateQueue gives a queue for the fields
+// not set: deletions refused before the FLEX minimum of a minute, or failing
+// on a transient error, are retried for over an hour.
+var DefaultRetry = RetryConfig{MaxAttempts: 20, MinBackoff: 10 * time.Second, MaxBackoff: 5 * time.Minute}
+
+// RetryConfig is how a queue retries the tasks that fail. Cloud Tasks keeps
+// it on the queue, not on each task. Zero fields are left as they are.
+type RetryConfig struct {
+	MaxAttempts            int
+	MinBackoff, MaxBackoff time.Duration
+}
+
+// IsZero reports whether rc changes nothing.
+func (rc RetryConfig) IsZero() bool {
+	return rc == RetryConfig{}
+}
+
+// SetRetry updates the retry config of the queue with the fields of rc that
+// are set. It fails if the Client is not a QueueUpdater.
+func (q *Queue) SetRetry(ctx context.Context, rc RetryConfig) error {
+	u, ok := q.Client.(QueueUpdater)
+	if !ok {
+		return fmt.Errorf("the tasks of %s have no retry config to set", q.Name)
+	}
+	config := &taskspb.RetryConfig{}
+	mask := &fieldmaskpb.FieldMask{}
+	if rc.MaxAttempts > 0 {
+		config.MaxAttempts = int32(rc.MaxAttempts)
+		mask.Paths = append(mask.Paths, "retry_config.max_attempts")
+	}
+	if rc.MinBackoff > 0 {
+		config.MinBackoff = durationpb.New(rc.MinBackoff)
+		mask.Paths = append(mask.Paths, "retry_config.min_backoff")
+	}
+	if rc.MaxBackoff > 0 {
+		config.MaxBackoff = durationpb.New(rc.MaxBackoff)
+		mask.Paths = append(mask.Paths, "retry_config.max_backoff")
+	}
+	return q.Retry.Do(ctx, "UpdateQueue", func(ctx context.Context) error {
+		_, err := u.UpdateQueue(ctx, &taskspb.UpdateQueueRequest{
+			Queue:      &taskspb.Queue{Name: q.Name, RetryConfig: config},
+			UpdateMask: mask,
+		})
+		return err
+	})
+}
+
+// CreateQueue creates the queue if it does not exist, retrying its tasks as
+// rc says, DefaultRetry for the fields not set. It reports whether it created
+// it, and fails if the Client is not a QueueCreator.
+func (q *Queue) CreateQueue(ctx context.Context, rc RetryConfig) (created bool, err error) {
+	c, ok := q.Client.(QueueCreator)
+	if !ok {
+		return false, fmt.Errorf("queue %s can not be created", q.Name)
+	}
+	i := strings.Index(q.Name, "/queues/")
+	if i < 0 {
+		return false, fmt.Errorf("%s is not the name of a queue", q.Name)
+	}
+	err = q.Retry.Do(ctx, "GetQueue", func(ctx context.Context) error {
+		_, err := c.GetQueue(ctx, &taskspb.GetQueueRequest{Name: q.Name})
+		return err
+	})
+	if status.Code(err) != codes.NotFound {
+		return false, err
+	}
+
+	if rc.MaxAttempts == 0 {
+		rc.MaxAttempts = DefaultRetry.MaxAttempts
+	}
+	if rc.MinBackoff == 0 {
+		rc.MinBackoff = DefaultRetry.MinBackoff
+	}
+	if rc.MaxBackoff == 0 {
+		rc.MaxBackoff = DefaultRetry.MaxBackoff
+	}
+	err = q.Retry.Do(ctx, "CreateQueue", func(ctx context.Context) error {
+		_, err := c.CreateQueue(ctx, &taskspb.CreateQueueRequest{
+			Parent: q.Name[:i],
+			Queue: &taskspb.Queue{
+				Name: q.Name,
+				RetryConfig: &taskspb.RetryConfig{
+					MaxAttempts: int32(rc.MaxAttempts),
+					MinBackoff:  durationpb.New(rc.MinBackoff),
+					MaxBackoff:  durationpb.New(rc.MaxBackoff),
+				},
+			},
+		})
+		return err
+	})
+	if status.Code(err) == codes.AlreadyExists {
+		// Another instance created it first.
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// QueueName is the full resource name of a queue.
+func QueueName(project, location, queue string) string {
+	return fmt.Sprintf("projects/%s/locations/%s/queues/%s", project, location, queue)
+}
+
+var invalidTaskIDChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// DeleteTaskID derives the task ID for a commitment's delete task, so the
+// task can be found again from the commitment name alone.
+//
+// projects/p/locations/US/capacityCommitments/123 becomes delete-US-123.
+func DeleteTaskID(commitName string) string {
+	parts := strings.Split(commitName, "/")
+	region := ""
+	if len(parts) >= 4 && parts[2] == "locations" {
+		region = parts[3]
+	}
+	return invalidTaskIDChars.ReplaceAllString("delete-"+region+"-"+parts[len(parts)-1], "-")
+}
+
+// DeleteTaskName is the full resource name of a commitment's delete task.
+// Commitments of another project than the queue's have it in their task ID,
+// so those of two admin projects with the same ID never share a task.
+//
+// projects/other/locations/US/capacityCommitments/123 becomes
+// delete-other-US-123.
+func (q *Queue) DeleteTaskName(commitName string) string {
+	id := DeleteTaskID(commitName)
+	if project := projectOf(commitName); project != "" && project != projectOf(q.Name) {
+		id = invalidTaskIDChars.ReplaceAllString("delete-"+project+"-"+strings.TrimPrefix(id, "delete-"), "-")
+	}
+	return q.TaskName(id)
+}
+
+// projectOf returns the project of a resource name, projects/{project}/...
+func projectOf(name string) string {
+	parts := strings.SplitN(name, "/", 3)
+	if len(parts) < 2 || parts[0] != "projects" {
+		return ""
+	}
+	return parts[1]
+}
+
+// RescheduledTaskName names a delete task moved to deleteAt. Cloud Tasks
+// refuses to reuse the name of a recently deleted task, so rescheduled tasks
+// carry the new schedule time as a suffix.
+func (q *Queue) RescheduledTaskName(commitName string, deleteAt time.Time) string {
+	return fmt.Sprintf("%s-%d", q.DeleteTaskName(commitName), deleteAt.Unix())
+}
+
+// TaskName is the full resource name of the task id in the queue.
+func (q *Queue) TaskName(id string) string {
+	return q.Name + "/tasks/" + id
+}
+
+// Create adds task to the queue, retrying per the retry policy.
+// ALREADY_EXISTS on a retry means an earlier attempt did create the task,
+// which is returned.
+func (q *Queue) Create(ctx context.Context, t *taskspb.Task) (task *taskspb.Task, err error) {
+	req := &taskspb.CreateTaskRequest{
+		// See https://pkg.go.dev/google.golang.org/genproto/googleapis/cloud/tasks/v2#CreateTaskRequest.
+		Parent: q.Name,
+		Task:   t,
+	}
+	attempt := 0
+	err = q.Retry.Do(ctx, "CreateTask", func(ctx context.Context) error {
+		attempt++
+		task, err = q.Client.CreateTask(ctx, req)
+		if status.Code(err) == codes.AlreadyExists && attempt > 1 && req.Task.Name != "" {
+			task, err = q.Get(ctx, req.Task.Name)
+		}
+		return err
+	})
+	return task, err
+}
+
+// CreateHTTP creates a task POSTing body as JSON to url at scheduleAt, with
+// an OIDC token of the service account for audience.
+func (q *Queue) CreateHTTP(ctx context.Context, taskName, url, audience string, body interface{}, scheduleAt time.Time) (*taskspb.Task, error) {
+	t, err := q.httpTask(taskName, url, audience, body, scheduleAt)
+	if err != nil {
+		return nil, err
+	}
+	return q.Create(ctx, t)
+}
+
+// httpTask is the task CreateHTTP creates.
+func (q *Queue) httpTask(taskName, url, audience string, body interface{}, scheduleAt time.Time) (*taskspb.Task, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var deadline *durationpb.Duration
+	if q.DispatchDeadline > 0 {
+		deadline = durationpb.New(q.DispatchDeadline)
+	}
+	t := &taskspb.Task{
+		Name:             taskName,
+		ScheduleTime:     timestamppb.New(scheduleAt),
+		DispatchDeadline: deadline,
+	}
+	taskspb.SetHTTPRequest(t, &taskspb.HttpRequest{
+		Url:        url,
+		HttpMethod: taskspb.HttpMethod_POST,
+		Body:       b,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		AuthorizationHeader: &taskspb.HttpRequest_OidcToken{
+			OidcToken: &taskspb.OidcToken{
+				ServiceAccountEmail: q.ServiceAccount,
+				Audience:            audience,
+			},
+		},
+	})
+	return t, nil
+}
+
+// Get returns the task name with its full payload.
+func (q *Queue) Get(ctx context.Context, name string) (task *taskspb.Task, err error) {
+	err = q.Retry.Do(ctx, "GetTask", func(ctx context.Context) error {
+		task, err = q.Client.GetTask(ctx, &taskspb.GetTaskRequest{Name: name, ResponseView: taskspb.Task_FULL})
+		return err
+	})
+	return task, err
+}
+
+// Delete deletes a task, retrying per the retry policy. NOT_FOUND on a retry
+// means an earlier attempt did delete it.
+func (q *Queue) Delete(ctx context.Context, name string) error {
+	attempt := 0
+	return q.Retry.Do(ctx, "DeleteTask", func(ctx context.Context) error {
+		attempt++
+		err := q.Client.DeleteTask(ctx, &taskspb.DeleteTaskRequest{Name: name})
+		if status.Code(err) == codes.NotFound && attempt > 1 {
+			return nil
+		}
+		return err
+	})
+}
+
+// List returns the tasks waiting in the queue with their full payload.
+func (q *Queue) List(ctx context.Context) (list []*taskspb.Task, err error) {
+	err = q.Retry.Do(ctx, "ListTasks", func(ctx context.Context) error {
+		list, err = q.Client.ListTasks(ctx, &taskspb.ListTasksRequest{
+			Parent:       q.Name,
+			ResponseView: taskspb.Task_FULL,
+		})
+		return err
+	})
+	return list, err
+}
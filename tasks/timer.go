@@ -0,0 +1,250 @@
+package tasks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"go-slot-scheduler/internal/logging"
+	"go-slot-scheduler/internal/taskspb"
+)
+
+// Timer is a Client running tasks in process: each task is handed to Send by
+// a timer set for its schedule time. Without a Store tasks are only kept in
+// memory, so a restart loses them.
+type Timer struct {
+	// Send runs a due task. Tasks it fails are retried with exponential
+	// backoff.
+	Send func(ctx context.Context, t *taskspb.Task) error
+	// MaxAttempts is how many times a task is sent before it is dropped, 0
+	// retries forever.
+	MaxAttempts int
+	// MinBackoff and MaxBackoff bound the wait between attempts, 1s and
+	// an hour when zero.
+	MinBackoff, MaxBackoff time.Duration
+	// Store, if set, keeps the pending tasks for Load to set their timers
+	// again after a restart.
+	Store TimerStore
+
+	mu     sync.Mutex
+	tasks  map[string]*taskspb.Task
+	timers map[string]*time.Timer
+}
+
+// NewTimer returns a Timer handing tasks to send.
+func NewTimer(send func(ctx context.Context, t *taskspb.Task) error) *Timer {
+	return &Timer{
+		Send:   send,
+		tasks:  make(map[string]*taskspb.Task),
+		timers: make(map[string]*time.Timer),
+	}
+}
+
+var _ Client = (*Timer)(nil)
+
+// TimerStore persists the pending tasks of a Timer. Retries are not
+// persisted, a task loaded after its schedule time runs at once.
+type TimerStore interface {
+	// PutTask records a new pending task.
+	PutTask(ctx context.Context, t *taskspb.Task) error
+	// DeleteTask forgets a task that ran or was deleted. Deleting a task
+	// that is not recorded is not an error.
+	DeleteTask(ctx context.Context, name string) error
+	// ListTasks returns every pending task.
+	ListTasks(ctx context.Context) ([]*taskspb.Task, error)
+}
+
+// Load sets the timers of the tasks in the Store, and returns how many there
+// are.
+func (q *Timer) Load(ctx context.Context) (int, error) {
+	if q.Store == nil {
+		return 0, nil
+	}
+	list, err := q.Store.ListTasks(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, t := range list {
+		if _, ok := q.tasks[t.Name]; ok {
+			continue
+		}
+		q.tasks[t.Name] = t
+		q.schedule(t)
+	}
+	return len(list), nil
+}
+
+func (q *Timer) CreateTask(ctx context.Context, req *taskspb.CreateTaskRequest) (*taskspb.Task, error) {
+	if req.Parent == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "parent is required")
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	t := proto.Clone(req.Task).(*taskspb.Task)
+	if t.Name == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, status.Errorf(codes.Internal, "generating task id: %v", err)
+		}
+		t.Name = req.Parent + "/tasks/" + hex.EncodeToString(b)
+	} else if !strings.HasPrefix(t.Name, req.Parent+"/tasks/") {
+		return nil, status.Errorf(codes.InvalidArgument, "task %s is not in queue %s", t.Name, req.Parent)
+	}
+	if _, ok := q.tasks[t.Name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "task %s already exists", t.Name)
+	}
+	if t.ScheduleTime == nil {
+		t.ScheduleTime = timestamppb.New(time.Now())
+	}
+	t.CreateTime = timestamppb.New(time.Now())
+	if q.Store != nil {
+		if err := q.Store.PutTask(ctx, t); err != nil {
+			return nil, err
+		}
+	}
+	q.tasks[t.Name] = t
+	q.schedule(t)
+	return proto.Clone(t).(*taskspb.Task), nil
+}
+
+func (q *Timer) GetTask(ctx context.Context, req *taskspb.GetTaskRequest) (*taskspb.Task, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t, ok := q.tasks[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "task %s not found", req.Name)
+	}
+	return proto.Clone(t).(*taskspb.Task), nil
+}
+
+func (q *Timer) DeleteTask(ctx context.Context, req *taskspb.DeleteTaskRequest) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.tasks[req.Name]; !ok {
+		return status.Errorf(codes.NotFound, "task %s not found", req.Name)
+	}
+	if q.Store != nil {
+		if err := q.Store.DeleteTask(ctx, req.Name); err != nil {
+			return err
+		}
+	}
+	q.remove(req.Name)
+	return nil
+}
+
+// ListTasks returns the tasks of the queue in the order they are scheduled.
+func (q *Timer) ListTasks(ctx context.Context, req *taskspb.ListTasksRequest) ([]*taskspb.Task, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return listQueue(q.tasks, req.Parent), nil
+}
+
+// Stop cancels the timers of every pending task.
+func (q *Timer) Stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for name, t := range q.timers {
+		t.Stop()
+		delete(q.timers, name)
+	}
+}
+
+// schedule sets the timer of t. q.mu must be held.
+func (q *Timer) schedule(t *taskspb.Task) {
+	name := t.Name
+	q.timers[name] = time.AfterFunc(time.Until(t.ScheduleTime.AsTime()), func() { q.fire(name) })
+}
+
+// remove forgets the task name and stops its timer. q.mu must be held.
+func (q *Timer) remove(name string) {
+	if t, ok := q.timers[name]; ok {
+		t.Stop()
+		delete(q.timers, name)
+	}
+	delete(q.tasks, name)
+}
+
+// fire sends the task name, then removes it or schedules its next attempt.
+func (q *Timer) fire(name string) {
+	q.mu.Lock()
+	t, ok := q.tasks[name]
+	if !ok {
+		q.mu.Unlock()
+		return
+	}
+	t = proto.Clone(t).(*taskspb.Task)
+	q.mu.Unlock()
+
+	ctx := context.Background()
+	if t.DispatchDeadline != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.DispatchDeadline.AsDuration())
+		defer cancel()
+	}
+	err := q.Send(ctx, t)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.tasks[name]; !ok {
+		// Deleted while it ran.
+		return
+	}
+	t.DispatchCount++
+	if err == nil || q.MaxAttempts > 0 && int(t.DispatchCount) >= q.MaxAttempts {
+		if q.Store != nil {
+			if err := q.Store.DeleteTask(context.Background(), name); err != nil {
+				logging.Error(context.Background(), "forgetting task %s: %v", name, err)
+			}
+		}
+		q.remove(name)
+		return
+	}
+	t.ScheduleTime = timestamppb.New(time.Now().Add(retryDelay(t.DispatchCount, q.MinBackoff, q.MaxBackoff)))
+	q.tasks[name] = t
+	q.schedule(t)
+}
+
+// retryDelay is how long a task waits after its attempt n failed: min
+// doubling up to max, 1s and an hour when zero.
+func retryDelay(n int32, min, max time.Duration) time.Duration {
+	if min <= 0 {
+		min = time.Second
+	}
+	if max <= 0 {
+		max = time.Hour
+	}
+	d := min << (n - 1)
+	if d > max || d <= 0 {
+		d = max
+	}
+	return d
+}
+
+// listQueue returns copies of the tasks of queue parent in the order they are
+// scheduled.
+func listQueue(tasks map[string]*taskspb.Task, parent string) []*taskspb.Task {
+	var list []*taskspb.Task
+	for name, t := range tasks {
+		if strings.HasPrefix(name, parent+"/tasks/") {
+			list = append(list, proto.Clone(t).(*taskspb.Task))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ScheduleTime.AsTime().Before(list[j].ScheduleTime.AsTime())
+	})
+	return list
+}
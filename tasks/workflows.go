@@ -0,0 +1,225 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/workflowexecutions/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"go-slot-scheduler/internal/taskspb"
+)
+
+// WorkflowSource is the Cloud Workflows definition Workflows runs tasks
+// with. It sleeps until the schedule time of the task it is given, then
+// sends its request with an OIDC token of the workflow's service account.
+const WorkflowSource = `main:
+  params: [task]
+  steps:
+    - wait:
+        call: sys.sleep_until
+        args:
+          time: ${task.schedule_time}
+    - send:
+        call: http.request
+        args:
+          method: ${task.method}
+          url: ${task.url}
+          headers: ${task.headers}
+          body: ${task.body}
+          auth:
+            type: OIDC
+            audience: ${task.audience}
+`
+
+// Workflows is a Client running each HTTP task as an execution of a
+// workflow deployed from WorkflowSource. Executions can't be named, so tasks
+// are looked up among the active executions, and deleting a task cancels
+// its execution.
+type Workflows struct {
+	// Service calls the Workflow Executions API.
+	Service *workflowexecutions.Service
+	// Workflow is the full resource name of the workflow,
+	// projects/{project}/locations/{location}/workflows/{workflow}.
+	Workflow string
+}
+
+var _ Client = (*Workflows)(nil)
+
+// workflowTask is the argument of an execution.
+type workflowTask struct {
+	Name         string            `json:"name"`
+	Method       string            `json:"method"`
+	URL          string            `json:"url"`
+	Headers      map[string]string `json:"headers"`
+	Body         json.RawMessage   `json:"body,omitempty"`
+	Audience     string            `json:"audience"`
+	ScheduleTime string            `json:"schedule_time"`
+	CreateTime   string            `json:"create_time"`
+}
+
+func (q *Workflows) CreateTask(ctx context.Context, req *taskspb.CreateTaskRequest) (*taskspb.Task, error) {
+	h := req.Task.GetHttpRequest()
+	if h == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "only HTTP tasks can run as workflows")
+	}
+	if !json.Valid(h.Body) {
+		return nil, status.Errorf(codes.InvalidArgument, "task body must be JSON")
+	}
+	name := req.Task.Name
+	if name == "" {
+		name = req.Parent + "/tasks/" + time.Now().Format("20060102150405.000000000")
+	} else if _, _, err := q.find(ctx, name); err == nil {
+		return nil, status.Errorf(codes.AlreadyExists, "task %s already exists", name)
+	} else if status.Code(err) != codes.NotFound {
+		return nil, err
+	}
+
+	at := time.Now()
+	if req.Task.ScheduleTime != nil {
+		at = req.Task.ScheduleTime.AsTime()
+	}
+	arg := workflowTask{
+		Name:         name,
+		Method:       h.HttpMethod.String(),
+		URL:          h.Url,
+		Headers:      h.Headers,
+		Body:         h.Body,
+		Audience:     h.GetOidcToken().GetAudience(),
+		ScheduleTime: at.UTC().Format(time.RFC3339Nano),
+		CreateTime:   time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	b, err := json.Marshal(map[string]interface{}{"task": arg})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "encoding argument: %v", err)
+	}
+	_, err = q.Service.Projects.Locations.Workflows.Executions.Create(q.Workflow, &workflowexecutions.Execution{
+		Argument: string(b),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, apiError(err)
+	}
+	return arg.task(), nil
+}
+
+func (q *Workflows) GetTask(ctx context.Context, req *taskspb.GetTaskRequest) (*taskspb.Task, error) {
+	_, t, err := q.find(ctx, req.Name)
+	return t, err
+}
+
+func (q *Workflows) DeleteTask(ctx context.Context, req *taskspb.DeleteTaskRequest) error {
+	e, _, err := q.find(ctx, req.Name)
+	if err != nil {
+		return err
+	}
+	_, err = q.Service.Projects.Locations.Workflows.Executions.Cancel(e.Name, &workflowexecutions.CancelExecutionRequest{}).Context(ctx).Do()
+	return apiError(err)
+}
+
+// ListTasks returns the tasks of the queue whose executions are still
+// active, in the order they are scheduled.
+func (q *Workflows) ListTasks(ctx context.Context, req *taskspb.ListTasksRequest) ([]*taskspb.Task, error) {
+	tasks := make(map[string]*taskspb.Task)
+	err := q.pages(ctx, func(_ *workflowexecutions.Execution, t *taskspb.Task) {
+		tasks[t.Name] = t
+	})
+	if err != nil {
+		return nil, err
+	}
+	return listQueue(tasks, req.Parent), nil
+}
+
+// find returns the active execution running the task name.
+func (q *Workflows) find(ctx context.Context, name string) (*workflowexecutions.Execution, *taskspb.Task, error) {
+	var (
+		found *workflowexecutions.Execution
+		task  *taskspb.Task
+	)
+	err := q.pages(ctx, func(e *workflowexecutions.Execution, t *taskspb.Task) {
+		if t.Name == name {
+			found, task = e, t
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if found == nil {
+		return nil, nil, status.Errorf(codes.NotFound, "task %s not found", name)
+	}
+	return found, task, nil
+}
+
+// pages calls f with every active execution of the workflow running a task.
+func (q *Workflows) pages(ctx context.Context, f func(*workflowexecutions.Execution, *taskspb.Task)) error {
+	err := q.Service.Projects.Locations.Workflows.Executions.List(q.Workflow).View("FULL").Pages(ctx, func(resp *workflowexecutions.ListExecutionsResponse) error {
+		for _, e := range resp.Executions {
+			if e.State != "ACTIVE" {
+				continue
+			}
+			var arg struct {
+				Task *workflowTask `json:"task"`
+			}
+			if err := json.Unmarshal([]byte(e.Argument), &arg); err != nil || arg.Task == nil || arg.Task.Name == "" {
+				continue
+			}
+			f(e, arg.Task.task())
+		}
+		return nil
+	})
+	return apiError(err)
+}
+
+// task is the Cloud Tasks form of the argument.
+func (w *workflowTask) task() *taskspb.Task {
+	t := &taskspb.Task{Name: w.Name}
+	taskspb.SetHTTPRequest(t, &taskspb.HttpRequest{
+		Url:        w.URL,
+		HttpMethod: taskspb.HttpMethod(taskspb.HttpMethod_value[w.Method]),
+		Headers:    w.Headers,
+		Body:       w.Body,
+		AuthorizationHeader: &taskspb.HttpRequest_OidcToken{
+			OidcToken: &taskspb.OidcToken{Audience: w.Audience},
+		},
+	})
+	if at, err := time.Parse(time.RFC3339Nano, w.ScheduleTime); err == nil {
+		t.ScheduleTime = timestamppb.New(at)
+	}
+	if at, err := time.Parse(time.RFC3339Nano, w.CreateTime); err == nil {
+		t.CreateTime = timestamppb.New(at)
+	}
+	return t
+}
+
+// apiError turns the HTTP status of a REST error into the gRPC code the
+// Queue and its callers check.
+func apiError(err error) error {
+	var gerr *googleapi.Error
+	if err == nil || !errors.As(err, &gerr) {
+		return err
+	}
+	code := codes.Unknown
+	switch gerr.Code {
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.AlreadyExists
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	case http.StatusGatewayTimeout:
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, strings.TrimSpace(gerr.Error()))
+}